@@ -0,0 +1,315 @@
+package pingo
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Archives package a plugin for distribution: they are gzipped tar files, by convention with
+// the ArchiveExt extension, holding the manifest (see Manifest), the executables it lists
+// and, optionally, an ed25519 signature of the manifest and a default configuration. All
+// files are at the top level of the archive.
+const (
+	ArchiveExt = ".pingo"
+	// Signature of the manifest file
+	signatureFile = "manifest.sig"
+	// Configuration pushed to the plugin when connected
+	configFile = "config"
+)
+
+// Largest file accepted in an archive.
+const maxArchiveFile = 1 << 30
+
+// Error returned when an archive is malformed or its files do not match its manifest.
+type ErrArchive error
+
+// Archive is a packaged plugin installed in a directory (see InstallArchive).
+type Archive struct {
+	// Directory the archive is installed in
+	Dir      string
+	Manifest *Manifest
+	// Signature of the manifest, if signed
+	Signature []byte
+	// Default configuration, if any
+	Config []byte
+}
+
+// PackArchive writes to w an archive of the plugin built in dir, which must contain the
+// manifest written by "pingo build" and the executables it lists. The archive includes
+// config as default configuration, if not nil, and a signature of the manifest with key,
+// if not nil.
+func PackArchive(w io.Writer, dir string, config []byte, key ed25519.PrivateKey) error {
+	manifest, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	m, err := ReadManifest(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	if err := m.checkFiles(dir); err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	add := func(name string, mode int64, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: mode, Size: int64(len(data))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(ManifestFile, 0644, manifest); err != nil {
+		return err
+	}
+	if key != nil {
+		sig, err := cryptoProvider.Sign(key, manifest)
+		if err != nil {
+			return err
+		}
+		if err := add(signatureFile, 0644, sig); err != nil {
+			return err
+		}
+	}
+	if config != nil {
+		if err := add(configFile, 0644, config); err != nil {
+			return err
+		}
+	}
+	for _, a := range m.Artifacts {
+		data, err := os.ReadFile(a.File)
+		if err != nil {
+			return err
+		}
+		if err := add(filepath.Base(a.File), 0755, data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// InstallArchive extracts the archive at path into a directory under dir, named after the
+// plugin and its version, as in "hello-1.2.0", replacing any previous installation of the
+// same version. The checksums of the executables are verified against the manifest.
+func InstallArchive(path, dir string) (*Archive, error) {
+	return installArchive(path, dir, nil, "")
+}
+
+// Install the archive at path as InstallArchive does, verifying that its manifest is signed
+// by one of keys, if any, before it replaces a previous installation. The installation in
+// directory keep, if not empty, is not replaced: an error is returned instead.
+func installArchive(path, dir string, keys []ed25519.PublicKey, keep string) (*Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	tmp, err := os.MkdirTemp(dir, ".install-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+	if err := os.Chmod(tmp, 0755); err != nil {
+		return nil, err
+	}
+	if err := extractArchive(f, tmp); err != nil {
+		return nil, ErrArchive(errors.New(path + ": " + err.Error()))
+	}
+	a, err := OpenArchive(tmp)
+	if err != nil {
+		return nil, ErrArchive(errors.New(path + ": " + err.Error()))
+	}
+	if err := a.verify(); err != nil {
+		return nil, ErrArchive(errors.New(path + ": " + err.Error()))
+	}
+	if keys != nil {
+		if err := a.Verify(keys...); err != nil {
+			return nil, err
+		}
+	}
+
+	name := a.Manifest.Name
+	if a.Manifest.Version != "" {
+		name += "-" + a.Manifest.Version
+	}
+	if name != filepath.Base(name) || strings.HasPrefix(name, ".") {
+		return nil, ErrArchive(errors.New(path + ": Invalid plugin name " + name))
+	}
+	target := filepath.Join(dir, name)
+	if keep != "" && sameFile(target, keep) {
+		return nil, errors.New("Cannot replace " + target + ", which is in use")
+	}
+	if err := os.RemoveAll(target); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		return nil, err
+	}
+	return OpenArchive(target)
+}
+
+// Check whether the paths a and b refer to the same file.
+func sameFile(a, b string) bool {
+	ai, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	bi, err := os.Stat(b)
+	return err == nil && os.SameFile(ai, bi)
+}
+
+// Extract the files of the archive read from r into dir.
+func extractArchive(r io.Reader, dir string) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return errors.New("Unexpected entry " + hdr.Name)
+		}
+		if hdr.Name != filepath.Base(hdr.Name) || strings.HasPrefix(hdr.Name, ".") {
+			return errors.New("Invalid file name " + hdr.Name)
+		}
+		if hdr.Size > maxArchiveFile {
+			return errors.New("File too large: " + hdr.Name)
+		}
+		mode := os.FileMode(0644)
+		if hdr.Mode&0111 != 0 {
+			mode = 0755
+		}
+		out, err := os.OpenFile(filepath.Join(dir, hdr.Name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, tr)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// OpenArchive reads an archive installed in dir by InstallArchive.
+func OpenArchive(dir string) (*Archive, error) {
+	m, err := ReadManifest(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	if err := m.checkFiles(dir); err != nil {
+		return nil, ErrArchive(err)
+	}
+	a := &Archive{Dir: dir, Manifest: m}
+	if a.Signature, err = readOptional(filepath.Join(dir, signatureFile)); err != nil {
+		return nil, err
+	}
+	if a.Config, err = readOptional(filepath.Join(dir, configFile)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Read the file at path, returning nil if it does not exist.
+func readOptional(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// Check that the executables listed by the manifest, read from dir, are files directly in
+// dir, as archives hold no directories.
+func (m *Manifest) checkFiles(dir string) error {
+	for _, art := range m.Artifacts {
+		if filepath.Dir(art.File) != filepath.Clean(dir) || strings.HasPrefix(filepath.Base(art.File), ".") {
+			return errors.New("Executable " + art.File + " is not a file of " + dir)
+		}
+	}
+	return nil
+}
+
+// Check that the executables match the checksums of the manifest.
+func (a *Archive) verify() error {
+	for _, art := range a.Manifest.Artifacts {
+		if err := checkFile(art.File, art.SHA256); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// NewPlugin creates a plugin running the executable of the archive for the platform of the
+// host, as NewPlugin does. The executable is verified against the checksum of the manifest
+// each time it is started (see SetChecksum). The default configuration of the archive, if any, is pushed to
+// the plugin each time the host connects to it, by the function set with OnConnect: it
+// must not be replaced.
+func (a *Archive) NewPlugin(proto string, params ...string) (*Plugin, error) {
+	if err := a.Manifest.checkFiles(a.Dir); err != nil {
+		return nil, ErrArchive(err)
+	}
+	art, err := a.Manifest.Artifact("")
+	if err != nil {
+		return nil, err
+	}
+	p := NewPlugin(proto, art.File, params...)
+	p.SetChecksum(art.SHA256)
+	if a.Config != nil {
+		config := a.Config
+		p.OnConnect(func(p *Plugin) {
+			if _, err := p.UpdateConfig(context.Background(), config); err != nil {
+				p.handler.Error(errors.New("Cannot apply default configuration: " + err.Error()))
+			}
+		})
+	}
+	return p, nil
+}
+
+// AddArchive installs the archive at path into dir (see InstallArchive) and adds its plugin
+// under the name of its manifest, as Add does. The plugin is created with proto and params
+// as by Archive.NewPlugin.
+//
+// The manifest must be signed by one of keys (see Archive.Verify), which is checked before
+// the archive is installed; otherwise an ErrSignature error is returned. Unsigned archives
+// can be added with the plugin of InstallArchive and Add instead.
+func (m *Manager) AddArchive(path, dir string, keys []ed25519.PublicKey, proto string, params ...string) (*Plugin, error) {
+	if len(keys) == 0 {
+		return nil, ErrSignature(errors.New("No keys to verify " + path + " with"))
+	}
+	a, err := installArchive(path, dir, keys, "")
+	if err != nil {
+		return nil, err
+	}
+	p, err := a.NewPlugin(proto, params...)
+	if err != nil {
+		return nil, err
+	}
+	m.Add(a.Manifest.Name, p)
+	return p, nil
+}
@@ -0,0 +1,177 @@
+package pingo
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Replacement for redacted values in audit records.
+const redacted = "[REDACTED]"
+
+// AuditRecord describes a call served by the plugin. See SetAuditLogger.
+type AuditRecord struct {
+	// Time the call started, in UTC
+	Time     time.Time
+	Duration time.Duration
+	Method   string
+	// Tenant of the call, if any (see WithTenant)
+	Tenant string `json:",omitempty"`
+	// Argument and response of the call, after redaction. Reply is nil if the call failed.
+	Args  interface{}
+	Reply interface{}
+	// Error returned by the method, if any.
+	Error string `json:",omitempty"`
+}
+
+// Redactor returns copies of args and reply of a call where sensitive data is masked.
+// It must not modify its arguments.
+type Redactor func(args, reply interface{}) (interface{}, interface{})
+
+type auditor struct {
+	mu        sync.RWMutex
+	logger    func(*AuditRecord)
+	redactors map[string]Redactor
+}
+
+func (a *auditor) record(ctx context.Context, method string, start time.Time, args, reply interface{}, errmsg string) {
+	a.mu.RLock()
+	logger := a.logger
+	redact := a.redactors[method]
+	a.mu.RUnlock()
+
+	if logger == nil {
+		return
+	}
+	if errmsg != "" {
+		reply = nil
+	}
+	if redact != nil {
+		args, reply = redact(args, reply)
+	} else {
+		args, reply = redactTagged(args), redactTagged(reply)
+	}
+	logger(&AuditRecord{
+		Time:     start.UTC().Round(0),
+		Duration: time.Since(start),
+		Method:   method,
+		Tenant:   Tenant(ctx),
+		Args:     args,
+		Reply:    reply,
+		Error:    errmsg,
+	})
+}
+
+// SetAuditLogger sets a function receiving a record for every call served by this plugin.
+//
+// Sensitive data is masked before records are passed to the logger: struct fields tagged
+// with `pingo:"secret"` are replaced (strings with "[REDACTED]", other types with their zero
+// value) unless a Redactor is set for the method with SetRedactor.
+func SetAuditLogger(logger func(*AuditRecord)) {
+	DefaultServer().SetAuditLogger(logger)
+}
+
+// SetAuditLogger sets the audit logger of the server, as the SetAuditLogger function
+// does.
+func (s *Server) SetAuditLogger(logger func(*AuditRecord)) {
+	s.r.server.audit.mu.Lock()
+	defer s.r.server.audit.mu.Unlock()
+
+	s.r.server.audit.logger = logger
+}
+
+// SetRedactor sets a function masking sensitive data in audit records of a method,
+// in the form "Object.Method". It replaces the masking of tagged fields for that method.
+func SetRedactor(method string, r Redactor) {
+	DefaultServer().SetRedactor(method, r)
+}
+
+// SetRedactor sets a redactor of the audit records of the server, as the SetRedactor
+// function does.
+func (s *Server) SetRedactor(method string, r Redactor) {
+	s.r.server.audit.mu.Lock()
+	defer s.r.server.audit.mu.Unlock()
+
+	s.r.server.audit.redactors[method] = r
+}
+
+// NewAuditWriter returns an audit logger writing records as JSON lines to w.
+func NewAuditWriter(w io.Writer) func(*AuditRecord) {
+	var mu sync.Mutex
+	enc := json.NewEncoder(w)
+	return func(r *AuditRecord) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		enc.Encode(r)
+	}
+}
+
+// Return a copy of v where fields tagged as secret are masked, or v itself if
+// there is nothing to mask.
+func redactTagged(v interface{}) interface{} {
+	if v == nil {
+		return nil
+	}
+	val := reflect.ValueOf(v)
+	if !hasSecrets(val.Type(), 0) {
+		return v
+	}
+	return redactValue(val).Interface()
+}
+
+// Only nested structs and pointers to structs are inspected, up to a limited depth.
+func hasSecrets(t reflect.Type, depth int) bool {
+	if depth > 8 {
+		return false
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return false
+	}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.Tag.Get("pingo") == "secret" || hasSecrets(f.Type, depth+1) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return v
+		}
+		p := reflect.New(v.Type().Elem())
+		p.Elem().Set(redactValue(v.Elem()))
+		return p
+	case reflect.Struct:
+		c := reflect.New(v.Type()).Elem()
+		c.Set(v)
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := c.Field(i)
+			if !f.CanSet() {
+				continue
+			}
+			if t.Field(i).Tag.Get("pingo") == "secret" {
+				if f.Kind() == reflect.String {
+					f.SetString(redacted)
+				} else {
+					f.Set(reflect.Zero(f.Type()))
+				}
+				continue
+			}
+			f.Set(redactValue(f))
+		}
+		return c
+	}
+	return v
+}
@@ -0,0 +1,38 @@
+package pingo
+
+// SetAuthorizer sets a function consulted before every call the plugin serves, after the
+// checks of capabilities, with the connection the call was received on and the name of the
+// method, as in "Object.Method". If it returns an error, the call is refused and the error
+// message is returned to the caller. This allows integrating external policy engines.
+//
+// Calls performed by the host to control the plugin, on the object "PingoRpc", are also
+// submitted: refusing "PingoRpc.Exit" makes the host kill the plugin on Stop.
+//
+// SetAuthorizer will panic if called after Run.
+func SetAuthorizer(fn func(conn *ConnInfo, method string) error) {
+	DefaultServer().SetAuthorizer(fn)
+}
+
+// SetAuthorizer sets the authorizer of the server, as the SetAuthorizer function does.
+func (s *Server) SetAuthorizer(fn func(conn *ConnInfo, method string) error) {
+	if s.r.running {
+		panic("Do not call SetAuthorizer after Run")
+	}
+	s.r.authorize = fn
+}
+
+// Check performed on each call received on the connection described by info, given the
+// capability check, if any.
+func (r *rpcServer) callCheck(info *ConnInfo, scope func(string) error) func(string) error {
+	if r.authorize == nil {
+		return scope
+	}
+	return func(method string) error {
+		if scope != nil {
+			if err := scope(method); err != nil {
+				return err
+			}
+		}
+		return r.authorize(info, method)
+	}
+}
@@ -0,0 +1,112 @@
+package pingo
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Interface the plugin listens on with TCP, unless set
+	defaultTCPHost = "127.0.0.1"
+	// First port tried, unprivileged
+	defaultFirstPort = 1024
+	// Ports tried unless a range is set
+	defaultPortRetries = 500
+)
+
+// BindAddress makes plugins using TCP listen on the interface with address host, as
+// "0.0.0.0" for all interfaces, instead of only on 127.0.0.1. This is mostly useful for
+// plugins running in containers, where the loopback interface of the plugin is not
+// reachable by the host. It sets the -pingo:tcp-addr flag of the plugin.
+//
+// Hosts connect to the address the plugin listens on: make sure other hosts cannot reach
+// it, or protect connections with authentication (see SetSecure) or TLS.
+func BindAddress(host string) Option {
+	return func(o *options) {
+		o.tcpHost = host
+	}
+}
+
+// PortRange restricts the ports plugins using TCP may listen on to those from first to
+// last included, for example the ones open in a firewall. The plugin tries each of them
+// in turn, and fails to start if all are taken. It sets the -pingo:tcp-ports flag of the
+// plugin, as in "40000-41000".
+func PortRange(first, last int) Option {
+	return func(o *options) {
+		o.tcpPorts = strconv.Itoa(first) + "-" + strconv.Itoa(last)
+	}
+}
+
+// Parameters passing the TCP bind options to the plugin.
+func (o *options) tcpParams() []string {
+	var params []string
+	if o.tcpHost != "" {
+		params = append(params, "-pingo:tcp-addr="+o.tcpHost)
+	}
+	if o.tcpPorts != "" {
+		params = append(params, "-pingo:tcp-ports="+o.tcpPorts)
+	}
+	return params
+}
+
+// Parse a range of ports as "first-last"; a single port is a range of one.
+func parsePortRange(s string) (first, last int, err error) {
+	lo, hi, ok := strings.Cut(s, "-")
+	if !ok {
+		hi = lo
+	}
+	if first, err = strconv.Atoi(strings.TrimSpace(lo)); err != nil {
+		return 0, 0, errors.New("Invalid port range " + s)
+	}
+	if last, err = strconv.Atoi(strings.TrimSpace(hi)); err != nil {
+		return 0, 0, errors.New("Invalid port range " + s)
+	}
+	if first < 1 || last > 65535 || first > last {
+		return 0, 0, errors.New("Invalid port range " + s)
+	}
+	return first, last, nil
+}
+
+// Addresses to listen on with TCP, trying each port of a range in turn.
+type tcp struct {
+	host        string
+	first, last int
+	// Try every port of the range, set with PortRange
+	ranged bool
+	// Next port to try
+	next int
+}
+
+func newTCP(host, ports string) (*tcp, error) {
+	t := &tcp{host: host, first: defaultFirstPort, last: 65535}
+	if t.host == "" {
+		t.host = defaultTCPHost
+	}
+	if ports != "" {
+		var err error
+		if t.first, t.last, err = parsePortRange(ports); err != nil {
+			return nil, err
+		}
+		t.ranged = true
+	}
+	t.next = t.first
+	return t, nil
+}
+
+func (t *tcp) addr() string {
+	port := t.next
+	if t.next++; t.next > t.last {
+		t.next = t.first
+	}
+	return net.JoinHostPort(t.host, strconv.Itoa(port))
+}
+
+func (t *tcp) retries() int {
+	n := t.last - t.first + 1
+	if !t.ranged && n > defaultPortRetries {
+		return defaultPortRetries
+	}
+	return n
+}
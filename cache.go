@@ -0,0 +1,141 @@
+package pingo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"sync"
+	"time"
+)
+
+// Caller is implemented by anything performing RPC calls with the same semantics
+// of Plugin.Call. Middlewares like Cache wrap a Caller and are Callers themselves.
+type Caller interface {
+	Call(name string, args interface{}, resp interface{}) error
+}
+
+type cacheEntry struct {
+	resp    []byte
+	expires time.Time
+}
+
+// Cache is a Caller that keeps the responses of cacheable methods for a fixed time, to avoid
+// calling the plugin again for the same arguments.
+//
+// Entries are keyed by method name and arguments encoded with "encoding/gob". Arguments
+// containing maps do not have a stable encoding and are not cached effectively.
+type Cache struct {
+	next      Caller
+	ttl       time.Duration
+	methods   map[string]bool
+	mu        sync.Mutex
+	entries   map[string]*cacheEntry
+	lastSweep time.Time
+}
+
+// NewCache creates a cache in front of next. Responses of the specified methods are kept
+// for ttl; calls to any other method are passed through.
+func NewCache(next Caller, ttl time.Duration, methods ...string) *Cache {
+	c := &Cache{
+		next:      next,
+		ttl:       ttl,
+		methods:   make(map[string]bool),
+		entries:   make(map[string]*cacheEntry),
+		lastSweep: time.Now(),
+	}
+	for _, m := range methods {
+		c.methods[m] = true
+	}
+	return c
+}
+
+// Call returns the cached response for name and args, if present, or performs the call.
+// Only successful responses are cached.
+func (c *Cache) Call(name string, args interface{}, resp interface{}) error {
+	if !c.methods[name] {
+		return c.next.Call(name, args, resp)
+	}
+
+	key, err := cacheKey(name, args)
+	if err != nil {
+		return c.next.Call(name, args, resp)
+	}
+
+	if data := c.get(key); data != nil {
+		if err := gob.NewDecoder(bytes.NewReader(data)).Decode(resp); err == nil {
+			return nil
+		}
+	}
+
+	if err := c.next.Call(name, args, resp); err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err == nil {
+		c.set(key, buf.Bytes())
+	}
+	return nil
+}
+
+// Invalidate removes the cached response for name and args.
+func (c *Cache) Invalidate(name string, args interface{}) {
+	key, err := cacheKey(name, args)
+	if err != nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.entries, key)
+}
+
+// Purge removes all cached responses.
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]*cacheEntry)
+}
+
+func (c *Cache) get(key string) []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return e.resp
+}
+
+func (c *Cache) set(key string, resp []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	// Remove expired entries from time to time, to not grow without bounds.
+	if now.Sub(c.lastSweep) > c.ttl {
+		for k, e := range c.entries {
+			if now.After(e.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	c.entries[key] = &cacheEntry{resp: resp, expires: now.Add(c.ttl)}
+}
+
+func cacheKey(name string, args interface{}) (string, error) {
+	var buf bytes.Buffer
+	buf.WriteString(name)
+	buf.WriteByte(0)
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
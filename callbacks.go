@@ -0,0 +1,192 @@
+package pingo
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"sync"
+)
+
+// The host serves its callbacks on a connection it opens to the plugin with a CONNECT
+// request for callbacksPath. On this connection the roles are reversed: the plugin sends
+// calls and the host answers them.
+const callbacksPath = "/_pingo_/callbacks"
+
+var (
+	errNoCallbacks       = ErrNoCallbacks(errors.New("Host did not register callbacks"))
+	errInsecureCallbacks = ErrNoCallbacks(errors.New("Callbacks need connections authenticated with a secret or a host certificate"))
+)
+
+// Error reported to a plugin calling the host when the host has no callbacks.
+type ErrNoCallbacks error
+
+// RegisterCallback exports an object of the host to the plugin, which calls its methods
+// with Host().Call. The object must obey the rules of the standard "rpc" package.
+//
+// Calls from the plugin are received on a connection the host opens to it, authenticated
+// as the other connections to the plugin. Otherwise anyone reaching the plugin could serve
+// its callbacks in place of the host: RegisterCallback makes connections secure (see
+// SetSecure), and callbacks are not served if connections are made insecure again, unless
+// the plugin verifies the certificate of the host (see TLSClientCA).
+//
+// Panics if called after Start.
+func (p *Plugin) RegisterCallback(obj interface{}) error {
+	if p.running {
+		panic("Cannot call RegisterCallback after Start")
+	}
+	if p.callbacks == nil {
+		p.callbacks = rpc.NewServer()
+		p.secure = true
+	}
+	return p.callbacks.Register(obj)
+}
+
+// Open the connection serving callbacks to the plugin, if any.
+func (c *ctrl) serveCallbacks() {
+	if c.p.callbacks == nil {
+		return
+	}
+	if !c.p.secure && !(c.p.tls && c.p.opts.tlsClientCA != "") {
+		c.p.handler.Error(errInsecureCallbacks)
+		return
+	}
+	conn, br, err := c.dialer.dial(callbacksPath)
+	if err != nil {
+		c.p.handler.Error(errors.New("Cannot connect callbacks: " + err.Error()))
+		return
+	}
+	codec := newGobServerCodec(&bufConn{conn, br}, c.p.opts.maxMessage)
+	go c.p.callbacks.ServeCodec(c.p.opts.limitCalls(codec))
+}
+
+// HostClient calls the objects registered by the host with RegisterCallback.
+type HostClient struct {
+	r *rpcServer
+}
+
+// Host returns a client of the host of the plugin.
+func Host() *HostClient {
+	return DefaultServer().Host()
+}
+
+// Host returns a client of the host of the server, as the Host function does.
+func (s *Server) Host() *HostClient {
+	return &HostClient{r: s.r}
+}
+
+// Call performs a call to the host, as rpc.Client.Call does. Call can be called from any
+// goroutine; it waits for Run to be called and for the host to connect. If the host has
+// not registered callbacks, an ErrNoCallbacks error is returned.
+func (h *HostClient) Call(name string, args interface{}, resp interface{}) error {
+	return h.CallContext(context.Background(), name, args, resp)
+}
+
+// CallContext is like Call, but returns early with the error of ctx if ctx is done before
+// the host has connected or answered.
+func (h *HostClient) CallContext(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	client, err := h.r.callbacks.get(ctx, h.r)
+	if err != nil {
+		return err
+	}
+	call := client.Go(name, args, resp, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+		return call.Error
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Connection to the callbacks of the host.
+type callbackClient struct {
+	mu     sync.Mutex
+	client *rpc.Client
+	// Closed when the host connects the first time
+	ready chan struct{}
+}
+
+func (c *callbackClient) init() chan struct{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.ready == nil {
+		c.ready = make(chan struct{})
+	}
+	return c.ready
+}
+
+// Wait for the host to connect and return the client.
+func (c *callbackClient) get(ctx context.Context, r *rpcServer) (*rpc.Client, error) {
+	select {
+	case <-r.started:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if !r.conf.callbacks {
+		return nil, errNoCallbacks
+	}
+	if !r.authenticatesHost() {
+		return nil, errInsecureCallbacks
+	}
+	select {
+	case <-c.init():
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.client, nil
+}
+
+// Returns true if only the host can open connections authenticated without a capability.
+func (r *rpcServer) authenticatesHost() bool {
+	return r.secret != "" || r.conf.tls && r.conf.tlsclientca != ""
+}
+
+// Use conn, opened by the host, for calls to its callbacks until it is closed. Connections
+// that may not come from the host are closed.
+func (r *rpcServer) serveCallbacks(conn net.Conn, br *bufio.Reader) {
+	if !r.authenticatesHost() {
+		conn.Close()
+		return
+	}
+	done := make(chan struct{})
+	client := rpc.NewClient(&closeNotifier{ReadWriteCloser: &bufConn{conn, br}, done: done})
+
+	ready := r.callbacks.init()
+	r.callbacks.mu.Lock()
+	old := r.callbacks.client
+	r.callbacks.client = client
+	if old == nil {
+		close(ready)
+	}
+	r.callbacks.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	<-done
+}
+
+// Signals when the connection fails or is closed.
+type closeNotifier struct {
+	io.ReadWriteCloser
+	once sync.Once
+	done chan struct{}
+}
+
+func (c *closeNotifier) Read(b []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(b)
+	if err != nil {
+		c.once.Do(func() { close(c.done) })
+	}
+	return n, err
+}
+
+func (c *closeNotifier) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.ReadWriteCloser.Close()
+}
@@ -0,0 +1,75 @@
+package pingo
+
+import (
+	"context"
+	"math"
+	"net/rpc"
+	"net/url"
+	"sync"
+)
+
+// Cancellations are requests with a sequence number never used by the "rpc" package,
+// like keepalive pings. They carry the ID the host has sent with the metadata of the call
+// to cancel and are not answered. Only calls received on the same connection can be
+// cancelled.
+const (
+	cancelMethod        = internalObject + ".Cancel"
+	cancelSeq    uint64 = math.MaxUint64 - 1
+)
+
+// Metadata key of the ID of a call that the host can cancel.
+const cancelKey = "call"
+
+// Set the ID of the call in md, if the context of the call can be cancelled.
+func setCancelID(md url.Values, ctx context.Context) string {
+	if ctx.Done() == nil {
+		return ""
+	}
+	id := randstr(12)
+	md.Set(cancelKey, id)
+	return id
+}
+
+// Ask the plugin to cancel the context of the call with the specified ID.
+func (c *gobClientCodec) cancel(id string) error {
+	return c.write(&rpc.Request{ServiceMethod: cancelMethod, Seq: cancelSeq}, id, Gob)
+}
+
+// Calls in progress on a connection that can be cancelled, by ID.
+type cancellations struct {
+	mu    sync.Mutex
+	calls map[string]context.CancelFunc
+}
+
+// Return the context for the call with metadata md, cancelled if the host asks so. The
+// context must be released with the returned function once the call is complete.
+func (c *cancellations) context(md url.Values) (context.Context, context.CancelFunc) {
+	id := md.Get(cancelKey)
+	if id == "" {
+		return context.Background(), func() {}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.calls == nil {
+		c.calls = make(map[string]context.CancelFunc)
+	}
+	c.calls[id] = cancel
+	return ctx, func() {
+		c.mu.Lock()
+		delete(c.calls, id)
+		c.mu.Unlock()
+		cancel()
+	}
+}
+
+func (c *cancellations) cancel(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if cancel, ok := c.calls[id]; ok {
+		cancel()
+	}
+}
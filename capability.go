@@ -0,0 +1,284 @@
+package pingo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoCapabilities   = errors.New("Capabilities require a secure plugin (see SetSecure)")
+	errInvalidToken     = ErrCapability(errors.New("Invalid capability token"))
+	errTokenExpired     = ErrCapability(errors.New("Capability token expired"))
+	errPermissionDenied = ErrCapability(errors.New("Permission denied by capability"))
+)
+
+// Error reported when a capability token is invalid or does not allow a call.
+type ErrCapability error
+
+// Modes of a secure connection, sent by the client before the key exchange.
+const (
+	// Full access, authenticated with the plugin secret.
+	modeSecret byte = iota
+	// Access restricted by a capability, authenticated with a key derived from it.
+	modeCapability
+)
+
+// Claims embedded in a capability token.
+type claims struct {
+	// Patterns of allowed "Object.Method" names, as for path.Match.
+	Allow []string `json:"allow"`
+	// Expiration time as Unix time in seconds; zero for never.
+	Expires int64 `json:"exp,omitempty"`
+	// Random identifier of the token, for logging; empty for tokens of older versions.
+	ID string `json:"jti,omitempty"`
+}
+
+func (c *claims) expired() bool {
+	return c.Expires != 0 && time.Now().Unix() > c.Expires
+}
+
+// First instant at which the claims are expired. Only valid if Expires is set.
+func (c *claims) expiry() time.Time {
+	return time.Unix(c.Expires+1, 0)
+}
+
+// Check whether a method can be called by the holder of the capability.
+func (c *claims) check(method string) error {
+	if c.expired() {
+		return errTokenExpired
+	}
+	for _, p := range c.Allow {
+		if ok, _ := path.Match(p, method); ok {
+			return nil
+		}
+	}
+	return errPermissionDenied
+}
+
+// The key of a capability is derived from the plugin secret, so that the
+// plugin can verify it without the host having to share its secret.
+func capabilityKey(secret, payload string) string {
+	return hex.EncodeToString(mac(secret, []byte("pingo capability"), []byte(payload)))
+}
+
+func parseClaims(payload string) (*claims, error) {
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	c := &claims{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, errInvalidToken
+	}
+	return c, nil
+}
+
+// NewCapability returns a token allowing to call only the methods matching one of patterns
+// (for example "Store.Get" or "Store.*", see path.Match) for the duration ttl, or forever if
+// ttl is zero. The token can be handed to a less trusted component, which connects to the
+// plugin directly with DialCapability.
+//
+// The plugin must be secure (see SetSecure) and use TCP, as unix sockets are removed once
+// the host is connected.
+func (p *Plugin) NewCapability(ttl time.Duration, patterns ...string) (string, error) {
+	conn, err := p.request(context.Background())
+	if err != nil {
+		return "", err
+	}
+	if conn.secret == "" {
+		return "", errNoCapabilities
+	}
+
+	id := make([]byte, 8)
+	if err := cryptoProvider.Random(id); err != nil {
+		return "", err
+	}
+	c := &claims{Allow: patterns, ID: hex.EncodeToString(id)}
+	if ttl > 0 {
+		c.Expires = time.Now().Add(ttl).Unix()
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + capabilityKey(conn.secret, payload), nil
+}
+
+// Addr returns the protocol and address the plugin is listening on, once initialized.
+func (p *Plugin) Addr() (proto, addr string, err error) {
+	conn, err := p.request(context.Background())
+	if err != nil {
+		return "", "", err
+	}
+	return conn.proto, conn.addr, nil
+}
+
+// DialCapability connects to a secure plugin at the specified address using a token created
+// with NewCapability. Only calls allowed by the token are accepted on the connection.
+func DialCapability(proto, addr, token string) (*rpc.Client, error) {
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+	return dialRPC(proto, addr, &credentials{capability: parts[0], secret: parts[1]}, &options{})
+}
+
+// CapabilityClient performs calls on a plugin with capability tokens obtained by calling
+// a refresh function, for example one asking the host for a new token (see NewCapability).
+// Before a token expires, the client obtains a new one and reconnects with it: calls in
+// progress complete on the previous connection. Plugins drop connections whose token has
+// expired, which limits the use of captured tokens.
+type CapabilityClient struct {
+	proto, addr string
+	refresh     func() (string, error)
+
+	mu sync.Mutex
+	// Connection new calls are performed on; nil when closed
+	cur *capabilityConn
+	// Last error obtaining a new token, if any
+	err    error
+	closed chan struct{}
+}
+
+// A connection authenticated with a token.
+type capabilityConn struct {
+	client *rpc.Client
+	// Zero if the token does not expire
+	expires time.Time
+	// Calls in progress
+	calls sync.WaitGroup
+}
+
+func (cc *capabilityConn) expired() bool {
+	return !cc.expires.IsZero() && time.Now().After(cc.expires)
+}
+
+// DialCapabilityRefresh connects to a secure plugin at the specified address using the
+// token returned by refresh, which is called again each time the token is about to expire.
+func DialCapabilityRefresh(proto, addr string, refresh func() (string, error)) (*CapabilityClient, error) {
+	c := &CapabilityClient{
+		proto:   proto,
+		addr:    addr,
+		refresh: refresh,
+		closed:  make(chan struct{}),
+	}
+	cc, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.cur = cc
+	go c.renew()
+	return c, nil
+}
+
+// Obtain a token and connect with it.
+func (c *CapabilityClient) dial() (*capabilityConn, error) {
+	token, err := c.refresh()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(token, ".", 2)
+	if len(parts) != 2 {
+		return nil, errInvalidToken
+	}
+	claims, err := parseClaims(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	client, err := dialRPC(c.proto, c.addr, &credentials{capability: parts[0], secret: parts[1]}, &options{})
+	if err != nil {
+		return nil, err
+	}
+	cc := &capabilityConn{client: client}
+	if claims.Expires != 0 {
+		cc.expires = claims.expiry()
+	}
+	return cc, nil
+}
+
+// Reconnect when four fifths of the validity of the token have passed, retrying
+// on failure until the client is closed.
+func (c *CapabilityClient) renew() {
+	c.mu.Lock()
+	expires := c.cur.expires
+	c.mu.Unlock()
+
+	delay := time.Until(expires) * 4 / 5
+	for !expires.IsZero() {
+		select {
+		case <-time.After(delay):
+		case <-c.closed:
+			return
+		}
+
+		cc, err := c.dial()
+		if err != nil {
+			c.mu.Lock()
+			c.err = err
+			c.mu.Unlock()
+			if delay = time.Until(expires) / 2; delay < time.Second {
+				delay = time.Second
+			}
+			continue
+		}
+
+		c.mu.Lock()
+		old := c.cur
+		if old == nil {
+			// Closed while dialing
+			c.mu.Unlock()
+			cc.client.Close()
+			return
+		}
+		c.cur, c.err = cc, nil
+		c.mu.Unlock()
+
+		go func() {
+			old.calls.Wait()
+			old.client.Close()
+		}()
+		expires = cc.expires
+		delay = time.Until(expires) * 4 / 5
+	}
+}
+
+// Call the named method, as rpc.Client.Call does.
+func (c *CapabilityClient) Call(name string, args interface{}, resp interface{}) error {
+	c.mu.Lock()
+	cc, err := c.cur, c.err
+	if cc == nil {
+		c.mu.Unlock()
+		return rpc.ErrShutdown
+	}
+	cc.calls.Add(1)
+	c.mu.Unlock()
+	defer cc.calls.Done()
+
+	if err != nil && cc.expired() {
+		return ErrCapability(errors.New("Cannot refresh capability token: " + err.Error()))
+	}
+	return cc.client.Call(name, args, resp)
+}
+
+// Close the connection. Calls in progress fail.
+func (c *CapabilityClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.cur == nil {
+		return rpc.ErrShutdown
+	}
+	close(c.closed)
+	err := c.cur.client.Close()
+	c.cur = nil
+	return err
+}
@@ -0,0 +1,181 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of faults injected by Chaos.
+const (
+	// The process of the plugin is killed.
+	FaultKill = "kill"
+	// The process of the plugin is stopped for a while, then continued.
+	FaultPause = "pause"
+	// The next call to the plugin through the manager is delayed.
+	FaultDelay = "delay"
+)
+
+// Chaos injects faults in the plugins of a Manager, to verify in staging that the host
+// copes with plugins dying, hanging or being slow. Faults follow a schedule generated from
+// Seed: with the same seed and the same plugins, the same faults are injected in the same
+// order and at the same intervals.
+type Chaos struct {
+	// Seed of the schedule.
+	Seed int64
+	// Average interval between faults; each interval is random between half and one and
+	// a half times Every. It must be positive.
+	Every time.Duration
+	// Relative weights of the kinds of faults.
+	Kill, Pause, Delay int
+	// Duration of pauses and delays.
+	PauseFor, DelayFor time.Duration
+	// Names of the plugins subject to faults; if empty, all plugins.
+	Plugins []string
+	// Called for each fault injected, if not nil.
+	Injected func(plugin, fault string)
+}
+
+// SetChaos starts injecting faults when the manager is started, or immediately if the manager
+// is running already. Previous faults are stopped; nil stops injecting faults. Paused plugins
+// are continued when faults are stopped.
+//
+// SetChaos panics if the interval between faults is not positive.
+func (m *Manager) SetChaos(c *Chaos) {
+	if c != nil && c.Every <= 0 {
+		panic("Chaos interval must be positive")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopChaos()
+	m.chaos = c
+	if m.running {
+		m.startChaos()
+	}
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) startChaos() {
+	if m.chaos == nil {
+		return
+	}
+	m.chaosStop = make(chan struct{})
+	go m.chaos.run(m, m.chaosStop)
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) stopChaos() {
+	if m.chaosStop != nil {
+		close(m.chaosStop)
+		m.chaosStop = nil
+	}
+}
+
+// Plugins subject to faults, in a stable order.
+func (c *Chaos) targets(m *Manager) []string {
+	names := c.Plugins
+	if len(names) == 0 {
+		names = m.Names()
+	}
+	names = append([]string(nil), names...)
+	sort.Strings(names)
+	return names
+}
+
+func (c *Chaos) fault(rnd *rand.Rand) string {
+	total := c.Kill + c.Pause + c.Delay
+	if total <= 0 {
+		return ""
+	}
+	n := rnd.Intn(total)
+	switch {
+	case n < c.Kill:
+		return FaultKill
+	case n < c.Kill+c.Pause:
+		return FaultPause
+	}
+	return FaultDelay
+}
+
+func (c *Chaos) run(m *Manager, stop <-chan struct{}) {
+	rnd := rand.New(rand.NewSource(c.Seed))
+
+	for {
+		// Draw the whole step first, so that the schedule does not depend on timing.
+		wait := c.Every/2 + time.Duration(rnd.Int63n(int64(c.Every)+1))
+		targets := c.targets(m)
+		target := -1
+		if len(targets) > 0 {
+			target = rnd.Intn(len(targets))
+		}
+		fault := c.fault(rnd)
+
+		select {
+		case <-time.After(wait):
+		case <-stop:
+			return
+		}
+		if target < 0 || fault == "" {
+			continue
+		}
+		p := m.Plugin(targets[target])
+		if p == nil {
+			continue
+		}
+		if c.Injected != nil {
+			c.Injected(targets[target], fault)
+		}
+		switch fault {
+		case FaultKill:
+			p.killProcess()
+		case FaultPause:
+			// Unlike Pause, calls are not held: the plugin appears to hang.
+			if err := pauseProcess(p); err != nil {
+				p.handler.Error(errors.New("Chaos cannot pause plugin: " + err.Error()))
+				continue
+			}
+			select {
+			case <-time.After(c.PauseFor):
+			case <-stop:
+			}
+			resumeProcess(p)
+		case FaultDelay:
+			p.chaosDelay.add(c.DelayFor)
+		}
+	}
+}
+
+// Delays injected in the next calls of a plugin.
+type chaosDelay struct {
+	mu      sync.Mutex
+	pending time.Duration
+}
+
+func (d *chaosDelay) add(t time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.pending += t
+}
+
+// Wait for the pending delay, if any.
+func (d *chaosDelay) wait(ctx context.Context) error {
+	d.mu.Lock()
+	t := d.pending
+	d.pending = 0
+	d.mu.Unlock()
+
+	if t == 0 {
+		return nil
+	}
+	select {
+	case <-time.After(t):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
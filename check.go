@@ -0,0 +1,121 @@
+package pingo
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// CheckReport describes the objects registered by a plugin, as printed by plugins
+// started with -pingo:check. See Verify.
+type CheckReport struct {
+	// No object failed to register
+	OK bool `json:"ok"`
+	// Meta lines the plugin would output before being ready
+	Handshake map[string]string `json:"handshake"`
+	Objects   []CheckObject     `json:"objects"`
+	Errors    []string          `json:"errors,omitempty"`
+}
+
+// CheckObject describes an object registered by a plugin.
+type CheckObject struct {
+	Name string `json:"name"`
+	// Methods that can be called
+	Methods []string `json:"methods"`
+	// Exported methods without a signature suitable for RPC
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// Verify runs the plugin executable at path in check mode, which validates the registered
+// objects without listening for calls, and returns its report. An error is returned only
+// if the report cannot be obtained: a plugin failing validation returns a report with OK
+// set to false.
+func Verify(path string, params ...string) (*CheckReport, error) {
+	out, err := exec.Command(path, append([]string{"-pingo:check"}, params...)...).Output()
+	if len(out) == 0 && err != nil {
+		return nil, err
+	}
+	report := &CheckReport{}
+	if err := json.Unmarshal(out, report); err != nil {
+		return nil, errors.New("Invalid check report: " + err.Error())
+	}
+	return report, nil
+}
+
+// Validate the registered objects and print a report as JSON, without listening.
+// The process exits with status 1 if any object could not be registered.
+func (r *rpcServer) check() {
+	report := &CheckReport{
+		Handshake: map[string]string{
+			"objects": strings.Join(r.objs, ", "),
+			"proto":   r.conf.proto,
+		},
+		Objects: make([]CheckObject, 0),
+	}
+	if r.conf.secure {
+		report.Handshake["auth-token"] = "<secret>"
+	}
+	if r.overloaded {
+		report.Handshake["overload"] = "on"
+	}
+	for _, err := range r.regErrs {
+		report.Errors = append(report.Errors, err.Error())
+	}
+
+	r.server.mu.RLock()
+	for name, svc := range r.server.services {
+		if name == internalObject {
+			continue
+		}
+		obj := CheckObject{Name: name, Methods: make([]string, 0)}
+		typ := svc.rcvr.Type()
+		for m := 0; m < typ.NumMethod(); m++ {
+			method := typ.Method(m)
+			if _, ok := svc.method[method.Name]; ok {
+				obj.Methods = append(obj.Methods, method.Name)
+			} else if method.IsExported() {
+				obj.Skipped = append(obj.Skipped, method.Name+" "+signature(method.Type))
+			}
+		}
+		report.Objects = append(report.Objects, obj)
+	}
+	r.server.mu.RUnlock()
+
+	sort.Slice(report.Objects, func(i, j int) bool {
+		return report.Objects[i].Name < report.Objects[j].Name
+	})
+	report.OK = len(report.Errors) == 0
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if !report.OK {
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+// Signature of a method, without the receiver.
+func signature(t reflect.Type) string {
+	in := make([]string, 0, t.NumIn())
+	for i := 1; i < t.NumIn(); i++ {
+		in = append(in, t.In(i).String())
+	}
+	out := make([]string, 0, t.NumOut())
+	for i := 0; i < t.NumOut(); i++ {
+		out = append(out, t.Out(i).String())
+	}
+	sig := "(" + strings.Join(in, ", ") + ")"
+	if len(out) == 1 {
+		return sig + " " + out[0]
+	}
+	if len(out) > 1 {
+		return sig + " (" + strings.Join(out, ", ") + ")"
+	}
+	return sig
+}
@@ -0,0 +1,83 @@
+package pingo
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Child describes the process of a plugin started by this host.
+type Child struct {
+	// Process ID
+	PID int
+	// Executable and parameters of the plugin, as passed to NewPlugin
+	Name string
+	// Protocol and address the plugin listens on; empty until it is ready
+	Proto, Addr string
+	// The plugin the process belongs to
+	Plugin *Plugin
+}
+
+// Processes of plugins, by process ID.
+var children = struct {
+	mu    sync.Mutex
+	procs map[int]*Child
+}{procs: make(map[int]*Child)}
+
+// Children returns the processes of all plugins started by this host that have not
+// exited yet, ordered by process ID.
+func Children() []Child {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+
+	list := make([]Child, 0, len(children.procs))
+	for _, c := range children.procs {
+		list = append(list, *c)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].PID < list[j].PID
+	})
+	return list
+}
+
+// ForceKillAll kills the processes of all plugins started by this host, without asking
+// them to exit, for example in crash handlers or at the end of tests. Plugins are not
+// stopped: use Stop to release their resources. Errors killing the processes are returned.
+func ForceKillAll() error {
+	var errs []error
+	for _, c := range Children() {
+		proc, err := os.FindProcess(c.PID)
+		if err == nil {
+			err = proc.Kill()
+		}
+		if err != nil && !errors.Is(err, os.ErrProcessDone) {
+			errs = append(errs, fmt.Errorf("Cannot kill plugin %s (pid %d): %w", c.Name, c.PID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func addChild(p *Plugin, pid int) {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+
+	children.procs[pid] = &Child{PID: pid, Name: p.String(), Plugin: p}
+}
+
+func readyChild(pid int, proto, addr string) {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+
+	if c, ok := children.procs[pid]; ok {
+		c.Proto, c.Addr = proto, addr
+	}
+}
+
+func removeChild(pid int) {
+	children.mu.Lock()
+	defer children.mu.Unlock()
+
+	delete(children.procs, pid)
+}
@@ -0,0 +1,119 @@
+package pingo
+
+import (
+	"context"
+	"fmt"
+	"net/rpc"
+	"time"
+)
+
+// Default skew above which a warning is reported. See MaxClockSkew.
+const defaultMaxSkew = time.Second
+
+// Internal RPC call returning the clock of the plugin. Do not call manually.
+func (s *PingoRpc) Clock(unused int, now *string) error {
+	*now = formatTime(time.Now())
+	return nil
+}
+
+// MaxClockSkew sets the clock offset above which a plugin using TCP is reported to the
+// ErrorHandler, as it would break absolute deadlines (see AbsoluteDeadlines) and the expiry
+// of capabilities. The default is one second.
+func MaxClockSkew(d time.Duration) Option {
+	return func(o *options) {
+		o.maxSkew = d
+	}
+}
+
+// Offset of the clock of a plugin, measured as in NTP: the plugin time is assumed to be
+// read halfway through the round trip, so the error is at most half the round trip.
+type clockSkew struct {
+	offset    time.Duration
+	roundTrip time.Duration
+	measured  bool
+}
+
+// Measure the offset of the clock of the plugin reachable with client. Plugins built
+// with older versions do not answer; the offset is then not measured.
+func measureClock(client *rpc.Client, timeout time.Duration) clockSkew {
+	var reply string
+	start := time.Now()
+	call := client.Go(internalObject+".Clock", 0, &reply, make(chan *rpc.Call, 1))
+	select {
+	case <-call.Done:
+	case <-time.After(timeout):
+		return clockSkew{}
+	}
+	end := time.Now()
+	if call.Error != nil {
+		return clockSkew{}
+	}
+	remote, err := parseTime(reply)
+	if err != nil {
+		return clockSkew{}
+	}
+	rtt := end.Sub(start)
+	local := start.Add(rtt / 2)
+	return clockSkew{offset: remote.Sub(local), roundTrip: rtt, measured: true}
+}
+
+// Measure the clock of the plugin, if remote, and warn if it is too far off.
+func (c *ctrl) checkClock() {
+	if c.proto != "tcp" {
+		return
+	}
+	c.skew = measureClock(c.client, c.p.initTimeout)
+	max := c.p.opts.maxSkew
+	if max == 0 {
+		max = defaultMaxSkew
+	}
+	offset := c.skew.offset
+	if offset < 0 {
+		offset = -offset
+	}
+	if c.skew.measured && offset-c.skew.roundTrip/2 > max {
+		c.p.handler.Error(fmt.Errorf("Clock of plugin %s is off by %s (±%s)", c.p.exe, c.skew.offset, c.skew.roundTrip/2))
+	}
+}
+
+// PluginInfo describes a running plugin. See Plugin.Info.
+type PluginInfo struct {
+	// Protocol and address the plugin is listening on
+	Proto, Addr string
+	// Process ID of the plugin
+	PID int
+	// Connection is encrypted (see SetSecure)
+	Secure bool
+	// Whether the clock of the plugin was measured, which happens when it uses TCP
+	ClockMeasured bool
+	// Estimated offset of the clock of the plugin from the one of the host: positive
+	// if the plugin is ahead
+	ClockOffset time.Duration
+	// Round trip time of the measure; the offset is accurate within half of it
+	RoundTrip time.Duration
+	// Version of the protocol spoken by the plugin and codecs it serves; zero and empty
+	// for plugins built with versions of this package predating the handshake
+	ProtocolVersion int
+	Codecs          []string
+}
+
+// Info returns the details of the plugin, once initialized.
+func (p *Plugin) Info() (*PluginInfo, error) {
+	conn, err := p.request(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	info := &PluginInfo{
+		Proto:         conn.proto,
+		Addr:          conn.addr,
+		PID:           conn.pid,
+		Secure:        conn.secret != "",
+		ClockMeasured: conn.skew.measured,
+		ClockOffset:   conn.skew.offset,
+		RoundTrip:     conn.skew.roundTrip,
+	}
+	if conn.hello != nil {
+		info.ProtocolVersion, info.Codecs = conn.hello.Version, conn.hello.Codecs
+	}
+	return info, nil
+}
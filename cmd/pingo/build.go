@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/dullgiulio/pingo"
+)
+
+func build(args []string) {
+	fs := flag.NewFlagSet("build", flag.ExitOnError)
+	platforms := fs.String("platforms", runtime.GOOS+"/"+runtime.GOARCH, "Comma-separated platforms to build for, as in linux/amd64")
+	out := fs.String("o", "dist", "Directory to write the executables and the manifest to")
+	name := fs.String("name", "", "Name of the plugin; defaults to the last element of the package path")
+	version := fs.String("version", "", "Version of the plugin recorded in the manifest")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	pkg := fs.Arg(0)
+
+	if *name == "" {
+		ipath, err := exec.Command("go", "list", "-f", "{{.ImportPath}}", pkg).Output()
+		if err != nil {
+			fatal(goError(err))
+		}
+		*name = path.Base(strings.TrimSpace(string(ipath)))
+	}
+	if err := os.MkdirAll(*out, 0755); err != nil {
+		fatal(err)
+	}
+
+	m := &pingo.Manifest{Name: *name, Version: *version}
+	for _, platform := range strings.Split(*platforms, ",") {
+		a, err := buildArtifact(pkg, *name, *out, strings.TrimSpace(platform))
+		if err != nil {
+			fatal(fmt.Errorf("%s: %s", platform, err))
+		}
+		fmt.Printf("%s\t%s\t%s\n", a.Platform, filepath.Join(*out, a.File), a.SHA256)
+		m.Artifacts = append(m.Artifacts, *a)
+	}
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(*out, pingo.ManifestFile), append(data, '\n'), 0644); err != nil {
+		fatal(err)
+	}
+}
+
+// Build pkg for platform into dir and checksum the executable.
+func buildArtifact(pkg, name, dir, platform string) (*pingo.Artifact, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, errors.New("Platform must be in the form os/arch")
+	}
+	goos, goarch := parts[0], parts[1]
+	file := name + "-" + goos + "-" + goarch
+	if goos == "windows" {
+		file += ".exe"
+	}
+
+	cmd := exec.Command("go", "build", "-trimpath", "-o", filepath.Join(dir, file), pkg)
+	cmd.Env = append(os.Environ(), "GOOS="+goos, "GOARCH="+goarch)
+	// Cross-compiling with cgo needs a C toolchain for the target
+	if goos != runtime.GOOS || goarch != runtime.GOARCH {
+		cmd.Env = append(cmd.Env, "CGO_ENABLED=0")
+	}
+	cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(filepath.Join(dir, file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, f)
+	if err != nil {
+		return nil, err
+	}
+	return &pingo.Artifact{
+		Platform: platform,
+		File:     file,
+		SHA256:   hex.EncodeToString(h.Sum(nil)),
+		Size:     size,
+	}, nil
+}
+
+// Add the error output of a failed command to its error.
+func goError(err error) error {
+	if eerr, ok := err.(*exec.ExitError); ok {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(eerr.Stderr)))
+	}
+	return err
+}
@@ -0,0 +1,120 @@
+// Command pingo provides tools for developing and shipping pingo plugins.
+//
+// Usage:
+//
+//	pingo build [-platforms os/arch,...] [-o dir] [-name name] [-version version] package
+//		Build the plugin in package for each platform, writing the executables to dir
+//		(default "dist") with a manifest.json listing them with their SHA-256 checksums.
+//	pingo pack [-o file] [-config file] [-key file] dir
+//		Package the plugin built in dir into a .pingo archive with its default
+//		configuration, signing the manifest with the ed25519 seed in the key file.
+//	pingo install [-dir dir] archive
+//		Verify and extract the archive into a directory under dir (default "plugins").
+//	pingo describe [-proto unix|tcp] plugin [args...]
+//		Start the plugin and print the schema of its objects as JSON.
+//	pingo diff old.json new.json
+//		Compare two schemas printed by describe; exit with status 1 on breaking changes.
+//	pingo proxy [-record file] plugin [args...]
+//		Run the plugin behind a proxy relaying its connections, recording the frames
+//		exchanged to a pcapng file, each with a comment describing it. The proxy is
+//		started by the host in place of the plugin:
+//
+//		pingo.NewPlugin("unix", "pingo", "proxy", "-record", "frames.pcapng", "./plugin")
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/dullgiulio/pingo"
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage:\n")
+	fmt.Fprintf(os.Stderr, "\tpingo build [-platforms os/arch,...] [-o dir] [-name name] [-version version] package\n")
+	fmt.Fprintf(os.Stderr, "\tpingo pack [-o file] [-config file] [-key file] dir\n")
+	fmt.Fprintf(os.Stderr, "\tpingo install [-dir dir] archive\n")
+	fmt.Fprintf(os.Stderr, "\tpingo describe [-proto unix|tcp] plugin [args...]\n")
+	fmt.Fprintf(os.Stderr, "\tpingo diff old.json new.json\n")
+	fmt.Fprintf(os.Stderr, "\tpingo proxy [-record file] plugin [args...]\n")
+	os.Exit(2)
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "pingo: %s\n", err)
+	os.Exit(1)
+}
+
+func describe(args []string) {
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	proto := fs.String("proto", "unix", "Protocol to use with the plugin: unix or tcp")
+	fs.Parse(args)
+	if fs.NArg() < 1 {
+		usage()
+	}
+
+	p := pingo.NewPlugin(*proto, fs.Arg(0), fs.Args()[1:]...)
+	p.Start()
+	schema, err := p.Describe(context.Background())
+	p.Stop()
+	if err != nil {
+		fatal(err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(schema)
+}
+
+func readSchema(path string) *pingo.Schema {
+	f, err := os.Open(path)
+	if err != nil {
+		fatal(err)
+	}
+	defer f.Close()
+
+	schema := &pingo.Schema{}
+	if err := json.NewDecoder(f).Decode(schema); err != nil {
+		fatal(fmt.Errorf("%s: %s", path, err))
+	}
+	return schema
+}
+
+func diff(args []string) {
+	if len(args) != 2 {
+		usage()
+	}
+	changes := pingo.CompareSchemas(readSchema(args[0]), readSchema(args[1]))
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if pingo.Breaking(changes) {
+		os.Exit(1)
+	}
+}
+
+func main() {
+	// Flags of the host precede the command when run as a plugin
+	args, hf := splitHostFlags(os.Args[1:])
+	if len(args) < 1 {
+		usage()
+	}
+	switch args[0] {
+	case "build":
+		build(args[1:])
+	case "pack":
+		pack(args[1:])
+	case "install":
+		install(args[1:])
+	case "describe":
+		describe(args[1:])
+	case "diff":
+		diff(args[1:])
+	case "proxy":
+		proxy(args[1:], hf)
+	default:
+		usage()
+	}
+}
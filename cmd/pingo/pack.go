@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dullgiulio/pingo"
+)
+
+func pack(args []string) {
+	fs := flag.NewFlagSet("pack", flag.ExitOnError)
+	out := fs.String("o", "", "Archive to write; defaults to the name and version of the plugin")
+	config := fs.String("config", "", "File with the default configuration of the plugin")
+	keyfile := fs.String("key", "", "File with the hex-encoded ed25519 seed to sign the manifest with")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+	dir := fs.Arg(0)
+
+	m, err := pingo.ReadManifest(filepath.Join(dir, pingo.ManifestFile))
+	if err != nil {
+		fatal(err)
+	}
+	var cfg []byte
+	if *config != "" {
+		if cfg, err = os.ReadFile(*config); err != nil {
+			fatal(err)
+		}
+	}
+	var key ed25519.PrivateKey
+	if *keyfile != "" {
+		if key, err = readKey(*keyfile); err != nil {
+			fatal(err)
+		}
+	}
+	if *out == "" {
+		*out = m.Name
+		if m.Version != "" {
+			*out += "-" + m.Version
+		}
+		*out += pingo.ArchiveExt
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		fatal(err)
+	}
+	if err := pingo.PackArchive(f, dir, cfg, key); err != nil {
+		f.Close()
+		os.Remove(*out)
+		fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		fatal(err)
+	}
+	fmt.Println(*out)
+}
+
+// Read a private key from a file containing its hex-encoded seed.
+func readKey(path string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New(path + ": not a hex-encoded ed25519 seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func install(args []string) {
+	fs := flag.NewFlagSet("install", flag.ExitOnError)
+	dir := fs.String("dir", "plugins", "Directory to install the plugin under")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usage()
+	}
+
+	a, err := pingo.InstallArchive(fs.Arg(0), *dir)
+	if err != nil {
+		fatal(err)
+	}
+	fmt.Println(a.Dir)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Block types, options and link type of the pcapng format, written in little endian.
+const (
+	pcapngSectionHeader  = 0x0a0d0d0a
+	pcapngInterface      = 0x00000001
+	pcapngEnhancedPacket = 0x00000006
+	pcapngByteOrderMagic = 0x1a2b3c4d
+
+	pcapngOptEnd     = 0
+	pcapngOptComment = 1
+	pcapngOptFlags   = 2
+
+	// Frames are not packets of any protocol known to capture tools
+	pcapngLinkTypeUser0 = 147
+)
+
+// Direction in the flags of enhanced packet blocks.
+const (
+	pcapngInbound  = 1
+	pcapngOutbound = 2
+)
+
+// Writes packets of a single interface to a pcapng file. Timestamps have a resolution of
+// microseconds.
+type pcapngWriter struct {
+	w   io.Writer
+	err error
+}
+
+func newPcapngWriter(w io.Writer) (*pcapngWriter, error) {
+	pw := &pcapngWriter{w: w}
+	var shb []byte
+	shb = binary.LittleEndian.AppendUint32(shb, pcapngByteOrderMagic)
+	shb = binary.LittleEndian.AppendUint16(shb, 1)
+	shb = binary.LittleEndian.AppendUint16(shb, 0)
+	// Unknown section length
+	shb = binary.LittleEndian.AppendUint64(shb, ^uint64(0))
+	pw.block(pcapngSectionHeader, shb)
+
+	var idb []byte
+	idb = binary.LittleEndian.AppendUint16(idb, pcapngLinkTypeUser0)
+	idb = binary.LittleEndian.AppendUint16(idb, 0)
+	// No limit on the length of packets
+	idb = binary.LittleEndian.AppendUint32(idb, 0)
+	pw.block(pcapngInterface, idb)
+	return pw, pw.err
+}
+
+// Write a packet with its data, the flags of its direction and a comment.
+func (pw *pcapngWriter) packet(t time.Time, data []byte, dir uint32, comment string) error {
+	us := uint64(t.UnixMicro())
+	var epb []byte
+	epb = binary.LittleEndian.AppendUint32(epb, 0)
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us>>32))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(us))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = binary.LittleEndian.AppendUint32(epb, uint32(len(data)))
+	epb = pad(append(epb, data...))
+	epb = option(epb, pcapngOptComment, []byte(comment))
+	epb = option(epb, pcapngOptFlags, binary.LittleEndian.AppendUint32(nil, dir))
+	epb = option(epb, pcapngOptEnd, nil)
+	pw.block(pcapngEnhancedPacket, epb)
+	return pw.err
+}
+
+// Write a block with its type and total length around body, which must be padded.
+func (pw *pcapngWriter) block(kind uint32, body []byte) {
+	if pw.err != nil {
+		return
+	}
+	length := uint32(len(body) + 12)
+	var b []byte
+	b = binary.LittleEndian.AppendUint32(b, kind)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	b = append(b, body...)
+	b = binary.LittleEndian.AppendUint32(b, length)
+	_, pw.err = pw.w.Write(b)
+}
+
+// Append an option to b, padded to 32 bits.
+func option(b []byte, code uint16, value []byte) []byte {
+	b = binary.LittleEndian.AppendUint16(b, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	return pad(append(b, value...))
+}
+
+func pad(b []byte) []byte {
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
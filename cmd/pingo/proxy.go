@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Flags passed by the host to the plugin, as in "-pingo:proto=unix".
+type hostFlags struct {
+	args    []string
+	prefix  string
+	unixdir string
+	// Descriptor of the pipe of the secret, if passed by the host (see pingo.SecretPipe)
+	secretfd int
+	// The flags are followed by "--" (see pingo.SeparateArgs)
+	separate bool
+}
+
+// The pipe of the secret passed by the host is passed on to the plugin as its first extra
+// file, whatever its descriptor in the proxy.
+const (
+	secretFD    = 3
+	envSecretFD = "PINGO_SECRETFD"
+)
+
+// Separate the flags passed by a host, which precede the command, from the others.
+func splitHostFlags(args []string) ([]string, *hostFlags) {
+	hf := &hostFlags{}
+	rest := make([]string, 0, len(args))
+	for _, arg := range args {
+		if arg == "--" && len(rest) == 0 && len(hf.args) > 0 && !hf.separate {
+			hf.separate = true
+			continue
+		}
+		if !strings.HasPrefix(arg, "-pingo:") {
+			rest = append(rest, arg)
+			continue
+		}
+		kv := strings.SplitN(strings.TrimPrefix(arg, "-pingo:"), "=", 2)
+		if len(kv) < 2 {
+			hf.args = append(hf.args, arg)
+			continue
+		}
+		switch kv[0] {
+		case "prefix":
+			hf.prefix = kv[1]
+		case "unixdir":
+			hf.unixdir = kv[1]
+		case "secretfd":
+			hf.secretfd, _ = strconv.Atoi(kv[1])
+			// The plugin inherits the pipe as its first extra file
+			arg = "-pingo:secretfd=" + strconv.Itoa(secretFD)
+		}
+		hf.args = append(hf.args, arg)
+	}
+	return rest, hf
+}
+
+// A frame seen by the proxy. Messages on secure connections cannot be decoded: each
+// chunk of data is recorded as a frame.
+type frame struct {
+	// Connection, numbered from one in order of acceptance
+	conn int
+	// dirToPlugin or dirToHost
+	dir    string
+	method string
+	seq    *uint64
+	err    string
+	// Header and body, or message of JSON-RPC clients, or chunk of encrypted data
+	data []byte
+	// How the data was decoded, if not as a gob message
+	kind string
+}
+
+// Describe the frame in the comment of its packet.
+func (f *frame) comment() string {
+	s := fmt.Sprintf("conn %d %s", f.conn, f.dir)
+	if f.kind != "" {
+		return s + " " + f.kind
+	}
+	if f.method != "" {
+		s += " " + f.method
+	}
+	if f.seq != nil {
+		s += " seq " + strconv.FormatUint(*f.seq, 10)
+	}
+	if f.err != "" {
+		s += " error: " + f.err
+	}
+	return s
+}
+
+// Writes frames as packets of a pcapng file, with a comment describing each.
+type recorder struct {
+	mu sync.Mutex
+	w  *pcapngWriter
+}
+
+func (r *recorder) record(f *frame) {
+	t := time.Now()
+	dir := uint32(pcapngInbound)
+	if f.dir == dirToHost {
+		dir = pcapngOutbound
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.w.packet(t, f.data, dir, f.comment())
+}
+
+// Keeps the bytes read. Implements io.ByteReader, so that gob does not read ahead.
+type captureReader struct {
+	r   *bufio.Reader
+	buf bytes.Buffer
+}
+
+func (c *captureReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.buf.Write(b[:n])
+	return n, err
+}
+
+func (c *captureReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.buf.WriteByte(b)
+	}
+	return b, err
+}
+
+// Bytes read since the last call.
+func (c *captureReader) take() []byte {
+	data := append([]byte(nil), c.buf.Bytes()...)
+	c.buf.Reset()
+	return data
+}
+
+// Decode the stream of one direction of a connection, recording its frames. Plain
+// connections start with a JSON-RPC message or the HTTP handshake; others are encrypted.
+// The stream is drained on decoding errors, not to block the relay.
+func (r *recorder) decode(conn int, dir string, src io.Reader) {
+	defer io.Copy(io.Discard, src)
+
+	br := bufio.NewReader(src)
+	b, err := br.Peek(1)
+	if err != nil {
+		return
+	}
+	switch {
+	case b[0] == '{':
+		dec := json.NewDecoder(br)
+		for {
+			var msg json.RawMessage
+			if err := dec.Decode(&msg); err != nil {
+				return
+			}
+			r.record(&frame{conn: conn, dir: dir, data: msg, kind: "json"})
+		}
+	case dir == dirToPlugin && b[0] == 'C', dir == dirToHost && b[0] == 'H':
+	default:
+		buf := make([]byte, 32<<10)
+		for {
+			n, err := br.Read(buf)
+			if n > 0 {
+				r.record(&frame{conn: conn, dir: dir, data: append([]byte(nil), buf[:n]...), kind: "encrypted"})
+			}
+			if err != nil {
+				return
+			}
+		}
+	}
+	// Skip the HTTP handshake
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if line == "\n" || line == "\r\n" {
+			break
+		}
+	}
+	cr := &captureReader{r: br}
+	dec := gob.NewDecoder(cr)
+	for {
+		f := &frame{conn: conn, dir: dir}
+		if dir == dirToPlugin {
+			var req rpc.Request
+			if dec.Decode(&req) != nil {
+				return
+			}
+			f.method, f.seq = req.ServiceMethod, &req.Seq
+		} else {
+			var resp rpc.Response
+			if dec.Decode(&resp) != nil {
+				return
+			}
+			f.method, f.seq, f.err = resp.ServiceMethod, &resp.Seq, resp.Error
+		}
+		if dec.DecodeValue(reflect.Value{}) != nil {
+			return
+		}
+		f.data = cr.take()
+		r.record(f)
+	}
+}
+
+const (
+	dirToPlugin = "host>plugin"
+	dirToHost   = "plugin>host"
+)
+
+// Copy src to dst, passing the data to the recorder, if any.
+func (r *recorder) copy(dst io.WriteCloser, src io.Reader, conn int, dir string) {
+	defer dst.Close()
+
+	if r == nil {
+		io.Copy(dst, src)
+		return
+	}
+	pr, pw := io.Pipe()
+	go r.decode(conn, dir, pr)
+	io.Copy(dst, io.TeeReader(src, pw))
+	pw.Close()
+}
+
+// Relay connections accepted by l to the plugin listening at addr.
+func relay(l net.Listener, proto, addr string, rec *recorder) {
+	for n := 1; ; n++ {
+		host, err := l.Accept()
+		if err != nil {
+			return
+		}
+		plugin, err := net.Dial(proto, addr)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "pingo: proxy: %s\n", err)
+			host.Close()
+			continue
+		}
+		go rec.copy(plugin, host, n, dirToPlugin)
+		go rec.copy(host, plugin, n, dirToHost)
+	}
+}
+
+// Parse the value of a ready line, "proto=... addr=...", where the address is the rest of
+// the line, as the host does.
+func parseReady(val string) (proto, addr string, ok bool) {
+	val, ok = strings.CutPrefix(val, "proto=")
+	if !ok {
+		return "", "", false
+	}
+	proto, addr, ok = strings.Cut(val, " addr=")
+	if !ok || addr == "" {
+		return "", "", false
+	}
+	return proto, addr, true
+}
+
+// Listen with proto, on a unix socket in dir or on a local port.
+func listenProxy(proto, dir string) (net.Listener, error) {
+	if proto == "tcp" {
+		return net.Listen("tcp", "127.0.0.1:0")
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return net.Listen("unix", filepath.Join(dir, "pingo-proxy-"+strconv.Itoa(os.Getpid())))
+}
+
+// Run the plugin, relaying its output and its connections to the host.
+func proxy(args []string, hf *hostFlags) {
+	fs := flag.NewFlagSet("proxy", flag.ExitOnError)
+	record := fs.String("record", "", "Record the frames exchanged to this file, in pcapng format")
+	fs.Parse(args)
+	if fs.NArg() < 1 || hf.prefix == "" {
+		// Not started by a host
+		usage()
+	}
+
+	var rec *recorder
+	if *record != "" {
+		f, err := os.Create(*record)
+		if err != nil {
+			fatal(err)
+		}
+		defer f.Close()
+		w, err := newPcapngWriter(f)
+		if err != nil {
+			fatal(err)
+		}
+		rec = &recorder{w: w}
+	}
+
+	params := hf.args
+	if hf.separate {
+		params = append(params, "--")
+	}
+	cmd := exec.Command(fs.Arg(0), append(params, fs.Args()[1:]...)...)
+	cmd.Stderr = os.Stderr
+	if hf.secretfd == 0 {
+		if fd, err := strconv.Atoi(os.Getenv(envSecretFD)); err == nil {
+			hf.secretfd = fd
+			cmd.Env = append(os.Environ(), envSecretFD+"="+strconv.Itoa(secretFD))
+		}
+	}
+	if hf.secretfd > 0 {
+		cmd.ExtraFiles = []*os.File{os.NewFile(uintptr(hf.secretfd), "pingo-secret")}
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		fatal(err)
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		for sig := range sigs {
+			cmd.Process.Signal(sig)
+		}
+	}()
+
+	prefix := hf.prefix + ": "
+	var listener net.Listener
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		line := scanner.Text()
+		proto, addr, ok := parseReady(strings.TrimPrefix(line, prefix+"ready: "))
+		if !strings.HasPrefix(line, prefix+"ready: ") || !ok || listener != nil {
+			fmt.Println(line)
+			continue
+		}
+		if listener, err = listenProxy(proto, hf.unixdir); err != nil {
+			fmt.Printf("%sfatal: err-connection-failed: Proxy cannot listen: %s\n", prefix, err)
+			cmd.Process.Kill()
+			break
+		}
+		go relay(listener, proto, addr, rec)
+		// Only the address is replaced, the rest of the line is forwarded as is
+		fmt.Println(line[:len(line)-len(addr)] + listener.Addr().String())
+	}
+	io.Copy(io.Discard, stdout)
+
+	err = cmd.Wait()
+	if listener != nil {
+		listener.Close()
+	}
+	if exit, ok := err.(*exec.ExitError); ok {
+		os.Exit(exit.ExitCode())
+	}
+}
@@ -0,0 +1,132 @@
+package pingo
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"reflect"
+	"sync"
+)
+
+// Implemented by Callers accepting a context, as Plugin.
+type contextCaller interface {
+	CallContext(ctx context.Context, name string, args interface{}, resp interface{}) error
+}
+
+// Coalescer is a Caller collapsing concurrent calls with the same method and arguments
+// into a single call, whose response is shared by all callers. This protects plugins from
+// bursts of identical calls, as when each request served by the host looks up the same
+// data at once.
+//
+// Calls are keyed by method name and arguments encoded with "encoding/gob", as by Cache.
+// Each caller waiting for the call in flight receives a copy of its response, decoded
+// from its "encoding/gob" encoding into a zeroed resp, or its error. Only methods without side effects
+// should be coalesced.
+type Coalescer struct {
+	next    Caller
+	methods map[string]bool
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// A call shared by concurrent callers.
+type flight struct {
+	// Context of the caller performing the call
+	ctx context.Context
+	// Closed once the call is complete
+	done chan struct{}
+	// Encoded response, nil if it could not be encoded
+	resp []byte
+	err  error
+}
+
+// NewCoalescer creates a coalescer in front of next. Concurrent calls to the specified
+// methods are coalesced; calls to any other method are passed through.
+func NewCoalescer(next Caller, methods ...string) *Coalescer {
+	c := &Coalescer{
+		next:    next,
+		methods: make(map[string]bool),
+		flights: make(map[string]*flight),
+	}
+	for _, m := range methods {
+		c.methods[m] = true
+	}
+	return c
+}
+
+// Call waits for the identical call in flight, if any, and returns its response; otherwise
+// it performs the call, sharing it with the callers arriving meanwhile.
+func (c *Coalescer) Call(name string, args interface{}, resp interface{}) error {
+	return c.CallContext(context.Background(), name, args, resp)
+}
+
+// CallContext is like Call, but stops waiting for the call in flight when ctx is done. The
+// call is performed with the context of the caller starting it, if next has a CallContext
+// method as Plugin does: when that context is done before the call completes, the callers
+// waiting for it perform the call again instead of receiving its error.
+func (c *Coalescer) CallContext(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	if !c.methods[name] {
+		return c.call(ctx, name, args, resp)
+	}
+
+	key, err := cacheKey(name, args)
+	if err != nil {
+		return c.call(ctx, name, args, resp)
+	}
+
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if f.err != nil && f.ctx.Err() != nil {
+			// The call may have been interrupted by the context of its caller
+			return c.CallContext(ctx, name, args, resp)
+		}
+		if f.err != nil {
+			return f.err
+		}
+		if f.resp != nil {
+			// Decoding merges into maps and leaves fields missing from the encoding as they were
+			v := reflect.ValueOf(resp)
+			if v.Kind() == reflect.Ptr && !v.IsNil() {
+				v.Elem().Set(reflect.Zero(v.Elem().Type()))
+			}
+			if err := gob.NewDecoder(bytes.NewReader(f.resp)).Decode(resp); err == nil {
+				return nil
+			}
+		}
+		// The response cannot be shared
+		return c.call(ctx, name, args, resp)
+	}
+	f := &flight{ctx: ctx, done: make(chan struct{})}
+	c.flights[key] = f
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		delete(c.flights, key)
+		c.mu.Unlock()
+		close(f.done)
+	}()
+
+	f.err = c.call(ctx, name, args, resp)
+	if f.err == nil {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(resp); err == nil {
+			f.resp = buf.Bytes()
+		}
+	}
+	return f.err
+}
+
+// Call next with ctx, if it supports contexts.
+func (c *Coalescer) call(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	if cc, ok := c.next.(contextCaller); ok {
+		return cc.CallContext(ctx, name, args, resp)
+	}
+	return c.next.Call(name, args, resp)
+}
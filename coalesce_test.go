@@ -0,0 +1,117 @@
+package pingo_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+// Answers lookups once released, counting them.
+type Directory struct {
+	mu      sync.Mutex
+	calls   int
+	started chan struct{}
+	release chan struct{}
+}
+
+func newDirectory() *Directory {
+	return &Directory{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (d *Directory) Lookup(key string, resp *map[string]int) error {
+	d.mu.Lock()
+	d.calls++
+	d.mu.Unlock()
+
+	d.started <- struct{}{}
+	<-d.release
+	*resp = map[string]int{key: len(key)}
+	return nil
+}
+
+func (d *Directory) count() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.calls
+}
+
+// Concurrent callers wait for the same call and receive its response.
+func TestCoalescer(t *testing.T) {
+	dir := newDirectory()
+	c := pingo.NewCoalescer(pingotest.NewInProcess(t, dir), "Directory.Lookup")
+
+	resps := make([]map[string]int, 4)
+	errs := make([]error, 4)
+	var wg sync.WaitGroup
+	call := func(i int) {
+		defer wg.Done()
+		errs[i] = c.Call("Directory.Lookup", "key", &resps[i])
+	}
+	wg.Add(1)
+	go call(0)
+	<-dir.started
+	for i := 1; i < len(resps); i++ {
+		// Values held by the waiters are replaced, not merged with the response.
+		resps[i] = map[string]int{"stale": i}
+		wg.Add(1)
+		go call(i)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(dir.release)
+	wg.Wait()
+
+	if n := dir.count(); n != 1 {
+		t.Errorf("Plugin called %d times", n)
+	}
+	want := map[string]int{"key": 3}
+	for i := range resps {
+		if errs[i] != nil || !reflect.DeepEqual(resps[i], want) {
+			t.Errorf("Caller %d: unexpected response %v, %v", i, resps[i], errs[i])
+		}
+	}
+}
+
+// Waiters stop waiting when their context is done, and perform the call themselves when
+// the context of the caller performing it is done.
+func TestCoalescerContext(t *testing.T) {
+	dir := newDirectory()
+	c := pingo.NewCoalescer(pingotest.NewInProcess(t, dir), "Directory.Lookup")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var first map[string]int
+	firstErr := make(chan error, 1)
+	go func() {
+		firstErr <- c.CallContext(ctx, "Directory.Lookup", "key", &first)
+	}()
+	<-dir.started
+
+	wctx, wcancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer wcancel()
+	var resp map[string]int
+	if err := c.CallContext(wctx, "Directory.Lookup", "key", &resp); err != context.DeadlineExceeded {
+		t.Errorf("Expected waiter to time out, got %v", err)
+	}
+
+	waiterErr := make(chan error, 1)
+	go func() {
+		waiterErr <- c.CallContext(context.Background(), "Directory.Lookup", "key", &resp)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+	if err := <-firstErr; err == nil {
+		t.Error("Cancelled call succeeded")
+	}
+	<-dir.started
+	close(dir.release)
+	if err := <-waiterErr; err != nil || !reflect.DeepEqual(resp, map[string]int{"key": 3}) {
+		t.Errorf("Unexpected response of waiter %v, %v", resp, err)
+	}
+	if n := dir.count(); n != 2 {
+		t.Errorf("Plugin called %d times, want 2", n)
+	}
+}
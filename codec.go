@@ -0,0 +1,587 @@
+package pingo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+var errMessageTooLarge = ErrMessageTooLarge(errors.New("Message exceeds maximum size"))
+
+// Error reported when a message exceeds the configured maximum size.
+type ErrMessageTooLarge error
+
+// ErrDecode is returned by Call and the other calls of a plugin, including those of pools
+// and managers, when the response passed is a pointer, nil or not, and the reply of the
+// method cannot be decoded into it or exceeds the decode limits (see LimitDecoding).
+// Responses that are not pointers fail with a plain error instead (see also Strict), as do
+// calls with a codec set with ClientCodec. As with the "rpc" package, the connection to
+// the plugin is shut down after such an error: later calls on it fail with
+// rpc.ErrShutdown.
+type ErrDecode struct {
+	// Name of the method called
+	Method string
+	// Type sent by the plugin, if known
+	GotType string
+	// Type of the response value
+	WantType string
+	// Raw message received, only if enabled with CapturePayload
+	Payload []byte
+	// Underlying error
+	Err error
+}
+
+func (e *ErrDecode) Error() string {
+	if e.GotType != "" {
+		return fmt.Sprintf("Cannot decode reply of %s: got %s, want %s", e.Method, e.GotType, e.WantType)
+	}
+	return fmt.Sprintf("Cannot decode reply of %s into %s: %v", e.Method, e.WantType, e.Err)
+}
+
+func (e *ErrDecode) Unwrap() error {
+	return e.Err
+}
+
+// Extract the remote type from a gob error, if reported.
+func remoteType(err error) string {
+	msg := err.Error()
+	for _, marker := range []string{"received remote type ", "; got "} {
+		if i := strings.LastIndex(msg, marker); i >= 0 {
+			return msg[i+len(marker):]
+		}
+	}
+	return ""
+}
+
+// A reader failing when more than max bytes are read between resets.
+// It is a ByteReader, so that gob does not buffer ahead of it. If capture
+// is set, it keeps a copy of the bytes read since the last reset.
+type limitReader struct {
+	r       *bufio.Reader
+	max     int
+	n       int
+	capture *bytes.Buffer
+}
+
+func newLimitReader(r io.Reader, max int) *limitReader {
+	return &limitReader{r: bufio.NewReader(r), max: max}
+}
+
+func (l *limitReader) reset() {
+	l.n = 0
+	if l.capture != nil {
+		l.capture.Reset()
+	}
+}
+
+// Bytes read since the last reset, if captured.
+func (l *limitReader) captured() []byte {
+	if l.capture == nil {
+		return nil
+	}
+	return append([]byte(nil), l.capture.Bytes()...)
+}
+
+func (l *limitReader) Read(b []byte) (int, error) {
+	if l.max > 0 && l.n >= l.max {
+		return 0, errMessageTooLarge
+	}
+	if l.max > 0 && l.n+len(b) > l.max {
+		b = b[:l.max-l.n+1]
+	}
+	n, err := l.r.Read(b)
+	l.n += n
+	if l.capture != nil {
+		l.capture.Write(b[:n])
+	}
+	if l.max > 0 && l.n > l.max {
+		return n, errMessageTooLarge
+	}
+	return n, err
+}
+
+func (l *limitReader) ReadByte() (byte, error) {
+	b, err := l.r.ReadByte()
+	if err == nil {
+		l.n++
+		if l.capture != nil {
+			l.capture.WriteByte(b)
+		}
+		if l.max > 0 && l.n > l.max {
+			return b, errMessageTooLarge
+		}
+	}
+	return b, err
+}
+
+// Maximum number of decode failures kept by a client codec.
+const maxDecodeFailures = 64
+
+// Client codec equivalent to the default one of the "rpc" package, with an
+// optional limit on the size of each response.
+//
+// Failures decoding a response body are kept as ErrDecode, as the "rpc" package
+// reports them only as strings; see decodeError.
+type gobClientCodec struct {
+	rwc    io.ReadWriteCloser
+	lr     *limitReader
+	dec    *gob.Decoder
+	scan   *gobScanner
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	// Method and encoding of the response being read
+	method   string
+	encoding Encoding
+	// Time of the last response, in nanoseconds; accessed atomically
+	lastRead int64
+	// Closed when the codec is closed
+	closing   chan struct{}
+	closeOnce sync.Once
+	// Set once the plugin has closed the connection; accessed atomically
+	eof int32
+
+	// Serializes writes of requests and keepalive pings
+	wmu       sync.Mutex
+	mu        sync.Mutex
+	failed    map[interface{}]*ErrDecode
+	encodings map[uint64]Encoding
+	// Pass errors as messages, for clients not decoding them
+	plainErrors bool
+}
+
+func newGobClientCodec(conn io.ReadWriteCloser, opts *options) *gobClientCodec {
+	lr := newLimitReader(conn, opts.maxMessage)
+	if opts.capturePayload {
+		lr.capture = new(bytes.Buffer)
+	}
+	buf := bufio.NewWriter(conn)
+	// Responses are checked against the decode limits while reading them.
+	dec, scan := newGobDecoder(lr, opts.decodeLimits)
+	return &gobClientCodec{
+		rwc:       conn,
+		lr:        lr,
+		dec:       dec,
+		scan:      scan,
+		enc:       gob.NewEncoder(buf),
+		encBuf:    buf,
+		failed:    make(map[interface{}]*ErrDecode),
+		encodings: make(map[uint64]Encoding),
+		lastRead:  time.Now().UnixNano(),
+		closing:   make(chan struct{}),
+	}
+}
+
+// Encode a body in the encoding of its call, if any, as a slice of bytes.
+func encodeBody(enc *gob.Encoder, encoding Encoding, body interface{}) error {
+	if encoding == Gob {
+		return enc.Encode(body)
+	}
+	data, err := encoding.marshal(body)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(data)
+}
+
+// Decode a body, checking it against the limits of scan, if any.
+func decodeBody(dec *gob.Decoder, scan *gobScanner, encoding Encoding, body interface{}, max int) error {
+	if encoding == Gob {
+		return scan.decode(dec, body, true)
+	}
+	var data []byte
+	if err := scan.decode(dec, &data, false); err != nil {
+		return err
+	}
+	return encoding.unmarshal(data, body, max, scan.decodeLimits())
+}
+
+func (c *gobClientCodec) WriteRequest(r *rpc.Request, body interface{}) error {
+	encoding := callEncoding(r.ServiceMethod)
+	if !encoding.valid() {
+		return errUnknownEncoding
+	}
+	if encoding != Gob {
+		c.mu.Lock()
+		c.encodings[r.Seq] = encoding
+		c.mu.Unlock()
+	}
+	return c.write(r, body, encoding)
+}
+
+func (c *gobClientCodec) write(r *rpc.Request, body interface{}, encoding Encoding) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	if err := c.enc.Encode(r); err != nil {
+		return err
+	}
+	if err := encodeBody(c.enc, encoding, body); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobClientCodec) ReadResponseHeader(r *rpc.Response) error {
+	var err error
+	for {
+		c.lr.reset()
+		if err = c.scan.decode(c.dec, r, false); err != nil {
+			break
+		}
+		atomic.StoreInt64(&c.lastRead, time.Now().UnixNano())
+		if r.Seq != keepaliveSeq {
+			break
+		}
+		// Pong: discard it and read the next response.
+		if err = c.scan.decode(c.dec, nil, false); err != nil {
+			break
+		}
+		*r = rpc.Response{}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF || errors.Is(err, syscall.ECONNRESET) {
+		select {
+		case <-c.closing:
+		default:
+			atomic.StoreInt32(&c.eof, 1)
+		}
+	}
+	c.method = r.ServiceMethod
+	if c.plainErrors {
+		if e := parseEnvelope(r.Error); e != nil {
+			r.Error = e.Message
+		}
+	}
+
+	c.mu.Lock()
+	c.encoding = c.encodings[r.Seq]
+	delete(c.encodings, r.Seq)
+	c.mu.Unlock()
+
+	return err
+}
+
+func (c *gobClientCodec) ReadResponseBody(body interface{}) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("gob: panic decoding reply: %v", r)
+		}
+		if err == nil || err == errMessageTooLarge || body == nil {
+			return
+		}
+		derr := &ErrDecode{
+			Method:   c.method,
+			GotType:  remoteType(err),
+			WantType: reflect.TypeOf(body).String(),
+			Payload:  c.lr.captured(),
+			Err:      err,
+		}
+		if reflect.TypeOf(body).Kind() == reflect.Ptr {
+			c.mu.Lock()
+			// Failures not collected by the caller are dropped eventually.
+			if len(c.failed) >= maxDecodeFailures {
+				c.failed = make(map[interface{}]*ErrDecode)
+			}
+			c.failed[body] = derr
+			c.mu.Unlock()
+		}
+		err = derr
+	}()
+	return decodeBody(c.dec, c.scan, c.encoding, body, c.lr.max)
+}
+
+// Return the decode failure of the call that had body as response, if err is the
+// error of that call. Otherwise, err is returned unchanged.
+func (c *gobClientCodec) decodeError(body interface{}, err error) error {
+	err = remoteError(err)
+	if err == nil || c == nil || body == nil || reflect.TypeOf(body).Kind() != reflect.Ptr {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if derr, ok := c.failed[body]; ok {
+		delete(c.failed, body)
+		return derr
+	}
+	return err
+}
+
+// Reports whether the plugin has closed the connection, rather than the host.
+func (c *gobClientCodec) closedByPlugin() bool {
+	return atomic.LoadInt32(&c.eof) == 1
+}
+
+func (c *gobClientCodec) Close() error {
+	c.closeOnce.Do(func() { close(c.closing) })
+	return c.rwc.Close()
+}
+
+// Server codec equivalent to the default one of the "rpc" package, with an
+// optional limit on the size of each request. Calls can request a different
+// encoding for their body, which is also used for the response.
+type gobServerCodec struct {
+	rwc    io.ReadWriteCloser
+	lr     *limitReader
+	dec    *gob.Decoder
+	scan   *gobScanner
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	closed bool
+	// Encoding of the request being read
+	encoding Encoding
+
+	mu        sync.Mutex
+	encodings map[uint64]Encoding
+}
+
+func newGobServerCodec(conn io.ReadWriteCloser, max int) *gobServerCodec {
+	lr := newLimitReader(conn, max)
+	buf := bufio.NewWriter(conn)
+	return &gobServerCodec{
+		rwc:       conn,
+		lr:        lr,
+		dec:       gob.NewDecoder(lr),
+		enc:       gob.NewEncoder(buf),
+		encBuf:    buf,
+		encodings: make(map[uint64]Encoding),
+	}
+}
+
+func (c *gobServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.lr.reset()
+	if err := c.scan.decode(c.dec, r, false); err != nil {
+		return err
+	}
+	c.encoding = callEncoding(r.ServiceMethod)
+	if c.encoding != Gob {
+		c.mu.Lock()
+		c.encodings[r.Seq] = c.encoding
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+func (c *gobServerCodec) ReadRequestBody(body interface{}) error {
+	return decodeBody(c.dec, c.scan, c.encoding, body, c.lr.max)
+}
+
+// Check the bodies of requests against l while reading them, before they are allocated.
+func (c *gobServerCodec) limitDecoding(l DecodeLimits) {
+	c.dec, c.scan = newGobDecoder(c.lr, l)
+}
+
+func (c *gobServerCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mu.Lock()
+	encoding, ok := c.encodings[r.Seq]
+	delete(c.encodings, r.Seq)
+	c.mu.Unlock()
+
+	if ok {
+		// The reply is encoded before the header, so that failures can be reported.
+		data, merr := encoding.marshal(body)
+		if merr != nil {
+			r.Error = "rpc: " + merr.Error()
+		}
+		if err = c.enc.Encode(r); err == nil {
+			err = c.enc.Encode(data)
+		}
+		if err != nil {
+			c.Close()
+			return
+		}
+		return c.encBuf.Flush()
+	}
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Gob couldn't encode the header; shut down the connection.
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Was a gob problem encoding the body but the header has been written.
+			// Shut down the connection to signal that the connection is broken.
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *gobServerCodec) Close() error {
+	if c.closed {
+		// Only call c.rwc.Close once; otherwise the semantics are undefined.
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
+
+// Server codec for clients speaking JSON-RPC (see the "net/rpc/jsonrpc" package),
+// such as debugging scripts in other languages.
+type jsonServerCodec struct {
+	rpc.ServerCodec
+	lr *limitReader
+}
+
+func newJSONServerCodec(conn io.ReadWriteCloser, max int) *jsonServerCodec {
+	lr := newLimitReader(conn, max)
+	rwc := struct {
+		io.Reader
+		io.Writer
+		io.Closer
+	}{lr, conn, conn}
+	return &jsonServerCodec{ServerCodec: jsonrpc.NewServerCodec(rwc), lr: lr}
+}
+
+// The limit applies to the data read since the previous request, which can include
+// the beginning of the next one, as the JSON decoder reads ahead.
+func (c *jsonServerCodec) ReadRequestHeader(r *rpc.Request) error {
+	c.lr.reset()
+	return c.ServerCodec.ReadRequestHeader(r)
+}
+
+// ServerCodecFunc creates the codec serving the calls received on conn. Messages larger
+// than max bytes, if not zero, should be refused.
+type ServerCodecFunc func(conn io.ReadWriteCloser, max int) rpc.ServerCodec
+
+// GobCodec serves calls encoded with gob, as the "rpc" package does.
+func GobCodec(conn io.ReadWriteCloser, max int) rpc.ServerCodec {
+	return newGobServerCodec(conn, max)
+}
+
+// JSONCodec serves calls encoded with JSON-RPC, as the "net/rpc/jsonrpc" package does.
+func JSONCodec(conn io.ReadWriteCloser, max int) rpc.ServerCodec {
+	return newJSONServerCodec(conn, max)
+}
+
+// SetCodec sets the codec serving clients that do not send the CONNECT request of the "rpc"
+// package, for clients in other languages using, for example, msgpack-rpc. Clients speaking
+// JSON-RPC are served with JSONCodec in any case. The codec can also be chosen by starting
+// the plugin with -pingo:codec set to the name of a codec (see RegisterCodec).
+//
+// SetCodec will panic if called after Run.
+func SetCodec(codec ServerCodecFunc) {
+	DefaultServer().SetCodec(codec)
+}
+
+// SetCodec sets the codec of the server, as the SetCodec function does.
+func (s *Server) SetCodec(codec ServerCodecFunc) {
+	if s.r.running {
+		panic("Do not call SetCodec after Run")
+	}
+	s.r.codec = codec
+}
+
+// RegisterCodec makes a codec available to -pingo:codec under name. The codecs "gob" and
+// "json" are always available.
+//
+// RegisterCodec will panic if called after Run.
+func RegisterCodec(name string, codec ServerCodecFunc) {
+	DefaultServer().RegisterCodec(name, codec)
+}
+
+// RegisterCodec makes a codec available to the server, as the RegisterCodec function does.
+func (s *Server) RegisterCodec(name string, codec ServerCodecFunc) {
+	if s.r.running {
+		panic("Do not call RegisterCodec after Run")
+	}
+	s.r.codecs[name] = codec
+}
+
+// ClientCodecFunc creates the codec performing the calls of the host on conn. See
+// ClientCodec.
+type ClientCodecFunc func(conn io.ReadWriteCloser) rpc.ClientCodec
+
+// JSONClientCodec performs calls encoded with JSON-RPC, as the "net/rpc/jsonrpc" package
+// does. Plugins serve it as the "json" codec.
+func JSONClientCodec(conn io.ReadWriteCloser) rpc.ClientCodec {
+	return jsonrpc.NewClientCodec(conn)
+}
+
+// Features relying on the codec of this package.
+const gobCodecFeatures = FeatureMetadata | FeatureEncoding | FeatureCancellation | FeatureMultiplex |
+	FeatureMethodIDs
+
+// ClientCodec makes the host perform calls with codec instead of the gob codec of this
+// package, and starts the plugin with -pingo:codec set to name, so that it serves them
+// with the codec it registered under the same name (see RegisterCodec). Plugins written in
+// other languages can so be called in their own protocol, such as msgpack-rpc.
+//
+// Metadata, encodings, cancellation, multiplexing and method IDs need the codec of this
+// package and are not used with other codecs (see DisableFeatures), nor are keepalives.
+func ClientCodec(name string, codec ClientCodecFunc) Option {
+	return func(o *options) {
+		o.codecName, o.codec = name, codec
+		o.disabledFeatures |= gobCodecFeatures
+	}
+}
+
+// Path of the CONNECT request of connections for calls, empty for codecs served without
+// one (see ClientCodec).
+func (o *options) callPath() string {
+	if o.codec != nil {
+		return ""
+	}
+	return rpc.DefaultRPCPath
+}
+
+// Set the codec chosen with -pingo:codec, if any.
+func (r *rpcServer) chooseCodec() error {
+	if r.conf.codec == "" {
+		return nil
+	}
+	codec, ok := r.codecs[r.conf.codec]
+	if !ok {
+		return errors.New("Unknown codec " + r.conf.codec)
+	}
+	r.codec = codec
+	return nil
+}
+
+// Returns true if the client does not send a CONNECT request, which is the case of JSON-RPC
+// clients and, if a codec is set, of any client not starting with one.
+func (r *rpcServer) skipsConnect(br *bufio.Reader) bool {
+	return isJSON(br) || (r.codec != nil && !isConnect(br))
+}
+
+// Codec for a connection, chosen from the first bytes sent by the client: JSON-RPC
+// requests are objects, while gob streams start with the length of a message.
+func (r *rpcServer) serverCodec(conn io.ReadWriteCloser, br *bufio.Reader, max int) rpc.ServerCodec {
+	switch {
+	case isJSON(br):
+		return JSONCodec(conn, max)
+	case r.codec != nil && !isConnect(br):
+		return r.codec(conn, max)
+	}
+	return GobCodec(conn, max)
+}
+
+func isJSON(br *bufio.Reader) bool {
+	b, err := br.Peek(1)
+	return err == nil && b[0] == '{'
+}
+
+// Only peeks past the first byte if it can start a CONNECT request, as short messages of
+// other protocols would block waiting for more data.
+func isConnect(br *bufio.Reader) bool {
+	if b, err := br.Peek(1); err != nil || b[0] != 'C' {
+		return false
+	}
+	b, err := br.Peek(len("CONNECT "))
+	return err == nil && string(b) == "CONNECT "
+}
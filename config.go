@@ -0,0 +1,153 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Error reported when a plugin rejects a configuration. See UpdateConfig.
+type ErrConfigRejected error
+
+// OnConfigChange sets a function applying the configurations pushed by the host with
+// UpdateConfig, so that a plugin can be reconfigured without restarting it. Returning an
+// error rejects the configuration: the plugin is expected to keep the previous one.
+//
+// Configurations are applied one at a time and in the order of their versions;
+// configurations older than the one applied last are rejected without calling fn.
+//
+// OnConfigChange will panic if called after Run.
+func OnConfigChange(fn func(cfg []byte) error) {
+	DefaultServer().OnConfigChange(fn)
+}
+
+// OnConfigChange sets the function applying the configurations pushed to the server, as
+// the OnConfigChange function does.
+func (s *Server) OnConfigChange(fn func(cfg []byte) error) {
+	if s.r.running {
+		panic("Do not call OnConfigChange after Run")
+	}
+	s.r.config.apply = fn
+}
+
+// A configuration pushed by the host.
+type ConfigUpdate struct {
+	Version int64
+	Data    []byte
+}
+
+// Configuration applied by a plugin.
+type pluginConfig struct {
+	mu      sync.Mutex
+	version int64
+	apply   func([]byte) error
+}
+
+func (c *pluginConfig) update(u ConfigUpdate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.apply == nil {
+		return errors.New("Plugin does not accept configurations")
+	}
+	if u.Version <= c.version {
+		return errors.New("Configuration is older than the one applied")
+	}
+	if err := c.apply(u.Data); err != nil {
+		return err
+	}
+	c.version = u.Version
+	return nil
+}
+
+func (c *pluginConfig) current() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.version
+}
+
+// Internal RPC call to apply a configuration. Do not call manually.
+func (s *PingoRpc) Config(u ConfigUpdate, version *int64) error {
+	if err := s.server().config.update(u); err != nil {
+		return err
+	}
+	*version = u.Version
+	return nil
+}
+
+// Internal RPC call returning the version of the configuration applied. Do not call manually.
+func (s *PingoRpc) ConfigVersion(unused int, version *int64) error {
+	*version = s.server().config.current()
+	return nil
+}
+
+// Configuration sent to a plugin by the host.
+type hostConfig struct {
+	mu      sync.Mutex
+	version int64
+	data    []byte
+	// Update whose reply was lost: the plugin may have applied it
+	pending *ConfigUpdate
+}
+
+// UpdateConfig pushes a configuration to the running plugin, waiting for the plugin to be
+// ready, and returns its version. Versions increase with each update accepted. If the
+// plugin rejects the configuration (see OnConfigChange), an ErrConfigRejected error is
+// returned and the plugin keeps the previous one.
+//
+// Configurations are not pushed again if the plugin is restarted. If the reply of the
+// plugin is lost, as when the call times out, the next update first asks the plugin for
+// the version it applied.
+func (p *Plugin) UpdateConfig(ctx context.Context, cfg []byte) (int64, error) {
+	p.config.mu.Lock()
+	defer p.config.mu.Unlock()
+
+	if err := p.syncConfig(ctx); err != nil {
+		return 0, err
+	}
+	u := ConfigUpdate{Version: p.config.version + 1, Data: cfg}
+	var version int64
+	err := callContext(ctx, p, internalObject+".Config", u, &version)
+	// Plugins built with older versions do not know the call.
+	if isUnknownMethod(err) {
+		return 0, ErrConfigRejected(errors.New("Plugin does not accept configurations"))
+	}
+	if isMethodError(err) {
+		return 0, ErrConfigRejected(fmt.Errorf("Configuration rejected: %w", err))
+	}
+	if err != nil {
+		p.config.pending = &u
+		return 0, err
+	}
+	p.config.version, p.config.data = version, cfg
+	return version, nil
+}
+
+// Record the update whose reply was lost, if the plugin applied it.
+func (p *Plugin) syncConfig(ctx context.Context) error {
+	u := p.config.pending
+	if u == nil {
+		return nil
+	}
+	var version int64
+	if err := callContext(ctx, p, internalObject+".ConfigVersion", 0, &version); err != nil {
+		return err
+	}
+	// A restarted plugin has no configuration
+	if version == u.Version {
+		p.config.version, p.config.data = u.Version, u.Data
+	}
+	p.config.pending = nil
+	return nil
+}
+
+// Config returns the last configuration accepted by the plugin and its version, or
+// zero if no configuration was pushed with UpdateConfig.
+func (p *Plugin) Config() ([]byte, int64) {
+	p.config.mu.Lock()
+	defer p.config.mu.Unlock()
+
+	return p.config.data, p.config.version
+}
@@ -0,0 +1,102 @@
+package pingo
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+)
+
+// Options configure a plugin from its code, as its -pingo: flags do. Empty fields leave
+// the setting to the flags. See Configure.
+type Options struct {
+	// Protocol to use: unix or tcp, as -pingo:proto
+	Proto string
+	// Directory of the unix socket, as -pingo:unixdir
+	UnixDir string
+	// Prefix of the lines output for the host, as -pingo:prefix. The host must use the
+	// same prefix, set with its Prefix option.
+	Prefix string
+	// Encrypt connections with a secret exchanged via output, as -pingo:secure
+	Secure bool
+}
+
+// Configure sets options of the plugin, taking priority over the flags passed by the host
+// and over the environment.
+//
+// This package never calls flag.Parse: it reads its own -pingo: flags from the arguments
+// of the plugin when Run is called, leaving all other arguments to the plugin. The flags
+// are also defined in the default flag set, so that plugins calling flag.Parse accept
+// the flags passed by the host.
+//
+// Configure will panic if called after Run.
+func Configure(opts Options) {
+	DefaultServer().Configure(opts)
+}
+
+// Configure sets options of the server, as the Configure function does.
+func (s *Server) Configure(opts Options) {
+	if s.r.running {
+		panic("Do not call Configure after Run")
+	}
+	s.r.conf.overrides = &opts
+}
+
+// Parse the flags of this package in the arguments of the plugin, then apply the options
+// set with Configure. Only the first call has any effect.
+func (c *config) parse() {
+	c.parseOnce.Do(func() {
+		for _, err := range parseArgs(c.flags, c.args) {
+			defaultLogger.Log(LevelWarn, "Invalid flag", Field{"error", err})
+		}
+		if o := c.overrides; o != nil {
+			if o.Proto != "" {
+				c.proto = o.Proto
+			}
+			if o.UnixDir != "" {
+				c.unixdir = o.UnixDir
+			}
+			if o.Prefix != "" {
+				c.prefix = o.Prefix
+			}
+			if o.Secure {
+				c.secure = true
+			}
+		}
+	})
+}
+
+// Set the -pingo: flags found in args, up to a "--" argument, ignoring all others. Flags
+// that are unknown or have invalid values are skipped and reported.
+func parseArgs(fs *flag.FlagSet, args []string) []error {
+	var errs []error
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(arg, "-"), "-")
+		if !strings.HasPrefix(name, "pingo:") {
+			continue
+		}
+		name, value, hasValue := strings.Cut(name, "=")
+		f := fs.Lookup(name)
+		if f == nil {
+			errs = append(errs, errors.New("Unknown flag -"+name))
+			continue
+		}
+		if !hasValue {
+			// Values of flags other than booleans can be the next argument
+			if b, ok := f.Value.(interface{ IsBoolFlag() bool }); ok && b.IsBoolFlag() {
+				value = "true"
+			} else if i+1 < len(args) {
+				i++
+				value = args[i]
+			}
+		}
+		if err := fs.Set(name, value); err != nil {
+			errs = append(errs, fmt.Errorf("Invalid value %q for flag -%s: %v", value, name, err))
+		}
+	}
+	return errs
+}
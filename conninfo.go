@@ -0,0 +1,169 @@
+package pingo
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+)
+
+// ConnInfo describes a connection accepted by the plugin.
+type ConnInfo struct {
+	// Unique identifier of the connection within the plugin process
+	ID uint64
+	// Protocol of the listener: "unix" or "tcp"
+	Proto string
+	// Address of the peer, empty for unix sockets
+	RemoteAddr string
+	// The connection is encrypted (see -pingo:secure)
+	Secure bool
+	// Patterns of the methods allowed by the capability the connection was opened
+	// with; nil if all methods are allowed
+	Allow []string
+	// Identifier of the capability the connection was opened with, if any
+	TokenID string
+	// The host decodes errors with codes (see Error)
+	typedErrors bool
+	// Opened by the host rather than with a capability
+	host bool
+}
+
+type connInfoKey struct{}
+
+// ConnInfoFrom returns the connection a call was received on, given the context passed to
+// a method taking a context.Context as first argument. It returns nil for other contexts.
+//
+// The information must not be modified.
+func ConnInfoFrom(ctx context.Context) *ConnInfo {
+	info, _ := ctx.Value(connInfoKey{}).(*ConnInfo)
+	return info
+}
+
+var lastConnID uint64
+
+func newConnInfo(conn net.Conn, proto string, secure bool) *ConnInfo {
+	info := &ConnInfo{
+		ID:     atomic.AddUint64(&lastConnID, 1),
+		Proto:  proto,
+		Secure: secure,
+	}
+	if addr := conn.RemoteAddr(); addr != nil && proto == "tcp" {
+		info.RemoteAddr = addr.String()
+	}
+	return info
+}
+
+// SetAcceptFilter sets a function called for every connection as soon as it is accepted,
+// before the handshake. If it returns an error, the connection is closed. This allows
+// rejecting connections by remote address, by peer credentials of unix sockets or when
+// too many are open, before spending any work on them.
+//
+// SetAcceptFilter will panic if called after Run.
+func SetAcceptFilter(fn func(net.Conn) error) {
+	DefaultServer().SetAcceptFilter(fn)
+}
+
+// SetAcceptFilter sets the accept filter of the server, as the SetAcceptFilter function
+// does.
+func (s *Server) SetAcceptFilter(fn func(net.Conn) error) {
+	if s.r.running {
+		panic("Do not call SetAcceptFilter after Run")
+	}
+	s.r.acceptFilter = fn
+}
+
+// OnConnect sets a function called for every connection accepted by the plugin, once the
+// connection is authenticated and before any call on it is served.
+//
+// OnConnect will panic if called after Run.
+func OnConnect(fn func(*ConnInfo)) {
+	DefaultServer().OnConnect(fn)
+}
+
+// OnConnect sets the function called for the connections to the server, as the OnConnect
+// function does.
+func (s *Server) OnConnect(fn func(*ConnInfo)) {
+	if s.r.running {
+		panic("Do not call OnConnect after Run")
+	}
+	s.r.onConnect = fn
+}
+
+// OnDisconnect sets a function called when a connection for which the OnConnect function
+// was called is closed, after all calls on it have been served.
+//
+// OnDisconnect will panic if called after Run.
+func OnDisconnect(fn func(*ConnInfo)) {
+	DefaultServer().OnDisconnect(fn)
+}
+
+// OnDisconnect sets the function called when connections to the server are closed, as the
+// OnDisconnect function does.
+func (s *Server) OnDisconnect(fn func(*ConnInfo)) {
+	if s.r.running {
+		panic("Do not call OnDisconnect after Run")
+	}
+	s.r.onDisconnect = fn
+}
+
+// OnConnect sets a function called once the host is connected to the plugin, for example
+// to warm it up. The function runs in its own goroutine and can perform calls.
+//
+// Panics if called after Start.
+func (p *Plugin) OnConnect(fn func(*Plugin)) {
+	if p.running {
+		panic("Cannot call OnConnect after Start")
+	}
+	p.onConnect = fn
+}
+
+// OnDisconnect sets a function called when the plugin exits after the host had connected
+// to it. It is called after the OnConnect function has returned.
+//
+// Panics if called after Start.
+func (p *Plugin) OnDisconnect(fn func(*Plugin)) {
+	if p.running {
+		panic("Cannot call OnDisconnect after Start")
+	}
+	p.onDisconnect = fn
+}
+
+// Notify the connect function of the plugin, if any.
+func (c *ctrl) connected() {
+	c.hooked = make(chan struct{})
+	go func(done chan struct{}) {
+		defer close(done)
+		if c.p.onConnect != nil {
+			c.p.onConnect(c.p)
+		}
+	}(c.hooked)
+}
+
+// Notify the disconnect function of the plugin, if connected.
+func (c *ctrl) disconnected() {
+	if c.hooked == nil {
+		return
+	}
+	go func(done chan struct{}) {
+		<-done
+		if c.p.onDisconnect != nil {
+			c.p.onDisconnect(c.p)
+		}
+	}(c.hooked)
+	c.hooked = nil
+}
+
+// OnConnect sets a function called when each plugin of the pool is connected.
+// See Plugin.OnConnect.
+func (p *Pool) OnConnect(fn func(*Plugin)) {
+	for _, pl := range p.plugins {
+		pl.OnConnect(fn)
+	}
+}
+
+// OnDisconnect sets a function called when each plugin of the pool exits.
+// See Plugin.OnDisconnect.
+func (p *Pool) OnDisconnect(fn func(*Plugin)) {
+	for _, pl := range p.plugins {
+		pl.OnDisconnect(fn)
+	}
+}
@@ -0,0 +1,90 @@
+package pingo
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+// ConnLimits bound the resources a connection to the plugin can hold, so that connections
+// leaked or abandoned by clients are eventually closed. Zero values mean no limit, except
+// for AuthTimeout.
+//
+// Limits apply to the connections of the host too. When the plugin closes the connection
+// for calls of the host, the host dials a new one for the next calls; calls sent while the
+// plugin closes it fail.
+type ConnLimits struct {
+	// Close connections that do not complete their handshake, including authentication,
+	// within this time. Zero means the handshake timeout of SetTCPProtection, if set, or
+	// 2 seconds for plugins started with the Hardened option, or IdleTimeout, if set, or
+	// else 10 seconds. Negative values mean no limit.
+	AuthTimeout time.Duration
+	// Close connections on which nothing is received for this long.
+	IdleTimeout time.Duration
+	// Close connections on which a response cannot be written within this time.
+	WriteTimeout time.Duration
+	// Close connections once they have served this many calls.
+	MaxRequests int
+}
+
+// SetConnLimits sets the limits applied to each connection to the plugin.
+//
+// SetConnLimits will panic if called after Run.
+func SetConnLimits(l ConnLimits) {
+	DefaultServer().SetConnLimits(l)
+}
+
+// SetConnLimits sets the limits of the connections to the server, as the SetConnLimits
+// function does.
+func (s *Server) SetConnLimits(l ConnLimits) {
+	if s.r.running {
+		panic("Do not call SetConnLimits after Run")
+	}
+	s.r.limits = l
+	s.r.server.maxRequests = l.MaxRequests
+}
+
+// A connection closed when reads or writes do not complete within the timeouts. Closing
+// it makes sure the timeout is not ignored by buffered readers retrying the read.
+type timeoutConn struct {
+	net.Conn
+	read, write time.Duration
+}
+
+func (c *timeoutConn) closeOnTimeout(err error) {
+	if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+		c.Conn.Close()
+	}
+}
+
+// Apply the timeouts of l, if any, to conn and to br, which buffers the data read from
+// conn during the handshake.
+func (l *ConnLimits) wrap(conn net.Conn, br *bufio.Reader) (net.Conn, *bufio.Reader) {
+	if l.IdleTimeout == 0 && l.WriteTimeout == 0 {
+		return conn, br
+	}
+	tconn := &timeoutConn{Conn: conn, read: l.IdleTimeout, write: l.WriteTimeout}
+	buffered, _ := br.Peek(br.Buffered())
+	r := io.MultiReader(bytes.NewReader(append([]byte(nil), buffered...)), tconn)
+	return tconn, bufio.NewReader(r)
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if c.read > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.read))
+	}
+	n, err := c.Conn.Read(b)
+	c.closeOnTimeout(err)
+	return n, err
+}
+
+func (c *timeoutConn) Write(b []byte) (int, error) {
+	if c.write > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.write))
+	}
+	n, err := c.Conn.Write(b)
+	c.closeOnTimeout(err)
+	return n, err
+}
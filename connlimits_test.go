@@ -0,0 +1,38 @@
+package pingo_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+// The idle connection of the host to an insecure plugin is closed, and the host dials a
+// new one for its next call.
+func TestIdleHostConnection(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	p := pingo.NewInProcessPlugin(func(s *pingo.Server) {
+		s.Register(&Summer{})
+		s.SetConnLimits(pingo.ConnLimits{IdleTimeout: 100 * time.Millisecond})
+		s.OnDisconnect(func(*pingo.ConnInfo) {
+			closed <- struct{}{}
+		})
+	})
+	pingotest.Setup(t, p)
+	p.Start()
+
+	for i := 0; i < 2; i++ {
+		var sum int
+		if err := p.Call("Summer.Sum", []int{1, 2}, &sum); err != nil || sum != 3 {
+			t.Fatalf("Call %d: unexpected sum %d, %v", i, sum, err)
+		}
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Idle connection not closed after call %d", i)
+		}
+		// Calls sent before the host sees the connection closed fail
+		time.Sleep(50 * time.Millisecond)
+	}
+}
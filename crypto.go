@@ -0,0 +1,172 @@
+package pingo
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"hash"
+	"io"
+	"math/big"
+)
+
+// CryptoProvider supplies all cryptographic primitives used by pingo. Replace the default
+// implementation with SetCryptoProvider to use, for example, a FIPS-validated module.
+//
+// Host and plugins must use compatible providers, as the primitives determine the
+// format of secure connections.
+type CryptoProvider interface {
+	// Random fills b with cryptographically secure random bytes.
+	Random(b []byte) error
+	// MAC returns a keyed hash used to authenticate handshakes and derive keys.
+	MAC(key []byte) hash.Hash
+	// AEAD returns the cipher protecting records of secure connections.
+	// The key is as long as the output of MAC.
+	AEAD(key []byte) (cipher.AEAD, error)
+	// Curve returns the curve used for ephemeral key exchange.
+	Curve() ecdh.Curve
+	// Hash returns a SHA-256 hash, used to checksum executables and to fingerprint TLS
+	// certificates: manifests and plugins report SHA-256 checksums.
+	Hash() hash.Hash
+	// Sign and Verify sign manifests with ed25519 keys (see PackArchive and
+	// Archive.Verify). Verify is only called with keys of ed25519.PublicKeySize bytes.
+	Sign(key ed25519.PrivateKey, msg []byte) ([]byte, error)
+	Verify(key ed25519.PublicKey, msg, sig []byte) bool
+	// TLSConfig returns the base configuration of TLS connections (see Plugin.SetTLS),
+	// for example restricting versions, cipher suites and curves. Certificates and their
+	// verification are set on it; if its Rand is nil, Random is used.
+	TLSConfig() *tls.Config
+}
+
+// Default implementation of CryptoProvider using the Go standard library:
+// HMAC-SHA256, AES-GCM and X25519.
+type StdCrypto struct{}
+
+// Read from crypto/rand.
+func (StdCrypto) Random(b []byte) error {
+	_, err := io.ReadFull(rand.Reader, b)
+	return err
+}
+
+// HMAC-SHA256.
+func (StdCrypto) MAC(key []byte) hash.Hash {
+	return hmac.New(sha256.New, key)
+}
+
+// AES-GCM.
+func (StdCrypto) AEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// X25519.
+func (StdCrypto) Curve() ecdh.Curve {
+	return ecdh.X25519()
+}
+
+// SHA-256.
+func (StdCrypto) Hash() hash.Hash {
+	return sha256.New()
+}
+
+// Ed25519.
+func (StdCrypto) Sign(key ed25519.PrivateKey, msg []byte) ([]byte, error) {
+	return ed25519.Sign(key, msg), nil
+}
+
+// Ed25519.
+func (StdCrypto) Verify(key ed25519.PublicKey, msg, sig []byte) bool {
+	return ed25519.Verify(key, msg, sig)
+}
+
+// The defaults of crypto/tls.
+func (StdCrypto) TLSConfig() *tls.Config {
+	return &tls.Config{}
+}
+
+var cryptoProvider CryptoProvider = StdCrypto{}
+
+// SetCryptoProvider replaces the cryptographic primitives used by pingo, in hosts and plugins.
+// It must be called before any plugin is started or Run is called.
+func SetCryptoProvider(c CryptoProvider) {
+	cryptoProvider = c
+}
+
+// Reader for key generation, backed by the provider.
+type providerRand struct{}
+
+func (providerRand) Read(b []byte) (int, error) {
+	if err := cryptoProvider.Random(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Base configuration of TLS connections, drawing randomness from the provider.
+func providerTLSConfig() *tls.Config {
+	config := cryptoProvider.TLSConfig()
+	if config == nil {
+		config = &tls.Config{}
+	}
+	if config.Rand == nil {
+		config.Rand = providerRand{}
+	}
+	return config
+}
+
+var errKeyGeneration = errors.New("Cannot generate a key from the random bytes of the provider")
+
+// Generate a key of curve from the random bytes of the provider. GenerateKey ignores its
+// random source in recent versions of Go.
+func providerECDHKey(curve ecdh.Curve) (*ecdh.PrivateKey, error) {
+	size := 32
+	switch curve {
+	case ecdh.P384():
+		size = 48
+	case ecdh.P521():
+		size = 66
+	}
+	// Few values are out of range, but the provider could be broken
+	for i := 0; i < 16; i++ {
+		d := make([]byte, size)
+		if err := cryptoProvider.Random(d); err != nil {
+			return nil, err
+		}
+		if curve == ecdh.P521() {
+			// The order of P-521 has 521 bits
+			d[0] &= 1
+		}
+		if priv, err := curve.NewPrivateKey(d); err == nil {
+			return priv, nil
+		}
+	}
+	return nil, errKeyGeneration
+}
+
+// Generate a P-256 key from the random bytes of the provider.
+func providerECDSAKey() (*ecdsa.PrivateKey, error) {
+	priv, err := providerECDHKey(ecdh.P256())
+	if err != nil {
+		return nil, err
+	}
+	// Uncompressed point: 0x04, X, Y
+	pub := priv.PublicKey().Bytes()
+	return &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(pub[1:33]),
+			Y:     new(big.Int).SetBytes(pub[33:]),
+		},
+		D: new(big.Int).SetBytes(priv.Bytes()),
+	}, nil
+}
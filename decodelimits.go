@@ -0,0 +1,208 @@
+package pingo
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strconv"
+)
+
+// Limits on decoded structures applied with the Hardened option.
+var hardenedDecodeLimits = DecodeLimits{MaxDepth: 64, MaxElements: 1 << 20}
+
+var (
+	errDecodeDepth    = ErrDecodeLimit(errors.New("Decoded value is nested too deeply"))
+	errDecodeElements = ErrDecodeLimit(errors.New("Decoded value has too many elements"))
+)
+
+// Error reported when a decoded argument or reply exceeds the DecodeLimits.
+type ErrDecodeLimit error
+
+// DecodeLimits bound the structure of the arguments and replies of calls, so that values
+// nested deeply or with very many elements, sent by mistake or maliciously, do not reach
+// methods and callers. Values are checked while reading the messages holding them, before
+// they are decoded; the size of the messages is bounded separately. Zero values mean no
+// limit.
+type DecodeLimits struct {
+	// Maximum nesting of structs, maps, slices and arrays.
+	MaxDepth int
+	// Maximum number of elements of maps, slices and arrays in a whole value. Byte slices
+	// and strings are not counted. With the JSON encodings, the members of objects are
+	// counted too.
+	MaxElements int
+}
+
+// SetDecodeLimits sets the limits applied to the arguments of calls to the plugin. Calls
+// whose arguments exceed them fail without calling the method. Codecs set with SetCodec,
+// except GobCodec, and JSON-RPC clients have arguments checked once decoded. The host can
+// also set the limits with LimitDecoding; limits passed by the host take priority.
+//
+// SetDecodeLimits will panic if called after Run.
+func SetDecodeLimits(l DecodeLimits) {
+	DefaultServer().SetDecodeLimits(l)
+}
+
+// SetDecodeLimits sets the limits applied to the arguments of calls to the server, as the
+// SetDecodeLimits function does.
+func (s *Server) SetDecodeLimits(l DecodeLimits) {
+	if s.r.running {
+		panic("Do not call SetDecodeLimits after Run")
+	}
+	s.r.server.decodeLimits = l
+}
+
+// LimitDecoding applies limits to the replies of the plugin, and passes them to the plugin
+// to apply to the arguments of calls (see SetDecodeLimits). Replies exceeding the limits
+// fail with an *ErrDecode error wrapping an ErrDecodeLimit error.
+func LimitDecoding(l DecodeLimits) Option {
+	return func(o *options) {
+		o.decodeLimits = l
+	}
+}
+
+// Parameters passing the decode limits to the plugin.
+func (o *options) decodeParams() []string {
+	var params []string
+	if o.decodeLimits.MaxDepth > 0 {
+		params = append(params, "-pingo:maxdepth="+strconv.Itoa(o.decodeLimits.MaxDepth))
+	}
+	if o.decodeLimits.MaxElements > 0 {
+		params = append(params, "-pingo:maxelements="+strconv.Itoa(o.decodeLimits.MaxElements))
+	}
+	return params
+}
+
+// Apply the limits passed by the host, or those of hardened mode if none are set.
+func (c *config) applyDecodeLimits(l *DecodeLimits) {
+	if c.maxdepth > 0 {
+		l.MaxDepth = c.maxdepth
+	}
+	if c.maxelements > 0 {
+		l.MaxElements = c.maxelements
+	}
+	if c.hardened && *l == (DecodeLimits{}) {
+		*l = hardenedDecodeLimits
+	}
+}
+
+// Check a decoded value against the limits.
+func (l *DecodeLimits) check(v interface{}) error {
+	if l.MaxDepth == 0 && l.MaxElements == 0 {
+		return nil
+	}
+	elements := 0
+	return l.walk(reflect.ValueOf(v), 0, &elements)
+}
+
+func (l *DecodeLimits) walk(v reflect.Value, depth int, elements *int) error {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return l.walk(v.Elem(), depth, elements)
+	case reflect.Struct:
+		if l.MaxDepth > 0 && depth >= l.MaxDepth {
+			return errDecodeDepth
+		}
+		for i := 0; i < v.NumField(); i++ {
+			if err := l.walk(v.Field(i), depth+1, elements); err != nil {
+				return err
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return nil
+		}
+		if err := l.count(v.Len(), depth, elements); err != nil {
+			return err
+		}
+		if isScalar(v.Type().Elem()) {
+			return nil
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := l.walk(v.Index(i), depth+1, elements); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if err := l.count(v.Len(), depth, elements); err != nil {
+			return err
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := l.walk(iter.Key(), depth+1, elements); err != nil {
+				return err
+			}
+			if err := l.walk(iter.Value(), depth+1, elements); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Count the n elements of a container at depth.
+func (l *DecodeLimits) count(n, depth int, elements *int) error {
+	if l.MaxDepth > 0 && depth >= l.MaxDepth {
+		return errDecodeDepth
+	}
+	*elements += n
+	if l.MaxElements > 0 && *elements > l.MaxElements {
+		return errDecodeElements
+	}
+	return nil
+}
+
+// Check the first JSON value of data against the limits. As objects can be decoded into
+// maps, their members are counted as elements.
+func (l *DecodeLimits) checkJSON(data []byte) error {
+	type container struct {
+		object bool
+		tokens int
+	}
+	var stack []container
+	elements := 0
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			// Reported when decoding
+			return nil
+		}
+		delim, _ := tok.(json.Delim)
+		if delim == '}' || delim == ']' {
+			stack = stack[:len(stack)-1]
+		} else {
+			if n := len(stack); n > 0 {
+				// Keys of objects and values of arrays start elements.
+				if c := &stack[n-1]; !c.object || c.tokens%2 == 0 {
+					elements++
+					if l.MaxElements > 0 && elements > l.MaxElements {
+						return errDecodeElements
+					}
+				}
+				stack[n-1].tokens++
+			}
+			if delim != 0 {
+				if l.MaxDepth > 0 && len(stack) >= l.MaxDepth {
+					return errDecodeDepth
+				}
+				stack = append(stack, container{object: delim == '{'})
+			}
+		}
+		if len(stack) == 0 {
+			return nil
+		}
+	}
+}
+
+// Values of the type hold no other values.
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Interface, reflect.Struct, reflect.Slice, reflect.Array, reflect.Map:
+		return false
+	}
+	return true
+}
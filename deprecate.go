@@ -0,0 +1,86 @@
+package pingo
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+// Deprecate marks a method, as in "Object.Method", as deprecated. The hint, for example
+// "use Object.Other", is reported to hosts calling the method and in Describe.
+//
+// Deprecate will panic if called after Run.
+func Deprecate(method, hint string) {
+	DefaultServer().Deprecate(method, hint)
+}
+
+// Deprecate marks a method of the server as deprecated, as the Deprecate function does.
+func (s *Server) Deprecate(method, hint string) {
+	if s.r.running {
+		panic("Do not call Deprecate after Run")
+	}
+	s.r.deprecated[method] = hint
+}
+
+// Report deprecated methods to the host, one per line.
+func (r *rpcServer) outputDeprecated(h metaWriter) {
+	for method, hint := range r.deprecated {
+		h.output("deprecated", method+" "+hint)
+	}
+}
+
+// Deprecated methods reported by a plugin, and the ones already warned about.
+type deprecations struct {
+	mu     sync.Mutex
+	hints  map[string]string
+	warned map[string]bool
+}
+
+func (d *deprecations) add(line string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	method, hint := line, ""
+	if i := strings.IndexByte(line, ' '); i >= 0 {
+		method, hint = line[:i], line[i+1:]
+	}
+	if d.hints == nil {
+		d.hints = make(map[string]string)
+		d.warned = make(map[string]bool)
+	}
+	d.hints[method] = hint
+}
+
+// Warn once if method is deprecated.
+func (d *deprecations) check(method string, p *Plugin) {
+	d.mu.Lock()
+	hint, ok := d.hints[method]
+	warn := ok && !d.warned[method]
+	if warn {
+		d.warned[method] = true
+	}
+	d.mu.Unlock()
+
+	if !warn {
+		return
+	}
+	msg := "Method " + method + " is deprecated"
+	if hint != "" {
+		msg += ": " + hint
+	}
+	p.report(LevelWarn, errors.New(msg), "Method is deprecated", Field{"method", method}, Field{"hint", hint})
+}
+
+// Deprecations returns the deprecated methods of the plugin with a hint on their
+// replacement, as reported by the plugin (see Deprecate). The first call of a deprecated
+// method is reported to the ErrorHandler, or to the Logger set with SetLogger.
+func (p *Plugin) Deprecations() map[string]string {
+	p.deprecated.mu.Lock()
+	defer p.deprecated.mu.Unlock()
+
+	list := make(map[string]string, len(p.deprecated.hints))
+	for method, hint := range p.deprecated.hints {
+		list[method] = hint
+	}
+	return list
+}
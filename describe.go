@@ -0,0 +1,122 @@
+package pingo
+
+import (
+	"context"
+	"reflect"
+	"sort"
+)
+
+// Schema describes the objects exported by a plugin and the types they use. See Describe.
+type Schema struct {
+	Objects []ObjectSchema
+	// Struct types used by methods, by name, including the types of their fields
+	Types map[string]TypeSchema
+}
+
+// ObjectSchema describes an object exported by a plugin.
+type ObjectSchema struct {
+	Name string
+	// Version of the object, if set when registering it (see Versioned)
+	Version string
+	Methods []MethodSchema
+}
+
+// MethodSchema describes a method of an exported object.
+type MethodSchema struct {
+	Name string
+	// Types of argument and reply, as in "[]string" or "*main.Result"
+	Args  string
+	Reply string
+	// Method takes a context.Context
+	Context bool
+	// Method is deprecated, with a hint on what to use instead (see Deprecate)
+	Deprecated  bool
+	Replacement string
+}
+
+// TypeSchema describes the exported fields of a struct type.
+type TypeSchema struct {
+	Fields []FieldSchema
+}
+
+// FieldSchema describes a field of a struct type.
+type FieldSchema struct {
+	Name string
+	Type string
+}
+
+// Internal RPC call to describe the exported objects. Do not call manually.
+func (s *PingoRpc) Describe(unused int, schema *Schema) error {
+	*schema = *s.server().describe()
+	return nil
+}
+
+func (r *rpcServer) describe() *Schema {
+	schema := &Schema{Types: make(map[string]TypeSchema)}
+
+	r.server.mu.RLock()
+	defer r.server.mu.RUnlock()
+
+	for name, svc := range r.server.services {
+		if name == internalObject || r.hidden[name] {
+			continue
+		}
+		obj := ObjectSchema{Name: name, Version: r.versions[name]}
+		for mname, mtype := range svc.method {
+			m := MethodSchema{
+				Name:    mname,
+				Args:    mtype.ArgType.String(),
+				Reply:   mtype.ReplyType.String(),
+				Context: mtype.context,
+			}
+			m.Replacement, m.Deprecated = r.deprecated[name+"."+mname]
+			obj.Methods = append(obj.Methods, m)
+			describeType(schema.Types, mtype.ArgType)
+			describeType(schema.Types, mtype.ReplyType)
+		}
+		sort.Slice(obj.Methods, func(i, j int) bool {
+			return obj.Methods[i].Name < obj.Methods[j].Name
+		})
+		schema.Objects = append(schema.Objects, obj)
+	}
+	sort.Slice(schema.Objects, func(i, j int) bool {
+		return schema.Objects[i].Name < schema.Objects[j].Name
+	})
+	return schema
+}
+
+// Add the struct types reachable from t to types.
+func describeType(types map[string]TypeSchema, t reflect.Type) {
+	switch t.Kind() {
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		describeType(types, t.Elem())
+	case reflect.Map:
+		describeType(types, t.Key())
+		describeType(types, t.Elem())
+	case reflect.Struct:
+		if _, ok := types[t.String()]; ok {
+			return
+		}
+		ts := TypeSchema{}
+		// Register the type before its fields, for recursive types.
+		types[t.String()] = ts
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue
+			}
+			ts.Fields = append(ts.Fields, FieldSchema{Name: f.Name, Type: f.Type.String()})
+			describeType(types, f.Type)
+		}
+		types[t.String()] = ts
+	}
+}
+
+// Describe returns the schema of the objects exported by the plugin.
+func (p *Plugin) Describe(ctx context.Context) (*Schema, error) {
+	schema := &Schema{}
+	if err := callContext(ctx, p, internalObject+".Describe", 0, schema); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
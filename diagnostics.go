@@ -0,0 +1,99 @@
+package pingo
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Bytes of standard error kept to report an abnormal exit.
+const diagnosticsTail = 64 << 10
+
+// ErrExited is reported when a plugin started with Diagnostics exits abnormally.
+// It carries the end of the standard error of the plugin, which holds the stack
+// trace of a panic or the report of the race detector.
+type ErrExited struct {
+	// Last lines written by the plugin to standard error
+	Output string
+	// Error waiting for the process, usually an *exec.ExitError
+	Err error
+}
+
+func (e *ErrExited) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("Plugin exited: %v", e.Err)
+	}
+	return fmt.Sprintf("Plugin exited: %v\n%s", e.Err, e.Output)
+}
+
+func (e *ErrExited) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostics starts the plugin with GOTRACEBACK=all and, if not empty, the specified
+// GODEBUG settings (for example "gctrace=1"). If the plugin exits abnormally, the error
+// passed to the ErrorHandler and returned by further calls is an *ErrExited carrying the
+// end of the standard error of the plugin, such as the stack traces of all goroutines.
+func Diagnostics(godebug string) Option {
+	return func(o *options) {
+		o.diagnostics = true
+		o.godebug = godebug
+	}
+}
+
+// Environment for the plugin with diagnostics enabled.
+func (o *options) diagnosticsEnv(env []string) []string {
+	list := make([]string, 0, len(env)+2)
+	for _, e := range env {
+		if strings.HasPrefix(e, "GOTRACEBACK=") || (o.godebug != "" && strings.HasPrefix(e, "GODEBUG=")) {
+			continue
+		}
+		list = append(list, e)
+	}
+	list = append(list, "GOTRACEBACK=all")
+	if o.godebug != "" {
+		list = append(list, "GODEBUG="+o.godebug)
+	}
+	return list
+}
+
+// Keeps the last bytes written to it.
+type tailWriter struct {
+	max int
+	buf []byte
+}
+
+func (t *tailWriter) Write(b []byte) (int, error) {
+	t.buf = append(t.buf, b...)
+	if over := len(t.buf) - t.max; over > 0 {
+		t.buf = t.buf[over:]
+	}
+	return len(b), nil
+}
+
+// Output kept, starting at a complete line.
+func (t *tailWriter) String() string {
+	out := t.buf
+	if len(out) == t.max {
+		if i := bytes.IndexByte(out, '\n'); i >= 0 {
+			out = out[i+1:]
+		}
+	}
+	return strings.TrimRight(string(out), "\n")
+}
+
+// Environment for the plugin process; nil to inherit the one of the host.
+func (o *options) env() []string {
+	var env []string
+	if o.scrubEnv {
+		env = scrubEnv(os.Environ())
+	}
+	if o.diagnostics {
+		if env == nil {
+			env = os.Environ()
+		}
+		env = o.diagnosticsEnv(env)
+	}
+	return env
+}
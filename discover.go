@@ -0,0 +1,267 @@
+package pingo
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DiscoverOption configures Discover.
+type DiscoverOption func(*discoverOptions)
+
+type discoverOptions struct {
+	proto   string
+	setup   func(name string, p *Plugin)
+	handler ErrorHandler
+	// Keys manifests must be signed with, if verified
+	keys   []ed25519.PublicKey
+	verify bool
+}
+
+// DiscoverProto sets the protocol plugins found by Discover are started with: "unix",
+// the default, or "tcp".
+func DiscoverProto(proto string) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.proto = proto
+	}
+}
+
+// DiscoverSetup sets a function configuring each plugin found by Discover before it is
+// started, for example to make it secure.
+func DiscoverSetup(fn func(name string, p *Plugin)) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.setup = fn
+	}
+}
+
+// DiscoverErrorHandler sets the handler reporting the entries skipped by Discover. By
+// default, they are logged.
+func DiscoverErrorHandler(h ErrorHandler) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.handler = h
+	}
+}
+
+// DiscoverVerify makes Discover only accept plugins whose manifest is signed by one of keys
+// (see Archive.Verify). Plain executables and plugins whose manifest is not signed, or
+// signed by another key, are skipped. Discover fails if no key is given.
+func DiscoverVerify(keys ...ed25519.PublicKey) DiscoverOption {
+	return func(o *discoverOptions) {
+		o.keys, o.verify = keys, true
+	}
+}
+
+// DiscoveredPlugin describes a plugin found by Discover.
+type DiscoveredPlugin struct {
+	Name string
+	// Executable for the platform of the host
+	Path string
+	// Manifest of the plugin, nil for plain executables
+	Manifest *Manifest
+	// Checksum of the executable from the manifest, verified when it is started
+	Checksum string
+}
+
+// Registry holds the plugins found by Discover, keyed by name. Each plugin is started the
+// first time it is used.
+type Registry struct {
+	opts    discoverOptions
+	mu      sync.Mutex
+	found   map[string]*DiscoveredPlugin
+	plugins map[string]*Plugin
+}
+
+// Discover scans dir for plugins and returns a registry of them. Entries of dir are:
+//
+// - directories containing a manifest (see ManifestFile), such as the output of "pingo
+// build" or archives installed with InstallArchive; the plugin is named after the manifest
+// and runs its executable for the platform of the host;
+//
+// - executable files, named after the file without extension.
+//
+// Plugins without an executable for the platform of the host, or declaring a version of the
+// protocol other than the one of the host, are skipped and reported to the error handler.
+// If several entries have the same name, the one with the highest version is used.
+func Discover(dir string, opts ...DiscoverOption) (*Registry, error) {
+	r := &Registry{
+		opts:    discoverOptions{proto: "unix", handler: NewDefaultErrorHandler()},
+		found:   make(map[string]*DiscoveredPlugin),
+		plugins: make(map[string]*Plugin),
+	}
+	for _, o := range opts {
+		o(&r.opts)
+	}
+	if r.opts.verify && len(r.opts.keys) == 0 {
+		return nil, ErrSignature(errors.New("No keys to verify plugins with"))
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		path := filepath.Join(dir, e.Name())
+		d, err := discoverEntry(path, e, &r.opts)
+		if err != nil {
+			r.opts.handler.Error(errors.New("Skipping plugin " + path + ": " + err.Error()))
+			continue
+		}
+		if d == nil {
+			continue
+		}
+		if prev, ok := r.found[d.Name]; ok && compareVersions(prev.version(), d.version()) >= 0 {
+			continue
+		}
+		r.found[d.Name] = d
+	}
+	return r, nil
+}
+
+// Describe the plugin at path, if any.
+func discoverEntry(path string, e os.DirEntry, opts *discoverOptions) (*DiscoveredPlugin, error) {
+	if e.IsDir() {
+		m, err := ReadManifest(filepath.Join(path, ManifestFile))
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if opts.verify {
+			if err := verifyManifest(path, opts.keys); err != nil {
+				return nil, err
+			}
+		}
+		if m.Protocol != 0 && m.Protocol != protocolVersion {
+			return nil, ErrProtocolVersion(fmt.Errorf("Plugin speaks protocol version %d, host speaks version %d",
+				m.Protocol, protocolVersion))
+		}
+		a, err := m.Artifact("")
+		if err != nil {
+			return nil, err
+		}
+		return &DiscoveredPlugin{Name: m.Name, Path: a.File, Manifest: m, Checksum: a.SHA256}, nil
+	}
+	info, err := e.Info()
+	if err != nil {
+		return nil, err
+	}
+	if !info.Mode().IsRegular() || !isExecutable(e.Name(), info.Mode()) {
+		return nil, nil
+	}
+	if opts.verify {
+		return nil, ErrSignature(errors.New("Plugin has no signed manifest"))
+	}
+	name := strings.TrimSuffix(e.Name(), filepath.Ext(e.Name()))
+	return &DiscoveredPlugin{Name: name, Path: path}, nil
+}
+
+func isExecutable(name string, mode os.FileMode) bool {
+	if runtime.GOOS == "windows" {
+		return strings.EqualFold(filepath.Ext(name), ".exe")
+	}
+	return mode&0111 != 0
+}
+
+func (d *DiscoveredPlugin) version() string {
+	if d.Manifest == nil {
+		return ""
+	}
+	return d.Manifest.Version
+}
+
+// Compare versions such as "1.10.2" by their numeric parts, and other parts as strings.
+func compareVersions(a, b string) int {
+	as := strings.Split(strings.TrimPrefix(a, "v"), ".")
+	bs := strings.Split(strings.TrimPrefix(b, "v"), ".")
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		an, aerr := strconv.Atoi(as[i])
+		bn, berr := strconv.Atoi(bs[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case (aerr != nil || berr != nil) && as[i] != bs[i]:
+			return strings.Compare(as[i], bs[i])
+		}
+	}
+	return len(as) - len(bs)
+}
+
+// Names returns the names of the plugins found, sorted.
+func (r *Registry) Names() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := make([]string, 0, len(r.found))
+	for name := range r.found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Lookup returns the description of the named plugin, or nil if it was not found.
+func (r *Registry) Lookup(name string) *DiscoveredPlugin {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.found[name]
+}
+
+// Plugin returns the named plugin, starting it if it is not running yet. An
+// ErrUnknownPlugin error is returned if the plugin was not found.
+func (r *Registry) Plugin(name string) (*Plugin, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.plugins[name]; ok {
+		return p, nil
+	}
+	d, ok := r.found[name]
+	if !ok {
+		return nil, ErrUnknownPlugin(errors.New("Unknown plugin " + name))
+	}
+	p := NewPlugin(r.opts.proto, d.Path)
+	p.SetChecksum(d.Checksum)
+	if r.opts.setup != nil {
+		r.opts.setup(name, p)
+	}
+	p.Start()
+	r.plugins[name] = p
+	return p, nil
+}
+
+// Call performs an RPC call on the named plugin, starting it if needed.
+func (r *Registry) Call(ctx context.Context, plugin, name string, args interface{}, resp interface{}) error {
+	p, err := r.Plugin(plugin)
+	if err != nil {
+		return err
+	}
+	return p.CallContext(ctx, name, args, resp)
+}
+
+// Shutdown stops the plugins started, as StopAll does. They are started again if used.
+func (r *Registry) Shutdown(ctx context.Context) error {
+	r.mu.Lock()
+	plugins := make([]*Plugin, 0, len(r.plugins))
+	for _, p := range r.plugins {
+		plugins = append(plugins, p)
+	}
+	r.plugins = make(map[string]*Plugin)
+	r.mu.Unlock()
+
+	return StopAll(ctx, plugins...)
+}
@@ -0,0 +1,336 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"go/token"
+	"io"
+	"net/rpc"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Precompute the reflect types for error and context.Context.
+var (
+	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
+)
+
+type methodType struct {
+	method    reflect.Method
+	ArgType   reflect.Type
+	ReplyType reflect.Type
+	// Method takes a context.Context as first argument
+	context bool
+}
+
+type service struct {
+	name   string
+	rcvr   reflect.Value
+	method map[string]*methodType
+}
+
+// Dispatches calls to registered objects. Registration follows the same rules of
+// the "rpc" package, except that methods can take a context.Context as first argument;
+// unlike rpc.Server, each call passes through the checks of the connection it was
+// received on.
+type dispatcher struct {
+	mu       sync.RWMutex
+	services map[string]*service
+	// Records each call, if a logger is set
+	audit *auditor
+	// Hooks around each call
+	instr Instrumentation
+	// Rate limits per tenant
+	tenants tenantLimiter
+	// Calls in progress, waited for on exit
+	drain drain
+	// Calls served by a connection before closing it, zero for no limit
+	maxRequests int
+	// Limits checked on decoded arguments
+	decodeLimits DecodeLimits
+	// Methods by ID, set on Run
+	methodIDs []methodRef
+	// Calls to run by the workers, if bounded
+	calls chan func()
+}
+
+func newDispatcher() *dispatcher {
+	return &dispatcher{
+		services: make(map[string]*service),
+		audit:    &auditor{redactors: make(map[string]Redactor)},
+	}
+}
+
+func isExportedOrBuiltinType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return token.IsExported(t.Name()) || t.PkgPath() == ""
+}
+
+// Register the methods of rcvr suitable for RPC, under name or the name of its type.
+func (d *dispatcher) register(rcvr interface{}, name string) error {
+	s := &service{
+		rcvr:   reflect.ValueOf(rcvr),
+		method: make(map[string]*methodType),
+	}
+	typ := reflect.TypeOf(rcvr)
+	sname := reflect.Indirect(s.rcvr).Type().Name()
+	if name != "" {
+		sname = name
+	}
+	if sname == "" {
+		return errors.New("No service name for type " + typ.String())
+	}
+	if name == "" && !token.IsExported(sname) {
+		return errors.New("Type " + sname + " is not exported")
+	}
+	s.name = sname
+
+	for m := 0; m < typ.NumMethod(); m++ {
+		method := typ.Method(m)
+		if mt := suitableMethod(method); mt != nil {
+			s.method[method.Name] = mt
+		}
+	}
+	if len(s.method) == 0 {
+		return errors.New("Type " + sname + " has no exported methods of suitable type")
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, dup := d.services[sname]; dup {
+		return errors.New("Service already defined: " + sname)
+	}
+	d.services[sname] = s
+	return nil
+}
+
+// Method needs three ins: receiver, *args, *reply; and one out: error. It can
+// also take a context.Context after the receiver.
+func suitableMethod(method reflect.Method) *methodType {
+	mtype := method.Type
+	if !method.IsExported() || mtype.NumOut() != 1 {
+		return nil
+	}
+	first := 1
+	if mtype.NumIn() == 4 && mtype.In(1) == typeOfContext {
+		first = 2
+	} else if mtype.NumIn() != 3 {
+		return nil
+	}
+	argType := mtype.In(first)
+	if !isExportedOrBuiltinType(argType) {
+		return nil
+	}
+	replyType := mtype.In(first + 1)
+	if replyType.Kind() != reflect.Ptr || !isExportedOrBuiltinType(replyType) {
+		return nil
+	}
+	if mtype.Out(0) != typeOfError {
+		return nil
+	}
+	return &methodType{method: method, ArgType: argType, ReplyType: replyType, context: first == 2}
+}
+
+func (d *dispatcher) lookup(serviceMethod string) (*service, *methodType, error) {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		return nil, nil, errors.New("rpc: service/method request ill-formed: " + serviceMethod)
+	}
+	serviceName, methodName := serviceMethod[:dot], serviceMethod[dot+1:]
+
+	d.mu.RLock()
+	svc := d.services[serviceName]
+	d.mu.RUnlock()
+
+	if svc == nil {
+		return nil, nil, errors.New("rpc: can't find service " + serviceMethod)
+	}
+	mtype := svc.method[methodName]
+	if mtype == nil {
+		return nil, nil, errors.New("rpc: can't find method " + serviceMethod)
+	}
+	return svc, mtype, nil
+}
+
+// Implemented by codecs checking the bodies of requests against decode limits while
+// reading them.
+type limitedCodec interface {
+	limitDecoding(l DecodeLimits)
+}
+
+// A value sent as the response body when an error occurs.
+var invalidRequest = struct{}{}
+
+// Serializes writes of responses on a connection.
+type responder struct {
+	mu    sync.Mutex
+	codec rpc.ServerCodec
+}
+
+func (r *responder) send(req *rpc.Request, reply interface{}, errmsg string) {
+	resp := &rpc.Response{ServiceMethod: req.ServiceMethod, Seq: req.Seq}
+	if errmsg != "" {
+		resp.Error = errmsg
+		reply = invalidRequest
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.codec.WriteResponse(resp, reply)
+}
+
+// Serve calls received via codec on the connection described by info until the connection
+// is closed. Each call is checked with check, if not nil, before being dispatched.
+func (d *dispatcher) serveCodec(codec rpc.ServerCodec, info *ConnInfo, check func(method string) error) {
+	resp := &responder{codec: codec}
+	wg := new(sync.WaitGroup)
+	calls := new(cancellations)
+	var served int
+
+	// Arguments are checked against the decode limits while reading them if the codec
+	// supports it, or else once decoded.
+	checkBody := d.decodeLimits.check
+	if lc, ok := codec.(limitedCodec); ok {
+		lc.limitDecoding(d.decodeLimits)
+		checkBody = func(interface{}) error { return nil }
+	}
+
+	for {
+		req := &rpc.Request{}
+		if err := codec.ReadRequestHeader(req); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				resp.send(req, nil, "rpc: "+err.Error())
+			}
+			break
+		}
+		received := time.Now()
+
+		if req.Seq == keepaliveSeq && req.ServiceMethod == keepaliveMethod {
+			codec.ReadRequestBody(nil)
+			resp.send(req, struct{}{}, "")
+			continue
+		}
+		if req.Seq == cancelSeq && req.ServiceMethod == cancelMethod {
+			var id string
+			codec.ReadRequestBody(&id)
+			calls.cancel(id)
+			continue
+		}
+
+		var md url.Values
+		req.ServiceMethod, md = splitMetadata(req.ServiceMethod)
+
+		var svc *service
+		var mtype *methodType
+		var err error
+		if ref, ok := d.lookupID(req.ServiceMethod); ok {
+			req.ServiceMethod, svc, mtype = ref.name, ref.svc, ref.mtype
+		} else if svc, mtype, err = d.lookup(req.ServiceMethod); err != nil {
+			codec.ReadRequestBody(nil)
+			resp.send(req, nil, err.Error())
+			continue
+		}
+
+		// Decode the argument value, as a pointer even if the method takes a value.
+		var argv reflect.Value
+		argIsValue := false
+		if mtype.ArgType.Kind() == reflect.Ptr {
+			argv = reflect.New(mtype.ArgType.Elem())
+		} else {
+			argv = reflect.New(mtype.ArgType)
+			argIsValue = true
+		}
+		if err := codec.ReadRequestBody(argv.Interface()); err != nil {
+			resp.send(req, nil, "rpc: "+err.Error())
+			continue
+		}
+		if err := checkBody(argv.Interface()); err != nil {
+			resp.send(req, nil, "rpc: "+err.Error())
+			continue
+		}
+		if argIsValue {
+			argv = argv.Elem()
+		}
+
+		if check != nil {
+			if err := check(req.ServiceMethod); err != nil {
+				resp.send(req, nil, err.Error())
+				continue
+			}
+		}
+		if err := d.tenants.allow(md.Get(tenantKey)); err != nil {
+			resp.send(req, nil, err.Error())
+			continue
+		}
+
+		replyv := reflect.New(mtype.ReplyType.Elem())
+		switch mtype.ReplyType.Elem().Kind() {
+		case reflect.Map:
+			replyv.Elem().Set(reflect.MakeMap(mtype.ReplyType.Elem()))
+		case reflect.Slice:
+			replyv.Elem().Set(reflect.MakeSlice(mtype.ReplyType.Elem(), 0, 0))
+		}
+
+		if !d.drain.begin() {
+			resp.send(req, nil, errShuttingDown.Error())
+			continue
+		}
+		served++
+		parent, release := calls.context(md)
+		ctx, cancel := metadataContext(parent, md, received)
+		done := func() { cancel(); release() }
+		wg.Add(1)
+		if !d.spawn(func() { d.call(ctx, done, info, svc, resp, wg, mtype, req, argv, replyv) }) {
+			done()
+			wg.Done()
+			d.drain.end()
+			resp.send(req, nil, encodeError(ErrBusy, ErrBusy.Error(), info.typedErrors))
+		}
+
+		if d.maxRequests > 0 && served >= d.maxRequests {
+			break
+		}
+	}
+
+	// Wait for outstanding calls before closing the codec.
+	wg.Wait()
+	codec.Close()
+}
+
+func (d *dispatcher) call(ctx context.Context, cancel context.CancelFunc, info *ConnInfo, s *service, resp *responder, wg *sync.WaitGroup, mtype *methodType, req *rpc.Request, argv, replyv reflect.Value) {
+	defer wg.Done()
+	defer d.drain.end()
+	defer cancel()
+	ctx = context.WithValue(ctx, connInfoKey{}, info)
+
+	ctx = d.instr.callStart(ctx, info, req.ServiceMethod)
+	in := []reflect.Value{s.rcvr, argv, replyv}
+	if mtype.context {
+		in = []reflect.Value{s.rcvr, reflect.ValueOf(ctx), argv, replyv}
+	}
+
+	var errmsg string
+	start := time.Now()
+	returnValues := mtype.method.Func.Call(in)
+	if errInter := returnValues[0].Interface(); errInter != nil {
+		errmsg = errInter.(error).Error()
+		if errmsg == "" {
+			errmsg = fmt.Sprintf("rpc: method %s returned an empty error", req.ServiceMethod)
+		}
+	}
+	d.instr.callDone(ctx, info, req.ServiceMethod, start, errmsg)
+	d.audit.record(ctx, req.ServiceMethod, start, argv.Interface(), replyv.Interface(), errmsg)
+	if errmsg != "" {
+		errmsg = encodeError(returnValues[0].Interface().(error), errmsg, info.typedErrors)
+	}
+	resp.send(req, replyv.Interface(), errmsg)
+}
@@ -0,0 +1,120 @@
+package pingo
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+var errShuttingDown = errors.New("Plugin is shutting down")
+
+// Default time the plugin waits for calls in progress when asked to exit.
+const defaultShutdownTimeout = time.Second
+
+// OnShutdown adds a function to run when the host stops the plugin, after the calls
+// in progress have completed, for example to flush buffers. Functions run in the order
+// they were added, before the process exits.
+//
+// OnShutdown will panic if called after Run.
+func OnShutdown(fn func()) {
+	DefaultServer().OnShutdown(fn)
+}
+
+// OnShutdown adds a function to run when the host stops the server, as the OnShutdown
+// function does.
+func (s *Server) OnShutdown(fn func()) {
+	if s.r.running {
+		panic("Do not call OnShutdown after Run")
+	}
+	s.r.shutdownHooks = append(s.r.shutdownHooks, fn)
+}
+
+// SetShutdownTimeout sets how long the plugin waits for calls in progress to complete when
+// the host stops it; calls still running are then abandoned. The default is one second.
+// Hosts kill plugins that do not exit within their timeout (see Plugin.SetTimeout).
+//
+// SetShutdownTimeout will panic if called after Run.
+func SetShutdownTimeout(d time.Duration) {
+	DefaultServer().SetShutdownTimeout(d)
+}
+
+// SetShutdownTimeout sets how long the server waits for calls in progress when stopped,
+// as the SetShutdownTimeout function does.
+func (s *Server) SetShutdownTimeout(d time.Duration) {
+	if s.r.running {
+		panic("Do not call SetShutdownTimeout after Run")
+	}
+	s.r.shutdownTimeout = d
+}
+
+// Counts the calls in progress, so that they can complete before exiting.
+type drain struct {
+	mu      sync.Mutex
+	calls   int
+	closing bool
+	// Closed when closing and no call is in progress
+	idle chan struct{}
+}
+
+// Start a call. Returns false if the plugin is shutting down.
+func (d *drain) begin() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closing {
+		return false
+	}
+	d.calls++
+	return true
+}
+
+func (d *drain) end() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.calls--
+	if d.closing && d.calls == 0 {
+		close(d.idle)
+	}
+}
+
+func (d *drain) isClosing() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.closing
+}
+
+// Refuse further calls and wait up to timeout for the ones in progress.
+func (d *drain) close(timeout time.Duration) {
+	d.mu.Lock()
+	d.closing = true
+	d.idle = make(chan struct{})
+	if d.calls == 0 {
+		close(d.idle)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.idle:
+	case <-time.After(timeout):
+	}
+}
+
+// Drain the calls in progress, run the shutdown hooks and exit with status.
+func (r *rpcServer) shutdown(status int) {
+	timeout := r.shutdownTimeout
+	if timeout == 0 {
+		timeout = defaultShutdownTimeout
+	}
+	r.server.drain.close(timeout)
+	for _, fn := range r.shutdownHooks {
+		fn()
+	}
+	if r.embedded {
+		r.listener.Close()
+		return
+	}
+	os.Exit(status)
+}
@@ -0,0 +1,128 @@
+package pingo
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+var errUnknownEncoding = errors.New("Unknown encoding")
+
+// Encoding of the arguments and reply of a single call. See WithEncoding.
+type Encoding string
+
+const (
+	// Gob, as the rest of the connection. This is the default.
+	Gob Encoding = ""
+	// Gob, compressed with gzip.
+	CompressedGob Encoding = "gob+gzip"
+	// JSON, for values that do not encode well with gob.
+	JSON Encoding = "json"
+	// JSON, compressed with gzip.
+	CompressedJSON Encoding = "json+gzip"
+)
+
+// Metadata key of the encoding of a call.
+const encodingKey = "enc"
+
+type encodingCtxKey struct{}
+
+// WithEncoding returns a context making calls performed with it (see CallContext) use
+// the specified encoding for arguments and reply, instead of the default gob encoding of
+// the connection. Compression is worth it for methods moving large blobs; the plugin
+// answers in the same encoding.
+func WithEncoding(ctx context.Context, enc Encoding) context.Context {
+	return context.WithValue(ctx, encodingCtxKey{}, enc)
+}
+
+func (e Encoding) valid() bool {
+	switch e {
+	case Gob, CompressedGob, JSON, CompressedJSON:
+		return true
+	}
+	return false
+}
+
+func (e Encoding) compressed() bool {
+	return e == CompressedGob || e == CompressedJSON
+}
+
+func (e Encoding) marshal(v interface{}) ([]byte, error) {
+	if !e.valid() {
+		return nil, errUnknownEncoding
+	}
+
+	var buf bytes.Buffer
+	var w io.Writer = &buf
+	var zw *gzip.Writer
+	if e.compressed() {
+		zw = gzip.NewWriter(&buf)
+		w = zw
+	}
+
+	var err error
+	if e == JSON || e == CompressedJSON {
+		err = json.NewEncoder(w).Encode(v)
+	} else {
+		err = gob.NewEncoder(w).Encode(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if zw != nil {
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Decode data into v, if not nil, checking it against limits. Decompressed data larger
+// than max bytes is refused, if max is not zero.
+func (e Encoding) unmarshal(data []byte, v interface{}, max int, limits DecodeLimits) error {
+	if !e.valid() {
+		return errUnknownEncoding
+	}
+	if v == nil {
+		return nil
+	}
+
+	var r io.Reader = bytes.NewReader(data)
+	if e.compressed() {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+		if max > 0 {
+			r = newLimitReader(zr, max)
+		}
+	}
+
+	if e == JSON || e == CompressedJSON {
+		if limits == (DecodeLimits{}) {
+			return json.NewDecoder(r).Decode(v)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if err := limits.checkJSON(data); err != nil {
+			return err
+		}
+		return json.NewDecoder(bytes.NewReader(data)).Decode(v)
+	}
+	dec, scan := newGobDecoder(r, limits)
+	return scan.decode(dec, v, true)
+}
+
+// Return the encoding requested with the metadata of a call.
+func callEncoding(method string) Encoding {
+	_, md := splitMetadata(method)
+	return Encoding(md.Get(encodingKey))
+}
@@ -1,13 +1,16 @@
 package pingo
 
 import (
+	"encoding/json"
 	"errors"
 	"strings"
+	"syscall"
 )
 
 const (
 	errorCodeConnFailed = "err-connection-failed"
 	errorCodeHttpServe  = "err-http-serve"
+	errorCodeFallback   = "err-fallback"
 )
 
 // Error reported when connection to the external plugin has failed.
@@ -19,10 +22,103 @@ type ErrHttpServe error
 // Error reported when an invalid message is printed by the external plugin.
 type ErrInvalidMessage error
 
+// Error reported when a call is refused because the plugin has signaled to be overloaded.
+type ErrOverloaded error
+
+// Error reported when a plugin would use an insecure connection that options forbid.
+type ErrInsecure error
+
+// Error reported in strict mode when the response passed to a call cannot receive a reply.
+type ErrInvalidReply error
+
 // Error reported when the plugin fails to register before the registration
 // timeout expires.
 type ErrRegistrationTimeout error
 
+// FatalInfo details the error that made a plugin fail. Fatal errors reported by plugins
+// carry it when the plugin supports structured reports; for example:
+//
+//	if info, ok := err.(*pingo.FatalInfo); ok && info.Errno == "EADDRINUSE" {
+//		// No free port: retry later
+//	}
+type FatalInfo struct {
+	// Error code, for example "err-connection-failed"
+	Code string `json:"code"`
+	// Description of the error
+	Message string `json:"message"`
+	// Number of attempts made, if the operation was retried
+	Attempts int `json:"attempts,omitempty"`
+	// Last error returned by the operating system, if any
+	OSError string `json:"os_error,omitempty"`
+	// Symbolic name of the error number of OSError, if known: one of
+	// EADDRINUSE, EADDRNOTAVAIL, EACCES, EPERM, ENOENT, EROFS, ENOSPC
+	Errno string `json:"errno,omitempty"`
+}
+
+func (f *FatalInfo) Error() string {
+	if f.OSError != "" {
+		return f.Message + ": " + f.OSError
+	}
+	return f.Message
+}
+
+var errnoNames = []struct {
+	errno syscall.Errno
+	name  string
+}{
+	{syscall.EADDRINUSE, "EADDRINUSE"},
+	{syscall.EADDRNOTAVAIL, "EADDRNOTAVAIL"},
+	{syscall.EACCES, "EACCES"},
+	{syscall.EPERM, "EPERM"},
+	{syscall.ENOENT, "ENOENT"},
+	{syscall.EROFS, "EROFS"},
+	{syscall.ENOSPC, "ENOSPC"},
+}
+
+func newFatalInfo(code, msg string, attempts int, err error) *FatalInfo {
+	f := &FatalInfo{Code: code, Message: msg, Attempts: attempts}
+	if err != nil {
+		f.OSError = err.Error()
+		for _, e := range errnoNames {
+			if errors.Is(err, e.errno) {
+				f.Errno = e.name
+				break
+			}
+		}
+	}
+	return f
+}
+
+// Report a fatal error to the host, first as structured information, then in
+// the format understood by any host.
+func (h metaWriter) fatal(f *FatalInfo) {
+	if data, err := json.Marshal(f); err == nil {
+		h.output("fatal-info", string(data))
+	}
+	h.output("fatal", f.Code+": "+f.Error())
+}
+
+// Return the error reported with a fatal line, using info if reported just before it for
+// the same error.
+func parseFatal(line string, info *FatalInfo) error {
+	if info != nil && !strings.HasPrefix(line, info.Code+": ") {
+		info = nil
+	}
+	if info == nil {
+		if err := parseError(line); err != nil {
+			return err
+		}
+		return errors.New(line)
+	}
+	switch info.Code {
+	case errorCodeConnFailed:
+		return ErrConnectionFailed(info)
+	case errorCodeHttpServe:
+		return ErrHttpServe(info)
+	}
+	return info
+}
+
 func parseError(line string) error {
 	parts := strings.SplitN(line, ": ", 2)
 	if parts[0] == "" {
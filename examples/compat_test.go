@@ -0,0 +1,111 @@
+package examples
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/rpc"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+// Hosts use plugins built with the first version of pingo, which do not negotiate any
+// feature: calls fall back to the plain protocol.
+func TestLegacyPlugin(t *testing.T) {
+	exe := pingotest.Build(t, "./testdata/legacy")
+	for _, proto := range []string{"unix", "tcp"} {
+		p := pingo.NewPlugin(proto, exe)
+		p.SetOptions(pingo.Multiplex())
+		pingotest.Setup(t, p)
+		p.Start()
+
+		if f, err := p.Features(); err != nil || f != 0 {
+			t.Fatalf("Unexpected features over %s: %v, %v", proto, f, err)
+		}
+		var resp string
+		if err := p.Call("Plugin.SayHello", "old plugin", &resp); err != nil || resp != "Hello old plugin" {
+			t.Errorf("Unexpected response over %s: %q, %v", proto, resp, err)
+		}
+		if err := p.Call("Plugin.Fail", "failed", nil); err == nil || err.Error() != "failed" {
+			t.Errorf("Unexpected error over %s: %v", proto, err)
+		}
+
+		// Metadata, encodings and cancellation are not sent to the plugin.
+		ctx, cancel := context.WithTimeout(pingo.WithEncoding(context.Background(), pingo.CompressedJSON), time.Minute)
+		resp = ""
+		if err := p.CallContext(ctx, "Plugin.SayHello", "context", &resp); err != nil || resp != "Hello context" {
+			t.Errorf("Unexpected response with context over %s: %q, %v", proto, resp, err)
+		}
+		cancel()
+		if _, err := p.OpenStream(context.Background(), "Plugin.SayHello", ""); err == nil {
+			t.Errorf("Stream opened over %s", proto)
+		}
+	}
+}
+
+// Plugins are used by hosts built with the first version of pingo, which dial plain
+// net/rpc over HTTP and stop plugins with PingoRpc.Exit.
+func TestLegacyHost(t *testing.T) {
+	dir, err := os.MkdirTemp("", "pingotest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, proto := range []string{"unix", "tcp"} {
+		cmd := exec.Command(pingotest.Build(t, pkg+"pingo-kv"),
+			"-pingo:prefix=pingo-legacy", "-pingo:proto="+proto, "-pingo:unixdir="+dir)
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+
+		var ready string
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if line := scanner.Text(); strings.HasPrefix(line, "pingo-legacy: ready: ") {
+				ready = strings.TrimPrefix(line, "pingo-legacy: ready: ")
+				break
+			}
+		}
+		var rproto, addr string
+		if _, err := fmt.Sscanf(ready, "proto=%s addr=%s", &rproto, &addr); err != nil || rproto != proto {
+			cmd.Process.Kill()
+			t.Fatalf("Unexpected ready line over %s: %q", proto, ready)
+		}
+		go scanner.Scan()
+
+		client, err := rpc.DialHTTP(rproto, addr)
+		if err != nil {
+			cmd.Process.Kill()
+			t.Fatal(err)
+		}
+		var value string
+		if err := client.Call("KV.Set", Pair{"a", "1"}, new(int)); err != nil {
+			t.Error(err)
+		}
+		if err := client.Call("KV.Get", "a", &value); err != nil || value != "1" {
+			t.Errorf("Unexpected value over %s: %q, %v", proto, value, err)
+		}
+		// Errors are plain strings, as the host does not understand typed errors.
+		err = client.Call("KV.Get", "b", &value)
+		if serr, ok := err.(rpc.ServerError); !ok || string(serr) != "Key not found: b" {
+			t.Errorf("Unexpected error over %s: %#v", proto, err)
+		}
+
+		client.Call("PingoRpc.Exit", 0, new(int))
+		client.Close()
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("Plugin did not exit cleanly over %s: %v", proto, err)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+// Package examples runs the example plugins, as hosts would.
+package examples
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+const pkg = "github.com/dullgiulio/pingo/examples/"
+
+func TestHelloWorld(t *testing.T) {
+	for _, proto := range []string{"unix", "tcp"} {
+		p := pingo.NewPlugin(proto, pingotest.Build(t, pkg+"pingo-hello-world"))
+		pingotest.Setup(t, p)
+		p.Start()
+
+		var resp string
+		if err := p.Call("Plugin.SayHello", "Go developer", &resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp != "Hello Go developer" {
+			t.Errorf("Unexpected response over %s: %q", proto, resp)
+		}
+	}
+}
+
+// Same fields as the Pair of the plugin.
+type Pair struct {
+	Key, Value string
+}
+
+func TestKV(t *testing.T) {
+	p := pingotest.Start(t, pingotest.Build(t, pkg+"pingo-kv"))
+
+	for _, pair := range []Pair{{"b", "2"}, {"a", "1"}, {"c", "3"}} {
+		if err := p.Call("KV.Set", pair, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.Call("KV.Delete", "c", nil); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	if err := p.Call("KV.Keys", 0, &keys); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+	var value string
+	if err := p.Call("KV.Get", "b", &value); err != nil || value != "2" {
+		t.Errorf("Unexpected value of b: %q, %v", value, err)
+	}
+	if err := p.Call("KV.Get", "c", &value); err == nil {
+		t.Error("Deleted key was found")
+	}
+}
+
+func TestImageFilter(t *testing.T) {
+	p := pingotest.Start(t, pingotest.Build(t, pkg+"pingo-imagefilter"))
+
+	img := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			img.Set(x, y, color.RGBA{R: uint8(x * 4), G: uint8(y * 4), B: 128, A: 255})
+		}
+	}
+	var in bytes.Buffer
+	if err := png.Encode(&in, img); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := p.OpenStream(context.Background(), "Grayscale", in.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	out, err := png.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := out.(*image.Gray); !ok {
+		t.Fatalf("Image is not grayscale: %T", out)
+	}
+	if out.Bounds() != img.Bounds() {
+		t.Errorf("Unexpected bounds: %v", out.Bounds())
+	}
+
+	r, err = p.OpenStream(context.Background(), "Grayscale", []byte("not an image"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("Invalid image was filtered")
+	}
+}
+
+// Collects the lines logged by the plugin.
+type Logger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (l *Logger) Log(line string, unused *int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.lines = append(l.lines, line)
+	return nil
+}
+
+func TestLogger(t *testing.T) {
+	logger := &Logger{}
+	p := pingo.NewPlugin("unix", pingotest.Build(t, pkg+"pingo-logger"))
+	if err := p.RegisterCallback(logger); err != nil {
+		t.Fatal(err)
+	}
+	pingotest.Setup(t, p)
+	p.Start()
+
+	var done int
+	if err := p.Call("Worker.Run", 3, &done); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"step 1 of 3", "step 2 of 3", "step 3 of 3"}
+	if done != 3 || !reflect.DeepEqual(logger.lines, want) {
+		t.Errorf("Unexpected steps %d, logged %v", done, logger.lines)
+	}
+}
+
+// Calls storing values of different sizes, to measure the overhead of each transport.
+func BenchmarkCall(b *testing.B) {
+	exe := pingotest.Build(b, pkg+"pingo-kv")
+	for _, proto := range []string{"unix", "tcp"} {
+		p := pingo.NewPlugin(proto, exe)
+		pingotest.Setup(b, p)
+		p.Start()
+
+		for _, size := range []int{16, 4 << 10, 64 << 10} {
+			pair := Pair{Key: "k", Value: string(bytes.Repeat([]byte("v"), size))}
+			b.Run(fmt.Sprintf("%s/%d", proto, size), func(b *testing.B) {
+				b.SetBytes(int64(size))
+				for i := 0; i < b.N; i++ {
+					if err := p.Call("KV.Set", pair, nil); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,33 @@
+// Plugin converting images to grayscale, streaming the result to the host.
+package main
+
+import (
+	"bytes"
+	"context"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+
+	"github.com/dullgiulio/pingo"
+)
+
+// Decode the PNG image passed by the host and write it back in grayscale.
+func grayscale(ctx context.Context, args func(interface{}) error, w io.Writer) error {
+	var data []byte
+	if err := args(&data); err != nil {
+		return err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	gray := image.NewGray(img.Bounds())
+	draw.Draw(gray, gray.Bounds(), img, img.Bounds().Min, draw.Src)
+	return png.Encode(w, gray)
+}
+
+func main() {
+	pingo.RegisterStream("Grayscale", grayscale)
+	pingo.Run()
+}
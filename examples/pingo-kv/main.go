@@ -0,0 +1,70 @@
+// Plugin keeping a key-value store in memory.
+package main
+
+import (
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/dullgiulio/pingo"
+)
+
+// Pair is a key with its value.
+type Pair struct {
+	Key, Value string
+}
+
+type KV struct {
+	mu   sync.RWMutex
+	data map[string]string
+}
+
+// Set the value of a key.
+func (kv *KV) Set(p Pair, unused *int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.data[p.Key] = p.Value
+	return nil
+}
+
+// Get the value of a key; an error is returned if it is not set.
+func (kv *KV) Get(key string, value *string) error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	v, ok := kv.data[key]
+	if !ok {
+		return errors.New("Key not found: " + key)
+	}
+	*value = v
+	return nil
+}
+
+// Delete a key.
+func (kv *KV) Delete(key string, unused *int) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	delete(kv.data, key)
+	return nil
+}
+
+// Keys returns all keys, sorted.
+func (kv *KV) Keys(unused int, keys *[]string) error {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	list := make([]string, 0, len(kv.data))
+	for k := range kv.data {
+		list = append(list, k)
+	}
+	sort.Strings(list)
+	*keys = list
+	return nil
+}
+
+func main() {
+	pingo.Register(&KV{data: make(map[string]string)})
+	pingo.Run()
+}
@@ -0,0 +1,26 @@
+// Plugin logging its progress through the logger of the host.
+package main
+
+import (
+	"fmt"
+
+	"github.com/dullgiulio/pingo"
+)
+
+type Worker struct{}
+
+// Run performs the specified number of steps, logging each one on the host.
+func (w *Worker) Run(steps int, done *int) error {
+	for i := 1; i <= steps; i++ {
+		if err := pingo.Host().Call("Logger.Log", fmt.Sprintf("step %d of %d", i, steps), nil); err != nil {
+			return err
+		}
+		*done = i
+	}
+	return nil
+}
+
+func main() {
+	pingo.Register(&Worker{})
+	pingo.Run()
+}
@@ -0,0 +1,90 @@
+package examples
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+// Comments of the packets of a pcapng file written by the proxy.
+func pcapngComments(data []byte) []string {
+	var comments []string
+	for len(data) >= 12 {
+		kind := binary.LittleEndian.Uint32(data)
+		length := int(binary.LittleEndian.Uint32(data[4:]))
+		if length < 12 || length > len(data) {
+			break
+		}
+		if kind == 6 && length >= 32 {
+			captured := int(binary.LittleEndian.Uint32(data[20:]))
+			opts := data[28+(captured+3)&^3 : length-4]
+			for len(opts) >= 4 {
+				code := binary.LittleEndian.Uint16(opts)
+				n := int(binary.LittleEndian.Uint16(opts[2:]))
+				if code == 0 || 4+n > len(opts) {
+					break
+				}
+				if code == 1 {
+					comments = append(comments, string(opts[4:4+n]))
+				}
+				opts = opts[4+(n+3)&^3:]
+			}
+		}
+		data = data[length:]
+	}
+	return comments
+}
+
+// Plugins run behind the proxy, which records the frames exchanged with the host, including
+// those of secure plugins receiving their secret from the host.
+func TestProxy(t *testing.T) {
+	proxy := pingotest.Build(t, "github.com/dullgiulio/pingo/cmd/pingo")
+	hello := pingotest.Build(t, pkg+"pingo-hello-world")
+	dir := t.TempDir()
+
+	tests := []struct {
+		name   string
+		secure bool
+		mode   pingo.SecretMode
+		want   string
+	}{
+		{"plain", false, pingo.SecretOutput, "plugin>host Plugin.SayHello"},
+		{"secret-output", true, pingo.SecretOutput, "host>plugin encrypted"},
+		{"secret-pipe", true, pingo.SecretPipe, "host>plugin encrypted"},
+	}
+	for _, test := range tests {
+		record := filepath.Join(dir, test.name+".pcapng")
+		p := pingo.NewPlugin("unix", proxy, "proxy", "-record", record, hello)
+		p.SetSecure(test.secure)
+		p.SetOptions(pingo.SecretExchange(test.mode))
+		pingotest.Setup(t, p)
+		p.Start()
+
+		var resp string
+		if err := p.Call("Plugin.SayHello", test.name, &resp); err != nil || resp != "Hello "+test.name {
+			t.Fatalf("%s: unexpected response %q, %v", test.name, resp, err)
+		}
+
+		// Frames are recorded while relayed
+		var comments []string
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			data, err := os.ReadFile(record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			comments = pcapngComments(data)
+			if strings.Contains(strings.Join(comments, "\n"), test.want) {
+				break
+			}
+		}
+		if !strings.Contains(strings.Join(comments, "\n"), test.want) {
+			t.Errorf("%s: no frame %q recorded in %q", test.name, test.want, comments)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// Plugin speaking the protocol of the first version of pingo, before features were
+// negotiated: it serves net/rpc over HTTP and is shut down with PingoRpc.Exit.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"path/filepath"
+)
+
+type Plugin struct{}
+
+func (p *Plugin) SayHello(name string, msg *string) error {
+	*msg = "Hello " + name
+	return nil
+}
+
+func (p *Plugin) Fail(msg string, unused *int) error {
+	return errors.New(msg)
+}
+
+type PingoRpc struct{}
+
+func (s *PingoRpc) Exit(status int, unused *int) error {
+	os.Exit(status)
+	return nil
+}
+
+func main() {
+	proto := flag.String("pingo:proto", "unix", "Protocol to use: unix or tcp")
+	unixdir := flag.String("pingo:unixdir", "", "Alternative directory for unix socket")
+	prefix := flag.String("pingo:prefix", "pingo", "Prefix to output lines")
+	flag.Parse()
+
+	rpc.Register(&Plugin{})
+	rpc.Register(&PingoRpc{})
+	rpc.HandleHTTP()
+	fmt.Printf("%s: objects: Plugin, PingoRpc\n", *prefix)
+
+	var l net.Listener
+	var addr string
+	var err error
+	for i := 0; i < 500; i++ {
+		if *proto == "tcp" {
+			addr = fmt.Sprintf("127.0.0.1:%d", 1024+rand.Intn(60000))
+		} else {
+			addr = filepath.Join(*unixdir, fmt.Sprintf("%08x", rand.Uint32()))
+		}
+		if l, err = net.Listen(*proto, addr); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s: fatal: %s\n", *prefix, err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s: ready: proto=%s addr=%s\n", *prefix, *proto, addr)
+	http.Serve(l, nil)
+}
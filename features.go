@@ -0,0 +1,93 @@
+package pingo
+
+import (
+	"context"
+	"strings"
+)
+
+// Protocol features that host and plugin agree to use. Plugins announce the features
+// they support when started; the host only uses those supported by both sides, so that
+// hosts and plugins built with different versions of this package keep working.
+type Feature uint32
+
+const (
+	// Metadata sent with calls: bridged context values, deadlines and tenants.
+	FeatureMetadata Feature = 1 << iota
+	// Encodings of single calls, including compression (see WithEncoding).
+	FeatureEncoding
+	// Cancellation of calls whose context is done (see CallContext).
+	FeatureCancellation
+	// Streams (see OpenStream).
+	FeatureStreams
+	// Sessions multiplexed over a single connection (see Multiplex).
+	FeatureMultiplex
+	// Numeric IDs sent instead of the names of methods, from a table announced by the plugin.
+	FeatureMethodIDs
+)
+
+// Features supported by this version of the package.
+const supportedFeatures = FeatureMetadata | FeatureEncoding | FeatureCancellation | FeatureStreams |
+	FeatureMultiplex | FeatureMethodIDs
+
+var featureNames = []struct {
+	f    Feature
+	name string
+}{
+	{FeatureMetadata, "metadata"},
+	{FeatureEncoding, "encoding"},
+	{FeatureCancellation, "cancellation"},
+	{FeatureStreams, "streams"},
+	{FeatureMultiplex, "multiplex"},
+	{FeatureMethodIDs, "method-ids"},
+}
+
+// Has returns true if all features in f2 are in f.
+func (f Feature) Has(f2 Feature) bool {
+	return f&f2 == f2
+}
+
+func (f Feature) String() string {
+	var names []string
+	for _, n := range featureNames {
+		if f.Has(n.f) {
+			names = append(names, n.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// Parse a list of feature names. Unknown features are ignored.
+//
+// Plugins started with -pingo:features only announce the features listed, so that hosts
+// can be checked against plugins built with older versions: with an empty list, a plugin
+// behaves as one predating feature negotiation.
+func parseFeatures(s string) Feature {
+	var f Feature
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		for _, n := range featureNames {
+			if n.name == name {
+				f |= n.f
+			}
+		}
+	}
+	return f
+}
+
+// DisableFeatures prevents the host from using the specified protocol features, for
+// example to roll back a feature without rebuilding the plugins.
+func DisableFeatures(f Feature) Option {
+	return func(o *options) {
+		o.disabledFeatures |= f
+	}
+}
+
+// Features returns the protocol features negotiated with the plugin, waiting for it to
+// be ready. Plugins built with older versions do not announce any feature.
+func (p *Plugin) Features() (Feature, error) {
+	conn, err := p.request(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	return conn.features, nil
+}
@@ -0,0 +1,45 @@
+package pingo
+
+// UnixDir sets the directory where plugins using the unix protocol place their socket.
+// It is the same as SetSocketDirectory.
+func UnixDir(dir string) Option {
+	return func(o *options) {
+		o.unixdir = dir
+	}
+}
+
+// Prefix sets the prefix of the lines the plugin outputs for the host, instead of a
+// random one. The output of the plugin must never contain lines starting with the prefix
+// followed by a colon other than the ones printed by this package.
+func Prefix(name string) Option {
+	return func(o *options) {
+		o.prefix = name
+	}
+}
+
+// Flag passes "-pingo:name=value" to the plugin, for flags of the plugin without an option
+// of their own, or defined by newer versions of this package.
+func Flag(name, value string) Option {
+	return func(o *options) {
+		o.flags = append(o.flags, "-pingo:"+name+"="+value)
+	}
+}
+
+// SeparateArgs passes "--" between the flags used by this package and the parameters of
+// the plugin (see NewPlugin), so that the parameters are never parsed as flags of this
+// package. Plugins then find their parameters in flag.Args().
+func SeparateArgs() Option {
+	return func(o *options) {
+		o.separateArgs = true
+	}
+}
+
+// FlagsLast passes the flags used by this package after the parameters of the plugin
+// instead of before them, for plugins started through a command, such as "docker run",
+// that must not receive them itself (see Templates). Plugins find the flags of this package
+// anywhere in their arguments. SeparateArgs has no effect with FlagsLast.
+func FlagsLast() Option {
+	return func(o *options) {
+		o.flagsLast = true
+	}
+}
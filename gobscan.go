@@ -0,0 +1,507 @@
+package pingo
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+)
+
+// Messages larger than this are refused by gob.
+const gobTooBig = 1 << 30
+
+// Ids of the types predefined by gob.
+const (
+	gobBool = 1 + iota
+	gobInt
+	gobUint
+	gobFloat
+	gobBytes
+	gobString
+	gobComplex
+	gobInterface
+
+	gobFirstUserId = 64
+)
+
+// Kinds of the types defined in a gob stream.
+const (
+	gobArray = iota
+	gobSlice
+	gobStruct
+	gobMap
+	// GobEncoder, BinaryMarshaler or TextMarshaler
+	gobEncoded
+)
+
+var (
+	errGobCorrupt   = errors.New("gob: corrupted data")
+	errGobDuplicate = errors.New("gob: duplicate type received")
+	errGobUnknown   = errors.New("gob: unknown type id")
+)
+
+// Type defined in a gob stream.
+type gobType struct {
+	kind      int
+	key, elem int
+	len       int
+	fields    []int
+}
+
+// A gobScanner reads the messages of a gob stream ahead of the decoder reading from it,
+// and checks the values they hold against DecodeLimits before the decoder allocates them.
+// The scanner follows the structure of the stream as the gob decoder does, keeping track
+// of the types defined in it.
+type gobScanner struct {
+	r      io.Reader
+	limits DecodeLimits
+	types  map[int]*gobType
+	// Messages scanned and not yet read by the decoder
+	pending bytes.Buffer
+	// Rest of the message being scanned
+	msg []byte
+	// Whether the value is checked, its elements so far and the limit it exceeds
+	check    bool
+	elements int
+	exceeded error
+	// Error reading the stream
+	err error
+}
+
+// Return a decoder of the gob stream r, checking values against l if set.
+func newGobDecoder(r io.Reader, l DecodeLimits) (*gob.Decoder, *gobScanner) {
+	if l == (DecodeLimits{}) {
+		return gob.NewDecoder(r), nil
+	}
+	if _, ok := r.(io.ByteReader); !ok {
+		r = bufio.NewReader(r)
+	}
+	s := &gobScanner{r: r, limits: l, types: make(map[int]*gobType)}
+	return gob.NewDecoder(s), s
+}
+
+// Decode the next value of the stream into v, if not nil, checking it against the limits
+// if limited. Values failing the check are skipped.
+func (s *gobScanner) decode(dec *gob.Decoder, v interface{}, limited bool) error {
+	if s == nil {
+		return dec.Decode(v)
+	}
+	err := s.scan(limited && v != nil)
+	if err == nil {
+		return dec.Decode(v)
+	}
+	if s.err != nil {
+		return err
+	}
+	// Let the decoder skip the value, so that it knows the types defined with it.
+	if derr := dec.DecodeValue(reflect.Value{}); derr != nil && err != s.exceeded {
+		return derr
+	}
+	return err
+}
+
+// Limits of the scanner, if any.
+func (s *gobScanner) decodeLimits() DecodeLimits {
+	if s == nil {
+		return DecodeLimits{}
+	}
+	return s.limits
+}
+
+func (s *gobScanner) Read(b []byte) (int, error) {
+	if s.pending.Len() == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return s.pending.Read(b)
+}
+
+func (s *gobScanner) ReadByte() (byte, error) {
+	if s.pending.Len() == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return s.pending.ReadByte()
+}
+
+// Read the messages of the next value, checking the value if check is set.
+func (s *gobScanner) scan(check bool) error {
+	s.pending.Reset()
+	s.msg = nil
+	s.check, s.elements, s.exceeded = check, 0, nil
+	id, err := s.typeSequence(false)
+	if err == nil {
+		err = s.value(id, 0)
+	}
+	if err == nil {
+		err = s.exceeded
+	}
+	return err
+}
+
+// Record that the value exceeds the limits. The rest of the value is still scanned for
+// the types it defines.
+func (s *gobScanner) exceed(err error) {
+	s.check = false
+	s.exceeded = err
+}
+
+// Read the next message from the stream.
+func (s *gobScanner) readMessage() error {
+	if s.err != nil {
+		return s.err
+	}
+	var count [9]byte
+	if _, s.err = io.ReadFull(s.r, count[:1]); s.err != nil {
+		return s.err
+	}
+	width := 0
+	size := uint64(count[0])
+	if count[0] > 0x7f {
+		width = -int(int8(count[0]))
+		if width > 8 {
+			s.err = errGobCorrupt
+			return s.err
+		}
+		if _, s.err = io.ReadFull(s.r, count[1:1+width]); s.err != nil {
+			if s.err == io.EOF {
+				s.err = io.ErrUnexpectedEOF
+			}
+			return s.err
+		}
+		size = 0
+		for _, b := range count[1 : 1+width] {
+			size = size<<8 | uint64(b)
+		}
+	}
+	if size >= gobTooBig {
+		s.err = errGobCorrupt
+		return s.err
+	}
+	s.pending.Write(count[:1+width])
+	start := s.pending.Len()
+	// The buffer grows with the data actually read, not with the size announced.
+	n, err := s.pending.ReadFrom(&io.LimitedReader{R: s.r, N: int64(size)})
+	if err == nil && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		s.err = err
+		return err
+	}
+	s.msg = s.pending.Bytes()[start:]
+	return nil
+}
+
+// Read type definitions until the id of a value, as the decoder does.
+func (s *gobScanner) typeSequence(iface bool) (int, error) {
+	first := true
+	for {
+		if len(s.msg) == 0 {
+			if err := s.readMessage(); err != nil {
+				if err == io.EOF && !first {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+		n, err := s.int()
+		if err != nil {
+			return 0, err
+		}
+		id := int(int32(n))
+		if id >= 0 {
+			return id, nil
+		}
+		if err := s.define(-id); err != nil {
+			return 0, err
+		}
+		// In interfaces, the byte count of the value can follow.
+		if len(s.msg) > 0 {
+			if !iface {
+				return 0, errGobCorrupt
+			}
+			if _, err := s.uint(); err != nil {
+				return 0, err
+			}
+		}
+		first = false
+	}
+}
+
+func (s *gobScanner) uint() (uint64, error) {
+	if len(s.msg) == 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	b := s.msg[0]
+	s.msg = s.msg[1:]
+	if b <= 0x7f {
+		return uint64(b), nil
+	}
+	n := -int(int8(b))
+	if n > 8 || n > len(s.msg) {
+		return 0, errGobCorrupt
+	}
+	var x uint64
+	for _, b := range s.msg[:n] {
+		x = x<<8 | uint64(b)
+	}
+	s.msg = s.msg[n:]
+	return x, nil
+}
+
+func (s *gobScanner) int() (int64, error) {
+	x, err := s.uint()
+	i := int64(x >> 1)
+	if x&1 != 0 {
+		i = ^i
+	}
+	return i, err
+}
+
+func (s *gobScanner) typeId(id *int) error {
+	n, err := s.int()
+	*id = int(int32(n))
+	return err
+}
+
+// Skip a length and the bytes following it.
+func (s *gobScanner) skipBytes() error {
+	n, err := s.uint()
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(s.msg)) {
+		return errGobCorrupt
+	}
+	s.msg = s.msg[n:]
+	return nil
+}
+
+// Read a struct, calling field with the number of each field present.
+func (s *gobScanner) fields(field func(n int) error) error {
+	n := -1
+	for len(s.msg) > 0 {
+		delta, err := s.uint()
+		if err != nil {
+			return err
+		}
+		if delta == 0 {
+			return nil
+		}
+		if delta > math.MaxInt32 {
+			return errGobCorrupt
+		}
+		n += int(delta)
+		if err := field(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read the definition of type id, a wireType of the gob package.
+func (s *gobScanner) define(id int) error {
+	if id < gobFirstUserId || s.types[id] != nil {
+		return errGobDuplicate
+	}
+	t := &gobType{kind: -1}
+	// CommonType: name and id
+	common := func(n int) error {
+		switch n {
+		case 0:
+			return s.skipBytes()
+		case 1:
+			_, err := s.int()
+			return err
+		}
+		return errGobCorrupt
+	}
+	// Fields of the type definitions, after their CommonType
+	def := func(ids ...*int) func(n int) error {
+		return func(n int) error {
+			if n == 0 {
+				return s.fields(common)
+			}
+			if n > len(ids) {
+				return errGobCorrupt
+			}
+			return s.typeId(ids[n-1])
+		}
+	}
+	field := func(n int) error {
+		var id int
+		switch n {
+		case 0:
+			return s.skipBytes()
+		case 1:
+			err := s.typeId(&id)
+			t.fields = append(t.fields, id)
+			return err
+		}
+		return errGobCorrupt
+	}
+	err := s.fields(func(n int) error {
+		switch n {
+		case 0:
+			t.kind = gobArray
+			return s.fields(def(&t.elem, &t.len))
+		case 1:
+			t.kind = gobSlice
+			return s.fields(def(&t.elem))
+		case 2:
+			t.kind = gobStruct
+			return s.fields(func(n int) error {
+				if n != 1 {
+					return def()(n)
+				}
+				count, err := s.uint()
+				for i := uint64(0); err == nil && i < count; i++ {
+					if len(s.msg) == 0 {
+						return errGobCorrupt
+					}
+					// Fields not present are recorded as unknown types.
+					before := len(t.fields)
+					if err = s.fields(field); err == nil && len(t.fields) == before {
+						t.fields = append(t.fields, 0)
+					}
+				}
+				return err
+			})
+		case 3:
+			t.kind = gobMap
+			return s.fields(def(&t.key, &t.elem))
+		case 4, 5, 6:
+			t.kind = gobEncoded
+			return s.fields(def())
+		}
+		return errGobCorrupt
+	})
+	if err != nil {
+		return err
+	}
+	if t.kind < 0 {
+		return errGobCorrupt
+	}
+	s.types[id] = t
+	return nil
+}
+
+// Read a value of type id at the top level of a message or of an interface.
+func (s *gobScanner) value(id, depth int) error {
+	if t := s.types[id]; t != nil && t.kind == gobStruct {
+		return s.structValue(t, depth)
+	}
+	if delta, err := s.uint(); err != nil || delta != 0 {
+		return errGobCorrupt
+	}
+	return s.elem(id, depth)
+}
+
+// Read a value of type id.
+func (s *gobScanner) elem(id, depth int) error {
+	switch id {
+	case gobBool, gobInt, gobUint, gobFloat:
+		_, err := s.uint()
+		return err
+	case gobComplex:
+		if _, err := s.uint(); err != nil {
+			return err
+		}
+		_, err := s.uint()
+		return err
+	case gobBytes, gobString:
+		return s.skipBytes()
+	case gobInterface:
+		return s.iface(depth)
+	}
+	t := s.types[id]
+	if t == nil {
+		return errGobUnknown
+	}
+	switch t.kind {
+	case gobStruct:
+		return s.structValue(t, depth)
+	case gobArray, gobSlice:
+		n, err := s.uint()
+		if err != nil {
+			return err
+		}
+		if t.kind == gobArray && n != uint64(t.len) {
+			return errGobCorrupt
+		}
+		// Arrays of uint include arrays of bytes, whose elements are not counted.
+		return s.elems(n, depth, t.kind == gobArray && t.elem == gobUint, t.elem, 0)
+	case gobMap:
+		n, err := s.uint()
+		if err != nil {
+			return err
+		}
+		return s.elems(n, depth, false, t.key, t.elem)
+	}
+	return s.skipBytes()
+}
+
+func (s *gobScanner) structValue(t *gobType, depth int) error {
+	if s.check && s.limits.MaxDepth > 0 && depth >= s.limits.MaxDepth {
+		s.exceed(errDecodeDepth)
+	}
+	return s.fields(func(n int) error {
+		if n >= len(t.fields) {
+			return errGobCorrupt
+		}
+		return s.elem(t.fields[n], depth+1)
+	})
+}
+
+// Read the n elements of a container at depth, pairs of key and elem if elem is set.
+func (s *gobScanner) elems(n uint64, depth int, uncounted bool, key, elem int) error {
+	if s.check && !uncounted {
+		if s.limits.MaxDepth > 0 && depth >= s.limits.MaxDepth {
+			s.exceed(errDecodeDepth)
+		} else if s.limits.MaxElements > 0 && n > uint64(s.limits.MaxElements-s.elements) {
+			s.exceed(errDecodeElements)
+		} else {
+			s.elements += int(n)
+		}
+	}
+	for i := uint64(0); i < n; i++ {
+		if len(s.msg) == 0 {
+			return errGobCorrupt
+		}
+		if err := s.elem(key, depth+1); err != nil {
+			return err
+		}
+		if elem == 0 {
+			continue
+		}
+		if err := s.elem(elem, depth+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Read an interface value: the name of its concrete type, its type id and the value.
+func (s *gobScanner) iface(depth int) error {
+	n, err := s.uint()
+	if err != nil {
+		return err
+	}
+	if n > uint64(len(s.msg)) {
+		return errGobCorrupt
+	}
+	s.msg = s.msg[n:]
+	if n == 0 {
+		return nil
+	}
+	id, err := s.typeSequence(true)
+	if err != nil {
+		return err
+	}
+	if _, err := s.uint(); err != nil {
+		return err
+	}
+	return s.value(id, depth)
+}
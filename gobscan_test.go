@@ -0,0 +1,155 @@
+package pingo
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type scanNode struct {
+	Name  string
+	Next  *scanNode
+	Items []int
+}
+
+type scanShape interface{}
+
+type scanValue struct {
+	Flag    bool
+	Num     int64
+	Ratio   float64
+	C       complex128
+	Data    []byte
+	Hash    [4]byte
+	Pairs   [2]string
+	Nodes   []scanNode
+	Index   map[string][]int
+	Any     scanShape
+	Anys    []scanShape
+	When    time.Time
+	Ignored chan int
+}
+
+// Subset of scanValue, so that the other fields are skipped when decoding.
+type scanPartial struct {
+	Num   int64
+	Nodes []scanNode
+}
+
+func init() {
+	gob.Register(scanNode{})
+	gob.Register(&scanValue{})
+	gob.Register(map[int]scanShape{})
+}
+
+func scanValues() []interface{} {
+	deep := &scanNode{Name: "0"}
+	for i := 1; i < 10; i++ {
+		deep = &scanNode{Name: string(rune('0' + i)), Next: deep}
+	}
+	full := scanValue{
+		Flag: true, Num: -42, Ratio: 0.5, C: complex(1, -1),
+		Data:  []byte("data"),
+		Hash:  [4]byte{1, 2, 3, 4},
+		Pairs: [2]string{"a", "b"},
+		Nodes: []scanNode{{Name: "a", Items: []int{1, 2, 3}}, *deep},
+		Index: map[string][]int{"x": {1}, "y": {2, 3}},
+		Any:   scanNode{Name: "any"},
+		Anys:  []scanShape{1, "two", map[int]scanShape{3: scanNode{Items: []int{4}}}},
+		When:  time.Unix(1, 0).UTC(),
+	}
+	nested := full
+	nested.Any = &full
+	return []interface{}{
+		42, "string", []int{1, 2, 3}, map[string]int{"a": 1}, deep, full, nested,
+		scanValue{}, []scanShape{nil, full},
+	}
+}
+
+// Values decoded through the scanner are decoded as by gob, and exceed the limits when
+// they fail the check of decoded values.
+func TestGobScanner(t *testing.T) {
+	limits := []DecodeLimits{
+		{MaxDepth: 1}, {MaxDepth: 2}, {MaxDepth: 3}, {MaxDepth: 5}, {MaxDepth: 64},
+		{MaxElements: 1}, {MaxElements: 3}, {MaxElements: 10}, {MaxElements: 100},
+	}
+	for _, l := range limits {
+		// All values on the same stream, so that types defined earlier are reused.
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		values := scanValues()
+		for _, v := range values {
+			if err := enc.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, v := range values {
+			if err := enc.Encode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+		dec, scan := newGobDecoder(&buf, l)
+		plain := gob.NewDecoder(bytes.NewReader(buf.Bytes()))
+		for i := 0; i < 2*len(values); i++ {
+			v := values[i%len(values)]
+			got := reflect.New(reflect.TypeOf(v))
+			want := reflect.New(reflect.TypeOf(v))
+			if err := plain.Decode(want.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			err := scan.decode(dec, got.Interface(), true)
+			if werr := l.check(want.Interface()); err != werr {
+				t.Fatalf("%+v: value %d: got error %v, want %v", l, i, err, werr)
+			}
+			if err == nil && !reflect.DeepEqual(got.Interface(), want.Interface()) {
+				t.Fatalf("%+v: value %d: got %+v, want %+v", l, i, got.Elem(), want.Elem())
+			}
+		}
+	}
+}
+
+// Fields skipped by the decoder are scanned too.
+func TestGobScannerIgnored(t *testing.T) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(scanValues()[5]); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	dec, scan := newGobDecoder(bytes.NewReader(data), DecodeLimits{MaxDepth: 64, MaxElements: 100})
+	var v scanPartial
+	if err := scan.decode(dec, &v, true); err != nil {
+		t.Fatal(err)
+	}
+	if v.Num != -42 || len(v.Nodes) != 2 {
+		t.Errorf("Unexpected value %+v", v)
+	}
+	dec, scan = newGobDecoder(bytes.NewReader(data), DecodeLimits{MaxElements: 10})
+	if err := scan.decode(dec, &v, true); err != errDecodeElements {
+		t.Errorf("Expected error for elements of skipped fields, got %v", err)
+	}
+}
+
+func TestCheckJSON(t *testing.T) {
+	tests := []struct {
+		data string
+		l    DecodeLimits
+		err  error
+	}{
+		{`1`, DecodeLimits{MaxDepth: 1, MaxElements: 1}, nil},
+		{`[1,2]`, DecodeLimits{MaxElements: 2}, nil},
+		{`[1,2,3]`, DecodeLimits{MaxElements: 2}, errDecodeElements},
+		{`{"a":[1],"b":{}}`, DecodeLimits{MaxElements: 3}, nil},
+		{`{"a":[1,2],"b":{}}`, DecodeLimits{MaxElements: 3}, errDecodeElements},
+		{`[[1]]`, DecodeLimits{MaxDepth: 2}, nil},
+		{`[[[1]]]`, DecodeLimits{MaxDepth: 2}, errDecodeDepth},
+		{`{"a":{"b":{}}}`, DecodeLimits{MaxDepth: 2}, errDecodeDepth},
+		{`[1] [1,2,3]`, DecodeLimits{MaxElements: 1}, nil},
+	}
+	for _, test := range tests {
+		if err := test.l.checkJSON([]byte(test.data)); err != test.err {
+			t.Errorf("%s with %+v: got error %v, want %v", test.data, test.l, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package pingo
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const (
+	// Identifies the handshake of a pingo plugin.
+	handshakeMagic = "pingo-rpc"
+	// Version of the protocol between host and plugin. Hosts refuse plugins speaking a
+	// version they do not know; it must only change for incompatible changes, as the
+	// compatible ones are negotiated as features.
+	protocolVersion = 1
+)
+
+var errHandshakeMagic = ErrHandshake(errors.New("Plugin sent an invalid handshake"))
+
+// Error reported when host and plugin speak incompatible versions of the protocol.
+type ErrProtocolVersion error
+
+// Describes the protocol spoken by a plugin. The plugin sends it before being ready;
+// plugins built with older versions do not send it.
+type hello struct {
+	Magic   string   `json:"magic"`
+	Version int      `json:"version"`
+	Codecs  []string `json:"codecs"`
+	Objects []string `json:"objects"`
+	Streams []string `json:"streams,omitempty"`
+	// Connections are closed by limits, so that the host must dial new ones
+	Redial bool `json:"redial,omitempty"`
+}
+
+// Handshake describing this plugin.
+func (r *rpcServer) hello() string {
+	codecs := make([]string, 0, len(r.codecs))
+	for name := range r.codecs {
+		codecs = append(codecs, name)
+	}
+	sort.Strings(codecs)
+	streams := make([]string, 0, len(r.streams))
+	for name := range r.streams {
+		streams = append(streams, name)
+	}
+	sort.Strings(streams)
+	b, _ := json.Marshal(&hello{
+		Magic:   handshakeMagic,
+		Version: protocolVersion,
+		Codecs:  codecs,
+		Objects: r.objs,
+		Streams: streams,
+		Redial:  r.limits.IdleTimeout > 0 || r.limits.MaxRequests > 0,
+	})
+	return string(b)
+}
+
+// Validate the handshake sent by the plugin.
+func (c *ctrl) checkHello(val string) error {
+	h := &hello{}
+	if err := json.Unmarshal([]byte(val), h); err != nil || h.Magic != handshakeMagic {
+		return errHandshakeMagic
+	}
+	if h.Version != protocolVersion {
+		return ErrProtocolVersion(fmt.Errorf("Plugin speaks protocol version %d, host speaks version %d",
+			h.Version, protocolVersion))
+	}
+	if !h.hasCodec("gob") {
+		return ErrProtocolVersion(errors.New("Plugin does not serve the gob codec"))
+	}
+	c.hello = h
+	return nil
+}
+
+func (h *hello) hasCodec(name string) bool {
+	for _, c := range h.Codecs {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
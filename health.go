@@ -0,0 +1,243 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"strings"
+	"time"
+)
+
+// Error reported when the health check of a plugin fails. See SetHealthCheck.
+type ErrUnhealthy error
+
+// SetHealthCheck sets a function reporting whether the plugin is currently able to serve
+// calls, for example that its connection pool is not exhausted. Unlike the self test, it is
+// run on request of the host at any time (see Plugin.Health) and should be quick.
+//
+// SetHealthCheck will panic if called after Run.
+func SetHealthCheck(check func() error) {
+	DefaultServer().SetHealthCheck(check)
+}
+
+// SetHealthCheck sets the health check of the server, as the SetHealthCheck function
+// does.
+func (s *Server) SetHealthCheck(check func() error) {
+	if s.r.running {
+		panic("Do not call SetHealthCheck after Run")
+	}
+	s.r.healthCheck = check
+}
+
+// Internal RPC call answered without running any code of the plugin. Do not call manually.
+func (s *PingoRpc) Ping(unused int, unusedReply *int) error {
+	return nil
+}
+
+// Internal RPC call to run the health check of the plugin. Do not call manually.
+func (s *PingoRpc) Health(unused int, unusedReply *int) error {
+	if s.server().healthCheck == nil {
+		return nil
+	}
+	return s.server().healthCheck()
+}
+
+// Plugins built with older versions do not know the call, but answered it.
+func isUnknownMethod(err error) bool {
+	var serr rpc.ServerError
+	return errors.As(err, &serr) && strings.HasPrefix(string(serr), "rpc: can't find method")
+}
+
+// Ping performs a call that the plugin answers without running any of its code and returns
+// the time it took, which includes waiting for the plugin to be ready.
+func (p *Plugin) Ping(ctx context.Context) (time.Duration, error) {
+	var unused int
+	start := time.Now()
+	err := callContext(ctx, p, internalObject+".Ping", 0, &unused)
+	if isUnknownMethod(err) {
+		err = nil
+	}
+	return time.Since(start), err
+}
+
+// Health runs the health check of the plugin (see SetHealthCheck), waiting for the plugin
+// to be ready. Plugins without a health check are healthy. If the check fails, an
+// ErrUnhealthy error is returned.
+func (p *Plugin) Health(ctx context.Context) error {
+	var unused int
+	err := callContext(ctx, p, internalObject+".Health", 0, &unused)
+	if isUnknownMethod(err) {
+		return nil
+	}
+	if isMethodError(err) {
+		return ErrUnhealthy(fmt.Errorf("Plugin is unhealthy: %w", err))
+	}
+	return err
+}
+
+// Watchdog periodically pings the plugins of a Manager (see Plugin.Ping) to detect plugins
+// that have become unresponsive. Plugins paused with Pause are not pinged.
+type Watchdog struct {
+	// Interval between pings; if not positive, ten seconds.
+	Every time.Duration
+	// Time after which a ping fails, not counting the wait for the plugin to be ready;
+	// if not positive, Every.
+	Timeout time.Duration
+	// Called with the time each successful ping took, if not nil.
+	Latency func(plugin string, d time.Duration)
+	// Called when a ping fails, if not nil.
+	Unresponsive func(plugin string, err error)
+	// Restart plugins whose ping fails. Plugins that do not exit within their timeout
+	// (see SetTimeout) are killed.
+	Restart bool
+}
+
+// SetWatchdog starts pinging plugins when the manager is started, or immediately if the
+// manager is running already. A previous watchdog is stopped; nil stops pinging plugins.
+func (m *Manager) SetWatchdog(w *Watchdog) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopWatchdog()
+	m.watchdog = w
+	if m.running {
+		m.startWatchdog()
+	}
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) startWatchdog() {
+	if m.watchdog == nil {
+		return
+	}
+	m.watchdogStop = make(chan struct{})
+	go m.watchdog.run(m, m.watchdogStop)
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) stopWatchdog() {
+	if m.watchdogStop != nil {
+		close(m.watchdogStop)
+		m.watchdogStop = nil
+	}
+}
+
+// Interval between pings if not set.
+const defaultWatchdogEvery = 10 * time.Second
+
+func (w *Watchdog) every() time.Duration {
+	if w.Every <= 0 {
+		return defaultWatchdogEvery
+	}
+	return w.Every
+}
+
+func (w *Watchdog) run(m *Manager, stop <-chan struct{}) {
+	ticker := time.NewTicker(w.every())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		for _, name := range m.Names() {
+			w.check(m, name, stop)
+		}
+	}
+}
+
+// Ping the named plugin, restarting it if it does not answer.
+func (w *Watchdog) check(m *Manager, name string, stop <-chan struct{}) {
+	p := m.Plugin(name)
+	if p == nil || p.pause.paused() {
+		return
+	}
+	timeout := w.Timeout
+	if timeout <= 0 {
+		timeout = w.every()
+	}
+	// A plugin that is slow to start is not unresponsive: its start has a timeout of its own
+	d, err := time.Duration(0), w.ready(p, p.initTimeout+timeout, stop)
+	if err == errWatchdogStopped {
+		return
+	}
+	if err == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		d, err = p.Ping(ctx)
+		cancel()
+	}
+	if err == nil {
+		if w.Latency != nil {
+			w.Latency(name, d)
+		}
+		return
+	}
+	if w.Unresponsive != nil {
+		w.Unresponsive(name, err)
+	}
+	if w.Restart {
+		m.restart(name, p, stop)
+	}
+}
+
+var errWatchdogStopped = errors.New("Watchdog stopped")
+
+// Wait for the plugin to be ready, for at most timeout or until the watchdog is stopped.
+func (w *Watchdog) ready(p *Plugin, timeout time.Duration, stop <-chan struct{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	_, err := p.request(ctx)
+	select {
+	case <-stop:
+		return errWatchdogStopped
+	default:
+	}
+	return err
+}
+
+// Restart the named plugin, unless it was removed or the watchdog was stopped meanwhile.
+// The manager is not locked while the plugin stops.
+func (m *Manager) restart(name string, p *Plugin, stop <-chan struct{}) {
+	if !m.restartable(name, p, stop) {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), p.exitTimeout)
+	// Do not leave the unresponsive process for the next start to reuse
+	p.stop(ctx, false)
+	cancel()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.restartableLocked(name, p, stop) {
+		p.Start()
+		m.startSelfTest(name, p)
+	}
+}
+
+func (m *Manager) restartable(name string, p *Plugin, stop <-chan struct{}) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.restartableLocked(name, p, stop)
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) restartableLocked(name string, p *Plugin, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	return m.plugins[name] == p
+}
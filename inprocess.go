@@ -0,0 +1,201 @@
+package pingo
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Protocol of plugins served in the process of the host, over in-memory pipes.
+const pipeProto = "pipe"
+
+var errInProcessKilled = errors.New("In-process plugin killed")
+
+// NewInProcessPlugin returns a plugin served in the process of the host, so that hosts and
+// plugins can be tested together without building and starting an executable. Each time
+// the plugin is started, setup is called with a new server to register objects on and to
+// set up as the main function of a plugin would before calling Run; the server then runs
+// in the process, and connections to it are in-memory pipes (see net.Pipe).
+//
+// The server is configured by the host as a plugin process would be, with the same flags.
+// Secrets are always exchanged via output, and killing the plugin, as when a call times
+// out with KillOnTimeout, closes all its connections at once. The settings of the process,
+// such as memory limits and the watchdog, are not applied, as the process is the host's.
+func NewInProcessPlugin(setup func(s *Server)) *Plugin {
+	p := newPlugin(pipeProto, "in-process")
+	p.inProcessSetup = setup
+	return p
+}
+
+// A server running in the process of the host.
+type inProcess struct {
+	r      *rpcServer
+	killed chan struct{}
+	once   sync.Once
+}
+
+// Stop serving at once, as killing a process would.
+func (ip *inProcess) kill() {
+	ip.once.Do(func() {
+		close(ip.killed)
+		go func() {
+			<-ip.r.listening
+			if ip.r.listener != nil {
+				ip.r.listener.Close()
+			}
+		}()
+	})
+}
+
+// Run the server of an in-process plugin configured with params, as wait runs the process
+// of other plugins.
+func (c *ctrl) serveInProcess(pidCh chan<- int, params []string) {
+	defer close(c.waitCh)
+	close(pidCh)
+
+	conf := newConfig()
+	conf.args = params
+	ip := &inProcess{r: newRpcServer(conf), killed: make(chan struct{})}
+	ip.r.embedded = true
+	ip.r.jobsSecret = c.jobsSecret
+	pr, pw := io.Pipe()
+	ip.r.out = pw
+	c.p.inProcess.Store(ip)
+	c.p.inProcessSetup(&Server{r: ip.r})
+
+	done := make(chan struct{})
+	go func() {
+		c.readOutput(pr, Stdout)
+		close(done)
+	}()
+	err := ip.r.parseAndRun()
+	pw.Close()
+	<-done
+
+	select {
+	case <-ip.killed:
+		err = errInProcessKilled
+	default:
+	}
+	c.waitCh <- err
+}
+
+// Kill the in-process server of the plugin, if running.
+func (p *Plugin) killInProcess() {
+	if ip, ok := p.inProcess.Load().(*inProcess); ok {
+		ip.kill()
+	}
+}
+
+// Listeners of in-process servers, by address.
+var pipeListeners sync.Map
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string {
+	return pipeProto
+}
+
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// A listener of the connections opened by dialPipe. Closing it closes all connections it
+// accepted, as if the process of the plugin had exited.
+type pipeListener struct {
+	addr   pipeAddr
+	connCh chan net.Conn
+	closed chan struct{}
+
+	mu    sync.Mutex
+	conns map[*pipeConn]struct{}
+	done  bool
+}
+
+func listenPipe() *pipeListener {
+	l := &pipeListener{
+		addr:   pipeAddr("inprocess-" + randstr(8)),
+		connCh: make(chan net.Conn),
+		closed: make(chan struct{}),
+		conns:  make(map[*pipeConn]struct{}),
+	}
+	pipeListeners.Store(string(l.addr), l)
+	return l
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.connCh:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.done {
+		return nil
+	}
+	l.done = true
+	pipeListeners.Delete(string(l.addr))
+	close(l.closed)
+	for c := range l.conns {
+		c.Conn.Close()
+	}
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return l.addr
+}
+
+// Connection accepted by a pipeListener.
+type pipeConn struct {
+	net.Conn
+	l *pipeListener
+}
+
+func (c *pipeConn) Close() error {
+	c.l.mu.Lock()
+	delete(c.l.conns, c)
+	c.l.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// Connect to the in-process server listening at addr.
+func dialPipe(addr string) (net.Conn, error) {
+	v, ok := pipeListeners.Load(addr)
+	if !ok {
+		return nil, errors.New("No in-process plugin listening at " + addr)
+	}
+	l := v.(*pipeListener)
+	client, server := net.Pipe()
+	sconn := &pipeConn{Conn: server, l: l}
+
+	l.mu.Lock()
+	if l.done {
+		l.mu.Unlock()
+		return nil, net.ErrClosed
+	}
+	l.conns[sconn] = struct{}{}
+	l.mu.Unlock()
+
+	select {
+	case l.connCh <- sconn:
+		return client, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+// Connect to a plugin listening with proto at addr.
+func dial(proto, addr string) (net.Conn, error) {
+	if proto == pipeProto {
+		return dialPipe(addr)
+	}
+	return net.Dial(proto, addr)
+}
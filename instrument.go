@@ -0,0 +1,83 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ServeStats describes a connection or a call served by the plugin.
+type ServeStats struct {
+	// Connection the call was received on, or the connection itself
+	Conn *ConnInfo
+	// Method called, empty for connections
+	Method string
+	// Tenant of the call, if any (see WithTenant)
+	Tenant string
+	// Time the call or the connection started and its duration
+	Start    time.Time
+	Duration time.Duration
+	// Error returned by the method, or the error that caused the handshake of a
+	// connection to fail
+	Err error
+}
+
+// Instrumentation contains hooks called by the serve loop of a plugin, to integrate
+// tracing or metrics systems. Any hook can be nil.
+type Instrumentation struct {
+	// Called before a method is called. The returned context is passed to the method,
+	// if it takes one, and to CallDone.
+	CallStart func(ctx context.Context, conn *ConnInfo, method string) context.Context
+	// Called after a method has returned.
+	CallDone func(ctx context.Context, stats *ServeStats)
+	// Called when a connection is closed, or when its handshake fails.
+	ConnDone func(stats *ServeStats)
+}
+
+// SetInstrumentation sets the hooks called when serving connections and calls.
+//
+// SetInstrumentation will panic if called after Run.
+func SetInstrumentation(in Instrumentation) {
+	DefaultServer().SetInstrumentation(in)
+}
+
+// SetInstrumentation sets the hooks of the server, as the SetInstrumentation function
+// does.
+func (s *Server) SetInstrumentation(in Instrumentation) {
+	if s.r.running {
+		panic("Do not call SetInstrumentation after Run")
+	}
+	s.r.server.instr = in
+}
+
+func (in *Instrumentation) callStart(ctx context.Context, conn *ConnInfo, method string) context.Context {
+	if in.CallStart == nil {
+		return ctx
+	}
+	return in.CallStart(ctx, conn, method)
+}
+
+func (in *Instrumentation) callDone(ctx context.Context, conn *ConnInfo, method string, start time.Time, errmsg string) {
+	if in.CallDone == nil {
+		return
+	}
+	var err error
+	if errmsg != "" {
+		err = errors.New(errmsg)
+	}
+	in.CallDone(ctx, &ServeStats{
+		Conn:     conn,
+		Method:   method,
+		Tenant:   Tenant(ctx),
+		Start:    start,
+		Duration: time.Since(start),
+		Err:      err,
+	})
+}
+
+func (in *Instrumentation) connDone(conn *ConnInfo, start time.Time, err error) {
+	if in.ConnDone == nil {
+		return
+	}
+	in.ConnDone(&ServeStats{Conn: conn, Start: start, Duration: time.Since(start), Err: err})
+}
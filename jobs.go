@@ -0,0 +1,355 @@
+package pingo
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errNoJobQueue   = ErrNoJobQueue(errors.New("Plugin was not started with a job queue"))
+	errLeaseExpired = ErrLeaseExpired(errors.New("Job is unknown or its lease has expired"))
+)
+
+// Error reported to a plugin pulling jobs when the host did not provide a job queue.
+type ErrNoJobQueue error
+
+// Error reported when a job is acknowledged after its lease has expired.
+type ErrLeaseExpired error
+
+const jobsObject = "PingoJobs"
+
+// Environment variable holding the secret of the job queue of the host.
+const envJobsSecret = "PINGO_JOBS_SECRET"
+
+// Job is a unit of work handed out by a JobQueue.
+type Job struct {
+	// Unique identifier of the job in its queue. Zero if no job is available.
+	ID uint64
+	// Opaque payload, as pushed by the host.
+	Data []byte
+}
+
+// JobResult is sent by a plugin to acknowledge a completed job.
+type JobResult struct {
+	ID     uint64
+	Result []byte
+}
+
+type leasedJob struct {
+	job     *Job
+	expires time.Time
+}
+
+// JobQueue is a queue of jobs exposed by the host to its plugins. Instead of receiving
+// calls, plugins pull jobs at their own pace (see PullJob), holding a lease on each job
+// until they acknowledge it. Jobs whose lease expires are handed out again.
+//
+// A queue is attached to one or more plugins with Plugin.SetJobQueue. Plugins authenticate
+// with a secret passed in their environment, so that other processes that can reach the
+// queue cannot pull its jobs.
+type JobQueue struct {
+	mu       sync.Mutex
+	lease    time.Duration
+	done     func(id uint64, result []byte)
+	nextID   uint64
+	pending  []*Job
+	leased   map[uint64]*leasedJob
+	notify   chan struct{}
+	once     sync.Once
+	listener net.Listener
+	proto    string
+	addr     string
+	// Plugins connecting must prove they know it, as with SetSecure
+	secret string
+	err    error
+}
+
+// NewJobQueue creates a job queue handing out jobs with the specified lease time.
+// If done is not nil, it is called with the result of every acknowledged job.
+func NewJobQueue(lease time.Duration, done func(id uint64, result []byte)) *JobQueue {
+	return &JobQueue{
+		lease:  lease,
+		done:   done,
+		leased: make(map[uint64]*leasedJob),
+		notify: make(chan struct{}),
+	}
+}
+
+// Push appends a new job to the queue and returns its ID.
+func (q *JobQueue) Push(data []byte) uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.nextID++
+	q.pending = append(q.pending, &Job{ID: q.nextID, Data: data})
+	q.wake()
+	return q.nextID
+}
+
+// Len returns the number of jobs not yet acknowledged, including leased ones.
+func (q *JobQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return len(q.pending) + len(q.leased)
+}
+
+// Close stops accepting connections from plugins.
+func (q *JobQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.listener == nil {
+		return nil
+	}
+	err := q.listener.Close()
+	if q.proto == "unix" {
+		os.Remove(q.addr)
+	}
+	q.listener = nil
+	return err
+}
+
+// Must be called with the lock held.
+func (q *JobQueue) wake() {
+	close(q.notify)
+	q.notify = make(chan struct{})
+}
+
+// Start listening for plugins, once. Returns the address to pass to plugins.
+func (q *JobQueue) listen(proto, unixdir string) (string, error) {
+	q.once.Do(func() {
+		var addr string
+		switch proto {
+		case "unix":
+			addr = filepath.Join(unixdir, "pingo-jobs-"+randstr(8))
+		default:
+			proto, addr = "tcp", "127.0.0.1:0"
+		}
+
+		if q.secret, q.err = newSecret(); q.err != nil {
+			return
+		}
+		server := rpc.NewServer()
+		if q.err = server.RegisterName(jobsObject, &jobService{q}); q.err != nil {
+			return
+		}
+		if q.listener, q.err = net.Listen(proto, addr); q.err != nil {
+			return
+		}
+		q.proto, q.addr = proto, q.listener.Addr().String()
+		go q.accept(server, q.listener)
+	})
+	if q.err != nil {
+		return "", q.err
+	}
+	return q.proto + ":" + q.addr, nil
+}
+
+func (q *JobQueue) accept(server *rpc.Server, l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// Listener closed
+			return
+		}
+		go q.serve(server, conn)
+	}
+}
+
+// Serve a plugin once it has proved it knows the secret of the queue.
+func (q *JobQueue) serve(server *rpc.Server, conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(defaultAuthTimeout))
+	sconn, err := secureServer(conn, q.secret)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	server.ServeConn(sconn)
+}
+
+// Must be called with the lock held.
+func (q *JobQueue) expire(now time.Time) {
+	for id, l := range q.leased {
+		if now.After(l.expires) {
+			delete(q.leased, id)
+			q.pending = append([]*Job{l.job}, q.pending...)
+		}
+	}
+}
+
+func (q *JobQueue) pull(wait time.Duration) *Job {
+	deadline := time.Now().Add(wait)
+	for {
+		q.mu.Lock()
+		now := time.Now()
+		q.expire(now)
+		if len(q.pending) > 0 {
+			job := q.pending[0]
+			q.pending = q.pending[1:]
+			q.leased[job.ID] = &leasedJob{job: job, expires: now.Add(q.lease)}
+			q.mu.Unlock()
+			return job
+		}
+		notify := q.notify
+		q.mu.Unlock()
+
+		if !now.Before(deadline) {
+			return nil
+		}
+		// Wake up on new jobs, or at most every lease period to find expired jobs.
+		wait := deadline.Sub(now)
+		if q.lease < wait {
+			wait = q.lease
+		}
+		select {
+		case <-notify:
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (q *JobQueue) ack(res *JobResult) error {
+	q.mu.Lock()
+	_, ok := q.leased[res.ID]
+	delete(q.leased, res.ID)
+	q.mu.Unlock()
+
+	if !ok {
+		return errLeaseExpired
+	}
+	if q.done != nil {
+		q.done(res.ID, res.Result)
+	}
+	return nil
+}
+
+func (q *JobQueue) nack(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	l, ok := q.leased[id]
+	if !ok {
+		return errLeaseExpired
+	}
+	delete(q.leased, id)
+	q.pending = append([]*Job{l.job}, q.pending...)
+	q.wake()
+	return nil
+}
+
+// RPC interface of the queue exposed to plugins.
+type jobService struct {
+	q *JobQueue
+}
+
+func (s *jobService) Pull(wait time.Duration, job *Job) error {
+	if j := s.q.pull(wait); j != nil {
+		*job = *j
+	}
+	return nil
+}
+
+func (s *jobService) Ack(res JobResult, unused *int) error {
+	return s.q.ack(&res)
+}
+
+func (s *jobService) Nack(id uint64, unused *int) error {
+	return s.q.nack(id)
+}
+
+// Client side of the job queue, used by plugins.
+type jobClient struct {
+	mu     sync.Mutex
+	client *rpc.Client
+}
+
+func (j *jobClient) get(addr, secret string) (*rpc.Client, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.client != nil {
+		return j.client, nil
+	}
+	if addr == "" || secret == "" {
+		return nil, errNoJobQueue
+	}
+	parts := strings.SplitN(addr, ":", 2)
+	if len(parts) != 2 {
+		return nil, errNoJobQueue
+	}
+	conn, err := net.Dial(parts[0], parts[1])
+	if err != nil {
+		return nil, err
+	}
+	sconn, err := secureClient(conn, secret)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	j.client = rpc.NewClient(sconn)
+	return j.client, nil
+}
+
+// PullJob waits up to wait for a job from the host's job queue. It returns nil if no job
+// became available in time.
+//
+// The job is leased to this plugin: it must be acknowledged with AckJob (or returned to
+// the queue with NackJob) before the lease expires, otherwise it is handed out again.
+//
+// PullJob can be called from any goroutine; it waits for Run to be called first.
+func PullJob(wait time.Duration) (*Job, error) {
+	return DefaultServer().PullJob(wait)
+}
+
+// PullJob waits for a job from the job queue of the host of the server, as the PullJob
+// function does.
+func (s *Server) PullJob(wait time.Duration) (*Job, error) {
+	client, err := s.r.jobs()
+	if err != nil {
+		return nil, err
+	}
+	job := &Job{}
+	if err := client.Call(jobsObject+".Pull", wait, job); err != nil {
+		return nil, err
+	}
+	if job.ID == 0 {
+		return nil, nil
+	}
+	return job, nil
+}
+
+// AckJob marks a job as completed, passing an optional result to the host.
+func AckJob(id uint64, result []byte) error {
+	return DefaultServer().AckJob(id, result)
+}
+
+// AckJob marks a job pulled by the server as completed, as the AckJob function does.
+func (s *Server) AckJob(id uint64, result []byte) error {
+	client, err := s.r.jobs()
+	if err != nil {
+		return err
+	}
+	return client.Call(jobsObject+".Ack", JobResult{ID: id, Result: result}, nil)
+}
+
+// NackJob returns a leased job to the queue, to be handed out again.
+func NackJob(id uint64) error {
+	return DefaultServer().NackJob(id)
+}
+
+// NackJob returns a job pulled by the server to the queue, as the NackJob function does.
+func (s *Server) NackJob(id uint64) error {
+	client, err := s.r.jobs()
+	if err != nil {
+		return err
+	}
+	return client.Call(jobsObject+".Nack", id, nil)
+}
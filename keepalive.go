@@ -0,0 +1,69 @@
+package pingo
+
+import (
+	"errors"
+	"math"
+	"net/rpc"
+	"sync/atomic"
+	"time"
+)
+
+var errDeadConnection = ErrDeadConnection(errors.New("Connection to plugin is dead: no keepalive response"))
+
+// Error reported when a connection does not answer keepalive pings.
+type ErrDeadConnection error
+
+// Keepalive pings are requests with a sequence number never used by the "rpc"
+// package, answered by the dispatcher before any check. Plugins built with older
+// versions reply with an error, which is just as good as a pong.
+const (
+	keepaliveMethod        = internalObject + ".Keepalive"
+	keepaliveSeq    uint64 = math.MaxUint64
+)
+
+// Keepalive makes the connection to the plugin send a ping every interval when idle, so
+// that connections through NAT or firewalls are not silently dropped. If nothing is
+// received from the plugin within an interval of a ping, the connection is closed and
+// dead, if not nil, is called with an ErrDeadConnection error; pending and further calls
+// fail.
+//
+// Pings are handled by the transport: they are not seen by plugin objects.
+func Keepalive(interval time.Duration, dead func(error)) Option {
+	return func(o *options) {
+		o.keepalive = interval
+		o.keepaliveDead = dead
+	}
+}
+
+// Send pings until the codec is closed or the connection is found dead.
+func (c *gobClientCodec) keepalive(interval time.Duration, dead func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var sent int64
+	for {
+		select {
+		case <-c.closing:
+			return
+		case <-ticker.C:
+		}
+
+		if sent > 0 && atomic.LoadInt64(&c.lastRead) < sent {
+			c.Close()
+			if dead != nil {
+				dead(errDeadConnection)
+			}
+			return
+		}
+		// Only ping when idle
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.lastRead))) < interval {
+			sent = 0
+			continue
+		}
+
+		sent = time.Now().UnixNano()
+		if err := c.write(&rpc.Request{ServiceMethod: keepaliveMethod, Seq: keepaliveSeq}, struct{}{}, Gob); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package pingo
+
+import (
+	"context"
+	"reflect"
+	"sync"
+)
+
+// ReplyPool holds replies of one type that are reused across calls, so that hosts
+// performing many calls do not allocate a reply for each of them. See CallPooled.
+type ReplyPool struct {
+	pool sync.Pool
+}
+
+// NewReplyPool returns a pool of the replies created by newReply, which must return a
+// non-nil pointer, as in:
+//
+//	pool := pingo.NewReplyPool(func() interface{} { return new(Result) })
+//
+// Released replies are cleared with their Reset method, if they have one, or set to their
+// zero value otherwise. Implementing Reset to truncate slices and clear maps lets decoding
+// reuse the memory they hold.
+func NewReplyPool(newReply func() interface{}) *ReplyPool {
+	p := &ReplyPool{}
+	p.pool.New = func() interface{} {
+		return &Reply{Value: newReply()}
+	}
+	return p
+}
+
+func (p *ReplyPool) get() *Reply {
+	r := p.pool.Get().(*Reply)
+	r.pool = p
+	return r
+}
+
+// Reply is a reply leased from a ReplyPool.
+type Reply struct {
+	// Reply of the call, a pointer as returned by the function of the pool
+	Value interface{}
+	// Pool to return to, nil once released or if it must not be reused
+	pool *ReplyPool
+}
+
+// Release returns the reply to its pool. Neither the reply nor the values it references,
+// such as slices, may be used afterwards. Releasing a reply more than once has no effect.
+func (r *Reply) Release() {
+	p := r.pool
+	if p == nil {
+		return
+	}
+	r.pool = nil
+	if v, ok := r.Value.(interface{ Reset() }); ok {
+		v.Reset()
+	} else {
+		reflect.ValueOf(r.Value).Elem().SetZero()
+	}
+	p.pool.Put(r)
+}
+
+// CallPooled is like CallContext, but decodes the reply into a value leased from pool,
+// which the caller must release once done with it. Unlike CallContext, the reply is
+// decoded in place, without allocating a new value for each call. On error, no reply is
+// returned.
+//
+// Replies of calls abandoned because their context is done may still be written by the
+// plugin, so they are not returned to the pool.
+func (p *Plugin) CallPooled(ctx context.Context, name string, args interface{}, pool *ReplyPool) (*Reply, error) {
+	r := pool.get()
+	if err := callContext(ctx, p, name, args, r); err != nil {
+		r.Release()
+		return nil, err
+	}
+	return r, nil
+}
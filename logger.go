@@ -0,0 +1,145 @@
+package pingo
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// Severity of a log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int(l))
+}
+
+// Field is a named value attached to a log record, such as the name of a plugin.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the records pingo logs about the plugins it runs or serves. Messages are
+// constant strings, details are carried by fields, so that records can be forwarded to any
+// structured logging library.
+//
+// Records are separate from the lines plugins print to talk to their host, which are not
+// affected by the logger.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// Writes records to a standard logger.
+type stdLogger struct {
+	l   *log.Logger
+	min LogLevel
+}
+
+// NewLogger returns a Logger writing the records of level min or higher to l, one per line,
+// as in "pingo: warn: Cannot open wire dump error=...".
+func NewLogger(l *log.Logger, min LogLevel) Logger {
+	return &stdLogger{l: l, min: min}
+}
+
+func (s *stdLogger) Log(level LogLevel, msg string, fields ...Field) {
+	if level < s.min {
+		return
+	}
+	var b strings.Builder
+	b.WriteString("pingo: ")
+	b.WriteString(level.String())
+	b.WriteString(": ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+	s.l.Print(b.String())
+}
+
+// Logger of plugins unless set with SetLogger. Records below warnings are dropped, as the
+// host receives what plugins print.
+var defaultLogger = NewLogger(log.Default(), LevelWarn)
+
+// SetLogger sets the logger receiving the records of the plugin, such as invalid settings
+// and failures of connections. By default, warnings and errors are printed with the "log"
+// package. Call SetLogger before Register to receive the errors of registering objects.
+//
+// SetLogger will panic if called after Run.
+func SetLogger(l Logger) {
+	DefaultServer().SetLogger(l)
+}
+
+// SetLogger sets the logger of the server, as the SetLogger function does.
+func (s *Server) SetLogger(l Logger) {
+	if s.r.running {
+		panic("Do not call SetLogger after Run")
+	}
+	s.r.logger = l
+}
+
+// SetLogger makes the host send the errors and output of the plugin to l, with levels and
+// the name of the plugin (as in OutputLine) as field, instead of to the ErrorHandler (see
+// SetErrorHandler). Reports of the plugin, such as errors, memory warnings and calls of
+// deprecated methods, are logged with their details as fields. Output lines carry the
+// stream they were printed on as field, unless forwarded with OnOutput.
+//
+// Panics if called after Start.
+func (p *Plugin) SetLogger(l Logger) {
+	if p.running {
+		panic("Cannot call SetLogger after Start")
+	}
+	p.handler = &logHandler{logger: l, plugin: filepath.Base(p.exe)}
+	p.logger = l
+}
+
+// Report err to the logger of the plugin as msg with fields, if set with SetLogger, or
+// else to the ErrorHandler: errors with Error, lower levels with Print.
+func (p *Plugin) report(level LogLevel, err error, msg string, fields ...Field) {
+	if p.logger == nil {
+		if level >= LevelError {
+			p.handler.Error(err)
+		} else {
+			p.handler.Print(err)
+		}
+		return
+	}
+	p.logger.Log(level, msg, append(fields, Field{"plugin", filepath.Base(p.exe)})...)
+}
+
+// ErrorHandler passing errors and output to a Logger.
+type logHandler struct {
+	logger Logger
+	plugin string
+}
+
+func (h *logHandler) Error(err error) {
+	h.logger.Log(LevelError, err.Error(), Field{"plugin", h.plugin})
+}
+
+// Output lines are informational; errors printed, such as those reported by the plugin,
+// are warnings.
+func (h *logHandler) Print(v interface{}) {
+	if err, ok := v.(error); ok {
+		h.logger.Log(LevelWarn, err.Error(), Field{"plugin", h.plugin})
+		return
+	}
+	h.logger.Log(LevelInfo, fmt.Sprint(v), Field{"plugin", h.plugin})
+}
@@ -0,0 +1,281 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Error reported when a plugin name is not known to a Manager.
+type ErrUnknownPlugin error
+
+// Manager keeps a set of named plugins, starts and stops them together and can run
+// scheduled calls on them.
+//
+// Once started, each plugin runs its self test (see SetSelfTest), and again each time its
+// process is restarted; calls to a plugin wait for its test and fail if the test has failed.
+type Manager struct {
+	mu        sync.Mutex
+	plugins   map[string]*Plugin
+	names     []string
+	schedules []*Schedule
+	tests     map[string]*selfTest
+	routes    *routeTable
+	running   bool
+	// Parent of the state directories of plugins, if assigned
+	stateRoot string
+	// Limits on the size of state directories, if any
+	quota     *StateQuota
+	quotaStop chan struct{}
+	// Startup phases, in order
+	phases []*Phase
+	// Faults injected, if any
+	chaos     *Chaos
+	chaosStop chan struct{}
+	// Pings of the plugins, if any
+	watchdog     *Watchdog
+	watchdogStop chan struct{}
+	// Upgrades in progress, by plugin
+	upgrades map[string]*upgrade
+}
+
+// NewManager creates an empty manager.
+func NewManager() *Manager {
+	return &Manager{
+		plugins: make(map[string]*Plugin),
+		tests:   make(map[string]*selfTest),
+	}
+}
+
+// Add a plugin under the specified name. If the manager is running, the plugin
+// is started immediately.
+//
+// Panics if a plugin with the same name already exists, or if the manager assigns
+// state directories (see SetStateRoot) and the plugin is started already.
+func (m *Manager) Add(name string, p *Plugin) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.plugins[name]; ok {
+		panic("Plugin " + name + " already added to manager")
+	}
+	if m.stateRoot != "" {
+		p.SetStateDir(m.stateDir(name))
+	}
+	m.plugins[name] = p
+	m.names = append(m.names, name)
+	m.invalidateRoutes()
+	if m.running {
+		p.Start()
+		m.startSelfTest(name, p)
+	}
+}
+
+// Plugin returns the plugin with the specified name, or nil.
+func (m *Manager) Plugin(name string) *Plugin {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.plugins[name]
+}
+
+// Names returns the names of all plugins, in the order they were added.
+func (m *Manager) Names() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	names := make([]string, len(m.names))
+	copy(names, m.names)
+	return names
+}
+
+// Start all plugins and schedules.
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.running = true
+	for _, name := range m.names {
+		m.plugins[name].Start()
+		m.startSelfTest(name, m.plugins[name])
+	}
+	for _, s := range m.schedules {
+		s.start(m)
+	}
+	m.startQuota()
+	m.startChaos()
+	m.startWatchdog()
+}
+
+// Stop and remove all schedules, then stop all plugins. Does nothing if the manager is
+// not started.
+func (m *Manager) Stop() {
+	m.Shutdown(context.Background())
+}
+
+// Shutdown stops and removes all schedules, then stops all plugins concurrently. Plugins
+// that have not exited when ctx is done are killed. The errors of the plugins are returned
+// as for StopAll. Does nothing if the manager is not started.
+func (m *Manager) Shutdown(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.running {
+		return nil
+	}
+
+	for _, s := range m.schedules {
+		s.Stop()
+	}
+	m.schedules = nil
+	m.stopQuota()
+	m.stopChaos()
+	m.stopWatchdog()
+	plugins := make([]*Plugin, len(m.names))
+	for i, name := range m.names {
+		plugins[i] = m.plugins[name]
+	}
+	err := StopAll(ctx, plugins...)
+	m.tests = make(map[string]*selfTest)
+	m.invalidateRoutes()
+	m.running = false
+	return err
+}
+
+// Call performs an RPC call on the named plugin. If the plugin has failed its self test,
+// the error of the test is returned.
+func (m *Manager) Call(ctx context.Context, plugin, name string, args interface{}, resp interface{}) error {
+	p, u := m.pick(plugin)
+	if p == nil {
+		return ErrUnknownPlugin(errors.New("Unknown plugin " + plugin))
+	}
+	if err := m.selfTested(ctx, plugin); err != nil {
+		return err
+	}
+	if err := p.chaosDelay.wait(ctx); err != nil {
+		return err
+	}
+	err := callContext(ctx, p, name, args, resp)
+	if u != nil {
+		u.record(err)
+	}
+	return err
+}
+
+// OverlapPolicy decides what happens when a scheduled call is due while the
+// previous call of the same schedule is still running.
+type OverlapPolicy int
+
+const (
+	// Skip the call; the schedule continues at the next interval.
+	OverlapSkip OverlapPolicy = iota
+	// Wait for the running call to complete, then perform the call.
+	OverlapDelay
+	// Perform the call regardless of running calls.
+	OverlapAllow
+)
+
+// Schedule describes a call performed periodically on a plugin of a Manager.
+//
+// Errors returned by scheduled calls are reported to the ErrorHandler of the plugin.
+type Schedule struct {
+	// Name of the plugin in the Manager.
+	Plugin string
+	// Method to call and its arguments. Responses are discarded.
+	Method string
+	Args   interface{}
+	// Interval between calls.
+	Every time.Duration
+	// A random delay up to Jitter is added to each interval.
+	Jitter time.Duration
+	// What to do if a call is due while the previous one is still running.
+	Overlap OverlapPolicy
+
+	once sync.Once
+	stop chan struct{}
+}
+
+// Schedule adds a periodic call. The schedule begins when the manager is started, or
+// immediately if the manager is running already.
+//
+// Schedule panics if the interval between calls is not positive.
+func (m *Manager) Schedule(s *Schedule) {
+	if s.Every <= 0 {
+		panic("Schedule interval must be positive")
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s.stop = make(chan struct{})
+	m.schedules = append(m.schedules, s)
+	if m.running {
+		s.start(m)
+	}
+}
+
+// Stop the schedule. Calls already running are not interrupted.
+func (s *Schedule) Stop() {
+	s.once.Do(func() {
+		close(s.stop)
+	})
+}
+
+// Must be called with the manager lock held.
+func (s *Schedule) start(m *Manager) {
+	p := m.plugins[s.Plugin]
+	if p == nil {
+		panic("Schedule for unknown plugin " + s.Plugin)
+	}
+	go s.run(m, p)
+}
+
+func (s *Schedule) interval() time.Duration {
+	if s.Jitter <= 0 {
+		return s.Every
+	}
+	return s.Every + time.Duration(rand.Int63n(int64(s.Jitter)))
+}
+
+func (s *Schedule) run(m *Manager, p *Plugin) {
+	var prev chan struct{}
+
+	for {
+		select {
+		case <-time.After(s.interval()):
+		case <-s.stop:
+			return
+		}
+
+		if prev != nil {
+			select {
+			case <-prev:
+				prev = nil
+			default:
+			}
+		}
+		if prev != nil {
+			switch s.Overlap {
+			case OverlapSkip:
+				continue
+			case OverlapDelay:
+				select {
+				case <-prev:
+				case <-s.stop:
+					return
+				}
+			}
+		}
+
+		done := make(chan struct{})
+		prev = done
+		go func() {
+			defer close(done)
+			if err := m.Call(context.Background(), s.Plugin, s.Method, s.Args, nil); err != nil {
+				p.handler.Error(fmt.Errorf("Scheduled call %s on %s: %s", s.Method, s.Plugin, err))
+			}
+		}()
+	}
+}
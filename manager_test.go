@@ -0,0 +1,70 @@
+package pingo_test
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+)
+
+// Schedules without a positive interval are refused rather than calling in a loop.
+func TestScheduleInterval(t *testing.T) {
+	tests := []struct {
+		every, jitter time.Duration
+	}{
+		{0, 0},
+		{-time.Second, 0},
+		{0, -time.Second},
+	}
+	for _, test := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Schedule every %v with jitter %v accepted", test.every, test.jitter)
+				}
+			}()
+			m := pingo.NewManager()
+			m.Schedule(&pingo.Schedule{Plugin: "p", Method: "P.M", Every: test.every, Jitter: test.jitter, Overlap: pingo.OverlapAllow})
+		}()
+	}
+}
+
+// Echoes its argument.
+type Echo struct{}
+
+func (e *Echo) Echo(s string, resp *string) error {
+	*resp = s
+	return nil
+}
+
+// An object moves to a plugin added earlier once that plugin exports it.
+func TestLookupMovedObject(t *testing.T) {
+	var starts int32
+	first := pingo.NewInProcessPlugin(func(s *pingo.Server) {
+		if atomic.AddInt32(&starts, 1) == 1 {
+			s.Register(&Summer{})
+		} else {
+			s.Register(&Echo{})
+		}
+	})
+	first.SetRestartPolicy(pingo.RestartAlways, pingo.Backoff{Initial: 10 * time.Millisecond})
+	m := pingo.NewManager()
+	m.Add("first", first)
+	m.Add("second", pingo.NewInProcessPlugin(func(s *pingo.Server) {
+		s.Register(&Echo{})
+	}))
+	m.Start()
+	defer m.Stop()
+
+	if name, err := m.Lookup("Echo.Echo"); err != nil || name != "second" {
+		t.Fatalf("Echo resolved to %q, %v", name, err)
+	}
+	first.Call("PingoRpc.Exit", 0, nil)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if name, _ := m.Lookup("Echo.Echo"); name == "first" {
+			return
+		}
+	}
+	t.Error("Echo still resolved to the second plugin after the first exported it")
+}
@@ -0,0 +1,69 @@
+package pingo
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// Name of the manifest written by "pingo build" beside the executables it describes.
+const ManifestFile = "manifest.json"
+
+// Error returned when a manifest has no executable for the requested platform.
+type ErrNoArtifact error
+
+// Manifest describes the executables of a plugin built for several platforms, as written
+// in JSON by "pingo build".
+type Manifest struct {
+	Name string
+	// Version of the plugin, if set when building it
+	Version string `json:",omitempty"`
+	// Version of the protocol spoken by the plugin (see PluginInfo), if declared
+	Protocol  int `json:",omitempty"`
+	Artifacts []Artifact
+}
+
+// Artifact is the executable of a plugin for one platform.
+type Artifact struct {
+	// Platform the executable runs on, as in "linux/amd64"
+	Platform string
+	// Path of the executable, relative to the directory of the manifest
+	File string
+	// Hex-encoded SHA-256 checksum and size of the executable
+	SHA256 string
+	Size   int64
+}
+
+// ReadManifest reads a manifest in JSON. The files of its artifacts are made relative to
+// the directory of path.
+func ReadManifest(path string) (*Manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	m := &Manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	dir := filepath.Dir(path)
+	for i := range m.Artifacts {
+		m.Artifacts[i].File = filepath.Join(dir, filepath.FromSlash(m.Artifacts[i].File))
+	}
+	return m, nil
+}
+
+// Artifact returns the executable for platform, or for the platform of the host if
+// platform is empty. An ErrNoArtifact error is returned if there is none.
+func (m *Manifest) Artifact(platform string) (*Artifact, error) {
+	if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+	for i := range m.Artifacts {
+		if m.Artifacts[i].Platform == platform {
+			return &m.Artifacts[i], nil
+		}
+	}
+	return nil, ErrNoArtifact(errors.New("Plugin " + m.Name + " was not built for " + platform))
+}
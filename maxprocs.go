@@ -0,0 +1,113 @@
+package pingo
+
+import (
+	"bufio"
+	"math"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// Files describing the CPU quota of the process in cgroups v2 and v1.
+const (
+	cgroupRoot       = "/sys/fs/cgroup"
+	cgroupV1Quota    = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1Period   = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+	cgroupProcSelf   = "/proc/self/cgroup"
+	cgroupV2Filename = "cpu.max"
+)
+
+// Set GOMAXPROCS to the CPU quota of the cgroup of the plugin, if lower than the number
+// of CPUs, so that a constrained plugin is not throttled by running more threads than
+// its quota allows. An explicit GOMAXPROCS environment variable is respected, as is the
+// runtime setting GOMAXPROCS itself.
+func alignMaxProcs() {
+	if os.Getenv("GOMAXPROCS") != "" || runtimeMaxProcs() {
+		return
+	}
+	quota, ok := cgroupQuota()
+	if !ok {
+		return
+	}
+	procs := int(math.Ceil(quota))
+	if procs < 1 {
+		procs = 1
+	}
+	if procs < runtime.NumCPU() {
+		runtime.GOMAXPROCS(procs)
+	}
+}
+
+// CPU quota of the process as a number of CPUs. Returns false if there is no quota or it
+// cannot be determined, as on systems without cgroups.
+func cgroupQuota() (float64, bool) {
+	if dir, ok := cgroupV2Dir(); ok {
+		if quota, ok := cgroupV2Quota(dir); ok {
+			return quota, true
+		}
+	}
+	quota, err := readInt(cgroupV1Quota)
+	if err != nil || quota <= 0 {
+		return 0, false
+	}
+	period, err := readInt(cgroupV1Period)
+	if err != nil || period <= 0 {
+		return 0, false
+	}
+	return float64(quota) / float64(period), true
+}
+
+// Directory of the cgroup v2 of the process.
+func cgroupV2Dir() (string, bool) {
+	f, err := os.Open(cgroupProcSelf)
+	if err != nil {
+		return "", false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if dir := strings.TrimPrefix(scanner.Text(), "0::"); dir != scanner.Text() {
+			return path.Join(cgroupRoot, dir), true
+		}
+	}
+	return "", false
+}
+
+// Lowest quota of the cgroup v2 dir and its parents.
+func cgroupV2Quota(dir string) (float64, bool) {
+	var (
+		lowest float64
+		found  bool
+	)
+	for ; strings.HasPrefix(dir, cgroupRoot); dir = path.Dir(dir) {
+		data, err := os.ReadFile(path.Join(dir, cgroupV2Filename))
+		if err != nil {
+			continue
+		}
+		// Format is "$MAX $PERIOD", where $MAX can be "max" for no limit.
+		fields := strings.Fields(string(data))
+		if len(fields) != 2 || fields[0] == "max" {
+			continue
+		}
+		quota, err1 := strconv.ParseFloat(fields[0], 64)
+		period, err2 := strconv.ParseFloat(fields[1], 64)
+		if err1 != nil || err2 != nil || period <= 0 {
+			continue
+		}
+		if cpus := quota / period; !found || cpus < lowest {
+			lowest, found = cpus, true
+		}
+	}
+	return lowest, found
+}
+
+func readInt(name string) (int64, error) {
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
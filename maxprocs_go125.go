@@ -0,0 +1,34 @@
+//go:build go1.25
+
+package pingo
+
+import (
+	"os"
+	"runtime/debug"
+	"strings"
+)
+
+// Since Go 1.25, the runtime sets GOMAXPROCS from the CPU quota of the process, unless
+// disabled with GODEBUG=containermaxprocs=0, or by default for main modules declaring an
+// older version of Go.
+func runtimeMaxProcs() bool {
+	godebug := os.Getenv("GODEBUG")
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "DefaultGODEBUG" {
+				// Settings of GODEBUG take priority
+				godebug = s.Value + "," + godebug
+			}
+		}
+	}
+	enabled := true
+	for _, s := range strings.Split(godebug, ",") {
+		switch s {
+		case "containermaxprocs=0":
+			enabled = false
+		case "containermaxprocs=1":
+			enabled = true
+		}
+	}
+	return enabled
+}
@@ -0,0 +1,8 @@
+//go:build !go1.25
+
+package pingo
+
+// Older runtimes do not set GOMAXPROCS from the CPU quota of the process.
+func runtimeMaxProcs() bool {
+	return false
+}
@@ -0,0 +1,61 @@
+package pingo
+
+import (
+	"runtime/debug"
+	"strconv"
+)
+
+// MemoryLimit makes the plugin runtime apply a soft memory limit of the specified number
+// of bytes, as with GOMEMLIMIT (see debug.SetMemoryLimit). The plugin need not be rebuilt
+// for the limit to change.
+func MemoryLimit(bytes int64) Option {
+	return func(o *options) {
+		o.memLimit = bytes
+	}
+}
+
+// GCPercent sets the garbage collection target percentage of the plugin runtime, as with
+// GOGC (see debug.SetGCPercent). A negative percentage disables the garbage collector,
+// which is useful together with MemoryLimit.
+func GCPercent(percent int) Option {
+	return func(o *options) {
+		o.gcPercent = strconv.Itoa(percent)
+		if percent < 0 {
+			o.gcPercent = "off"
+		}
+	}
+}
+
+// Parameters passing the memory hints to the plugin.
+func (o *options) memoryParams() []string {
+	var params []string
+	if o.memLimit > 0 {
+		params = append(params, "-pingo:memlimit="+strconv.FormatInt(o.memLimit, 10))
+	}
+	if o.gcPercent != "" {
+		params = append(params, "-pingo:gogc="+o.gcPercent)
+	}
+	if o.watchdog > 0 {
+		params = append(params, "-pingo:watchdog="+strconv.FormatInt(o.watchdog, 10))
+	}
+	return params
+}
+
+// Apply the memory hints passed by the host. Invalid values are ignored.
+func (c *config) applyMemory(l Logger) {
+	if c.memlimit > 0 {
+		debug.SetMemoryLimit(c.memlimit)
+	}
+	switch c.gogc {
+	case "":
+	case "off":
+		debug.SetGCPercent(-1)
+	default:
+		percent, err := strconv.Atoi(c.gogc)
+		if err != nil {
+			l.Log(LevelWarn, "Invalid GC percentage", Field{"gogc", c.gogc})
+			return
+		}
+		debug.SetGCPercent(percent)
+	}
+}
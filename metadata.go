@@ -0,0 +1,111 @@
+package pingo
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Separates the name of a method from the metadata of a call on the wire. Method names
+// cannot contain it, so plain "rpc" clients never send metadata.
+const metadataSep = "?"
+
+// Prefix of the metadata carrying bridged context values.
+const bridgePrefix = "ctx."
+
+type metadataKey struct{}
+
+var bridge = struct {
+	sync.RWMutex
+	keys map[string]interface{}
+}{keys: make(map[string]interface{})}
+
+// BridgeContext declares that the context value stored under key should flow from the
+// host to the plugin under the specified name. Only string values are passed.
+//
+// Both sides must declare the bridged values: the host to send the value of key with calls
+// that have a context (see CallContext); the plugin to store the received value under its
+// own key in the context of methods taking a context.Context as first argument:
+//
+//	func (s *Store) Get(ctx context.Context, key string, val *string) error {
+//		log.Printf("request %s: get %s", ctx.Value(requestID), key)
+//		...
+//	}
+func BridgeContext(name string, key interface{}) {
+	bridge.Lock()
+	defer bridge.Unlock()
+
+	bridge.keys[name] = key
+}
+
+// Return the name of method as sent on the wire, including the metadata from ctx
+// if the plugin supports it, and the ID to cancel the call with, if any.
+func withMetadata(ctx context.Context, method string, opts *options, features Feature) (string, string) {
+	if !features.Has(FeatureMetadata) {
+		return method, ""
+	}
+	md := make(url.Values)
+
+	bridge.RLock()
+	for name, key := range bridge.keys {
+		if val, ok := ctx.Value(key).(string); ok {
+			md.Set(bridgePrefix+name, val)
+		}
+	}
+	bridge.RUnlock()
+
+	if enc, ok := ctx.Value(encodingCtxKey{}).(Encoding); ok && enc != Gob && features.Has(FeatureEncoding) {
+		md.Set(encodingKey, string(enc))
+	}
+	if tenant, ok := ctx.Value(tenantCtxKey{}).(string); ok && tenant != "" {
+		md.Set(tenantKey, tenant)
+	}
+	setDeadline(md, ctx, opts.deadlines)
+	var id string
+	if features.Has(FeatureCancellation) {
+		id = setCancelID(md, ctx)
+	}
+
+	if len(md) == 0 {
+		return method, id
+	}
+	return method + metadataSep + md.Encode(), id
+}
+
+// Separate the name of a method from the metadata sent with it.
+func splitMetadata(method string) (string, url.Values) {
+	parts := strings.SplitN(method, metadataSep, 2)
+	if len(parts) < 2 {
+		return method, nil
+	}
+	md, err := url.ParseQuery(parts[1])
+	if err != nil {
+		return parts[0], nil
+	}
+	return parts[0], md
+}
+
+// Context of a call received at the specified time with metadata md, derived from ctx.
+// The context must be released with the returned function once the call is complete.
+func metadataContext(ctx context.Context, md url.Values, received time.Time) (context.Context, context.CancelFunc) {
+	if md == nil {
+		return ctx, func() {}
+	}
+	ctx = context.WithValue(ctx, metadataKey{}, md)
+	cancel := context.CancelFunc(func() {})
+	if deadline, ok := getDeadline(md, received); ok {
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+	}
+
+	bridge.RLock()
+	defer bridge.RUnlock()
+
+	for name, key := range bridge.keys {
+		if vals, ok := md[bridgePrefix+name]; ok && len(vals) > 0 {
+			ctx = context.WithValue(ctx, key, vals[0])
+		}
+	}
+	return ctx, cancel
+}
@@ -0,0 +1,75 @@
+package pingo
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the numeric IDs sent instead of the names of methods.
+const methodIDPrefix = "#"
+
+// A method in the table of IDs of the plugin.
+type methodRef struct {
+	name  string
+	svc   *service
+	mtype *methodType
+}
+
+// Build the table of method IDs, sorted by name, of the objects not hidden. Must be called
+// once all objects are registered.
+func (d *dispatcher) buildMethodIDs(hidden map[string]bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+
+	d.methodIDs = d.methodIDs[:0]
+	for name, svc := range d.services {
+		if hidden[name] {
+			continue
+		}
+		for mname, mtype := range svc.method {
+			d.methodIDs = append(d.methodIDs, methodRef{name: name + "." + mname, svc: svc, mtype: mtype})
+		}
+	}
+	sort.Slice(d.methodIDs, func(i, j int) bool {
+		return d.methodIDs[i].name < d.methodIDs[j].name
+	})
+}
+
+// Names of the methods, in the order of their IDs, as announced to the host.
+func (d *dispatcher) methodTable() string {
+	names := make([]string, len(d.methodIDs))
+	for i := range d.methodIDs {
+		names[i] = d.methodIDs[i].name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Find the method with the ID sent by the host, as in "#12".
+func (d *dispatcher) lookupID(id string) (*methodRef, bool) {
+	if !strings.HasPrefix(id, methodIDPrefix) {
+		return nil, false
+	}
+	n, err := strconv.Atoi(id[len(methodIDPrefix):])
+	if err != nil || n < 0 || n >= len(d.methodIDs) {
+		return nil, false
+	}
+	return &d.methodIDs[n], true
+}
+
+// Parse the table of method IDs announced by the plugin into the IDs by name.
+func parseMethodIDs(val string) map[string]string {
+	ids := make(map[string]string)
+	for i, name := range strings.Split(val, ", ") {
+		ids[name] = methodIDPrefix + strconv.Itoa(i)
+	}
+	return ids
+}
+
+// Name to send for method: its ID, if the plugin announced one.
+func (c *conn) wireMethod(method string) string {
+	if id, ok := c.methodIDs[method]; ok {
+		return id
+	}
+	return method
+}
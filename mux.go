@@ -0,0 +1,492 @@
+package pingo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os"
+	"sync"
+	"time"
+)
+
+// A multiplexed connection is opened with a CONNECT request for muxPath. It then carries
+// sessions, each behaving as a connection of its own: a session starts with the CONNECT
+// request of a plain connection, but is not authenticated again.
+const muxPath = "/_pingo_/mux"
+
+// Frames of a multiplexed connection start with a header: type, flags, two unused bytes,
+// the ID of the session and the length of the payload. For window updates, the length is
+// the number of bytes the receiver has consumed, and there is no payload.
+const (
+	muxHeaderSize = 12
+	// Data each session can receive before the receiver consumes it
+	muxWindow = 256 << 10
+	// Sessions open at once on a connection
+	muxMaxSessions = 1024
+)
+
+// Types of frames.
+const (
+	muxData byte = iota
+	muxWindowUpdate
+)
+
+// Flags of data frames.
+const (
+	// Opens the session
+	muxSYN byte = 1 << iota
+	// The sender closed the session
+	muxFIN
+)
+
+var (
+	errMuxClosed   = errors.New("Multiplexed connection closed")
+	errMuxProtocol = errors.New("Invalid frame on multiplexed connection")
+)
+
+// Multiplex carries all connections to the plugin, including streams and callbacks, as
+// sessions of a single connection, if the plugin supports it. This saves the handshake of
+// each connection, and lets Dial open connections after the unix socket of the plugin
+// has been removed.
+func Multiplex() Option {
+	return func(o *options) {
+		o.multiplex = true
+	}
+}
+
+// Dial opens a new connection for calls to the plugin, waiting for it to be ready, and
+// returns a client using it. Calls on separate connections do not queue behind large
+// arguments or replies of others. The client must be closed when no longer used.
+//
+// Over unix sockets, Dial fails once the socket of the plugin has been removed, unless
+// connections are multiplexed.
+func (p *Plugin) Dial() (*rpc.Client, error) {
+	conn, err := p.request(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	client, _, err := conn.dialer.client(true)
+	return client, err
+}
+
+// Sessions over a connection.
+type muxSession struct {
+	conn net.Conn
+	// Serializes frames written
+	wmu sync.Mutex
+
+	mu       sync.Mutex
+	sessions map[uint32]*muxConn
+	// ID of the next session opened; odd on the host, even on the plugin
+	nextID uint32
+	accept chan *muxConn
+	closed chan struct{}
+	err    error
+}
+
+func newMuxSession(conn net.Conn, client bool) *muxSession {
+	s := &muxSession{
+		conn:     conn,
+		sessions: make(map[uint32]*muxConn),
+		nextID:   2,
+		accept:   make(chan *muxConn, 16),
+		closed:   make(chan struct{}),
+	}
+	if client {
+		s.nextID = 1
+	}
+	go s.recv()
+	return s
+}
+
+// Open a new session.
+func (s *muxSession) Open() (net.Conn, error) {
+	s.mu.Lock()
+	if s.err != nil {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	c := s.newConn(s.nextID)
+	s.nextID += 2
+	s.mu.Unlock()
+
+	if err := s.write(muxData, muxSYN, c.id, nil); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Wait for a session opened by the other side.
+func (s *muxSession) Accept() (net.Conn, error) {
+	select {
+	case c := <-s.accept:
+		return c, nil
+	case <-s.closed:
+		return nil, s.err
+	}
+}
+
+// Close the connection and all its sessions.
+func (s *muxSession) Close() error {
+	s.fail(errMuxClosed)
+	return s.conn.Close()
+}
+
+// Must be called with the lock held.
+func (s *muxSession) newConn(id uint32) *muxConn {
+	c := &muxConn{
+		s:        s,
+		id:       id,
+		window:   muxWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+	s.sessions[id] = c
+	return c
+}
+
+// Error that closed the connection, if any.
+func (s *muxSession) failed() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.err
+}
+
+func (s *muxSession) fail(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	close(s.closed)
+	for _, c := range s.sessions {
+		c.wake()
+	}
+}
+
+func (s *muxSession) write(kind, flags byte, id uint32, payload []byte) error {
+	var hdr [muxHeaderSize]byte
+	hdr[0], hdr[1] = kind, flags
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(len(payload)))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	_, err := s.conn.Write(append(hdr[:], payload...))
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+func (s *muxSession) windowUpdate(id uint32, n int) error {
+	var hdr [muxHeaderSize]byte
+	hdr[0] = muxWindowUpdate
+	binary.BigEndian.PutUint32(hdr[4:], id)
+	binary.BigEndian.PutUint32(hdr[8:], uint32(n))
+
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+
+	_, err := s.conn.Write(hdr[:])
+	if err != nil {
+		s.fail(err)
+	}
+	return err
+}
+
+// Read frames until the connection fails.
+func (s *muxSession) recv() {
+	var hdr [muxHeaderSize]byte
+	for {
+		if _, err := io.ReadFull(s.conn, hdr[:]); err != nil {
+			s.fail(err)
+			return
+		}
+		kind, flags := hdr[0], hdr[1]
+		id := binary.BigEndian.Uint32(hdr[4:])
+		n := binary.BigEndian.Uint32(hdr[8:])
+
+		s.mu.Lock()
+		c := s.sessions[id]
+		opened := c == nil && kind == muxData && flags&muxSYN != 0
+		if opened && id%2 == s.nextID%2 {
+			// Only this side opens sessions with these IDs
+			s.mu.Unlock()
+			s.fail(errMuxProtocol)
+			s.conn.Close()
+			return
+		}
+		if opened && len(s.sessions) < muxMaxSessions {
+			c = s.newConn(id)
+			select {
+			case s.accept <- c:
+			default:
+				delete(s.sessions, id)
+				c = nil
+			}
+		}
+		s.mu.Unlock()
+		if opened && c == nil {
+			// Refuse the session, without holding up the frames of the others; its data
+			// is dropped.
+			go s.write(muxData, muxFIN, id, nil)
+		}
+
+		switch kind {
+		case muxWindowUpdate:
+			if c != nil {
+				c.grow(int(n))
+			}
+		case muxData:
+			if n > muxWindow {
+				s.fail(errMuxProtocol)
+				s.conn.Close()
+				return
+			}
+			payload := make([]byte, n)
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.fail(err)
+				return
+			}
+			// Data for sessions closed meanwhile is dropped
+			if c != nil && !c.received(payload, flags&muxFIN != 0) {
+				s.fail(errMuxProtocol)
+				s.conn.Close()
+				return
+			}
+		default:
+			s.fail(errMuxProtocol)
+			s.conn.Close()
+			return
+		}
+	}
+}
+
+// A session of a multiplexed connection.
+type muxConn struct {
+	s  *muxSession
+	id uint32
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+	// Data the other side can still receive
+	window int
+	// Data consumed and not yet reported to the other side
+	consumed int
+	// The other side or this side closed the session
+	eof, closed bool
+	// Deadlines of reads and writes
+	rdeadline, wdeadline time.Time
+	// Signaled when reads or writes might proceed
+	readable, writable chan struct{}
+}
+
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+func (c *muxConn) wake() {
+	signal(c.readable)
+	signal(c.writable)
+}
+
+// Buffer data sent by the other side. Returns false if the other side sent more than the
+// window it was given.
+func (c *muxConn) received(data []byte, fin bool) bool {
+	c.mu.Lock()
+	// Data consumed is not yet reported to the other side
+	if c.buf.Len()+c.consumed+len(data) > muxWindow {
+		c.mu.Unlock()
+		return false
+	}
+	c.buf.Write(data)
+	if fin {
+		c.eof = true
+	}
+	c.mu.Unlock()
+	signal(c.readable)
+	return true
+}
+
+func (c *muxConn) grow(n int) {
+	c.mu.Lock()
+	c.window += n
+	c.mu.Unlock()
+	signal(c.writable)
+}
+
+// Wait for ch to be signaled, the deadline to pass or the connection to fail.
+func (c *muxConn) wait(ch chan struct{}, deadline time.Time) {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-ch:
+	case <-timeout:
+	case <-c.s.closed:
+	}
+}
+
+func (c *muxConn) Read(b []byte) (int, error) {
+	for {
+		c.mu.Lock()
+		if c.buf.Len() > 0 {
+			n, _ := c.buf.Read(b)
+			c.consumed += n
+			update := 0
+			if c.consumed >= muxWindow/2 {
+				update, c.consumed = c.consumed, 0
+			}
+			c.mu.Unlock()
+			if update > 0 {
+				c.s.windowUpdate(c.id, update)
+			}
+			return n, nil
+		}
+		eof, closed, deadline := c.eof, c.closed, c.rdeadline
+		c.mu.Unlock()
+
+		switch {
+		case closed:
+			return 0, net.ErrClosed
+		case eof:
+			return 0, io.EOF
+		case c.s.failed() != nil:
+			return 0, c.s.failed()
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		c.wait(c.readable, deadline)
+	}
+}
+
+func (c *muxConn) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		c.mu.Lock()
+		closed, deadline := c.closed, c.wdeadline
+		c.mu.Unlock()
+
+		switch {
+		case closed:
+			return written, net.ErrClosed
+		case c.s.failed() != nil:
+			return written, c.s.failed()
+		case !deadline.IsZero() && !time.Now().Before(deadline):
+			return written, os.ErrDeadlineExceeded
+		}
+
+		c.mu.Lock()
+		n := len(b)
+		if n > c.window {
+			n = c.window
+		}
+		c.window -= n
+		c.mu.Unlock()
+
+		if n == 0 {
+			c.wait(c.writable, deadline)
+			continue
+		}
+		if err := c.s.write(muxData, 0, c.id, b[:n]); err != nil {
+			// The data was not sent
+			c.grow(n)
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close the session. Data received afterwards is dropped.
+func (c *muxConn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	c.wake()
+
+	c.s.mu.Lock()
+	delete(c.s.sessions, c.id)
+	c.s.mu.Unlock()
+	return c.s.write(muxData, muxFIN, c.id, nil)
+}
+
+func (c *muxConn) LocalAddr() net.Addr {
+	return c.s.conn.LocalAddr()
+}
+
+func (c *muxConn) RemoteAddr() net.Addr {
+	return c.s.conn.RemoteAddr()
+}
+
+func (c *muxConn) SetDeadline(t time.Time) error {
+	c.SetReadDeadline(t)
+	return c.SetWriteDeadline(t)
+}
+
+func (c *muxConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.rdeadline = t
+	c.mu.Unlock()
+	signal(c.readable)
+	return nil
+}
+
+func (c *muxConn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	c.wdeadline = t
+	c.mu.Unlock()
+	signal(c.writable)
+	return nil
+}
+
+// Serve the sessions of a multiplexed connection as connections received for path,
+// until the connection is closed.
+func (r *rpcServer) serveMux(conn net.Conn, serve func(conn net.Conn, br *bufio.Reader, path string)) {
+	s := newMuxSession(conn, false)
+	defer s.Close()
+
+	wg := new(sync.WaitGroup)
+	for {
+		sc, err := s.Accept()
+		if err != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer sc.Close()
+
+			br := bufio.NewReader(sc)
+			req, err := http.ReadRequest(br)
+			if err != nil || req.Method != "CONNECT" {
+				return
+			}
+			io.WriteString(sc, "HTTP/1.0 "+connectedStatus+"\n\n")
+			serve(sc, br, req.URL.Path)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,60 @@
+package pingo
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Sessions not accepted in time are refused, without holding up the others.
+func TestMuxRefusesSessions(t *testing.T) {
+	c1, c2 := net.Pipe()
+	client, server := newMuxSession(c1, true), newMuxSession(c2, false)
+	defer client.Close()
+	defer server.Close()
+
+	first, err := client.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := server.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Fill the queue of sessions waiting to be accepted
+	var refused net.Conn
+	for i := 0; i <= cap(server.accept); i++ {
+		if refused, err = client.Open(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("Expected refused session to be closed, got %v", err)
+	}
+
+	go first.Write([]byte("data"))
+	accepted.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(accepted, buf); err != nil || string(buf) != "data" {
+		t.Errorf("Accepted session stalled: %q, %v", buf, err)
+	}
+}
+
+// Sessions opened with the IDs of the other side close the connection.
+func TestMuxSessionParity(t *testing.T) {
+	c1, c2 := net.Pipe()
+	server := newMuxSession(c2, false)
+	defer server.Close()
+
+	var hdr [muxHeaderSize]byte
+	hdr[0], hdr[1] = muxData, muxSYN
+	binary.BigEndian.PutUint32(hdr[4:], 2)
+	go c1.Write(hdr[:])
+	if _, err := server.Accept(); err != errMuxProtocol {
+		t.Errorf("Expected protocol error, got %v", err)
+	}
+}
@@ -0,0 +1,267 @@
+package pingo
+
+import (
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Option configures optional behaviour of a Plugin. See SetOptions.
+type Option func(*options)
+
+type options struct {
+	// Start the plugin with a minimal environment
+	scrubEnv bool
+	// Place the unix socket in a directory private to the plugin
+	privateDir bool
+	// Deadline for completing the connection handshake
+	authTimeout time.Duration
+	// Maximum size of a single response, zero for no limit
+	maxMessage int
+	// Maximum number of output lines per second accepted from the plugin
+	maxLines int
+	// Maximum number of calls per second served for the plugin, zero for no limit
+	maxCalls int
+	// Refuse plain TCP connections
+	requireSecure bool
+	// Pass -pingo:hardened to the plugin
+	hardened bool
+	// Keep the raw message in decode errors
+	capturePayload bool
+	// Validate responses before performing calls
+	strict bool
+	// Interval of keepalive pings, zero to disable them
+	keepalive time.Duration
+	// Called when a connection does not answer pings
+	keepaliveDead func(error)
+	// Let the plugin use the other protocol if the requested one fails
+	fallback bool
+	// Soft memory limit of the plugin runtime, zero to leave it unchanged
+	memLimit int64
+	// GC percentage of the plugin runtime, empty to leave it unchanged
+	gcPercent string
+	// Report the end of standard error on abnormal exit
+	diagnostics bool
+	// GODEBUG settings for the plugin in diagnostics mode
+	godebug string
+	// How deadlines of calls are sent
+	deadlines DeadlineMode
+	// Clock offset of a remote plugin above which a warning is reported
+	maxSkew time.Duration
+	// Dump of the data exchanged, if any
+	wireDump *wireDump
+	// Protocol features not to use
+	disabledFeatures Feature
+	// Certificate and key files of a plugin using TLS, if not generated
+	tlsCert, tlsKey string
+	// CA file to verify hosts with, for plugins using TLS
+	tlsClientCA string
+	// Directory of the unix socket and prefix of output lines, if set
+	unixdir, prefix string
+	// Additional flags passed to the plugin
+	flags []string
+	// Pass "--" before the parameters of the plugin
+	separateArgs bool
+	// Pass the flags of this package after the parameters of the plugin
+	flagsLast bool
+	// Codec of calls and its name for the plugin, if not the one of this package
+	codec     ClientCodecFunc
+	codecName string
+	// Expand templates in the parameters, and variables to add to the environment
+	templates   bool
+	templateEnv []string
+	// How the secret of secure connections is passed
+	secretMode SecretMode
+	// Carry all connections to the plugin as sessions of a single one
+	multiplex bool
+	// Limits on the structure of decoded values
+	decodeLimits DecodeLimits
+	// Memory limit of the watchdog of the plugin, zero to disable it
+	watchdog int64
+	// Receives the output lines of the plugin, if set
+	output func(OutputLine)
+	// Latency and errors added to calls, if any
+	simulation Simulation
+	// Kill the plugin when a call times out
+	killOnTimeout bool
+	// Interface and range of ports of plugins using TCP, if set
+	tcpHost, tcpPorts string
+	// Interval and receiver of continuous profiles, if enabled
+	profileEvery time.Duration
+	profileFn    func(*Profile) error
+	// Directory of the handshakes of plugins kept running across hosts, if enabled
+	warmDir string
+}
+
+// Set options for the plugin.
+//
+// Panics if called after Start.
+func (p *Plugin) SetOptions(opts ...Option) {
+	if p.running {
+		panic("Cannot call SetOptions after Start")
+	}
+	for _, o := range opts {
+		o(&p.opts)
+	}
+}
+
+// Hardened enables a set of safe defaults for running untrusted plugins:
+//
+// - the plugin is started with an environment containing only PATH and PINGO_* variables;
+//
+// - unix sockets are placed in a new directory only accessible by the current user, and
+// the plugin creates them with 0600 permissions;
+//
+// - the connection handshake must complete within two seconds on both sides;
+//
+// - the plugin accepts at most 64 TCP connections from each address, and refuses
+// connections from addresses failing the handshake for increasing times (see
+// SetTCPProtection);
+//
+// - responses larger than 16MB are refused, as are more than 1000 output lines per second;
+//
+// - calls of the plugin to the host (see RegisterCallback) are served at most 1000 per
+// second, the others waiting, and are refused if larger than 16MB;
+//
+// - arguments and responses nested more than 64 levels deep or holding more than a million
+// elements are refused (see LimitDecoding);
+//
+// - TCP connections must be secure (see SetSecure), otherwise the plugin is not started.
+func Hardened() Option {
+	return func(o *options) {
+		o.scrubEnv = true
+		o.privateDir = true
+		o.authTimeout = hardenedAuthTimeout
+		o.maxMessage = hardenedMaxMessage
+		o.maxLines = 1000
+		o.maxCalls = 1000
+		o.requireSecure = true
+		o.decodeLimits = hardenedDecodeLimits
+		o.hardened = true
+	}
+}
+
+// CapturePayload makes ErrDecode errors carry the raw message received from the plugin,
+// to debug mismatches between the types of host and plugin. Every response is buffered
+// while it is decoded, so this should not be enabled in production.
+func CapturePayload() Option {
+	return func(o *options) {
+		o.capturePayload = true
+	}
+}
+
+// Fallback lets the plugin listen with TCP if it cannot create its unix socket (for example
+// because the socket directory is not writable), or with a unix socket if no TCP port is
+// available. The fallback is reported via the ErrorHandler. If options require secure
+// connections, a plugin that is not secure and falls back to TCP fails with ErrInsecure.
+func Fallback() Option {
+	return func(o *options) {
+		o.fallback = true
+	}
+}
+
+// Strict makes calls fail immediately with an ErrInvalidReply error if the response
+// is not a non-nil pointer, instead of failing after the call has been performed.
+// In strict mode, replies cannot be discarded by passing a nil response.
+func Strict() Option {
+	return func(o *options) {
+		o.strict = true
+	}
+}
+
+// Check that a reply to method can be decoded into resp.
+func checkReply(method string, resp interface{}) error {
+	if resp == nil {
+		return ErrInvalidReply(errors.New("Response for " + method + " is nil"))
+	}
+	val := reflect.ValueOf(resp)
+	if val.Kind() != reflect.Ptr {
+		return ErrInvalidReply(fmt.Errorf("Response for %s is not a pointer: %T", method, resp))
+	}
+	if val.IsNil() {
+		return ErrInvalidReply(fmt.Errorf("Response for %s is a nil %T", method, resp))
+	}
+	return nil
+}
+
+// Environment for a plugin, keeping only variables that are safe to pass.
+func scrubEnv(env []string) []string {
+	list := make([]string, 0)
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") || strings.HasPrefix(e, "PINGO_") {
+			list = append(list, e)
+		}
+	}
+	return list
+}
+
+// Counts output lines in one second windows.
+type lineLimiter struct {
+	max     int
+	n       int
+	window  time.Time
+	dropped bool
+}
+
+// Returns true if the line can be processed. Reports when lines start being dropped.
+func (l *lineLimiter) allow(report func(error)) bool {
+	if l.max <= 0 {
+		return true
+	}
+	now := time.Now()
+	if now.Sub(l.window) >= time.Second {
+		l.window = now
+		l.n = 0
+		l.dropped = false
+	}
+	l.n++
+	if l.n <= l.max {
+		return true
+	}
+	if !l.dropped {
+		l.dropped = true
+		report(errTooManyLines)
+	}
+	return false
+}
+
+// Delays the calls read by a codec beyond max per second, counted in one second windows.
+// Calls are read by a single goroutine.
+type callLimiter struct {
+	rpc.ServerCodec
+	max    int
+	n      int
+	window time.Time
+}
+
+func (o *options) limitCalls(codec rpc.ServerCodec) rpc.ServerCodec {
+	if o.maxCalls <= 0 {
+		return codec
+	}
+	return &callLimiter{ServerCodec: codec, max: o.maxCalls}
+}
+
+func (c *callLimiter) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.ServerCodec.ReadRequestHeader(r); err != nil {
+		return err
+	}
+	now := time.Now()
+	if now.Sub(c.window) >= time.Second {
+		c.window = now
+		c.n = 0
+	}
+	if c.n++; c.n > c.max {
+		time.Sleep(c.window.Add(time.Second).Sub(now))
+		c.window = time.Now()
+		c.n = 1
+	}
+	return nil
+}
+
+func privateSocketDir(parent string) (string, error) {
+	return os.MkdirTemp(parent, "pingo-")
+}
@@ -0,0 +1,208 @@
+package pingo
+
+import (
+	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+var (
+	errOutboxFull   = ErrOutboxFull(errors.New("Outbox is full"))
+	errOutboxClosed = errors.New("Outbox is closed")
+)
+
+// Error reported when a notification cannot be queued because the outbox has reached its size.
+type ErrOutboxFull error
+
+type outboxEntry struct {
+	Method string
+	Args   interface{}
+	Time   time.Time
+}
+
+// Outbox delivers fire-and-forget notifications to a plugin. Notifications are persisted to
+// a file first and delivered in order; if the plugin is not available, they are kept and
+// delivered once it comes back, also across restarts of the host.
+//
+// Arguments are persisted with "encoding/gob": their concrete types must be registered
+// with gob.Register before use.
+type Outbox struct {
+	p     *Plugin
+	path  string
+	max   int
+	ttl   time.Duration
+	retry time.Duration
+	mu    sync.Mutex
+	queue []*outboxEntry
+	wake  chan struct{}
+	done  chan struct{}
+	ctx   context.Context
+	stop  context.CancelFunc
+}
+
+// NewOutbox creates an outbox delivering to plugin p and persisting notifications in the file
+// at path. Notifications left in the file by a previous run are loaded and delivered.
+//
+// At most max notifications are kept (zero for no limit); notifications older than ttl are
+// dropped without delivery (zero to keep them forever).
+func NewOutbox(p *Plugin, path string, max int, ttl time.Duration) (*Outbox, error) {
+	o := &Outbox{
+		p:     p,
+		path:  path,
+		max:   max,
+		ttl:   ttl,
+		retry: time.Second,
+		wake:  make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+	o.ctx, o.stop = context.WithCancel(context.Background())
+	if err := o.load(); err != nil {
+		return nil, err
+	}
+	go o.deliver()
+	o.signal()
+	return o, nil
+}
+
+// Notify queues a call to method with args. The response of the plugin is discarded; errors
+// returned by the method are reported to the ErrorHandler of the plugin.
+func (o *Outbox) Notify(method string, args interface{}) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.ctx.Err() != nil {
+		return errOutboxClosed
+	}
+	if o.max > 0 && len(o.queue) >= o.max {
+		return errOutboxFull
+	}
+	o.queue = append(o.queue, &outboxEntry{Method: method, Args: args, Time: time.Now()})
+	if err := o.save(); err != nil {
+		o.queue = o.queue[:len(o.queue)-1]
+		return err
+	}
+	o.signal()
+	return nil
+}
+
+// Len returns the number of notifications not yet delivered.
+func (o *Outbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return len(o.queue)
+}
+
+// Close stops delivering notifications. Undelivered notifications remain in the file.
+func (o *Outbox) Close() {
+	o.mu.Lock()
+	o.stop()
+	o.mu.Unlock()
+	<-o.done
+}
+
+func (o *Outbox) signal() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (o *Outbox) load() error {
+	f, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := gob.NewDecoder(f).Decode(&o.queue); err != nil {
+		return fmt.Errorf("Cannot load outbox %s: %s", o.path, err)
+	}
+	return nil
+}
+
+// Must be called with the lock held.
+func (o *Outbox) save() error {
+	tmp := o.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(f).Encode(o.queue); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path)
+}
+
+// Return the first notification to deliver, dropping expired ones.
+func (o *Outbox) head() *outboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	n := 0
+	for n < len(o.queue) && o.ttl > 0 && time.Since(o.queue[n].Time) > o.ttl {
+		n++
+	}
+	if n > 0 {
+		o.queue = o.queue[n:]
+		if err := o.save(); err != nil {
+			o.p.handler.Error(err)
+		}
+	}
+	if len(o.queue) == 0 {
+		return nil
+	}
+	return o.queue[0]
+}
+
+func (o *Outbox) pop() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.queue = o.queue[1:]
+	if err := o.save(); err != nil {
+		o.p.handler.Error(err)
+	}
+}
+
+func (o *Outbox) deliver() {
+	defer close(o.done)
+
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-o.wake:
+		case <-retry:
+		case <-o.ctx.Done():
+			return
+		}
+		retry = nil
+
+		for e := o.head(); e != nil; e = o.head() {
+			err := callContext(o.ctx, o.p, e.Method, e.Args, nil)
+			if o.ctx.Err() != nil {
+				return
+			}
+			if err != nil && !isMethodError(err) {
+				// Plugin is not available, keep the notification for later.
+				retry = time.After(o.retry)
+				break
+			}
+			if err != nil {
+				o.p.handler.Error(fmt.Errorf("Notification %s: %s", e.Method, err))
+			}
+			o.pop()
+		}
+	}
+}
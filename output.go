@@ -0,0 +1,59 @@
+package pingo
+
+import (
+	"io"
+	"path/filepath"
+)
+
+// Streams output lines are read from.
+const (
+	Stdout = "stdout"
+	Stderr = "stderr"
+)
+
+// OutputLine is a line printed by a plugin that is not a message to the host, such as a
+// log line or a panic.
+type OutputLine struct {
+	// Name of the plugin, the base name of its executable
+	Plugin string
+	// Stream the line was printed on, Stdout or Stderr
+	Stream string
+	Text   string
+}
+
+func (l OutputLine) String() string {
+	return l.Plugin + " " + l.Stream + ": " + l.Text
+}
+
+// OnOutput passes the lines printed by the plugin to fn, for example to forward them to a
+// structured logger, instead of the Print method of the ErrorHandler. Lines are passed in
+// the order they are printed on each stream; fn must not block.
+func OnOutput(fn func(OutputLine)) Option {
+	return func(o *options) {
+		o.output = fn
+	}
+}
+
+// ForwardOutput writes the lines printed by the plugin to w, each tagged with the name of
+// the plugin and the stream, as in "plugin stderr: text". Each line is written with a
+// single call to Write, so that the lines of plugins sharing w do not interleave when w is
+// a file or a pipe. Errors writing to w are ignored.
+func ForwardOutput(w io.Writer) Option {
+	return OnOutput(func(l OutputLine) {
+		io.WriteString(w, l.String()+"\n")
+	})
+}
+
+// Handle a line printed by the plugin.
+func (p *Plugin) forwardOutput(l OutputLine) {
+	if p.opts.output == nil {
+		if p.logger != nil {
+			p.logger.Log(LevelInfo, l.Text, Field{"plugin", filepath.Base(p.exe)}, Field{"stream", l.Stream})
+			return
+		}
+		p.handler.Print(l.Text)
+		return
+	}
+	l.Plugin = filepath.Base(p.exe)
+	p.opts.output(l)
+}
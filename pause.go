@@ -0,0 +1,85 @@
+package pingo
+
+import (
+	"context"
+	"sync"
+)
+
+// Pause stops the process of the plugin, with SIGSTOP (or by suspending it on Windows),
+// for example to leave the CPU to the host during latency-critical phases. Calls performed
+// while the plugin is paused wait until Resume is called or their context is done; calls
+// in progress complete after Resume.
+//
+// Connections using Keepalive are found dead if the plugin is paused for longer than the
+// keepalive interval.
+func (p *Plugin) Pause() error {
+	// Wait for the plugin to be ready
+	if _, err := p.request(context.Background()); err != nil {
+		return err
+	}
+	return p.pause.pause(p)
+}
+
+// Resume continues the process of a plugin stopped with Pause and releases the calls
+// waiting for it.
+func (p *Plugin) Resume() error {
+	return p.pause.resume(p)
+}
+
+// Holds calls while the plugin is paused.
+type pauseGate struct {
+	mu sync.Mutex
+	// Closed on resume; nil if not paused
+	resumed chan struct{}
+}
+
+func (g *pauseGate) pause(p *Plugin) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.resumed != nil {
+		return nil
+	}
+	if err := pauseProcess(p); err != nil {
+		return err
+	}
+	g.resumed = make(chan struct{})
+	return nil
+}
+
+func (g *pauseGate) resume(p *Plugin) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.resumed == nil {
+		return nil
+	}
+	err := resumeProcess(p)
+	close(g.resumed)
+	g.resumed = nil
+	return err
+}
+
+func (g *pauseGate) paused() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.resumed != nil
+}
+
+// Wait until the plugin is not paused.
+func (g *pauseGate) wait(ctx context.Context) error {
+	g.mu.Lock()
+	resumed := g.resumed
+	g.mu.Unlock()
+
+	if resumed == nil {
+		return nil
+	}
+	select {
+	case <-resumed:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
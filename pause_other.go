@@ -0,0 +1,15 @@
+//go:build !unix && !windows
+
+package pingo
+
+import "errors"
+
+var errPauseUnsupported = errors.New("Pausing processes is not supported on this system")
+
+func pauseProcess(p *Plugin) error {
+	return errPauseUnsupported
+}
+
+func resumeProcess(p *Plugin) error {
+	return errPauseUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build unix
+
+package pingo
+
+import (
+	"errors"
+	"sync/atomic"
+	"syscall"
+)
+
+func signalProcess(p *Plugin, sig syscall.Signal) error {
+	pid := atomic.LoadInt64(&p.pid)
+	if pid == 0 {
+		return errors.New("Plugin is not running")
+	}
+	return syscall.Kill(int(pid), sig)
+}
+
+func pauseProcess(p *Plugin) error {
+	return signalProcess(p, syscall.SIGSTOP)
+}
+
+func resumeProcess(p *Plugin) error {
+	return signalProcess(p, syscall.SIGCONT)
+}
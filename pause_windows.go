@@ -0,0 +1,42 @@
+package pingo
+
+import (
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"syscall"
+)
+
+var (
+	ntdll            = syscall.NewLazyDLL("ntdll.dll")
+	ntSuspendProcess = ntdll.NewProc("NtSuspendProcess")
+	ntResumeProcess  = ntdll.NewProc("NtResumeProcess")
+)
+
+// Access right required to suspend and resume a process.
+const processSuspendResume = 0x0800
+
+func callProcess(p *Plugin, proc *syscall.LazyProc) error {
+	pid := atomic.LoadInt64(&p.pid)
+	if pid == 0 {
+		return errors.New("Plugin is not running")
+	}
+	h, err := syscall.OpenProcess(processSuspendResume, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+
+	if status, _, _ := proc.Call(uintptr(h)); status != 0 {
+		return fmt.Errorf("%s failed with status 0x%x", proc.Name, status)
+	}
+	return nil
+}
+
+func pauseProcess(p *Plugin) error {
+	return callProcess(p, ntSuspendProcess)
+}
+
+func resumeProcess(p *Plugin) error {
+	return callProcess(p, ntResumeProcess)
+}
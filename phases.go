@@ -0,0 +1,103 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Phase is a group of plugins of a Manager started together by StartContext. A phase
+// begins once the plugins of all previous phases are ready.
+type Phase struct {
+	// Name of the phase, as in "infra", used in errors.
+	Name string
+	// Names of the plugins of the phase, added to the manager with Add.
+	Plugins []string
+	// Wait for the self tests of the plugins to pass (see SetSelfTest), not just for the
+	// plugins to be ready, before the next phase.
+	SelfTest bool
+}
+
+// AddPhase declares the next phase of the startup of the manager. See StartContext.
+func (m *Manager) AddPhase(ph *Phase) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.phases = append(m.phases, ph)
+}
+
+// StartContext starts the plugins phase by phase, in the order the phases were added,
+// waiting for the plugins of each phase to be ready before starting the next phase. The
+// plugins that are not part of any phase are started last, without waiting for them.
+// Schedules begin after all phases.
+//
+// If a plugin of a phase fails or ctx is done, StartContext returns the error without
+// starting further phases; plugins already started keep running until the manager is
+// stopped.
+func (m *Manager) StartContext(ctx context.Context) error {
+	m.mu.Lock()
+	phases := make([]*Phase, len(m.phases))
+	copy(phases, m.phases)
+	m.mu.Unlock()
+
+	started := make(map[string]bool)
+	for _, ph := range phases {
+		var names []string
+		m.mu.Lock()
+		for _, name := range ph.Plugins {
+			p, ok := m.plugins[name]
+			if !ok {
+				m.mu.Unlock()
+				return ErrUnknownPlugin(fmt.Errorf("Unknown plugin %s in phase %s", name, ph.Name))
+			}
+			if started[name] {
+				continue
+			}
+			started[name] = true
+			names = append(names, name)
+			p.Start()
+			m.startSelfTest(name, p)
+		}
+		m.mu.Unlock()
+
+		for _, name := range names {
+			if err := m.phaseReady(ctx, name, ph.SelfTest); err != nil {
+				return fmt.Errorf("Phase %s: plugin %s: %w", ph.Name, name, err)
+			}
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// Plugins added meanwhile have not been started, as the manager is not running yet
+	m.running = true
+	for _, name := range m.names {
+		if !started[name] {
+			m.plugins[name].Start()
+			m.startSelfTest(name, m.plugins[name])
+		}
+	}
+	for _, s := range m.schedules {
+		s.start(m)
+	}
+	m.startQuota()
+	m.startChaos()
+	m.startWatchdog()
+	return nil
+}
+
+// Wait for the named plugin to be ready and, if selfTest is set, to pass its self test.
+func (m *Manager) phaseReady(ctx context.Context, name string, selfTest bool) error {
+	p := m.Plugin(name)
+	if p == nil {
+		return errors.New("Removed during startup")
+	}
+	if _, err := p.request(ctx); err != nil {
+		return err
+	}
+	if selfTest {
+		return m.selfTested(ctx, name)
+	}
+	return nil
+}
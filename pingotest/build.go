@@ -0,0 +1,144 @@
+package pingotest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Serializes builds within the test binary.
+var buildMu sync.Mutex
+
+// Build compiles the plugin in package pkg, a directory such as "./testdata/plugin" or an
+// import path, and returns the path of the executable. Executables are cached in the user
+// cache directory, keyed by a hash of the sources of the package and its dependencies
+// outside of the standard library, including embedded and cgo files, and of the settings
+// of the go command: tests only rebuild plugins whose code or toolchain has changed.
+//
+// The test fails if the plugin cannot be built.
+func Build(t testing.TB, pkg string) string {
+	t.Helper()
+
+	buildMu.Lock()
+	defer buildMu.Unlock()
+
+	key, err := sourceHash(pkg)
+	if err != nil {
+		t.Fatalf("Cannot list sources of %s: %v", pkg, err)
+	}
+	dir, err := cacheDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	exe := filepath.Join(dir, key)
+	if runtime.GOOS == "windows" {
+		exe += ".exe"
+	}
+	if _, err := os.Stat(exe); err == nil {
+		return exe
+	}
+
+	// Build beside the executable and rename, so that other test binaries building the
+	// same plugin never see a partial file.
+	f, err := os.CreateTemp(dir, key+"-*.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmp := f.Name()
+	f.Close()
+	out, err := exec.Command("go", "build", "-o", tmp, pkg).CombinedOutput()
+	if err != nil {
+		os.Remove(tmp)
+		t.Fatalf("Cannot build %s: %v\n%s", pkg, err, out)
+	}
+	if err := os.Rename(tmp, exe); err != nil {
+		os.Remove(tmp)
+		t.Fatal(err)
+	}
+	return exe
+}
+
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	dir = filepath.Join(dir, "pingotest")
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// Files of a package that are inputs of its build, as listed by "go list".
+var sourceFiles = []string{
+	"GoFiles", "CgoFiles", "CFiles", "CXXFiles", "MFiles", "HFiles", "FFiles", "SFiles",
+	"SwigFiles", "SwigCXXFiles", "SysoFiles", "EmbedFiles",
+}
+
+// Settings of the go command changing what it builds.
+var buildEnv = []string{
+	"GOVERSION", "GOOS", "GOARCH", "GOFLAGS", "GOEXPERIMENT", "GOAMD64", "GOARM", "GOARM64",
+	"CGO_ENABLED", "CC", "CXX", "CGO_CFLAGS", "CGO_CPPFLAGS", "CGO_CXXFLAGS", "CGO_LDFLAGS",
+}
+
+// Hash the input files of pkg and of its dependencies outside the standard library, with
+// the go.mod files of their modules, together with the settings of the go command.
+func sourceHash(pkg string) (string, error) {
+	format := "{{if not .Standard}}{{.Dir}}"
+	for _, field := range sourceFiles {
+		format += "{{range ." + field + "}}\t{{.}}{{end}}"
+	}
+	format += "{{with .Module}}{{if .GoMod}}\t{{.GoMod}}{{end}}{{end}}{{end}}"
+	out, err := goCommand("list", "-deps", "-f", format, pkg)
+	if err != nil {
+		return "", err
+	}
+	env, err := goCommand(append([]string{"env"}, buildEnv...)...)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	io.WriteString(h, env)
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		fields := strings.Split(line, "\t")
+		for _, name := range fields[1:] {
+			path := name
+			if !filepath.IsAbs(path) {
+				path = filepath.Join(fields[0], name)
+			}
+			io.WriteString(h, path+"\n")
+			if err := hashFile(h, path); err != nil {
+				return "", err
+			}
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))[:32], nil
+}
+
+// Run the go command and return its output.
+func goCommand(args ...string) (string, error) {
+	out, err := exec.Command("go", args...).Output()
+	if err != nil {
+		if eerr, ok := err.(*exec.ExitError); ok {
+			err = fmt.Errorf("%v: %s", err, eerr.Stderr)
+		}
+		return "", err
+	}
+	return string(out), nil
+}
+
+func hashFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,99 @@
+// Package pingotest helps writing tests of hosts and plugins using pingo.
+//
+// Plugins started with Start, or served in the process of the test with NewInProcess,
+// are stopped when the test ends, their sockets are removed and the test fails if the
+// plugin failed:
+//
+//	func TestHello(t *testing.T) {
+//		p := pingotest.Start(t, "./plugins/hello-world/hello-world")
+//		var resp string
+//		if err := p.Call("MyPlugin.SayHello", "test", &resp); err != nil {
+//			t.Fatal(err)
+//		}
+//	}
+package pingotest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+)
+
+// Maximum time for a plugin to stop when the test ends.
+const stopTimeout = 5 * time.Second
+
+// Start starts the plugin at path with the specified parameters, connected via a unix
+// socket in a temporary directory. The plugin is stopped when the test ends, see Setup.
+func Start(t testing.TB, path string, params ...string) *pingo.Plugin {
+	t.Helper()
+
+	p := pingo.NewPlugin("unix", path, params...)
+	Setup(t, p)
+	p.Start()
+	return p
+}
+
+// NewInProcess starts a plugin exporting objs from the process of the test, connected via
+// in-memory pipes, so that hosts and plugins can be tested together without building an
+// executable (see pingo.NewInProcessPlugin). The plugin is stopped when the test ends, see
+// Setup.
+func NewInProcess(t testing.TB, objs ...interface{}) *pingo.Plugin {
+	t.Helper()
+
+	p := pingo.NewInProcessPlugin(func(s *pingo.Server) {
+		for _, obj := range objs {
+			s.Register(obj)
+		}
+	})
+	Setup(t, p)
+	p.Start()
+	return p
+}
+
+// Setup prepares a plugin that is not started for use in the test: its output and errors
+// are logged to the test, and its socket is placed in a temporary directory. When the test
+// ends, the plugin is stopped, the directory is removed and the test fails if the plugin
+// reported a fatal error, crashed or did not exit cleanly. Tests must not stop the plugin
+// themselves.
+func Setup(t testing.TB, p *pingo.Plugin) {
+	t.Helper()
+
+	// Not t.TempDir: its path can be too long for a unix socket
+	dir, err := os.MkdirTemp("", "pingotest-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.SetSocketDirectory(dir)
+	p.SetErrorHandler(&handler{t: t, name: p.String()})
+	t.Cleanup(func() {
+		defer os.RemoveAll(dir)
+
+		ctx, cancel := context.WithTimeout(context.Background(), stopTimeout)
+		defer cancel()
+		// Errors of the plugin are reported to calls
+		if _, err := p.Ping(ctx); err != nil {
+			t.Errorf("Plugin %s failed: %v", p, err)
+		}
+		if err := p.StopContext(ctx); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+// Logs the output and errors of a plugin to the test.
+type handler struct {
+	t    testing.TB
+	name string
+}
+
+func (h *handler) Error(err error) {
+	h.t.Log(fmt.Sprintf("%s: error: %v", h.name, err))
+}
+
+func (h *handler) Print(s interface{}) {
+	h.t.Log(fmt.Sprintf("%s: %v", h.name, s))
+}
@@ -1,10 +1,18 @@
 // Package pingo implements the basics for creating and running subprocesses
 // as plugins.  The subprocesses will communicate via either TCP or Unix socket
 // to implement an interface that mimics the standard RPC package.
+//
+// Plugins register their objects with Register and serve them with Run. Hosts
+// create a Plugin for each executable with NewPlugin: Start spawns the process,
+// reads the address (and secret, if secure) it reports on its output and connects
+// to it, Call performs calls and Stop shuts the process down.
 package pingo
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -13,12 +21,18 @@ import (
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 var (
 	errInvalidMessage      = ErrInvalidMessage(errors.New("Invalid ready message"))
 	errRegistrationTimeout = ErrRegistrationTimeout(errors.New("Registration timed out"))
+	errOverloaded          = ErrOverloaded(errors.New("Plugin is overloaded"))
+	errNoSecret            = ErrHandshake(errors.New("Plugin did not provide a secret for a secure connection"))
+	errInsecure            = ErrInsecure(errors.New("Refusing to use TCP without a secure connection"))
+	errTooManyLines        = errors.New("Plugin produces too much output, dropping lines")
 )
 
 // Represents a plugin. After being created the plugin is not started or ready to run.
@@ -34,12 +48,56 @@ type Plugin struct {
 	initTimeout time.Duration
 	exitTimeout time.Duration
 	handler     ErrorHandler
-	running     bool
-	meta        meta
-	objsCh      chan *objects
-	connCh      chan *conn
-	killCh      chan *waiter
-	exitCh      chan struct{}
+	// Receives the records of the plugin instead of handler, if set
+	logger  Logger
+	jobs    *JobQueue
+	secure  bool
+	opts    options
+	running bool
+	meta    meta
+	objsCh  chan *objects
+	connCh  chan *conn
+	killCh  chan *waiter
+	exitCh  chan struct{}
+	// Held while stopping, which clears running
+	stopMu sync.Mutex
+	// Kill the process being stopped even if kept warm; set while holding stopMu
+	killWarm bool
+
+	// Connection lifecycle hooks
+	onConnect    func(*Plugin)
+	onDisconnect func(*Plugin)
+	// Incremented each time the plugin reports its objects; accessed atomically
+	gen uint32
+	// Methods reported as deprecated by the plugin
+	deprecated deprecations
+	// Directory for the state of the plugin, if any
+	statedir string
+	// Process ID of the plugin, zero if not running; accessed atomically
+	pid int64
+	// Delays injected in calls through a Manager (see Chaos)
+	chaosDelay chaosDelay
+	// Holds calls while paused
+	pause pauseGate
+	// Configuration pushed with UpdateConfig
+	config hostConfig
+	// Connect with TLS, verifying the plugin with tlsConfig if set (see SetTLS)
+	tls       bool
+	tlsConfig *tls.Config
+	// Restarts of the process when it exits (see SetRestartPolicy)
+	restart restarter
+	// Objects called by the plugin, if any
+	callbacks *rpc.Server
+	// Checksum the executable must match, if set
+	checksum string
+	// Maximum duration of calls, zero for no limit
+	callTimeout time.Duration
+	// Sets up the server of a plugin running in process, if any, and the running one
+	inProcessSetup func(*Server)
+	inProcess      atomic.Value
+	// Phases of the last start, and the function notified of each
+	startup   atomic.Value
+	onStartup func(*Plugin, *Startup)
 }
 
 // NewPlugin create a new plugin ready to be started, or returns an error if the initial setup fails.
@@ -58,6 +116,10 @@ func NewPlugin(proto, path string, params ...string) *Plugin {
 	if proto != "unix" && proto != "tcp" {
 		panic("Invalid protocol. Specify 'unix' or 'tcp'.")
 	}
+	return newPlugin(proto, path, params...)
+}
+
+func newPlugin(proto, path string, params ...string) *Plugin {
 	p := &Plugin{
 		exe:         path,
 		proto:       proto,
@@ -83,6 +145,7 @@ func (p *Plugin) SetErrorHandler(h ErrorHandler) {
 		panic("Cannot call SetErrorHandler after Start")
 	}
 	p.handler = h
+	p.logger = nil
 }
 
 // Set the maximum time a plugin is allowed to start up and to shut down.  Empty timeout (zero)
@@ -109,6 +172,31 @@ func (p *Plugin) SetSocketDirectory(dir string) {
 	p.unixdir = dir
 }
 
+// Set the job queue this plugin can pull jobs from (see JobQueue). The same queue can
+// be shared by several plugins.
+//
+// Panics if called after Start.
+func (p *Plugin) SetJobQueue(q *JobQueue) {
+	if p.running {
+		panic("Cannot call SetJobQueue after Start")
+	}
+	p.jobs = q
+}
+
+// Encrypt the connection to the plugin. On start, the plugin generates a secret and passes
+// it to the host via its output; host and plugin then perform an ephemeral key exchange
+// authenticated by the secret for each connection, and all traffic is encrypted and
+// authenticated with the resulting session keys. This protects TCP connections from
+// eavesdropping and tampering without requiring TLS certificates.
+//
+// Panics if called after Start.
+func (p *Plugin) SetSecure(secure bool) {
+	if p.running {
+		panic("Cannot call SetSecure after Start")
+	}
+	p.secure = secure
+}
+
 // Default string representation
 func (p *Plugin) String() string {
 	return fmt.Sprintf("%s %s", p.exe, strings.Join(p.params, " "))
@@ -119,37 +207,113 @@ func (p *Plugin) String() string {
 //
 // Calls subsequent to Start will hang until the plugin has been properly initialized.
 func (p *Plugin) Start() {
+	if p.opts.unixdir != "" {
+		p.unixdir = p.opts.unixdir
+	}
+	if p.opts.prefix != "" {
+		p.meta = meta(p.opts.prefix)
+	}
 	p.running = true
 	go p.run()
 }
 
 // Stop attemps to stop cleanly or kill the running plugin, then will free all resources.
 // Stop returns when the plugin as been shut down and related routines have exited.
+// Stopping a plugin that is not running has no effect.
 func (p *Plugin) Stop() {
-	wr := newWaiter()
-	p.killCh <- wr
-	wr.wait()
-	p.exitCh <- struct{}{}
+	p.StopContext(context.Background())
 }
 
 // Call performs an RPC call to the plugin. Prior to calling Call, the plugin must have been
 // initialized by calling Start.
 //
 // Call will hang until a plugin has been initialized; it will return any error that happens
-// either when performing the call or during plugin initialization via Start.
+// either when performing the call or during plugin initialization via Start. Calls fail
+// with an ErrTimeout error if they take longer than the timeout set with SetCallTimeout.
+//
+// If the plugin has reported to be overloaded (see SetOverloaded), Call fails immediately
+// with an ErrOverloaded error.
+//
+// If the reply cannot be decoded into resp, Call returns an *ErrDecode error. See also
+// the Strict option.
 //
 // Please refer to the "rpc" package from the standard library for more information on the
 // semantics of this function.
 func (p *Plugin) Call(name string, args interface{}, resp interface{}) error {
-	conn := &conn{wr: newWaiter()}
-	p.connCh <- conn
-	conn.wr.wait()
+	return callContext(context.Background(), p, name, args, resp)
+}
+
+// CallContext is like Call, but returns early with the error of ctx if ctx is done before
+// the reply is received; the context of the method in the plugin, if it takes one, is then
+// cancelled too. Context values declared with BridgeContext are passed to the plugin.
+func (p *Plugin) CallContext(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	return callContext(ctx, p, name, args, resp)
+}
+
+// Call is a call to a plugin performed asynchronously (see Go).
+type Call struct {
+	// Name of the method, arguments and reply of the call
+	ServiceMethod string
+	Args          interface{}
+	Reply         interface{}
+	// Error of the call, once complete
+	Error error
+	// Receives the call itself once complete
+	Done chan *Call
+}
+
+// Go performs an RPC call to the plugin asynchronously, as the Go method of rpc.Client
+// does: once the plugin is ready, the call is sent and Go returns. Once the call is
+// complete, Error is set as Call would return it and the call is sent on done. Calls to
+// many plugins can thus run concurrently without a goroutine of the caller waiting for
+// each.
+//
+// If done is nil, Go allocates a new channel. Otherwise done must be buffered, or Go will
+// panic; calls completing while it is full are dropped and reported to the ErrorHandler.
+func (p *Plugin) Go(name string, args interface{}, resp interface{}, done chan *Call) *Call {
+	return p.GoContext(context.Background(), name, args, resp, done)
+}
+
+// GoContext is like Go, but the call is performed as by CallContext.
+func (p *Plugin) GoContext(ctx context.Context, name string, args interface{}, resp interface{}, done chan *Call) *Call {
+	if done == nil {
+		done = make(chan *Call, 10)
+	} else if cap(done) == 0 {
+		panic("pingo: done channel is unbuffered")
+	}
+	call := &Call{ServiceMethod: name, Args: args, Reply: resp, Done: done}
+	sent, err := sendCall(ctx, p, p.callTimeout, name, args, resp)
+	if err != nil {
+		call.Error = err
+		p.callDone(call)
+		return call
+	}
+	go func() {
+		call.Error = timedOut(ctx, p, p.callTimeout, name, sent.wait())
+		p.callDone(call)
+	}()
+	return call
+}
+
+func (p *Plugin) callDone(call *Call) {
+	select {
+	case call.Done <- call:
+	default:
+		p.handler.Error(errors.New("Dropping call " + call.ServiceMethod + ": Done channel is full"))
+	}
+}
 
-	if conn.err != nil {
-		return conn.err
+// Wait for the plugin to be initialized and return the connection details.
+func (p *Plugin) request(ctx context.Context) (*conn, error) {
+	conn := &conn{wr: newWaiter()}
+	select {
+	case p.connCh <- conn:
+	case <-ctx.Done():
+		return nil, ctx.Err()
 	}
+	conn.wr.wait()
 
-	return conn.client.Call(name, args, resp)
+	return conn, conn.err
 }
 
 // Objects returns a list of the exported objects from the plugin. Exported objects used
@@ -197,13 +361,29 @@ func (e *DefaultErrorHandler) Print(s interface{}) {
 const internalObject = "PingoRpc"
 
 type conn struct {
-	client *rpc.Client
-	err    error
-	wr     *waiter
+	client      *rpc.Client
+	codec       *gobClientCodec
+	proto, addr string
+	secret      string
+	err         error
+	wr          *waiter
+
+	pid  int
+	skew clockSkew
+	// Protocol features negotiated with the plugin
+	features Feature
+	// IDs of methods by name, if negotiated
+	methodIDs map[string]string
+	// Handshake sent by the plugin, if any
+	hello *hello
+	// Opens further connections to the plugin
+	dialer *dialer
 }
 
 type waiter struct {
 	c chan struct{}
+	// Result of the operation waited for, if any
+	err error
 }
 
 func newWaiter() *waiter {
@@ -233,6 +413,8 @@ type ctrl struct {
 	objs []string
 	// Protocol and address for RPC
 	proto, addr string
+	// Secret for the key exchange, if the connection is secure
+	secret string
 	// Unrecoverable error is used as response to calls after it happened.
 	err error
 	// This channel is an alias to p.connCh. It allows to
@@ -245,21 +427,61 @@ type ctrl struct {
 	// Get notification from Wait on the subprocess
 	waitCh chan error
 	// Get output lines from subprocess
-	linesCh chan string
+	linesCh chan OutputLine
 	// Respond to a routine waiting for this mail loop to exit.
 	over *waiter
 	// Executable
 	proc *os.Process
 	// RPC client to subprocess
 	client *rpc.Client
+	codec  *gobClientCodec
+	// Plugin reported it cannot take more calls
+	overloaded bool
+	// Limit on output lines accepted from the plugin
+	lines lineLimiter
+	// Private directory for the unix socket, removed on exit
+	privdir string
+	// Private directory of the verified copy of the executable, removed on exit
+	exedir string
+	// Process ID of the plugin
+	pid int
+	// Closed when the connect hook has returned; nil if not connected
+	hooked chan struct{}
+	// Details of the next fatal error, if reported by the plugin
+	fatalInfo *FatalInfo
+	// Offset of the clock of the plugin, if measured
+	skew clockSkew
+	// The process was killed on request, as it was not ready
+	killed bool
+	// Protocol features negotiated with the plugin
+	features Feature
+	// IDs of methods by name, if negotiated
+	methodIDs map[string]string
+	// Fingerprint of the TLS certificate of the plugin
+	tlsCert string
+	// Read end of the pipe passing the secret, inherited by the process
+	secretPipe *os.File
+	// Secret of the job queue, if any
+	jobsSecret string
+	// Handshake sent by the plugin, nil for plugins predating it
+	hello *hello
+	// Opens connections to the plugin once ready
+	dialer *dialer
+	// When the process was started, and the phases of its startup
+	execStart time.Time
+	startup   *Startup
+	// Process kept running across hosts, if any, and whether the host left it running
+	warm     *warm
+	detached bool
 }
 
 func newCtrl(p *Plugin, t time.Duration) *ctrl {
 	return &ctrl{
 		p:         p,
 		timeoutCh: time.After(t),
-		linesCh:   make(chan string),
+		linesCh:   make(chan OutputLine),
 		waitCh:    make(chan error),
+		lines:     lineLimiter{max: p.opts.maxLines},
 	}
 }
 
@@ -291,30 +513,85 @@ func (c *ctrl) ready(val string) bool {
 		return false
 	}
 
-	c.client, err = rpc.DialHTTP(c.proto, c.addr)
-	if err != nil {
-		c.fatal(err)
+	if c.p.secure && c.secret == "" {
+		c.fatal(errNoSecret)
+		return false
+	}
+
+	// The plugin might have fallen back to TCP
+	if c.p.opts.requireSecure && c.proto == "tcp" && c.secret == "" && !c.p.tls {
+		c.fatal(errInsecure)
 		return false
 	}
 
-	// Remove the temp socket now that we are connected
-	if c.proto == "unix" {
+	cred := &credentials{secret: c.secret}
+	if c.p.tls {
+		if cred.tls, err = c.clientTLS(c.addr); err != nil {
+			c.fatal(err)
+			return false
+		}
+	}
+	c.dialer = &dialer{proto: c.proto, addr: c.addr, cred: cred, opts: &c.p.opts}
+	if c.p.opts.multiplex && c.features.Has(FeatureMultiplex) {
+		conn, br, err := c.dialFirst(muxPath)
+		if err != nil {
+			c.fatal(err)
+			return false
+		}
+		c.dialer.mux = newMuxSession(&bufConn{conn, br}, true)
+		c.client, c.codec, err = c.dialer.client(false)
+		if err != nil {
+			c.fatal(err)
+			return false
+		}
+	} else {
+		conn, br, err := c.dialFirst(c.p.opts.callPath())
+		if err != nil {
+			c.fatal(err)
+			return false
+		}
+		c.client, c.codec = newClient(conn, br, c.dialer.opts, false)
+	}
+	readyChild(c.pid, c.proto, c.addr)
+	c.serveCallbacks()
+
+	// Remove the temp socket now that we are connected, unless streams, redials or the next
+	// host need new connections; it is then removed on exit.
+	if c.proto == "unix" && c.dialer.mux == nil && (c.hello == nil || len(c.hello.Streams) == 0 && !c.hello.Redial) && c.warm == nil {
 		if err := os.Remove(c.addr); err != nil {
 			c.p.handler.Error(errors.New("Cannot remove temporary socket: " + err.Error()))
 		}
 	}
 
+	c.checkClock()
+
 	// Defuse the timeout on ready
 	c.timeoutCh = nil
 
 	return true
 }
 
-func (c *ctrl) readOutput(r io.Reader) {
+// Dial a new connection for calls if the plugin has closed the current one, as it does
+// when applying its ConnLimits.
+func (c *ctrl) redial() {
+	if c.codec == nil || !c.codec.closedByPlugin() {
+		return
+	}
+	client, codec, err := c.dialer.client(false)
+	if err != nil {
+		c.p.handler.Error(errors.New("Cannot reconnect to plugin: " + err.Error()))
+		return
+	}
+	c.client.Close()
+	c.client, c.codec = client, codec
+	c.collectProfiles(client)
+}
+
+func (c *ctrl) readOutput(r io.Reader, stream string) {
 	scanner := bufio.NewScanner(r)
 
 	for scanner.Scan() {
-		c.linesCh <- scanner.Text()
+		c.linesCh <- OutputLine{Stream: stream, Text: scanner.Text()}
 	}
 }
 
@@ -323,10 +600,15 @@ func (c *ctrl) waitErr(pidCh chan<- int, err error) {
 	c.waitCh <- err
 }
 
-func (c *ctrl) wait(pidCh chan<- int, exe string, params ...string) {
+func (c *ctrl) wait(pidCh chan<- int, env []string, exe string, params ...string) {
 	defer close(c.waitCh)
 
 	cmd := exec.Command(exe, params...)
+	cmd.Env = env
+	if c.secretPipe != nil {
+		cmd.ExtraFiles = []*os.File{c.secretPipe}
+		defer c.secretPipe.Close()
+	}
 
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
@@ -346,13 +628,177 @@ func (c *ctrl) wait(pidCh chan<- int, exe string, params ...string) {
 	pidCh <- cmd.Process.Pid
 	close(pidCh)
 
-	c.readOutput(stdout)
-	c.readOutput(stderr)
+	// Read standard error concurrently, as a large crash report could fill its pipe.
+	var tail *tailWriter
+	if c.p.opts.diagnostics {
+		tail = &tailWriter{max: diagnosticsTail}
+		stderr = io.NopCloser(io.TeeReader(stderr, tail))
+	}
+	stderrDone := make(chan struct{})
+	go func() {
+		c.readOutput(stderr, Stderr)
+		close(stderrDone)
+	}()
+	c.readOutput(stdout, Stdout)
+	<-stderrDone
+
+	err = cmd.Wait()
+	if _, ok := err.(*exec.ExitError); ok && tail != nil {
+		err = &ErrExited{Output: tail.String(), Err: err}
+	}
+	c.waitCh <- err
+}
 
-	c.waitCh <- cmd.Wait()
+// Build the parameters and start the plugin process.
+func (c *ctrl) start() {
+	p := c.p
+	unixdir := p.unixdir
+	if p.proto == "unix" && p.opts.privateDir && p.opts.warmDir == "" {
+		dir, err := privateSocketDir(p.unixdir)
+		if err != nil {
+			p.handler.Error(errors.New("Cannot create private socket directory: " + err.Error()))
+		} else {
+			c.privdir, unixdir = dir, dir
+		}
+	}
+
+	params := []string{
+		"-pingo:prefix=" + string(p.meta),
+		"-pingo:proto=" + p.proto,
+	}
+	if (p.proto == "unix" || p.opts.fallback) && unixdir != "" {
+		params = append(params, "-pingo:unixdir="+unixdir)
+	}
+	if p.opts.fallback {
+		params = append(params, "-pingo:fallback")
+	}
+	if p.secure {
+		params = append(params, "-pingo:secure")
+	}
+	if p.callbacks != nil {
+		params = append(params, "-pingo:callbacks")
+	}
+	if p.tls {
+		params = append(params, p.opts.tlsParams()...)
+	}
+	if p.opts.hardened {
+		params = append(params, "-pingo:hardened")
+	}
+	params = append(params, p.opts.memoryParams()...)
+	if p.opts.profileEvery > 0 && p.opts.profileFn != nil {
+		params = append(params, "-pingo:profile")
+	}
+	params = append(params, p.opts.decodeParams()...)
+	if p.opts.codecName != "" {
+		params = append(params, "-pingo:codec="+p.opts.codecName)
+	}
+	if p.proto == "tcp" || p.opts.fallback {
+		params = append(params, p.opts.tcpParams()...)
+	}
+	launch := &Launch{Proto: p.proto, Prefix: string(p.meta)}
+	if p.proto == "unix" {
+		launch.SocketDir = unixdir
+	}
+	if p.statedir != "" {
+		if err := createStateDir(p.statedir); err != nil {
+			p.handler.Error(errors.New("Cannot create state directory: " + err.Error()))
+		} else {
+			params = append(params, "-pingo:statedir="+p.statedir)
+			launch.StateDir = p.statedir
+		}
+	}
+	if p.jobs != nil {
+		if addr, err := p.jobs.listen(p.proto, p.unixdir); err != nil {
+			p.handler.Error(errors.New("Cannot listen for job queue: " + err.Error()))
+		} else {
+			params = append(params, "-pingo:jobs="+addr)
+			c.jobsSecret = p.jobs.secret
+		}
+	}
+	params = append(params, p.opts.flags...)
+	env := p.opts.env()
+	args := p.params
+	exe, err := c.verifiedExe()
+	if err == nil {
+		env, err = c.hostSecret(env)
+		launch.Secret = c.secret
+	}
+	if err == nil && c.jobsSecret != "" {
+		if env == nil {
+			env = os.Environ()
+		}
+		env = append(env, envJobsSecret+"="+c.jobsSecret)
+	}
+	if err == nil && p.opts.templates {
+		args, env, err = p.opts.expandTemplates(args, env, launch)
+	}
+	if p.opts.flagsLast {
+		params = append(append([]string(nil), args...), params...)
+	} else {
+		if p.opts.separateArgs {
+			params = append(params, "--")
+		}
+		params = append(params, args...)
+	}
+	if err == nil && p.opts.warmDir != "" && p.inProcessSetup == nil {
+		var werr error
+		if c.warm, werr = c.openWarm(params); werr != nil {
+			p.handler.Error(errors.New("Cannot keep plugin warm: " + werr.Error()))
+		}
+	}
+	if c.warm != nil && c.warm.adopted {
+		// The process has the secret and the prefix of the host that started it
+		c.secret = c.warm.entry.Secret
+		p.meta = meta(c.warm.entry.Prefix)
+		if c.secretPipe != nil {
+			c.secretPipe.Close()
+			c.secretPipe = nil
+		}
+	}
+
+	pidCh := make(chan int)
+	c.execStart = time.Now()
+	if err != nil {
+		go c.waitErr(pidCh, err)
+	} else if p.inProcessSetup != nil {
+		go c.serveInProcess(pidCh, params)
+	} else if c.warm != nil {
+		go c.warm.run(c, pidCh, env, exe, params)
+	} else {
+		go c.wait(pidCh, env, exe, params...)
+	}
+	pid := <-pidCh
+
+	if pid != 0 {
+		if proc, err := os.FindProcess(pid); err == nil {
+			c.proc = proc
+		}
+	}
+	c.pid = pid
+	atomic.StoreInt64(&p.pid, int64(pid))
+	if pid != 0 {
+		addChild(p, pid)
+	}
+}
+
+// Remove resources left behind by the process.
+func (c *ctrl) cleanup() {
+	// The socket is left behind if the plugin exits before the host connects
+	if c.proto == "unix" && c.addr != "" && !c.detached {
+		os.Remove(c.addr)
+	}
+	if c.privdir != "" {
+		os.RemoveAll(c.privdir)
+		c.privdir = ""
+	}
+	if c.exedir != "" {
+		os.RemoveAll(c.exedir)
+		c.exedir = ""
+	}
 }
 
 func (c *ctrl) kill() {
+	c.p.killInProcess()
 	if c.proc == nil {
 		return
 	}
@@ -372,7 +818,7 @@ func (c *ctrl) parseReady(str string) error {
 		return errInvalidMessage
 	}
 	proto := str[0:s]
-	if proto != "unix" && proto != "tcp" {
+	if proto != "unix" && proto != "tcp" && proto != pipeProto {
 		return errInvalidMessage
 	}
 	c.proto = proto
@@ -400,43 +846,31 @@ func (c *ctrl) objects() []string {
 }
 
 func (p *Plugin) run() {
-	var unixdir string
-
 	if p.unixdir == "" {
 		p.unixdir = os.TempDir()
 	}
 
-	paramsize := len(p.params) + 2
-	if p.proto == "unix" && p.unixdir != "" {
-		unixdir = "-pingo:unixdir=" + p.unixdir
-		paramsize += 1
-	}
-	offset := 2
-	params := make([]string, paramsize)
-	params[0] = "-pingo:prefix=" + string(p.meta)
-	params[1] = "-pingo:proto=" + p.proto
-	if unixdir != "" {
-		params[2] = unixdir
-		offset += 1
-	}
-
-	for i := 0; i < len(p.params); i++ {
-		params[i+offset] = p.params[i]
-	}
 	c := newCtrl(p, p.initTimeout)
 
-	pidCh := make(chan int)
-	go c.wait(pidCh, p.exe, params...)
-	pid := <-pidCh
-
-	if pid != 0 {
-		if proc, err := os.FindProcess(pid); err == nil {
-			c.proc = proc
-		}
+	if p.opts.requireSecure && p.proto == "tcp" && !p.secure && !p.tls {
+		c.fatal(errInsecure)
+		// No process will be waited for
+		c.waitCh = nil
+		c.linesCh = nil
+	} else {
+		c.start()
+		p.restart.started = time.Now()
 	}
+	// Fires when the process must be restarted
+	var restartCh <-chan time.Time
 
 	for {
 		select {
+		case <-restartCh:
+			restartCh = nil
+			c = newCtrl(p, p.initTimeout)
+			c.start()
+			p.restart.started = time.Now()
 		case <-c.timeoutCh:
 			c.fatal(errRegistrationTimeout)
 		case r := <-c.connCh:
@@ -445,8 +879,21 @@ func (p *Plugin) run() {
 				r.wr.done()
 				continue
 			}
+			if c.overloaded {
+				r.err = errOverloaded
+				r.wr.done()
+				continue
+			}
 
-			r.client = c.client
+			c.redial()
+			r.client, r.codec = c.client, c.codec
+			r.proto, r.addr, r.secret = c.proto, c.addr, c.secret
+			r.pid, r.skew = c.pid, c.skew
+			r.features, r.hello = c.features, c.hello
+			if c.features.Has(FeatureMethodIDs) {
+				r.methodIDs = c.methodIDs
+			}
+			r.dialer = c.dialer
 			r.wr.done()
 		case o := <-c.objsCh:
 			if c.isFatal() {
@@ -458,32 +905,74 @@ func (p *Plugin) run() {
 			o.list = c.objects()
 			o.wr.done()
 		case line := <-c.linesCh:
-			key, val := p.meta.parse(line)
+			if !c.lines.allow(p.handler.Error) {
+				continue
+			}
+			key, val := p.meta.parse(line.Text)
+			if c.warm != nil {
+				c.warm.record(key, line.Text)
+			}
 			switch key {
-			case "fatal":
-				if err := parseError(val); err != nil {
-					c.fatal(err)
-				} else {
-					c.fatal(errors.New(val))
+			case "fatal-info":
+				c.fatalInfo = new(FatalInfo)
+				if err := json.Unmarshal([]byte(val), c.fatalInfo); err != nil {
+					c.fatalInfo = nil
 				}
+			case "fatal":
+				info := c.fatalInfo
+				c.fatalInfo = nil
+				c.fatal(parseFatal(val, info))
 			case "error":
-				if err := parseError(val); err != nil {
-					p.handler.Print(err)
-				} else {
-					p.handler.Print(errors.New(val))
+				err := parseError(val)
+				if err == nil {
+					err = errors.New(val)
+				}
+				p.report(LevelWarn, err, "Plugin reported an error", Field{"error", err})
+			case "handshake":
+				if err := c.checkHello(val); err != nil {
+					c.fatal(err)
 				}
 			case "objects":
 				c.objs = strings.Split(val, ", ")
+				atomic.AddUint32(&p.gen, 1)
+			case "deprecated":
+				p.deprecated.add(val)
+			case "overload":
+				c.overloaded = val == "on"
+			case "memory":
+				p.memoryReport(val)
+			case "methods":
+				c.methodIDs = parseMethodIDs(val)
+			case "features":
+				c.features = parseFeatures(val) & supportedFeatures &^ p.opts.disabledFeatures
+			case "auth-token":
+				c.secret = val
+			case "tls-cert":
+				c.tlsCert = val
+			case "auth-failure":
+				p.report(LevelError, ErrHandshake(errors.New("Plugin rejected a connection: "+val)), "Plugin rejected a connection", Field{"reason", val})
+			case "startup":
+				c.parseStartup(val)
 			case "ready":
 				if !c.ready(val) {
 					continue
 				}
 				// Start accepting calls
+				if c.warm != nil {
+					if err := c.warm.save(c); err != nil {
+						p.handler.Error(errors.New("Cannot save handshake of warm plugin: " + err.Error()))
+					}
+				}
 				c.open()
+				c.started()
+				c.connected()
+				c.collectProfiles(c.client)
 			default:
-				p.handler.Print(line)
+				p.forwardOutput(line)
 			}
 		case wr := <-p.killCh:
+			// Do not restart a plugin being stopped
+			restartCh = nil
 			if c.waitCh == nil {
 				wr.done()
 				continue
@@ -492,6 +981,19 @@ func (p *Plugin) run() {
 			// If we don't accept calls, kill immediately
 			if c.connCh == nil || c.client == nil {
 				c.kill()
+				c.killed = true
+			} else if c.warm != nil && p.killWarm {
+				// The process must not be reused, as it may be hung
+				c.kill()
+				c.killed = true
+			} else if c.warm != nil {
+				// Leave the process running for the next host
+				c.client.Close()
+				if c.dialer.mux != nil {
+					c.dialer.mux.Close()
+				}
+				c.detached = true
+				c.warm.detach()
 			} else {
 				// Be sure to kill the process if it doesn't obey Exit.
 				go func(pid int, t time.Duration) {
@@ -500,8 +1002,9 @@ func (p *Plugin) run() {
 					if proc, err := os.FindProcess(pid); err == nil {
 						proc.Kill()
 					}
-				}(pid, p.exitTimeout)
+				}(c.pid, p.exitTimeout)
 
+				c.redial()
 				c.client.Call(internalObject+".Exit", 0, nil)
 			}
 
@@ -520,12 +1023,20 @@ func (p *Plugin) run() {
 
 			// Signal to whoever killed us (via killCh) that we are done
 			if c.over != nil {
+				if !c.killed {
+					c.over.err = err
+				}
 				c.over.done()
 			}
+			atomic.StoreInt64(&p.pid, 0)
+			removeChild(c.pid)
 
 			c.proc = nil
 			c.waitCh = nil
 			c.linesCh = nil
+			c.cleanup()
+			c.disconnected()
+			restartCh = c.scheduleRestart(err)
 		case <-p.exitCh:
 			return
 		}
@@ -0,0 +1,478 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/rpc"
+	"reflect"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var errEmptyPool = ErrEmptyPool(errors.New("Pool has no plugins"))
+
+// Error reported when a call is made on a pool without plugins.
+type ErrEmptyPool error
+
+// Error reported when a broadcast call failed on one or more plugins.
+type ErrBroadcast error
+
+// Result of a call performed on a single plugin of a pool.
+type Result struct {
+	// Plugin that served the call.
+	Plugin *Plugin
+	// Response from the plugin, of the same type as the response passed to Broadcast.
+	// Nil if the call failed or no response was requested.
+	Resp interface{}
+	// Error returned by the call, if any.
+	Err error
+}
+
+// Pool distributes calls among several instances of the same plugin.
+//
+// Plugins are added on creation; the pool takes care of starting and stopping them.
+type Pool struct {
+	plugins    []*Plugin
+	next       uint32
+	hedged     map[string]bool
+	hedgeDelay time.Duration
+	running    bool
+}
+
+// NewPool creates a pool from a list of plugins that are not yet started.
+func NewPool(plugins ...*Plugin) *Pool {
+	return &Pool{
+		plugins: plugins,
+		hedged:  make(map[string]bool),
+	}
+}
+
+// Enable hedging for the specified read-only methods. A call to one of these methods
+// is sent to a second plugin if the first has not responded after delay; the first
+// successful response is returned.
+//
+// Hedged methods must be safe to execute more than once.
+//
+// Panics if called after Start.
+func (p *Pool) SetHedging(delay time.Duration, methods ...string) {
+	if p.running {
+		panic("Cannot call SetHedging after Start")
+	}
+	p.hedgeDelay = delay
+	for _, m := range methods {
+		p.hedged[m] = true
+	}
+}
+
+// Plugins returns the plugins that are part of this pool.
+func (p *Pool) Plugins() []*Plugin {
+	return p.plugins
+}
+
+// Start all plugins in the pool. See Plugin.Start.
+func (p *Pool) Start() {
+	p.running = true
+	for _, pl := range p.plugins {
+		pl.Start()
+	}
+}
+
+// Stop all plugins in the pool concurrently. See Plugin.Stop.
+func (p *Pool) Stop() {
+	StopAll(context.Background(), p.plugins...)
+}
+
+// Call performs an RPC call on one of the plugins of the pool, chosen in round-robin.
+// Plugins that signal to be overloaded are skipped; if all are overloaded, an ErrOverloaded
+// error is returned.
+//
+// If the method has been marked for hedging (see SetHedging), the call may be sent to
+// more than one plugin.
+func (p *Pool) Call(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	if len(p.plugins) == 0 {
+		return errEmptyPool
+	}
+	if p.hedged[name] && len(p.plugins) > 1 {
+		return p.hedge(ctx, name, args, resp)
+	}
+	return p.callFirst(ctx, p.order(), name, args, resp)
+}
+
+// CallSticky performs an RPC call on the plugin of the pool that key consistently maps to.
+// Use it for stateful plugins, so that all calls for the same key reach the same instance.
+//
+// If the chosen plugin is overloaded, the call goes to the next plugin for the same key.
+func (p *Pool) CallSticky(ctx context.Context, key, name string, args interface{}, resp interface{}) error {
+	if len(p.plugins) == 0 {
+		return errEmptyPool
+	}
+	return p.callFirst(ctx, p.ranking(key), name, args, resp)
+}
+
+// Order plugins by their rendezvous hash for key. The same key always
+// results in the same order, as long as the plugins in the pool are the same.
+func (p *Pool) ranking(key string) []*Plugin {
+	scores := make([]uint64, len(p.plugins))
+	list := make([]*Plugin, len(p.plugins))
+	for i, pl := range p.plugins {
+		h := fnv.New64a()
+		h.Write([]byte(key))
+		h.Write([]byte{0})
+		h.Write([]byte(fmt.Sprint(i)))
+		scores[i] = h.Sum64()
+		list[i] = pl
+	}
+	sort.Sort(&byScore{list, scores})
+	return list
+}
+
+type byScore struct {
+	list   []*Plugin
+	scores []uint64
+}
+
+func (b *byScore) Len() int {
+	return len(b.list)
+}
+
+func (b *byScore) Less(i, j int) bool {
+	return b.scores[i] > b.scores[j]
+}
+
+func (b *byScore) Swap(i, j int) {
+	b.list[i], b.list[j] = b.list[j], b.list[i]
+	b.scores[i], b.scores[j] = b.scores[j], b.scores[i]
+}
+
+// Broadcast performs the same RPC call on all plugins of the pool concurrently and returns
+// one Result for each plugin, in the order plugins were added to the pool.
+//
+// The resp argument is only used to determine the type of the responses: each Result holds
+// a new value of the same type. Pass nil if responses are not needed.
+//
+// If any call fails, Broadcast returns an ErrBroadcast error together with all results.
+func (p *Pool) Broadcast(ctx context.Context, name string, args interface{}, resp interface{}) ([]Result, error) {
+	if len(p.plugins) == 0 {
+		return nil, errEmptyPool
+	}
+
+	var typ reflect.Type
+	if resp != nil {
+		typ = reflect.TypeOf(resp)
+		if typ.Kind() != reflect.Ptr {
+			return nil, errors.New("Response must be a pointer")
+		}
+		typ = typ.Elem()
+	}
+
+	results := make([]Result, len(p.plugins))
+	done := make(chan struct{})
+	for i, pl := range p.plugins {
+		go func(r *Result, pl *Plugin) {
+			defer func() { done <- struct{}{} }()
+
+			r.Plugin = pl
+			var val interface{}
+			if typ != nil {
+				val = reflect.New(typ).Interface()
+			}
+			if r.Err = callContext(ctx, pl, name, args, val); r.Err == nil {
+				r.Resp = val
+			}
+		}(&results[i], pl)
+	}
+
+	var failed int
+	var first error
+	for range p.plugins {
+		<-done
+	}
+	for _, r := range results {
+		if r.Err != nil {
+			if first == nil {
+				first = r.Err
+			}
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, ErrBroadcast(fmt.Errorf("Broadcast failed on %d of %d plugins: %s", failed, len(results), first))
+	}
+	return results, nil
+}
+
+// MapReduce splits items, which must be a slice, in one partition for each plugin of the pool
+// and calls name on every plugin concurrently, passing its partition (a slice of the same type
+// as items) as argument.
+//
+// The resp argument is used to determine the type of the responses, like in Broadcast. Once
+// all partitions are processed, fold is called with each response, in partition order, to
+// combine them; MapReduce stops at the first error returned by fold.
+//
+// If a call fails because a plugin is not available (but not because the method itself
+// returned an error), the partition is retried on the other plugins of the pool.
+func (p *Pool) MapReduce(ctx context.Context, name string, items interface{}, resp interface{}, fold func(resp interface{}) error) error {
+	if len(p.plugins) == 0 {
+		return errEmptyPool
+	}
+
+	slice := reflect.ValueOf(items)
+	if slice.Kind() != reflect.Slice {
+		return errors.New("Items must be a slice")
+	}
+	typ := reflect.TypeOf(resp)
+	if typ == nil || typ.Kind() != reflect.Ptr {
+		return errors.New("Response must be a pointer")
+	}
+	typ = typ.Elem()
+
+	n := slice.Len()
+	nparts := len(p.plugins)
+	if n < nparts {
+		nparts = n
+	}
+
+	resps := make([]interface{}, nparts)
+	errs := make([]error, nparts)
+	done := make(chan struct{})
+	for i := 0; i < nparts; i++ {
+		// Partitions differ in size by one item at most
+		start, end := i*n/nparts, (i+1)*n/nparts
+		go func(i int, part interface{}) {
+			defer func() { done <- struct{}{} }()
+			resps[i] = reflect.New(typ).Interface()
+			errs[i] = p.callRetry(ctx, i, name, part, resps[i])
+		}(i, slice.Slice(start, end).Interface())
+	}
+	for i := 0; i < nparts; i++ {
+		<-done
+	}
+
+	for i := range resps {
+		if errs[i] != nil {
+			return fmt.Errorf("Partition %d: %s", i, errs[i])
+		}
+		if err := fold(resps[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Call the plugin at position n, moving to the following plugins if the call fails
+// for reasons other than an error returned by the method.
+func (p *Pool) callRetry(ctx context.Context, n int, name string, args interface{}, resp interface{}) error {
+	var err error
+	for i := range p.plugins {
+		pl := p.plugins[(n+i)%len(p.plugins)]
+		err = callContext(ctx, pl, name, args, resp)
+		if isMethodError(err) || err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// Round-robin order of all plugins, starting from the next one to pick.
+func (p *Pool) order() []*Plugin {
+	n := int(atomic.AddUint32(&p.next, 1) - 1)
+	list := make([]*Plugin, len(p.plugins))
+	for i := range list {
+		list[i] = p.plugins[(n+i)%len(p.plugins)]
+	}
+	return list
+}
+
+// Try plugins in order, moving to the next one only if a plugin is overloaded.
+func (p *Pool) callFirst(ctx context.Context, plugins []*Plugin, name string, args interface{}, resp interface{}) error {
+	_, err := p.callServed(ctx, plugins, name, args, resp)
+	return err
+}
+
+// Like callFirst, but also returns the plugin that served the call.
+func (p *Pool) callServed(ctx context.Context, plugins []*Plugin, name string, args interface{}, resp interface{}) (*Plugin, error) {
+	var err error
+	for _, pl := range plugins {
+		if err = callContext(ctx, pl, name, args, resp); err != errOverloaded {
+			return pl, err
+		}
+	}
+	return nil, err
+}
+
+type attempt struct {
+	resp reflect.Value
+	err  error
+}
+
+func (p *Pool) hedge(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	val := reflect.ValueOf(resp)
+	if val.Kind() != reflect.Ptr || val.IsNil() {
+		return errors.New("Response must be a non-nil pointer")
+	}
+
+	// Losing attempts keep running in the plugin; their response is discarded.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Each attempt goes to a plugin that no other attempt has tried.
+	order := p.order()
+	var mu sync.Mutex
+	tried := make(map[*Plugin]bool)
+	results := make(chan attempt, 2)
+	launch := func() {
+		r := reflect.New(val.Type().Elem())
+		err := errOverloaded
+		for _, pl := range order {
+			mu.Lock()
+			skip := tried[pl]
+			tried[pl] = true
+			mu.Unlock()
+			if skip {
+				continue
+			}
+			if err = callContext(ctx, pl, name, args, r.Interface()); err != errOverloaded {
+				break
+			}
+		}
+		results <- attempt{resp: r, err: err}
+	}
+
+	go launch()
+	timer := time.NewTimer(p.hedgeDelay)
+	defer timer.Stop()
+
+	var err error
+	pending, hedged := 1, false
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedged {
+				hedged = true
+				pending++
+				go launch()
+			}
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				val.Elem().Set(a.resp.Elem())
+				return nil
+			}
+			err = a.err
+			// Do not wait for the delay if the first attempt has failed already.
+			if !hedged {
+				hedged = true
+				pending++
+				go launch()
+			}
+		}
+	}
+	return err
+}
+
+// Perform a call on a plugin, returning early if the context is done or the call times out.
+func callContext(ctx context.Context, pl *Plugin, name string, args interface{}, resp interface{}) error {
+	if pl.callTimeout > 0 {
+		return callTimeout(ctx, pl, pl.callTimeout, name, args, resp)
+	}
+	return performCall(ctx, pl, 0, name, args, resp)
+}
+
+// Perform a call on a plugin, returning early if the context is done or, if timeout is not
+// zero, once the call has taken longer than timeout since the plugin was ready to receive
+// it.
+func performCall(ctx context.Context, pl *Plugin, timeout time.Duration, name string, args interface{}, resp interface{}) error {
+	call, err := sendCall(ctx, pl, timeout, name, args, resp)
+	if err != nil {
+		return err
+	}
+	return call.wait()
+}
+
+// A call sent to a plugin, waiting for its reply.
+type sentCall struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	conn   *conn
+	call   *rpc.Call
+	// ID to cancel the call in the plugin, if supported
+	id string
+	// Response the reply is copied to, if decoded into a private value
+	resp reflect.Value
+	// Reply decoded in place, if leased from a pool
+	lease *Reply
+}
+
+// Send a call to a plugin once it is ready, unless the context is done first. If timeout
+// is not zero, the call times out once it has taken longer than timeout from then. The
+// response is decoded into a private value and copied only on success, so that an
+// abandoned call cannot write into resp.
+func sendCall(ctx context.Context, pl *Plugin, timeout time.Duration, name string, args interface{}, resp interface{}) (*sentCall, error) {
+	if pl.opts.strict {
+		if err := checkReply(name, resp); err != nil {
+			return nil, err
+		}
+	}
+	if err := pl.opts.simulation.apply(ctx, name); err != nil {
+		return nil, err
+	}
+	if err := pl.pause.wait(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := pl.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	pl.deprecated.check(name, pl)
+
+	c := &sentCall{ctx: ctx, cancel: func() {}, conn: conn}
+	if timeout > 0 {
+		c.ctx, c.cancel = context.WithTimeout(ctx, timeout)
+	}
+	name, c.id = withMetadata(c.ctx, conn.wireMethod(name), &pl.opts, conn.features)
+
+	// Replies that are not pointers are not decoded into
+	reply := resp
+	if r, ok := resp.(*Reply); ok {
+		c.lease = r
+		reply = r.Value
+	} else if val := reflect.ValueOf(resp); val.Kind() == reflect.Ptr && !val.IsNil() {
+		c.resp = val
+		reply = reflect.New(val.Type().Elem()).Interface()
+	}
+	c.call = conn.client.Go(name, args, reply, make(chan *rpc.Call, 1))
+	return c, nil
+}
+
+// Wait for the reply of the call, or for its context to be done.
+func (c *sentCall) wait() error {
+	defer c.cancel()
+
+	select {
+	case <-c.call.Done:
+		if c.call.Error != nil {
+			err := c.conn.codec.decodeError(c.call.Reply, c.call.Error)
+			if derr, ok := err.(*ErrDecode); ok && c.resp.IsValid() {
+				derr.WantType = c.resp.Type().String()
+			}
+			return err
+		}
+		if c.resp.IsValid() {
+			c.resp.Elem().Set(reflect.ValueOf(c.call.Reply).Elem())
+		}
+		return nil
+	case <-c.ctx.Done():
+		if c.id != "" {
+			c.conn.codec.cancel(c.id)
+		}
+		if c.lease != nil {
+			// The plugin may still write the reply
+			c.lease.pool = nil
+		}
+		return c.ctx.Err()
+	}
+}
@@ -0,0 +1,125 @@
+package pingo_test
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dullgiulio/pingo"
+	"github.com/dullgiulio/pingo/pingotest"
+)
+
+// Sums the items of each partition.
+type Summer struct{}
+
+func (s *Summer) Sum(items []int, sum *int) error {
+	for _, n := range items {
+		*sum += n
+	}
+	return nil
+}
+
+func TestMapReduce(t *testing.T) {
+	var plugins []*pingo.Plugin
+	for i := 0; i < 4; i++ {
+		plugins = append(plugins, pingotest.NewInProcess(t, &Summer{}))
+	}
+	pool := pingo.NewPool(plugins...)
+
+	// Lengths that are not multiples of the number of plugins, and shorter than it
+	for n := 0; n <= 9; n++ {
+		items := make([]int, n)
+		want := 0
+		for i := range items {
+			items[i] = i + 1
+			want += i + 1
+		}
+		var sums []int
+		err := pool.MapReduce(context.Background(), "Summer.Sum", items, new(int), func(resp interface{}) error {
+			sums = append(sums, *resp.(*int))
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("%d items: %v", n, err)
+		}
+		total := 0
+		for _, s := range sums {
+			total += s
+		}
+		if total != want {
+			t.Errorf("%d items: sum of partitions %v is %d, want %d", n, sums, total, want)
+		}
+		if n >= 4 && len(sums) != 4 || n < 4 && len(sums) != n {
+			t.Errorf("%d items: unexpected partitions %v", n, sums)
+		}
+	}
+
+	// Partitions are folded in order
+	var parts [][]int
+	err := pool.MapReduce(context.Background(), "Summer.Sum", []int{1, 10, 100, 1000, 10000}, new(int), func(resp interface{}) error {
+		parts = append(parts, []int{*resp.(*int)})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]int{{1}, {10}, {100}, {11000}}; !reflect.DeepEqual(parts, want) {
+		t.Errorf("Unexpected partitions %v, want %v", parts, want)
+	}
+}
+
+// Records the calls received by each replica.
+type Replica struct {
+	index int
+	calls *replicaCalls
+}
+
+type replicaCalls struct {
+	mu     sync.Mutex
+	served map[int][]int
+}
+
+func (r *Replica) Get(id int, index *int) error {
+	r.calls.mu.Lock()
+	r.calls.served[id] = append(r.calls.served[id], r.index)
+	r.calls.mu.Unlock()
+
+	time.Sleep(100 * time.Millisecond)
+	*index = r.index
+	return nil
+}
+
+func TestHedging(t *testing.T) {
+	calls := &replicaCalls{served: make(map[int][]int)}
+	var plugins []*pingo.Plugin
+	for i := 0; i < 2; i++ {
+		plugins = append(plugins, pingotest.NewInProcess(t, &Replica{index: i, calls: calls}))
+	}
+	pool := pingo.NewPool(plugins...)
+	pool.SetHedging(10*time.Millisecond, "Replica.Get")
+
+	// Concurrent calls, so that their attempts interleave
+	var wg sync.WaitGroup
+	for id := 0; id < 4; id++ {
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			var index int
+			if err := pool.Call(context.Background(), "Replica.Get", id, &index); err != nil {
+				t.Error(err)
+			}
+		}(id)
+	}
+	wg.Wait()
+
+	// Attempts that lost the race might still be running
+	calls.mu.Lock()
+	defer calls.mu.Unlock()
+	for id, served := range calls.served {
+		if len(served) != 2 || served[0] == served[1] {
+			t.Errorf("Call %d: attempts served by %v, want two different plugins", id, served)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package pingo
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/rpc"
+	"net/url"
+	"runtime/pprof"
+	"sync"
+	"time"
+)
+
+// Profile holds the profiles of a plugin over a period, in the format of pprof. See
+// Profiling.
+type Profile struct {
+	// Executable of the plugin, set by the host
+	Plugin string
+	// Period covered by the CPU profile
+	Start, End time.Time
+	// CPU profile of the period, if CPU profiling could be started in the plugin
+	CPU []byte
+	// Heap profile at the end of the period
+	Heap []byte
+}
+
+// Profiling makes the plugin profile itself continuously: every interval, the host
+// collects the CPU profile of the interval and a heap profile of the plugin and passes
+// them to fn, so that operators can follow the trends of each plugin instead of taking
+// dumps on demand. Errors returned by fn are reported to the ErrorHandler. Profiling is
+// not enabled if interval is not positive or fn is nil.
+//
+// The plugin keeps CPU profiling enabled while running, which slows it down slightly;
+// it cannot start a CPU profile of its own meanwhile.
+//
+// Use PostProfiles as fn to ship the profiles to a collector.
+func Profiling(interval time.Duration, fn func(*Profile) error) Option {
+	return func(o *options) {
+		o.profileEvery = interval
+		o.profileFn = fn
+	}
+}
+
+// PostProfiles returns a function for Profiling sending each profile to an HTTP endpoint,
+// with one POST request per profile. The query of the requests holds the plugin, the kind
+// of profile ("cpu" or "heap") and the period covered, in RFC 3339 format:
+//
+//	POST /ingest?plugin=resize&kind=cpu&start=...&end=...
+//
+// If client is nil, http.DefaultClient is used.
+func PostProfiles(endpoint string, client *http.Client) func(*Profile) error {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return func(p *Profile) error {
+		for _, prof := range []struct {
+			kind string
+			data []byte
+		}{{"cpu", p.CPU}, {"heap", p.Heap}} {
+			if len(prof.data) == 0 {
+				continue
+			}
+			u, err := url.Parse(endpoint)
+			if err != nil {
+				return err
+			}
+			q := u.Query()
+			q.Set("plugin", p.Plugin)
+			q.Set("kind", prof.kind)
+			q.Set("start", p.Start.Format(time.RFC3339Nano))
+			q.Set("end", p.End.Format(time.RFC3339Nano))
+			u.RawQuery = q.Encode()
+			resp, err := client.Post(u.String(), "application/octet-stream", bytes.NewReader(prof.data))
+			if err != nil {
+				return err
+			}
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				return errors.New("Cannot post " + prof.kind + " profile: " + resp.Status)
+			}
+		}
+		return nil
+	}
+}
+
+// Collect the profiles of the plugin over the control connection until it is closed.
+func (c *ctrl) collectProfiles(client *rpc.Client) {
+	every, fn := c.p.opts.profileEvery, c.p.opts.profileFn
+	if every <= 0 || fn == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			prof := &Profile{}
+			err := client.Call(internalObject+".Profile", 0, prof)
+			if isUnknownMethod(err) {
+				return
+			}
+			if isMethodError(err) {
+				c.p.handler.Error(fmt.Errorf("Cannot profile plugin %s: %v", c.p.exe, remoteError(err)))
+				continue
+			}
+			if err != nil {
+				// The plugin is gone
+				return
+			}
+			prof.Plugin = c.p.exe
+			if err := fn(prof); err != nil {
+				c.p.handler.Error(fmt.Errorf("Cannot ship profile of plugin %s: %v", c.p.exe, err))
+			}
+		}
+	}()
+}
+
+// Continuous profiling of the plugin, started on request of the host.
+type profiler struct {
+	mu    sync.Mutex
+	cpu   *bytes.Buffer
+	start time.Time
+}
+
+// Start a new CPU profile.
+func (p *profiler) startCPU() {
+	p.start = time.Now()
+	p.cpu = new(bytes.Buffer)
+	if pprof.StartCPUProfile(p.cpu) != nil {
+		// Profiled by the plugin itself
+		p.cpu = nil
+	}
+}
+
+// Take the CPU profile since the last one and a heap profile, then start the next CPU
+// profile.
+func (p *profiler) take(prof *Profile) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cpu != nil {
+		pprof.StopCPUProfile()
+		prof.CPU = p.cpu.Bytes()
+	}
+	prof.Start, prof.End = p.start, time.Now()
+	p.startCPU()
+
+	var heap bytes.Buffer
+	if err := pprof.Lookup("heap").WriteTo(&heap, 0); err != nil {
+		return err
+	}
+	prof.Heap = heap.Bytes()
+	return nil
+}
+
+// Internal RPC call returning the profiles of the plugin since the last call, to the host
+// only. Do not call manually.
+func (s *PingoRpc) Profile(ctx context.Context, unused int, prof *Profile) error {
+	if !s.server().conf.profile {
+		return errors.New("Profiling not enabled")
+	}
+	if info := ConnInfoFrom(ctx); info == nil || !info.host {
+		return errors.New("Profiles are only collected by the host")
+	}
+	return s.server().profiler.take(prof)
+}
@@ -0,0 +1,142 @@
+package pingo
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// Error reported when a plugin uses more disk space for its state than allowed.
+type ErrQuotaExceeded error
+
+// StateQuota limits the disk space used by the state directories of the plugins of a
+// Manager (see Manager.SetStateRoot). The usage is measured periodically by walking the
+// directories, so a plugin can exceed its allowance until the next measure.
+type StateQuota struct {
+	// Bytes allowed to each plugin.
+	Bytes int64
+	// Bytes allowed to specific plugins, by name, overriding Bytes.
+	Plugins map[string]int64
+	// Interval between measures; if not positive, one minute.
+	Every time.Duration
+	// Called when a plugin exceeds its allowance, once until its usage is back within it.
+	// If nil, an ErrQuotaExceeded error is reported to the ErrorHandler of the plugin.
+	Exceeded func(name string, used, allowed int64)
+}
+
+// SetStateQuota starts enforcing quota when the manager is started, or immediately if the
+// manager is running already. A previous quota is replaced; nil removes it.
+func (m *Manager) SetStateQuota(q *StateQuota) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stopQuota()
+	m.quota = q
+	if m.running {
+		m.startQuota()
+	}
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) startQuota() {
+	if m.quota == nil {
+		return
+	}
+	m.quotaStop = make(chan struct{})
+	go m.quota.run(m, m.quotaStop)
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) stopQuota() {
+	if m.quotaStop != nil {
+		close(m.quotaStop)
+		m.quotaStop = nil
+	}
+}
+
+// StateUsage returns the bytes used by the state directory of the named plugin.
+func (m *Manager) StateUsage(name string) (int64, error) {
+	p := m.Plugin(name)
+	if p == nil {
+		return 0, ErrUnknownPlugin(fmt.Errorf("Unknown plugin %s", name))
+	}
+	if p.StateDir() == "" {
+		return 0, nil
+	}
+	return dirSize(p.StateDir())
+}
+
+func (q *StateQuota) allowed(name string) int64 {
+	if n, ok := q.Plugins[name]; ok {
+		return n
+	}
+	return q.Bytes
+}
+
+// Interval between measures if not set.
+const defaultQuotaEvery = time.Minute
+
+func (q *StateQuota) every() time.Duration {
+	if q.Every <= 0 {
+		return defaultQuotaEvery
+	}
+	return q.Every
+}
+
+func (q *StateQuota) run(m *Manager, stop <-chan struct{}) {
+	exceeded := make(map[string]bool)
+
+	for {
+		select {
+		case <-time.After(q.every()):
+		case <-stop:
+			return
+		}
+
+		for _, name := range m.Names() {
+			allowed := q.allowed(name)
+			if allowed <= 0 {
+				continue
+			}
+			used, err := m.StateUsage(name)
+			if err != nil {
+				continue
+			}
+			if used <= allowed {
+				delete(exceeded, name)
+				continue
+			}
+			if exceeded[name] {
+				continue
+			}
+			exceeded[name] = true
+			if q.Exceeded != nil {
+				q.Exceeded(name, used, allowed)
+			} else if p := m.Plugin(name); p != nil {
+				p.handler.Error(ErrQuotaExceeded(fmt.Errorf("Plugin %s uses %d bytes of state, %d allowed", name, used, allowed)))
+			}
+		}
+	}
+}
+
+// Bytes used by the regular files under dir. Files removed while walking are ignored.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if d == nil {
+				return err
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
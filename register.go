@@ -0,0 +1,94 @@
+package pingo
+
+// RegisterOption configures how an object is exported. See Register.
+type RegisterOption func(*registration)
+
+type registration struct {
+	name    string
+	version string
+	hidden  bool
+}
+
+// AsName exports the object under the specified name instead of the name of its type.
+func AsName(name string) RegisterOption {
+	return func(r *registration) {
+		r.name = name
+	}
+}
+
+// Versioned attaches a version to the object, reported by Describe.
+func Versioned(version string) RegisterOption {
+	return func(r *registration) {
+		r.version = version
+	}
+}
+
+// Hidden makes the object callable without being listed by Objects or Describe on
+// the host, nor resolved by Manager.Lookup.
+func Hidden() RegisterOption {
+	return func(r *registration) {
+		r.hidden = true
+	}
+}
+
+// Server exports objects to the host. Plugins usually have a single server, returned by
+// DefaultServer, also used by the functions of this package such as Register and Run.
+// Others can be created with NewServer.
+type Server struct {
+	r *rpcServer
+}
+
+// DefaultServer returns the server of the plugin.
+func DefaultServer() *Server {
+	return &Server{r: defaultServer}
+}
+
+// NewServer returns a server independent of the default one, with its own objects,
+// codecs and secret, for binaries exposing several endpoints or for test harnesses serving
+// objects in process. Each server outputs the lines for its host, such as its address, with
+// its own prefix.
+//
+// Unlike the default server, it does not read the -pingo: flags from the command line nor
+// from the environment: its options are only set with Configure and its methods. Settings
+// of the whole process, such as the memory limits and the watchdog, are only applied by the
+// default server. When asked to exit, the server stops accepting connections and Run
+// returns, instead of exiting the process.
+func NewServer() *Server {
+	r := newRpcServer(newConfig())
+	r.embedded = true
+	return &Server{r: r}
+}
+
+// Addr returns the protocol and the address the server listens on, waiting for Run to
+// start listening. Both are empty if Run fails before.
+func (s *Server) Addr() (proto, addr string) {
+	<-s.r.listening
+	if s.r.listener == nil {
+		return "", ""
+	}
+	return s.r.conf.proto, s.r.conf.addr
+}
+
+// Register an object, as the Register function does.
+func (s *Server) Register(obj interface{}, opts ...RegisterOption) {
+	if s.r.running {
+		panic("Do not call Register after Run")
+	}
+	s.r.register(obj, opts...)
+}
+
+// Run the server, as the Run function does.
+func (s *Server) Run() error {
+	return s.r.parseAndRun()
+}
+
+// Objects returns the names of the objects listed to the host, in registration order.
+func (s *Server) Objects() []string {
+	objs := make([]string, 0, len(s.r.objs))
+	for _, name := range s.r.objs {
+		if name != internalObject {
+			objs = append(objs, name)
+		}
+	}
+	return objs
+}
@@ -0,0 +1,125 @@
+package pingo
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy deciding whether a plugin is started again when its process exits without
+// being stopped. See SetRestartPolicy.
+type RestartPolicy int
+
+const (
+	// The plugin is not restarted; calls fail with the error of the exit.
+	RestartNever RestartPolicy = iota
+	// The plugin is restarted if it exits with an error, including being killed or
+	// failing to start.
+	RestartOnFailure
+	// The plugin is restarted whenever it exits.
+	RestartAlways
+)
+
+const (
+	// Delay before the first restart, unless set
+	defaultRestartDelay = time.Second
+	// Time a plugin has to run for the delay to be reset, unless set
+	defaultRestartReset = time.Minute
+)
+
+// Backoff sets the delays between consecutive restarts of a plugin.
+type Backoff struct {
+	// Delay before the first restart; if zero, one second.
+	Initial time.Duration
+	// Maximum delay; if zero, the delay does not grow.
+	Max time.Duration
+	// Factor the delay is multiplied by after each restart; if less than one, two.
+	Factor float64
+	// Time the plugin has to run for the delay to be reset to Initial; if zero, Max, or
+	// one minute if Max is zero too.
+	Reset time.Duration
+}
+
+// SetRestartPolicy starts the plugin again when its process exits, waiting as set by
+// backoff before each restart. The new process is connected to as it was on Start,
+// including the key exchange of secure connections: calls performed meanwhile wait for
+// it to be ready. Calls in progress when the process exits fail.
+//
+// Plugins are never restarted after Stop.
+//
+// Panics if called after Start.
+func (p *Plugin) SetRestartPolicy(policy RestartPolicy, backoff Backoff) {
+	if p.running {
+		panic("Cannot call SetRestartPolicy after Start")
+	}
+	p.restart = restarter{policy: policy, backoff: backoff}
+}
+
+// Tracks the restarts of a plugin. Only accessed by the routine running the plugin.
+type restarter struct {
+	policy  RestartPolicy
+	backoff Backoff
+	// Delay of the next restart
+	delay time.Duration
+	// Time the current process was started
+	started time.Time
+}
+
+// Returns true if a process exited with err must be restarted.
+func (r *restarter) needed(err error) bool {
+	switch r.policy {
+	case RestartAlways:
+		return true
+	case RestartOnFailure:
+		return err != nil
+	}
+	return false
+}
+
+// Returns the delay before the next restart.
+func (r *restarter) next() time.Duration {
+	b := r.backoff
+	initial := b.Initial
+	if initial <= 0 {
+		initial = defaultRestartDelay
+	}
+	reset := b.Reset
+	if reset <= 0 {
+		reset = b.Max
+	}
+	if reset <= 0 {
+		reset = defaultRestartReset
+	}
+	if r.delay == 0 || time.Since(r.started) >= reset {
+		r.delay = initial
+		return r.delay
+	}
+	if b.Max <= 0 {
+		return r.delay
+	}
+	factor := b.Factor
+	if factor < 1 {
+		factor = 2
+	}
+	r.delay = time.Duration(float64(r.delay) * factor)
+	if r.delay > b.Max {
+		r.delay = b.Max
+	}
+	return r.delay
+}
+
+// Schedule a restart of a process that exited with err, if needed by the policy.
+// Calls are held until the plugin is restarted.
+func (c *ctrl) scheduleRestart(err error) <-chan time.Time {
+	r := &c.p.restart
+	if c.over != nil || !r.needed(err) {
+		return nil
+	}
+	d := r.next()
+	if err != nil {
+		c.p.handler.Error(fmt.Errorf("Plugin %s failed (%v), restarting in %s", c.p.exe, err, d))
+	} else {
+		c.p.handler.Error(fmt.Errorf("Plugin %s exited, restarting in %s", c.p.exe, d))
+	}
+	c.close()
+	return time.After(d)
+}
@@ -0,0 +1,98 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+)
+
+// Plugins exporting each object, as resolved by a Manager.
+type routeTable struct {
+	routes map[string]string
+	// Plugins and the generation of their objects when resolved
+	plugins []*Plugin
+	gens    []uint32
+}
+
+// Reports whether no plugin has reported a new list of objects since the routes were
+// resolved: an object can move to any plugin, including one added earlier.
+func (t *routeTable) current() bool {
+	for i, p := range t.plugins {
+		if atomic.LoadUint32(&p.gen) != t.gens[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) invalidateRoutes() {
+	m.routes = nil
+}
+
+// Lookup returns the name of the plugin exporting the object, as in "Object" or "Object.Method".
+// If more plugins export the same object, the first one added wins.
+//
+// Resolutions are cached. The cache is invalidated when plugins are added and when any
+// plugin reports a new list of objects, as happens when it is restarted.
+func (m *Manager) Lookup(object string) (string, error) {
+	if i := strings.IndexByte(object, '.'); i >= 0 {
+		object = object[:i]
+	}
+
+	m.mu.Lock()
+	t := m.routes
+	m.mu.Unlock()
+
+	if t == nil || !t.current() {
+		t = m.resolve()
+	}
+	name, ok := t.routes[object]
+	if !ok {
+		return "", ErrUnknownPlugin(errors.New("No plugin exports object " + object))
+	}
+	return name, nil
+}
+
+// Build the routes to all objects of the plugins, if the manager is running.
+func (m *Manager) resolve() *routeTable {
+	t := &routeTable{routes: make(map[string]string)}
+
+	m.mu.Lock()
+	running := m.running
+	m.mu.Unlock()
+	if !running {
+		return t
+	}
+
+	for _, name := range m.Names() {
+		p := m.Plugin(name)
+		t.plugins = append(t.plugins, p)
+		t.gens = append(t.gens, atomic.LoadUint32(&p.gen))
+		objs, err := p.Objects()
+		if err != nil {
+			continue
+		}
+		for _, o := range objs {
+			if _, ok := t.routes[o]; !ok {
+				t.routes[o] = name
+			}
+		}
+	}
+
+	m.mu.Lock()
+	m.routes = t
+	m.mu.Unlock()
+
+	return t
+}
+
+// Dispatch performs a call on the plugin exporting the object of the method. See Lookup.
+func (m *Manager) Dispatch(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	plugin, err := m.Lookup(name)
+	if err != nil {
+		return err
+	}
+	return m.Call(ctx, plugin, name, args, resp)
+}
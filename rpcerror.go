@@ -0,0 +1,98 @@
+package pingo
+
+import (
+	"encoding/json"
+	"errors"
+	"net/rpc"
+	"strings"
+)
+
+const (
+	// Header of CONNECT requests from hosts that decode errors with codes.
+	errorsHeader = "Pingo-Errors"
+	// Prefix of the errors with codes sent to those hosts.
+	errorEnvelope = "pingo-error:"
+)
+
+// Error is an error with a code that methods of plugins can return, directly or wrapped, to
+// let the host tell errors apart without matching their messages. The host receives it as
+// an *Error with the same code and details, and the message of the whole error returned by
+// the method.
+//
+// Plugins and hosts can share sentinel errors, matched by code with errors.Is:
+//
+//	var ErrNotFound = pingo.NewError("not-found", "Item not found")
+//
+//	// In the plugin
+//	return fmt.Errorf("Loading %s: %w", key, ErrNotFound)
+//
+//	// In the host
+//	if errors.Is(err, ErrNotFound) {
+//		...
+//	}
+type Error struct {
+	Code    string
+	Message string
+	// Additional information, if any
+	Details map[string]string `json:",omitempty"`
+}
+
+// NewError returns an error with code and message.
+func NewError(code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// Is reports whether target is an *Error with the same code.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+// Message sent for an error returned by a method: an envelope if the error carries an
+// *Error and the host decodes them, otherwise msg.
+func encodeError(err error, msg string, typed bool) string {
+	var e *Error
+	if !typed || !errors.As(err, &e) {
+		return msg
+	}
+	data, jerr := json.Marshal(&Error{Code: e.Code, Message: msg, Details: e.Details})
+	if jerr != nil {
+		return msg
+	}
+	return errorEnvelope + string(data)
+}
+
+// Decode the error of a call, if it is an envelope.
+func remoteError(err error) error {
+	serr, ok := err.(rpc.ServerError)
+	if !ok {
+		return err
+	}
+	if e := parseEnvelope(string(serr)); e != nil {
+		return e
+	}
+	return err
+}
+
+func parseEnvelope(msg string) *Error {
+	if !strings.HasPrefix(msg, errorEnvelope) {
+		return nil
+	}
+	e := &Error{}
+	if json.Unmarshal([]byte(msg[len(errorEnvelope):]), e) != nil {
+		return nil
+	}
+	return e
+}
+
+// Returns true if err was returned by the method called, rather than caused by a failure
+// to perform the call.
+func isMethodError(err error) bool {
+	var e *Error
+	var serr rpc.ServerError
+	return errors.As(err, &e) || errors.As(err, &serr)
+}
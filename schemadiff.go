@@ -0,0 +1,136 @@
+package pingo
+
+import (
+	"sort"
+)
+
+// SchemaChange is a difference between two schemas of a plugin. See CompareSchemas.
+type SchemaChange struct {
+	// Object, method ("Object.Method") or type the change is about
+	Subject     string
+	Description string
+	// Hosts built against the old schema can fail with the new one
+	Breaking bool
+}
+
+func (c SchemaChange) String() string {
+	if c.Breaking {
+		return "BREAKING " + c.Subject + ": " + c.Description
+	}
+	return c.Subject + ": " + c.Description
+}
+
+// CompareSchemas reports the differences between an old and a new schema of a plugin (see
+// Describe). Removed objects, methods and struct fields, as well as changed types, are
+// breaking changes; additions and deprecations are not.
+func CompareSchemas(old, new *Schema) []SchemaChange {
+	var changes []SchemaChange
+	add := func(subject, desc string, breaking bool) {
+		changes = append(changes, SchemaChange{Subject: subject, Description: desc, Breaking: breaking})
+	}
+
+	oldObjs, newObjs := objectsByName(old), objectsByName(new)
+	for name, oobj := range oldObjs {
+		nobj, ok := newObjs[name]
+		if !ok {
+			add(name, "object removed", true)
+			continue
+		}
+		if oobj.Version != nobj.Version {
+			add(name, "version changed from "+oobj.Version+" to "+nobj.Version, false)
+		}
+		oldMethods, newMethods := methodsByName(oobj), methodsByName(nobj)
+		for mname, om := range oldMethods {
+			subject := name + "." + mname
+			nm, ok := newMethods[mname]
+			if !ok {
+				add(subject, "method removed", true)
+				continue
+			}
+			if om.Args != nm.Args {
+				add(subject, "argument type changed from "+om.Args+" to "+nm.Args, true)
+			}
+			if om.Reply != nm.Reply {
+				add(subject, "reply type changed from "+om.Reply+" to "+nm.Reply, true)
+			}
+			if !om.Deprecated && nm.Deprecated {
+				add(subject, "method deprecated: "+nm.Replacement, false)
+			}
+		}
+		for mname := range newMethods {
+			if _, ok := oldMethods[mname]; !ok {
+				add(name+"."+mname, "method added", false)
+			}
+		}
+	}
+	for name := range newObjs {
+		if _, ok := oldObjs[name]; !ok {
+			add(name, "object added", false)
+		}
+	}
+
+	for tname, ot := range old.Types {
+		nt, ok := new.Types[tname]
+		if !ok {
+			// Types no longer used are reported via the methods using them.
+			continue
+		}
+		oldFields, newFields := fieldsByName(ot), fieldsByName(nt)
+		for fname, ftype := range oldFields {
+			subject := tname + "." + fname
+			ntype, ok := newFields[fname]
+			if !ok {
+				add(subject, "field removed", true)
+			} else if ftype != ntype {
+				add(subject, "field type changed from "+ftype+" to "+ntype, true)
+			}
+		}
+		for fname := range newFields {
+			if _, ok := oldFields[fname]; !ok {
+				add(tname+"."+fname, "field added", false)
+			}
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		if changes[i].Subject != changes[j].Subject {
+			return changes[i].Subject < changes[j].Subject
+		}
+		return changes[i].Description < changes[j].Description
+	})
+	return changes
+}
+
+// Breaking returns true if any of the changes is breaking.
+func Breaking(changes []SchemaChange) bool {
+	for _, c := range changes {
+		if c.Breaking {
+			return true
+		}
+	}
+	return false
+}
+
+func objectsByName(s *Schema) map[string]ObjectSchema {
+	m := make(map[string]ObjectSchema)
+	for _, o := range s.Objects {
+		m[o.Name] = o
+	}
+	return m
+}
+
+func methodsByName(o ObjectSchema) map[string]MethodSchema {
+	m := make(map[string]MethodSchema)
+	for _, meth := range o.Methods {
+		m[meth.Name] = meth
+	}
+	return m
+}
+
+func fieldsByName(t TypeSchema) map[string]string {
+	m := make(map[string]string)
+	for _, f := range t.Fields {
+		m[f.Name] = f.Type
+	}
+	return m
+}
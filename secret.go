@@ -0,0 +1,93 @@
+package pingo
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Environment variable holding the secret passed by the host with SecretEnv.
+const envSecret = "PINGO_SECRET"
+
+// How the secret of secure connections (see SetSecure) reaches the plugin.
+type SecretMode int
+
+const (
+	// The plugin generates the secret and prints it on its output, where anything
+	// capturing the output of the plugin can read it.
+	SecretOutput SecretMode = iota
+	// The host generates the secret and passes it in the environment of the plugin,
+	// which removes it from its environment on start.
+	SecretEnv
+	// The host generates the secret and writes it to a pipe inherited by the plugin.
+	// Not supported on Windows.
+	SecretPipe
+)
+
+// SecretExchange sets how the secret of secure connections is passed to the plugin.
+// Plugins built with versions of this package predating SecretEnv and SecretPipe still
+// print their own secret, which the host then uses.
+func SecretExchange(mode SecretMode) Option {
+	return func(o *options) {
+		o.secretMode = mode
+	}
+}
+
+// Generate the secret for the plugin, if passed by the host, and add it to env. Returns
+// the environment of the plugin, nil to inherit the one of the host.
+func (c *ctrl) hostSecret(env []string) ([]string, error) {
+	mode := c.p.opts.secretMode
+	if !c.p.secure || mode == SecretOutput {
+		return env, nil
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return nil, err
+	}
+	if env == nil {
+		env = os.Environ()
+	}
+	if mode == SecretEnv {
+		c.secret = secret
+		return append(env, envSecret+"="+secret), nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	// The secret fits in the buffer of the pipe
+	_, err = w.WriteString(secret + "\n")
+	w.Close()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	c.secret, c.secretPipe = secret, r
+	// The first of the extra files of the process
+	return append(env, "PINGO_SECRETFD=3"), nil
+}
+
+// Read the secret passed by the host, if any.
+func (r *rpcServer) hostSecret() (string, error) {
+	if secret, ok := os.LookupEnv(envSecret); ok {
+		// Do not leak the secret to processes started by the plugin
+		os.Unsetenv(envSecret)
+		return secret, nil
+	}
+	if r.conf.secretfd <= 0 {
+		return "", nil
+	}
+	f := os.NewFile(uintptr(r.conf.secretfd), "pingo-secret")
+	if f == nil {
+		return "", errors.New("Invalid file descriptor " + strconv.Itoa(r.conf.secretfd))
+	}
+	defer f.Close()
+	line, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
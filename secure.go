@@ -0,0 +1,247 @@
+package pingo
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+var errHandshake = ErrHandshake(errors.New("Secure handshake failed: peer does not know the secret"))
+
+// Error reported when the key exchange with the plugin fails.
+type ErrHandshake error
+
+const (
+	// Maximum plaintext carried by a single record.
+	maxRecord = 16 * 1024
+	// Length of generated secrets, in bytes.
+	secretSize = 32
+)
+
+// Generate a random secret shared between host and plugin.
+func newSecret() (string, error) {
+	b := make([]byte, secretSize)
+	if err := cryptoProvider.Random(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func mac(secret string, parts ...[]byte) []byte {
+	h := cryptoProvider.MAC([]byte(secret))
+	for _, p := range parts {
+		h.Write(p)
+	}
+	return h.Sum(nil)
+}
+
+// Handshake fields are sent with their length, as it depends on the curve and the MAC.
+func writeField(w io.Writer, key []byte) error {
+	buf := make([]byte, 2, 2+len(key))
+	binary.BigEndian.PutUint16(buf, uint16(len(key)))
+	_, err := w.Write(append(buf, key...))
+	return err
+}
+
+func readField(r io.Reader) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	key := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// Keys for both directions, derived from the ECDH shared secret and bound to the
+// secret and to both public keys.
+func sessionKeys(secret string, shared, cpub, spub []byte) (c2s, s2c []byte) {
+	k := mac(secret, []byte("pingo keys"), shared, cpub, spub)
+	return mac(string(k), []byte("client to server")), mac(string(k), []byte("server to client"))
+}
+
+// The client sends its ephemeral public key; the server answers with its own and a MAC
+// proving knowledge of the secret; the client then proves the same. Without the secret,
+// a man in the middle can neither complete the handshake nor derive the session keys.
+// This is a challenge-response over nonces: as both MACs cover the fresh keys of both
+// sides, the key of the server is the nonce the client answers, and a recorded handshake
+// cannot be replayed. MACs are compared in constant time.
+func secureClient(conn net.Conn, secret string) (net.Conn, error) {
+	curve := cryptoProvider.Curve()
+	priv, err := providerECDHKey(curve)
+	if err != nil {
+		return nil, err
+	}
+	cpub := priv.PublicKey().Bytes()
+	if err := writeField(conn, cpub); err != nil {
+		return nil, err
+	}
+
+	spub, err := readField(conn)
+	if err != nil {
+		return nil, err
+	}
+	smac, err := readField(conn)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(smac, mac(secret, []byte("pingo server"), cpub, spub)) != 1 {
+		return nil, errHandshake
+	}
+	if err := writeField(conn, mac(secret, []byte("pingo client"), cpub, spub)); err != nil {
+		return nil, err
+	}
+
+	pub, err := curve.NewPublicKey(spub)
+	if err != nil {
+		return nil, err
+	}
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c := sessionKeys(secret, shared, cpub, spub)
+	return newSecureConn(conn, c2s, s2c)
+}
+
+func secureServer(conn net.Conn, secret string) (net.Conn, error) {
+	curve := cryptoProvider.Curve()
+	cpub, err := readField(conn)
+	if err != nil {
+		return nil, err
+	}
+	pub, err := curve.NewPublicKey(cpub)
+	if err != nil {
+		return nil, err
+	}
+
+	priv, err := providerECDHKey(curve)
+	if err != nil {
+		return nil, err
+	}
+	spub := priv.PublicKey().Bytes()
+	if err := writeField(conn, spub); err != nil {
+		return nil, err
+	}
+	if err := writeField(conn, mac(secret, []byte("pingo server"), cpub, spub)); err != nil {
+		return nil, err
+	}
+
+	// Clients close the connection here when the proof of the server does not match
+	// their secret; they report the failure themselves.
+	cmac, err := readField(conn)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(cmac, mac(secret, []byte("pingo client"), cpub, spub)) != 1 {
+		return nil, errHandshake
+	}
+
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return nil, err
+	}
+	c2s, s2c := sessionKeys(secret, shared, cpub, spub)
+	return newSecureConn(conn, s2c, c2s)
+}
+
+// One direction of the record layer: AES-GCM with a counter as nonce.
+type recordCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+	seq   uint64
+}
+
+func newRecordCipher(key []byte) (*recordCipher, error) {
+	aead, err := cryptoProvider.AEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &recordCipher{aead: aead, nonce: make([]byte, aead.NonceSize())}, nil
+}
+
+func (r *recordCipher) next() []byte {
+	binary.BigEndian.PutUint64(r.nonce[len(r.nonce)-8:], r.seq)
+	r.seq++
+	return r.nonce
+}
+
+// A connection encrypting each write in length-prefixed records.
+type secureConn struct {
+	net.Conn
+	rmu  sync.Mutex
+	wmu  sync.Mutex
+	in   *recordCipher
+	out  *recordCipher
+	rbuf []byte
+}
+
+func newSecureConn(conn net.Conn, wkey, rkey []byte) (net.Conn, error) {
+	out, err := newRecordCipher(wkey)
+	if err != nil {
+		return nil, err
+	}
+	in, err := newRecordCipher(rkey)
+	if err != nil {
+		return nil, err
+	}
+	return &secureConn{Conn: conn, in: in, out: out}, nil
+}
+
+func (c *secureConn) Write(b []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	var n int
+	for len(b) > 0 {
+		chunk := b
+		if len(chunk) > maxRecord {
+			chunk = chunk[:maxRecord]
+		}
+		rec := make([]byte, 4, 4+len(chunk)+c.out.aead.Overhead())
+		rec = c.out.aead.Seal(rec, c.out.next(), chunk, nil)
+		binary.BigEndian.PutUint32(rec, uint32(len(rec)-4))
+		if _, err := c.Conn.Write(rec); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		b = b[len(chunk):]
+	}
+	return n, nil
+}
+
+func (c *secureConn) Read(b []byte) (int, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if len(c.rbuf) == 0 {
+		var hdr [4]byte
+		if _, err := io.ReadFull(c.Conn, hdr[:]); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(hdr[:])
+		if size > uint32(maxRecord+c.in.aead.Overhead()) {
+			return 0, errors.New("Record too large")
+		}
+		rec := make([]byte, size)
+		if _, err := io.ReadFull(c.Conn, rec); err != nil {
+			return 0, err
+		}
+		plain, err := c.in.aead.Open(rec[:0], c.in.next(), rec, nil)
+		if err != nil {
+			return 0, err
+		}
+		c.rbuf = plain
+	}
+
+	n := copy(b, c.rbuf)
+	c.rbuf = c.rbuf[n:]
+	return n, nil
+}
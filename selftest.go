@@ -0,0 +1,107 @@
+package pingo
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+)
+
+// Error reported when a plugin has failed its self test. See SetSelfTest.
+type ErrSelfTest error
+
+// SetSelfTest sets a function the host can run to check that the plugin is correctly
+// configured, for example that it can reach its database. Managers run it as soon as a
+// plugin is ready, and after each restart, and do not route calls to plugins whose test
+// fails.
+//
+// SetSelfTest will panic if called after Run.
+func SetSelfTest(test func() error) {
+	DefaultServer().SetSelfTest(test)
+}
+
+// SetSelfTest sets the self test of the server, as the SetSelfTest function does.
+func (s *Server) SetSelfTest(test func() error) {
+	if s.r.running {
+		panic("Do not call SetSelfTest after Run")
+	}
+	s.r.selfTest = test
+}
+
+// Internal RPC call to run the self test of the plugin. Do not call manually.
+func (s *PingoRpc) SelfTest(unused int, unusedReply *int) error {
+	if s.server().selfTest == nil {
+		return nil
+	}
+	return s.server().selfTest()
+}
+
+// SelfTest runs the self test of the plugin (see SetSelfTest), waiting for the plugin to
+// be ready. Plugins without a self test pass it. If the test fails, an ErrSelfTest error
+// is returned.
+func (p *Plugin) SelfTest(ctx context.Context) error {
+	var unused int
+	err := callContext(ctx, p, internalObject+".SelfTest", 0, &unused)
+	if isUnknownMethod(err) {
+		return nil
+	}
+	if isMethodError(err) {
+		return ErrSelfTest(fmt.Errorf("Self test failed: %w", err))
+	}
+	return err
+}
+
+// Result of the self test of a plugin of a Manager.
+type selfTest struct {
+	done chan struct{}
+	err  error
+	// Generation of the plugin tested, set when done
+	gen uint32
+}
+
+// Must be called with the manager lock held.
+func (m *Manager) startSelfTest(name string, p *Plugin) {
+	t := &selfTest{done: make(chan struct{})}
+	m.tests[name] = t
+	go func() {
+		t.err = p.SelfTest(context.Background())
+		t.gen = atomic.LoadUint32(&p.gen)
+		close(t.done)
+	}()
+}
+
+// Wait for the self test of the named plugin, if started, and return its error. The test
+// runs again if the plugin has restarted since it was last run.
+func (m *Manager) selfTested(ctx context.Context, name string) error {
+	for {
+		m.mu.Lock()
+		t, p := m.tests[name], m.plugins[name]
+		m.mu.Unlock()
+
+		if t == nil || p == nil {
+			return nil
+		}
+		select {
+		case <-t.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if t.err != nil {
+			// The plugin might be restarting after failing: wait for it, to test the new process
+			if _, err := p.request(ctx); err != nil {
+				return t.err
+			}
+		}
+
+		m.mu.Lock()
+		current := m.tests[name] == t
+		if current && t.gen != atomic.LoadUint32(&p.gen) {
+			m.startSelfTest(name, p)
+			current = false
+		}
+		m.mu.Unlock()
+
+		if current {
+			return t.err
+		}
+	}
+}
@@ -1,111 +1,337 @@
 package pingo
 
 import (
+	"crypto/tls"
 	"flag"
 	"fmt"
+	"io"
 	"net"
-	"net/http"
 	"net/rpc"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Register a new object this plugin exports. The object must be
 // an exported symbol and obey all rules an object in the standard
-// "rpc" module has to obey.
+// "rpc" module has to obey. Options can set the name, the version and
+// the visibility of the object:
+//
+//	pingo.Register(&Store{}, pingo.AsName("Store"), pingo.Versioned("1.2.0"))
 //
 // Register will panic if called after Run.
-func Register(obj interface{}) {
-	if defaultServer.running {
-		panic("Do not call Register after Run")
-	}
-	defaultServer.register(obj)
+func Register(obj interface{}, opts ...RegisterOption) {
+	DefaultServer().Register(obj, opts...)
 }
 
 // Run will start all the necessary steps to make the plugin available.
 func Run() error {
-	if !flag.Parsed() {
-		flag.Parse()
-	}
-	return defaultServer.run()
+	return DefaultServer().Run()
+}
+
+// SetOverloaded signals the host that this plugin cannot currently take more calls.
+// While overloaded, the host fails calls immediately (or routes them to other plugins
+// of a pool) instead of sending them here. Call again with false once recovered.
+func SetOverloaded(overloaded bool) {
+	DefaultServer().SetOverloaded(overloaded)
+}
+
+// SetOverloaded signals the host that the server cannot currently take more calls, as the
+// SetOverloaded function does.
+func (s *Server) SetOverloaded(overloaded bool) {
+	s.r.setOverloaded(overloaded)
 }
 
 // Internal object for plugin control
-type PingoRpc struct{}
+type PingoRpc struct {
+	// Server controlled, the default one if nil
+	r *rpcServer
+}
 
-// Default constructor for interal object. Do not call manually.
+// Default constructor for interal object, controlling the default server. Each server
+// registers its own. Do not call manually.
 func NewPingoRpc() *PingoRpc {
 	return &PingoRpc{}
 }
 
-// Internal RPC call to shut down a plugin. Do not call manually.
+func (s *PingoRpc) server() *rpcServer {
+	if s.r == nil {
+		return defaultServer
+	}
+	return s.r
+}
+
+// Internal RPC call to shut down a plugin. The plugin exits once the calls in progress
+// have completed (see SetShutdownTimeout) and the shutdown hooks have run (see OnShutdown).
+// Do not call manually.
 func (s *PingoRpc) Exit(status int, unused *int) error {
-	os.Exit(status)
+	r := s.server()
+	r.exiting.Do(func() {
+		go r.shutdown(status)
+	})
 	return nil
 }
 
 type config struct {
-	proto   string
-	addr    string
-	prefix  string
-	unixdir string
+	proto    string
+	addr     string
+	prefix   string
+	unixdir  string
+	jobs     string
+	secure   bool
+	secretfd int
+	hardened bool
+	fallback bool
+	check    bool
+	memlimit int64
+	gogc     string
+	watchdog int64
+	statedir string
+	features string
+	// Limits on decoded arguments
+	maxdepth, maxelements int
+	// TLS, with certificate and key files if not generated
+	tls             bool
+	tlscert, tlskey string
+	tlsclientca     string
+	codec           string
+	// Interface and range of ports to listen on with TCP
+	tcpaddr, tcpports string
+	// The host connects to serve callbacks
+	callbacks bool
+	// Profile continuously for the host
+	profile bool
+	// Flags of this package, parsed once from args
+	flags     *flag.FlagSet
+	args      []string
+	parseOnce sync.Once
+	// Set with Configure, taking priority over the flags
+	overrides *Options
 }
 
+// Configuration of a server created with NewServer, set only with Configure unless args
+// are set before parsing.
+func newConfig() *config {
+	c := &config{flags: flag.NewFlagSet("pingo", flag.ContinueOnError)}
+	c.define(c.flags)
+	return c
+}
+
+// Configuration of the default server, read from the command line and the environment.
 func makeConfig() *config {
-	c := &config{}
-	flag.StringVar(&c.proto, "pingo:proto", "unix", "Protocol to use: unix or tcp")
-	flag.StringVar(&c.unixdir, "pingo:unixdir", "", "Alternative directory for unix socket")
-	flag.StringVar(&c.prefix, "pingo:prefix", "pingo", "Prefix to output lines")
+	c := newConfig()
+	c.args = os.Args[1:]
+	// Also defined for plugins parsing the command line themselves, which the host passes
+	// the flags of this package to.
+	c.define(flag.CommandLine)
+	envDefaults(c.flags)
 	return c
 }
 
+// Define the flags of this package in fs.
+func (c *config) define(fs *flag.FlagSet) {
+	fs.StringVar(&c.proto, "pingo:proto", "unix", "Protocol to use: unix or tcp")
+	fs.StringVar(&c.tcpaddr, "pingo:tcp-addr", defaultTCPHost, "Address of the interface to listen on with TCP")
+	fs.StringVar(&c.tcpports, "pingo:tcp-ports", "", "Range of ports to listen on with TCP, as 40000-41000")
+	fs.StringVar(&c.unixdir, "pingo:unixdir", "", "Alternative directory for unix socket")
+	fs.StringVar(&c.prefix, "pingo:prefix", "pingo", "Prefix to output lines")
+	fs.StringVar(&c.jobs, "pingo:jobs", "", "Address of the host job queue")
+	fs.BoolVar(&c.callbacks, "pingo:callbacks", false, "Wait for the host to connect to serve callbacks")
+	fs.BoolVar(&c.secure, "pingo:secure", false, "Encrypt connections with a secret key exchanged via output")
+	fs.IntVar(&c.secretfd, "pingo:secretfd", 0, "Read the secret from this file descriptor instead of generating it")
+	fs.BoolVar(&c.hardened, "pingo:hardened", false, "Restrict socket permissions, handshake time and message size")
+	fs.BoolVar(&c.fallback, "pingo:fallback", false, "Use the other protocol if listening with the requested one fails")
+	fs.BoolVar(&c.check, "pingo:check", false, "Validate registered objects, print a JSON report and exit")
+	fs.Int64Var(&c.memlimit, "pingo:memlimit", 0, "Soft memory limit in bytes, as GOMEMLIMIT")
+	fs.StringVar(&c.gogc, "pingo:gogc", "", "Garbage collection target percentage, as GOGC")
+	fs.Int64Var(&c.watchdog, "pingo:watchdog", 0, "Exit cleanly when the memory used exceeds this number of bytes")
+	fs.StringVar(&c.statedir, "pingo:statedir", "", "Directory for the state of the plugin")
+	fs.IntVar(&c.maxdepth, "pingo:maxdepth", 0, "Maximum nesting depth of decoded arguments")
+	fs.IntVar(&c.maxelements, "pingo:maxelements", 0, "Maximum number of elements of decoded arguments")
+	fs.StringVar(&c.features, "pingo:features", supportedFeatures.String(), "Protocol features to announce, to behave as an older plugin")
+	fs.BoolVar(&c.tls, "pingo:tls", false, "Serve connections over TLS")
+	fs.StringVar(&c.tlscert, "pingo:tlscert", "", "Certificate file for TLS, generated if empty")
+	fs.StringVar(&c.tlskey, "pingo:tlskey", "", "Key file of the TLS certificate")
+	fs.StringVar(&c.tlsclientca, "pingo:tlsclientca", "", "Require hosts to present a certificate signed by the CAs in this file")
+	fs.BoolVar(&c.profile, "pingo:profile", false, "Profile continuously, for the host to collect the profiles")
+	fs.StringVar(&c.codec, "pingo:codec", "", "Codec for clients not sending a CONNECT request")
+}
+
+// Take the defaults of the flags from the environment, where -pingo:unixdir is
+// PINGO_UNIXDIR and -pingo:tcp-addr is PINGO_TCP_ADDR, for plugins started by wrappers
+// that cannot change their arguments. Flags passed on the command line take priority.
+func envDefaults(fs *flag.FlagSet) {
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "PINGO_" + strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(f.Name, "pingo:"), "-", "_"))
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(val); err != nil {
+			defaultLogger.Log(LevelWarn, "Invalid value in environment", Field{"variable", name}, Field{"error", err})
+		}
+	})
+}
+
 type rpcServer struct {
-	server  *rpc.Server
-	objs    []string
-	conf    *config
-	running bool
+	server     *dispatcher
+	objs       []string
+	conf       *config
+	running    bool
+	overloaded bool
+	started    chan struct{}
+	jobc       jobClient
+	secret     string
+	// Secret of the job queue of the host, if any
+	jobsSecret string
+	// Errors registering objects
+	regErrs []error
+	// Run on request of the host, if set
+	selfTest func() error
+	// Hints for deprecated methods
+	deprecated map[string]string
+	// Connection lifecycle hooks
+	onConnect    func(*ConnInfo)
+	onDisconnect func(*ConnInfo)
+	// Consulted before each call, if set
+	authorize func(*ConnInfo, string) error
+	// Versions and visibility of objects, by name
+	versions map[string]string
+	hidden   map[string]bool
+	// Dump of the data exchanged, if any
+	wireDump *wireDump
+	// Configuration pushed by the host
+	config pluginConfig
+	// Codec for clients not sending a CONNECT request, and the codecs available by name
+	codec  ServerCodecFunc
+	codecs map[string]ServerCodecFunc
+	// Run on exit, after waiting for calls for up to shutdownTimeout
+	shutdownHooks   []func()
+	shutdownTimeout time.Duration
+	exiting         sync.Once
+	// Limits of each connection
+	limits ConnLimits
+	// Consulted before the handshake of each connection, if set
+	acceptFilter func(net.Conn) error
+	// Run on request of the host, if set
+	healthCheck func() error
+	// Limits of TCP connections by address
+	guard tcpGuard
+	// Connections that failed to authenticate, reported to the host
+	authFailures authFailures
+	// Streams, by name
+	streams map[string]StreamFunc
+	// Connection to the callbacks of the host
+	callbacks callbackClient
+	// Memory limit of the watchdog, if set
+	watchdog int64
+	// Receives the records of the plugin
+	logger Logger
+	// Bounds on the goroutines serving connections
+	workers WorkerPool
+	// Profiles collected by the host, if enabled
+	profiler profiler
+	// Stop serving on exit instead of exiting the process, for servers from NewServer
+	embedded bool
+	// Receives the lines output for the host
+	out io.Writer
+	// Listener of the server, and closed once listening or failing to
+	listener   net.Listener
+	listening  chan struct{}
+	listenOnce sync.Once
+	// Called once listening, before reporting ready
+	onReady func() error
+	// Phases of the startup, sent to the host
+	startup startupTimes
 }
 
-func newRpcServer() *rpcServer {
+func newRpcServer(conf *config) *rpcServer {
 	r := &rpcServer{
-		server: rpc.DefaultServer,
-		objs:   make([]string, 0),
-		conf:   makeConfig(), // conf remains fixed after this point
+		server:     newDispatcher(),
+		objs:       make([]string, 0),
+		deprecated: make(map[string]string),
+		versions:   make(map[string]string),
+		hidden:     make(map[string]bool),
+		codecs:     map[string]ServerCodecFunc{"gob": GobCodec, "json": JSONCodec},
+		conf:       conf, // conf remains fixed after this point
+		started:    make(chan struct{}),
+		listening:  make(chan struct{}),
+		logger:     defaultLogger,
+		out:        os.Stdout,
 	}
-	r.register(&PingoRpc{})
+	r.register(&PingoRpc{r: r})
 	return r
 }
 
-var defaultServer = newRpcServer()
+var defaultServer = newRpcServer(makeConfig())
 
-func (r *rpcServer) register(obj interface{}) {
-	element := reflect.TypeOf(obj).Elem()
-	r.objs = append(r.objs, element.Name())
-	r.server.Register(obj)
+// Signal that the server listens, or failed to.
+func (r *rpcServer) listened() {
+	r.listenOnce.Do(func() { close(r.listening) })
 }
 
-type connection interface {
-	addr() string
-	retries() int
+// Writer of the lines output for the host.
+func (r *rpcServer) meta() metaWriter {
+	return metaWriter{prefix: meta(r.conf.prefix), w: r.out}
 }
 
-type tcp int
+func (r *rpcServer) output(key, val string) {
+	r.meta().output(key, val)
+}
 
-func (t *tcp) addr() string {
-	if *t < 1024 {
-		// Only use unprivileged ports
-		*t = 1023
+func (r *rpcServer) setOverloaded(overloaded bool) {
+	r.overloaded = overloaded
+	// Before Run, the state is reported together with the objects.
+	if !r.running {
+		return
 	}
+	r.outputOverload()
+}
 
-	*t = *t + 1
-	return fmt.Sprintf("127.0.0.1:%d", *t)
+func (r *rpcServer) outputOverload() {
+	val := "off"
+	if r.overloaded {
+		val = "on"
+	}
+	r.output("overload", val)
 }
 
-func (t *tcp) retries() int {
-	return 500
+// Client to the host job queue. Waits for Run to parse the configuration.
+func (r *rpcServer) jobs() (*rpc.Client, error) {
+	<-r.started
+	return r.jobc.get(r.conf.jobs, r.jobsSecret)
+}
+
+func (r *rpcServer) register(obj interface{}, opts ...RegisterOption) {
+	reg := &registration{}
+	for _, o := range opts {
+		o(reg)
+	}
+	name := reg.name
+	if name == "" {
+		name = reflect.TypeOf(obj).Elem().Name()
+	}
+	if reg.version != "" {
+		r.versions[name] = reg.version
+	}
+	if reg.hidden {
+		r.hidden[name] = true
+	} else {
+		r.objs = append(r.objs, name)
+	}
+	if err := r.server.register(obj, reg.name); err != nil {
+		r.regErrs = append(r.regErrs, err)
+		r.logger.Log(LevelError, "Cannot register object", Field{"object", name}, Field{"error", err})
+	}
+}
+
+type connection interface {
+	addr() string
+	retries() int
 }
 
 type unix string
@@ -122,41 +348,160 @@ func (u *unix) retries() int {
 	return 4
 }
 
-func (r *rpcServer) run() error {
+// Listen with the specified protocol, retrying with different addresses.
+func (r *rpcServer) listen(proto string) (net.Listener, *FatalInfo) {
 	var conn connection
+	switch proto {
+	case pipeProto:
+		l := listenPipe()
+		r.conf.proto, r.conf.addr = proto, l.addr.String()
+		return l, nil
+	case "tcp":
+		t, err := newTCP(r.conf.tcpaddr, r.conf.tcpports)
+		if err != nil {
+			return nil, newFatalInfo(errorCodeConnFailed, "Could not listen", 0, err)
+		}
+		conn = t
+	default:
+		dir := unix(r.conf.unixdir)
+		conn = &dir
+	}
+
 	var err error
-	var listener net.Listener
+	for i := 0; i < conn.retries(); i++ {
+		var listener net.Listener
+		addr := conn.addr()
+		if listener, err = net.Listen(proto, addr); err == nil {
+			r.conf.proto, r.conf.addr = proto, addr
+			return listener, nil
+		}
+	}
+	return nil, newFatalInfo(errorCodeConnFailed,
+		fmt.Sprintf("Could not connect in %d attemps, using %s protocol", conn.retries(), proto),
+		conn.retries(), err)
+}
+
+func (r *rpcServer) run() error {
+	var err error
+	defer r.listened()
+
+	if r.conf.proto != "tcp" && r.conf.proto != pipeProto {
+		r.conf.proto = "unix"
+	}
+	if r.conf.check {
+		r.check()
+	}
+	// Settings of the whole process are left to the default server
+	if !r.embedded {
+		r.conf.applyMemory(r.logger)
+		r.startWatchdog()
+	}
+	r.conf.applyDecodeLimits(&r.server.decodeLimits)
+	if r.conf.profile {
+		r.profiler.startCPU()
+	}
+	if !r.embedded {
+		alignMaxProcs()
+	}
+	if r.conf.hardened && !r.guard.isSet {
+		r.guard.set(hardenedTCPProtection)
+	}
+	r.wireDumpFromEnv()
 
 	r.running = true
+	close(r.started)
 
-	h := meta(r.conf.prefix)
+	h := r.meta()
+	if err := r.chooseCodec(); err != nil {
+		h.fatal(newFatalInfo(errorCodeConnFailed, "Could not set codec", 0, err))
+		return err
+	}
+	h.output("handshake", r.hello())
 	h.output("objects", strings.Join(r.objs, ", "))
+	h.output("features", (parseFeatures(r.conf.features) & supportedFeatures).String())
+	if parseFeatures(r.conf.features).Has(FeatureMethodIDs) {
+		r.server.buildMethodIDs(r.hidden)
+		if len(r.server.methodIDs) > 0 {
+			h.output("methods", r.server.methodTable())
+		}
+	}
+	r.outputDeprecated(h)
+	if r.overloaded {
+		r.outputOverload()
+	}
 
-	switch r.conf.proto {
-	case "tcp":
-		conn = new(tcp)
-	default:
-		r.conf.proto = "unix"
-		conn = new(unix)
+	if r.conf.secure {
+		if r.secret, err = r.hostSecret(); err != nil {
+			h.fatal(newFatalInfo(errorCodeConnFailed, "Could not read secret", 0, err))
+			return err
+		}
+	}
+	if r.conf.jobs != "" && r.jobsSecret == "" {
+		r.jobsSecret = os.Getenv(envJobsSecret)
+		// Do not leak the secret to processes started by the plugin
+		os.Unsetenv(envJobsSecret)
+	}
+	if r.conf.secure && r.secret == "" {
+		if r.secret, err = newSecret(); err != nil {
+			h.fatal(newFatalInfo(errorCodeConnFailed, "Could not generate secret", 0, err))
+			return err
+		}
+		h.output("auth-token", r.secret)
 	}
 
-	for i := 0; i < conn.retries(); i++ {
-		r.conf.addr = conn.addr()
-		r.server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
-		listener, err = net.Listen(r.conf.proto, r.conf.addr)
-		if err == nil {
-			break
+	r.startup.lap(&r.startup.Setup)
+	listener, info := r.listen(r.conf.proto)
+	if info != nil && r.conf.fallback {
+		other := "tcp"
+		if r.conf.proto == "tcp" {
+			other = "unix"
+		}
+		if l, _ := r.listen(other); l != nil {
+			h.output("error", fmt.Sprintf("%s: Using %s protocol instead: %s", errorCodeFallback, other, info.Error()))
+			r.logger.Log(LevelWarn, "Using fallback protocol", Field{"proto", other}, Field{"error", info})
+			listener, info = l, nil
 		}
 	}
+	if info != nil {
+		h.fatal(info)
+		return info
+	}
 
-	if err != nil {
-		h.output("fatal", fmt.Sprintf("%s: Could not connect in %d attemps, using %s protocol", errorCodeConnFailed, conn.retries(), r.conf.proto))
-		return err
+	if r.conf.tls {
+		config, fingerprint, err := r.serverTLS()
+		if err != nil {
+			h.fatal(newFatalInfo(errorCodeConnFailed, "Could not set up TLS", 0, err))
+			return err
+		}
+		listener = tls.NewListener(listener, config)
+		h.output("tls-cert", fingerprint)
+	}
+
+	if r.conf.proto == "unix" && r.conf.hardened {
+		if err := os.Chmod(r.conf.addr, 0600); err != nil {
+			h.fatal(newFatalInfo(errorCodeConnFailed, "Could not restrict socket permissions", 0, err))
+			return err
+		}
 	}
 
+	r.startup.lap(&r.startup.Bind)
+
+	r.listener = listener
+	r.listened()
+	if err := r.ready(); err != nil {
+		listener.Close()
+		h.fatal(newFatalInfo(errorCodeConnFailed, "Could not get ready", 0, err))
+		return err
+	}
+	h.output("startup", r.startup.encode())
 	h.output("ready", fmt.Sprintf("proto=%s addr=%s", r.conf.proto, r.conf.addr))
-	if err := http.Serve(listener, nil); err != nil {
-		h.output("fatal", fmt.Sprintf("err-http-serve: %s", err.Error()))
+	r.logger.Log(LevelInfo, "Serving", Field{"proto", r.conf.proto}, Field{"addr", r.conf.addr})
+	if err := r.serve(listener); err != nil {
+		if r.embedded && r.server.drain.isClosing() {
+			// Stopped by the host
+			return nil
+		}
+		h.fatal(newFatalInfo(errorCodeHttpServe, "Could not serve", 0, err))
 		return err
 	}
 	return nil
@@ -0,0 +1,74 @@
+package pingo
+
+import (
+	"context"
+	"sync"
+)
+
+// Session groups the calls of a single caller (for example, a user) to a pool of stateful
+// plugins, guaranteeing that reads observe the writes made in the same session.
+//
+// Writes are routed like CallSticky. After the first write, reads are sent to the plugin that
+// served the latest write, bypassing the cache; before any write, reads go through the cache,
+// if any, or are routed like CallSticky.
+type Session struct {
+	pool    *Pool
+	key     string
+	cache   Caller
+	mu      sync.Mutex
+	written *Plugin
+}
+
+// Session creates a session for key. The cache is optional and is used for reads until the
+// session performs its first write; it usually wraps Sticky(key) of the same pool.
+func (p *Pool) Session(key string, cache Caller) *Session {
+	return &Session{
+		pool:  p,
+		key:   key,
+		cache: cache,
+	}
+}
+
+// Write performs a call that modifies the state of a plugin.
+func (s *Session) Write(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	if len(s.pool.plugins) == 0 {
+		return errEmptyPool
+	}
+	pl, err := s.pool.callServed(ctx, s.pool.ranking(s.key), name, args, resp)
+	if pl != nil {
+		s.mu.Lock()
+		s.written = pl
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Read performs a call that only reads the state of a plugin.
+func (s *Session) Read(ctx context.Context, name string, args interface{}, resp interface{}) error {
+	s.mu.Lock()
+	written := s.written
+	s.mu.Unlock()
+
+	if written != nil {
+		return callContext(ctx, written, name, args, resp)
+	}
+	if s.cache != nil {
+		return s.cache.Call(name, args, resp)
+	}
+	return s.pool.CallSticky(ctx, s.key, name, args, resp)
+}
+
+type stickyCaller struct {
+	pool *Pool
+	key  string
+}
+
+// Sticky returns a Caller routing all calls like CallSticky with key. Use it to put
+// middlewares, like Cache, in front of the pool.
+func (p *Pool) Sticky(key string) Caller {
+	return &stickyCaller{pool: p, key: key}
+}
+
+func (s *stickyCaller) Call(name string, args interface{}, resp interface{}) error {
+	return s.pool.CallSticky(context.Background(), s.key, name, args, resp)
+}
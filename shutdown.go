@@ -0,0 +1,78 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// StopContext stops the plugin as Stop does. If ctx is done before the plugin has exited,
+// the plugin is killed. An error is returned if the plugin had to be killed or did not
+// exit cleanly, for example because it did not obey the request to exit within the
+// timeout (see SetTimeout).
+//
+// Plugins that were not started, or were stopped already, are ignored.
+func (p *Plugin) StopContext(ctx context.Context) error {
+	return p.stop(ctx, true)
+}
+
+// Stop the plugin as StopContext does. Unless keepWarm is set, the process is killed even
+// if kept warm (see KeepWarm), as when it is restarted for being unresponsive.
+func (p *Plugin) stop(ctx context.Context, keepWarm bool) error {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+
+	if !p.running {
+		return nil
+	}
+	p.killWarm = !keepWarm
+	p.Resume()
+	wr := newWaiter()
+	p.killCh <- wr
+
+	var err error
+	select {
+	case <-wr.c:
+		if wr.err != nil {
+			err = fmt.Errorf("Plugin %s did not exit cleanly: %w", p.exe, wr.err)
+		}
+	case <-ctx.Done():
+		p.killProcess()
+		wr.wait()
+		err = fmt.Errorf("Plugin %s killed: %w", p.exe, ctx.Err())
+	}
+	p.exitCh <- struct{}{}
+	p.running = false
+	return err
+}
+
+// Kill the process of the plugin, if running.
+func (p *Plugin) killProcess() {
+	p.killInProcess()
+	pid := atomic.LoadInt64(&p.pid)
+	if pid == 0 {
+		return
+	}
+	if proc, err := os.FindProcess(int(pid)); err == nil {
+		proc.Kill()
+	}
+}
+
+// StopAll stops the plugins concurrently, as StopContext does, and returns their errors.
+// Once it returns, no process of the plugins is left running.
+func StopAll(ctx context.Context, plugins ...*Plugin) error {
+	errs := make([]error, len(plugins))
+	wg := new(sync.WaitGroup)
+	for i, p := range plugins {
+		wg.Add(1)
+		go func(i int, p *Plugin) {
+			defer wg.Done()
+			errs[i] = p.StopContext(ctx)
+		}(i, p)
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+package pingo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// Error returned by calls failed on purpose by a Simulation.
+type ErrSimulated error
+
+// MethodSimulation sets the latency and errors simulated for the calls of a method.
+type MethodSimulation struct {
+	// Delay added to each call, plus a random delay of up to Jitter
+	Latency, Jitter time.Duration
+	// Share of the calls failing with an ErrSimulated error, without reaching the plugin
+	ErrorRate float64
+}
+
+// Simulation maps methods, as in "Object.Method", to the latency and errors simulated for
+// their calls. An entry "Object.*" applies to the methods of Object without an entry of
+// their own, and "*" to all other methods.
+type Simulation map[string]MethodSimulation
+
+// Simulate makes the host add latency and errors to the calls to the plugin as set by s, to
+// reproduce locally the timing of plugins in production while developing against plugins
+// that are faster, or slower, than they will be. Delays end early if the context of the
+// call is done. This is meant for development and should not be used in production.
+func Simulate(s Simulation) Option {
+	return func(o *options) {
+		o.simulation = s
+	}
+}
+
+// LoadSimulation reads a simulation in JSON, where durations are strings as accepted by
+// time.ParseDuration. For example:
+//
+//	{
+//		"Store.Get": {"Latency": "20ms", "Jitter": "10ms"},
+//		"Store.*": {"Latency": "100ms", "ErrorRate": 0.01}
+//	}
+func LoadSimulation(path string) (Simulation, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var s Simulation
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	return s, nil
+}
+
+func (m *MethodSimulation) UnmarshalJSON(data []byte) error {
+	var v struct {
+		Latency, Jitter string
+		ErrorRate       float64
+	}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = MethodSimulation{ErrorRate: v.ErrorRate}
+	for _, d := range []struct {
+		s   string
+		dst *time.Duration
+	}{{v.Latency, &m.Latency}, {v.Jitter, &m.Jitter}} {
+		if d.s == "" {
+			continue
+		}
+		t, err := time.ParseDuration(d.s)
+		if err != nil {
+			return err
+		}
+		*d.dst = t
+	}
+	return nil
+}
+
+// Settings for method, if any.
+func (s Simulation) lookup(method string) (MethodSimulation, bool) {
+	if m, ok := s[method]; ok {
+		return m, true
+	}
+	if i := strings.IndexByte(method, '.'); i >= 0 {
+		if m, ok := s[method[:i]+".*"]; ok {
+			return m, true
+		}
+	}
+	m, ok := s["*"]
+	return m, ok
+}
+
+// Delay or fail a call to method as set, if simulating.
+func (s Simulation) apply(ctx context.Context, method string) error {
+	m, ok := s.lookup(method)
+	if !ok {
+		return nil
+	}
+	d := m.Latency
+	if m.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(m.Jitter) + 1))
+	}
+	if d > 0 {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if m.ErrorRate > 0 && rand.Float64() < m.ErrorRate {
+		return ErrSimulated(errors.New("Simulated failure of " + method))
+	}
+	return nil
+}
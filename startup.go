@@ -0,0 +1,167 @@
+package pingo
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"time"
+)
+
+// Startup breaks down the time a plugin took to start, from the host starting its
+// process to the host being connected, so that a slow startup can be traced to its cause.
+//
+// The phases between Run and the plugin being ready are measured by the plugin and sent
+// to the host with the handshake. Plugins built with older versions of this package do
+// not send them: Exec then covers all of their startup.
+type Startup struct {
+	// From starting the process to the plugin calling Run: loading the executable,
+	// initializing the runtime and the packages, and the main function up to Run
+	Exec time.Duration
+	// Parsing the -pingo: flags of the plugin
+	Flags time.Duration
+	// Setting up the plugin before listening, such as choosing the codec and getting the
+	// secret
+	Setup time.Duration
+	// Listening for connections, including retries on other addresses and TLS setup
+	Bind time.Duration
+	// Running the function set with OnReady in the plugin
+	OnReady time.Duration
+	// Opening the first connection to the plugin
+	Dial time.Duration
+	// Authenticating the first connection: TLS handshake, key exchange and CONNECT
+	// request
+	Auth time.Duration
+	// From starting the process to the host being connected
+	Total time.Duration
+}
+
+// Startup returns how long the last start of the plugin took, phase by phase, or nil if
+// the host has not connected to the plugin yet. The result must not be modified.
+func (p *Plugin) Startup() *Startup {
+	s, _ := p.startup.Load().(*Startup)
+	return s
+}
+
+// OnStartup sets a function called with the phases of each start of the plugin, once the
+// host is connected to it. The function runs in its own goroutine.
+//
+// Panics if called after Start.
+func (p *Plugin) OnStartup(fn func(*Plugin, *Startup)) {
+	if p.running {
+		panic("Cannot call OnStartup after Start")
+	}
+	p.onStartup = fn
+}
+
+// OnReady sets a function called once the plugin listens for connections, before it
+// reports to the host that it is ready, for example to warm up caches. If it returns an
+// error, the plugin fails to start. Its duration is reported to the host (see Startup).
+//
+// OnReady will panic if called after Run.
+func OnReady(fn func() error) {
+	DefaultServer().OnReady(fn)
+}
+
+// OnReady sets the function called once the server listens, as the OnReady function does.
+func (s *Server) OnReady(fn func() error) {
+	if s.r.running {
+		panic("Do not call OnReady after Run")
+	}
+	s.r.onReady = fn
+}
+
+// Phases of the startup measured by the plugin, sent to the host.
+type startupTimes struct {
+	Flags   time.Duration `json:"flags"`
+	Setup   time.Duration `json:"setup"`
+	Bind    time.Duration `json:"bind"`
+	OnReady time.Duration `json:"onready"`
+	// Since Run was called, when sent
+	Run time.Duration `json:"run"`
+
+	// When Run was called and when the last phase ended
+	start, last time.Time
+}
+
+// Record the time since the end of the previous phase as the duration of phase d.
+func (t *startupTimes) lap(d *time.Duration) {
+	now := time.Now()
+	*d = now.Sub(t.last)
+	t.last = now
+}
+
+// Encode the phases for the host.
+func (t *startupTimes) encode() string {
+	t.Run = time.Since(t.start)
+	b, _ := json.Marshal(t)
+	return string(b)
+}
+
+// Parse the flags of the server, then run it, timing the startup.
+func (r *rpcServer) parseAndRun() error {
+	r.startup.start = time.Now()
+	r.startup.last = r.startup.start
+	r.conf.parse()
+	r.startup.lap(&r.startup.Flags)
+	return r.run()
+}
+
+// Run the function set with OnReady, if any.
+func (r *rpcServer) ready() error {
+	defer r.startup.lap(&r.startup.OnReady)
+	if r.onReady == nil {
+		return nil
+	}
+	return r.onReady()
+}
+
+// Record the phases of the startup sent by the plugin.
+func (c *ctrl) parseStartup(val string) {
+	t := &startupTimes{}
+	if err := json.Unmarshal([]byte(val), t); err != nil {
+		return
+	}
+	c.startup = &Startup{
+		Exec:    time.Since(c.execStart) - t.Run,
+		Flags:   t.Flags,
+		Setup:   t.Setup,
+		Bind:    t.Bind,
+		OnReady: t.OnReady,
+	}
+	if c.startup.Exec < 0 {
+		c.startup.Exec = 0
+	}
+}
+
+// Open the first connection to the plugin, timing the dial and the authentication.
+func (c *ctrl) dialFirst(path string) (net.Conn, *bufio.Reader, error) {
+	s := c.startup
+	if s == nil {
+		// The plugin did not send its phases
+		s = &Startup{Exec: time.Since(c.execStart)}
+		c.startup = s
+	}
+	start := time.Now()
+	conn, err := dial(c.dialer.proto, c.dialer.addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.Dial = time.Since(start)
+	start = time.Now()
+	conn, br, err := handshakeConn(conn, path, c.dialer.cred, c.dialer.opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.Auth = time.Since(start)
+	return conn, br, nil
+}
+
+// Publish the phases of the startup once connected.
+func (c *ctrl) started() {
+	s := c.startup
+	s.Total = time.Since(c.execStart)
+	c.p.startup.Store(s)
+	if fn := c.p.onStartup; fn != nil {
+		go fn(c.p, s)
+	}
+}
@@ -0,0 +1,124 @@
+package pingo
+
+import (
+	"errors"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Set the directory where the plugin keeps its state, such as caches and databases.
+// The directory is created with permissions restricted to the current user when the
+// plugin is started; the plugin retrieves it with StateDir. See also Manager.SetStateRoot.
+//
+// Panics if called after Start.
+func (p *Plugin) SetStateDir(dir string) {
+	if p.running {
+		panic("Cannot call SetStateDir after Start")
+	}
+	p.statedir = dir
+}
+
+// StateDir returns the state directory of the plugin, as set with SetStateDir.
+func (p *Plugin) StateDir() string {
+	return p.statedir
+}
+
+// Create the state directory, or restrict its permissions if it exists.
+func createStateDir(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	return os.Chmod(dir, 0700)
+}
+
+// StateDir returns the directory in which this plugin can keep its state, or an empty
+// string if the host has not assigned one. The directory persists across restarts.
+func StateDir() string {
+	return DefaultServer().StateDir()
+}
+
+// StateDir returns the state directory of the server, as the StateDir function does.
+func (s *Server) StateDir() string {
+	s.r.conf.parse()
+	return s.r.conf.statedir
+}
+
+// SetStateRoot makes the manager assign to each plugin added afterwards a state directory
+// under root, named after the plugin. Directories are stable across runs, so that plugins
+// find their state again. Remove them with Uninstall.
+func (m *Manager) SetStateRoot(root string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.stateRoot = root
+}
+
+// Name of the state directory of a plugin, safe to use as a single path element.
+func stateDirName(name string) string {
+	name = url.PathEscape(name)
+	if name == "" {
+		// Escaped names never contain a lone "%"
+		return "%"
+	}
+	if strings.Trim(name, ".") == "" {
+		name = strings.Replace(name, ".", "%2E", -1)
+	}
+	return name
+}
+
+// Remove stops the named plugin and its schedules and removes it from the manager.
+func (m *Manager) Remove(name string) error {
+	_, err := m.remove(name)
+	return err
+}
+
+// Uninstall removes the named plugin as Remove does, then deletes its state directory.
+func (m *Manager) Uninstall(name string) error {
+	p, err := m.remove(name)
+	if err != nil {
+		return err
+	}
+	if dir := p.StateDir(); dir != "" {
+		return os.RemoveAll(dir)
+	}
+	return nil
+}
+
+func (m *Manager) remove(name string) (*Plugin, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p, ok := m.plugins[name]
+	if !ok {
+		return nil, ErrUnknownPlugin(errors.New("Unknown plugin " + name))
+	}
+	schedules := m.schedules[:0]
+	for _, s := range m.schedules {
+		if s.Plugin == name {
+			s.Stop()
+			continue
+		}
+		schedules = append(schedules, s)
+	}
+	m.schedules = schedules
+	for i, n := range m.names {
+		if n == name {
+			m.names = append(m.names[:i], m.names[i+1:]...)
+			break
+		}
+	}
+	delete(m.plugins, name)
+	delete(m.tests, name)
+	m.invalidateRoutes()
+	if m.running {
+		p.Stop()
+	}
+	return p, nil
+}
+
+// Path of the state directory of the named plugin.
+func (m *Manager) stateDir(name string) string {
+	return filepath.Join(m.stateRoot, stateDirName(name))
+}
@@ -0,0 +1,293 @@
+package pingo
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"net"
+	"net/rpc"
+	"net/url"
+	"strings"
+)
+
+// Streams are served on connections of their own, opened with a CONNECT request for
+// streamPath followed by the name of the stream. The host sends the arguments in a single
+// frame, then the plugin sends the data in frames as it is written, followed by a frame
+// ending the stream with the error of the stream, if any.
+const streamPath = "/_pingo_/stream/"
+
+// Kinds of frames.
+const (
+	frameData byte = 'd'
+	frameEnd  byte = 'e'
+)
+
+const (
+	// Largest frame of data sent; larger writes are split.
+	maxFrame = 32 << 10
+	// Largest arguments and error message accepted.
+	maxStreamArgs = 16 << 20
+)
+
+var (
+	errFrameTooLarge = errors.New("Stream frame too large")
+	errNoStreams     = errors.New("Plugin does not support streams")
+)
+
+// StreamFunc produces the data of a stream opened by the host with OpenStream, writing it
+// to w as it becomes available. The arguments passed by the host are decoded by calling
+// args with a pointer, as for the arguments of a method. The context is cancelled when the
+// host closes the stream. The error returned, if any, is reported to the host when it has
+// read all the data written.
+type StreamFunc func(ctx context.Context, args func(interface{}) error, w io.Writer) error
+
+// RegisterStream exports a stream under the specified name. Streams let plugins return
+// results too large to be held in memory, or continuous data: unlike replies of methods,
+// the data is sent while it is written.
+//
+// RegisterStream will panic if called after Run.
+func RegisterStream(name string, fn StreamFunc) {
+	DefaultServer().RegisterStream(name, fn)
+}
+
+// RegisterStream exports a stream, as the RegisterStream function does.
+func (s *Server) RegisterStream(name string, fn StreamFunc) {
+	if s.r.running {
+		panic("Do not call RegisterStream after Run")
+	}
+	if s.r.streams == nil {
+		s.r.streams = make(map[string]StreamFunc)
+	}
+	s.r.streams[name] = fn
+}
+
+// OpenStream opens the stream registered by the plugin under name (see RegisterStream),
+// passing args to it, and returns a reader of its data. Once all data is read, the reader
+// returns io.EOF, or the error of the stream as an rpc.ServerError. The stream must be
+// closed; closing it before reading all data, or ctx being done, stops the stream.
+//
+// Streams are served on connections of their own, using the credentials of the plugin.
+// The unix socket of a plugin with streams is kept until the plugin exits, unless
+// connections are multiplexed (see Multiplex).
+// Plugins built with versions of this package predating streams fail with an error.
+func (p *Plugin) OpenStream(ctx context.Context, name string, args interface{}) (io.ReadCloser, error) {
+	if err := p.pause.wait(ctx); err != nil {
+		return nil, err
+	}
+	conn, err := p.request(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !conn.features.Has(FeatureStreams) {
+		return nil, errNoStreams
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(args); err != nil {
+		return nil, err
+	}
+	nc, br, err := conn.dialer.dial(streamPath + url.PathEscape(name))
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFrame(nc, frameData, buf.Bytes()); err != nil {
+		nc.Close()
+		return nil, err
+	}
+	s := &streamReader{conn: nc, r: br, closed: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			nc.Close()
+		case <-s.closed:
+		}
+	}()
+	return s, nil
+}
+
+func writeFrame(w io.Writer, kind byte, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = kind
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	if _, err := w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+func readFrameHeader(r io.Reader) (byte, int, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, 0, err
+	}
+	return hdr[0], int(binary.BigEndian.Uint32(hdr[1:])), nil
+}
+
+// Read a whole frame of the specified kind.
+func readFrame(r io.Reader, kind byte) ([]byte, error) {
+	k, n, err := readFrameHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	if k != kind {
+		return nil, errors.New("Unexpected stream frame")
+	}
+	if n > maxStreamArgs {
+		return nil, errFrameTooLarge
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Reads the data frames of a stream.
+type streamReader struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// Data left in the current frame
+	left int
+	// Error to return once the data is read
+	err    error
+	closed chan struct{}
+}
+
+func (s *streamReader) Read(b []byte) (int, error) {
+	for s.left == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		kind, n, err := readFrameHeader(s.r)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			s.err = err
+			continue
+		}
+		switch kind {
+		case frameData:
+			s.left = n
+		case frameEnd:
+			if n > maxStreamArgs {
+				s.err = errFrameTooLarge
+				continue
+			}
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(s.r, msg); err != nil {
+				s.err = err
+			} else if n > 0 {
+				s.err = rpc.ServerError(msg)
+			} else {
+				s.err = io.EOF
+			}
+		default:
+			s.err = errors.New("Unexpected stream frame")
+		}
+	}
+	if len(b) > s.left {
+		b = b[:s.left]
+	}
+	n, err := s.r.Read(b)
+	s.left -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (s *streamReader) Close() error {
+	select {
+	case <-s.closed:
+		return nil
+	default:
+	}
+	close(s.closed)
+	return s.conn.Close()
+}
+
+// Writes data frames of a stream, sending each write immediately.
+type streamWriter struct {
+	w *bufio.Writer
+}
+
+func (s *streamWriter) Write(b []byte) (int, error) {
+	var written int
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+		if err := writeFrame(s.w, frameData, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, s.w.Flush()
+}
+
+// Name of the stream requested by a CONNECT request for path, if any.
+func streamName(path string) string {
+	if !strings.HasPrefix(path, streamPath) {
+		return ""
+	}
+	name, err := url.PathUnescape(strings.TrimPrefix(path, streamPath))
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// Serve the named stream on conn, once the handshake is complete.
+func (r *rpcServer) serveStream(conn net.Conn, br *bufio.Reader, name string, info *ConnInfo, check func(string) error) {
+	w := &streamWriter{w: bufio.NewWriterSize(conn, maxFrame+5)}
+	err := r.stream(br, name, info, check, w)
+	var msg string
+	if err != nil {
+		if msg = err.Error(); msg == "" {
+			msg = "pingo: stream " + name + " returned an empty error"
+		}
+	}
+	if writeFrame(w.w, frameEnd, []byte(msg)) == nil {
+		w.w.Flush()
+	}
+	conn.Close()
+}
+
+func (r *rpcServer) stream(br *bufio.Reader, name string, info *ConnInfo, check func(string) error, w io.Writer) error {
+	args, err := readFrame(br, frameData)
+	if err != nil {
+		return err
+	}
+	fn := r.streams[name]
+	if fn == nil {
+		return errors.New("pingo: can't find stream " + name)
+	}
+	if check != nil {
+		if err := check(name); err != nil {
+			return err
+		}
+	}
+	if !r.server.drain.begin() {
+		return errShuttingDown
+	}
+	defer r.server.drain.end()
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), connInfoKey{}, info))
+	defer cancel()
+	// The host sends nothing more: reading ends when it closes the stream
+	go func() {
+		io.Copy(io.Discard, br)
+		cancel()
+	}()
+	decode := func(v interface{}) error {
+		return gob.NewDecoder(bytes.NewReader(args)).Decode(v)
+	}
+	return fn(ctx, decode, w)
+}
@@ -0,0 +1,180 @@
+package pingo
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	errTooManyConns = errors.New("Too many connections from the same address")
+	errLockedOut    = errors.New("Address locked out after failed handshakes")
+)
+
+// TCPProtection limits the connections accepted by a plugin listening with TCP, whose
+// port can be reached by any local process. Zero values mean no limit.
+//
+// Connections are limited as soon as they are accepted, before their handshake. Once a
+// connection has authenticated with the secret of the host, it is no longer counted, so
+// that the connections of the host do not use up the connections allowed from the
+// loopback address it shares with other local processes.
+type TCPProtection struct {
+	// Time for a connection to complete the handshake, including authentication.
+	HandshakeTimeout time.Duration
+	// Maximum number of open connections from the same IP address.
+	MaxConnsPerIP int
+	// After a failed handshake, connections from the same IP address are refused for
+	// this long, doubling with each consecutive failure up to MaxLockout.
+	Lockout, MaxLockout time.Duration
+}
+
+// Protection of plugins started with -pingo:hardened, unless set with SetTCPProtection.
+var hardenedTCPProtection = TCPProtection{
+	HandshakeTimeout: hardenedAuthTimeout,
+	MaxConnsPerIP:    64,
+	Lockout:          100 * time.Millisecond,
+	MaxLockout:       30 * time.Second,
+}
+
+// SetTCPProtection sets the limits applied to TCP connections to the plugin. Connections
+// over unix sockets are not limited.
+//
+// SetTCPProtection will panic if called after Run.
+func SetTCPProtection(p TCPProtection) {
+	DefaultServer().SetTCPProtection(p)
+}
+
+// SetTCPProtection sets the limits applied to TCP connections to the server, as the
+// SetTCPProtection function does.
+func (s *Server) SetTCPProtection(p TCPProtection) {
+	if s.r.running {
+		panic("Do not call SetTCPProtection after Run")
+	}
+	s.r.guard.set(p)
+}
+
+// Tracks connections and failed handshakes by IP address.
+type tcpGuard struct {
+	mu    sync.Mutex
+	p     TCPProtection
+	isSet bool
+	conns map[string]int
+	locks map[string]*lockout
+}
+
+type lockout struct {
+	failures int
+	until    time.Time
+}
+
+func (g *tcpGuard) set(p TCPProtection) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	g.p, g.isSet = p, true
+}
+
+// Returns the handshake timeout, if set.
+func (g *tcpGuard) handshakeTimeout(conn net.Conn) time.Duration {
+	if remoteIP(conn) == "" {
+		return 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.p.HandshakeTimeout
+}
+
+// IP address of a TCP connection, empty for other connections.
+func remoteIP(conn net.Conn) string {
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	return addr.IP.String()
+}
+
+// Account for a new connection, before its handshake. Returns an error if it must be
+// refused; otherwise release must be called when the connection is closed, or once it
+// has authenticated as the host.
+func (g *tcpGuard) admit(conn net.Conn) (release func(), err error) {
+	ip := remoteIP(conn)
+	if ip == "" {
+		return func() {}, nil
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if l := g.locks[ip]; l != nil {
+		now := time.Now()
+		if now.Before(l.until) {
+			return nil, errLockedOut
+		}
+		// Forget failures once the address has behaved for a while
+		if now.After(l.until.Add(g.p.MaxLockout)) {
+			delete(g.locks, ip)
+		}
+	}
+	if g.p.MaxConnsPerIP > 0 && g.conns[ip] >= g.p.MaxConnsPerIP {
+		return nil, errTooManyConns
+	}
+	if g.conns == nil {
+		g.conns = make(map[string]int)
+	}
+	g.conns[ip]++
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			g.mu.Lock()
+			defer g.mu.Unlock()
+
+			if g.conns[ip]--; g.conns[ip] <= 0 {
+				delete(g.conns, ip)
+			}
+		})
+	}, nil
+}
+
+// Record a connection that authenticated with the secret of the host: failures of its
+// address are forgotten.
+func (g *tcpGuard) authenticated(conn net.Conn) {
+	ip := remoteIP(conn)
+	if ip == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.locks, ip)
+}
+
+// Record a failed handshake. Consecutive failures lock the address out for increasing
+// times.
+func (g *tcpGuard) failed(conn net.Conn) {
+	ip := remoteIP(conn)
+	if ip == "" {
+		return
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.p.Lockout == 0 {
+		return
+	}
+	if g.locks == nil {
+		g.locks = make(map[string]*lockout)
+	}
+	l := g.locks[ip]
+	if l == nil {
+		l = &lockout{}
+		g.locks[ip] = l
+	}
+	d := g.p.Lockout << uint(l.failures)
+	if g.p.MaxLockout > 0 && d >= g.p.MaxLockout {
+		d = g.p.MaxLockout
+	} else if l.failures < 20 {
+		l.failures++
+	}
+	l.until = time.Now().Add(d)
+}
@@ -0,0 +1,79 @@
+package pingo
+
+import (
+	"os"
+	"strings"
+	"text/template"
+)
+
+// Launch holds the values that templates in the parameters and environment of a plugin
+// can refer to, as in "{{.SocketDir}}". See Templates.
+type Launch struct {
+	// Protocol requested to the plugin
+	Proto string
+	// Directory where the unix socket is placed, if any
+	SocketDir string
+	// Prefix of the lines the plugin outputs for the host
+	Prefix string
+	// Directory for the state of the plugin, if any (see SetStateDir)
+	StateDir string
+	// Secret of secure connections generated by the host, if passed with SecretEnv or
+	// SecretPipe (see SecretExchange). Parameters are visible to other processes: pass
+	// it in the environment instead.
+	Secret string
+}
+
+// Templates makes the parameters of the plugin (see NewPlugin) be expanded as templates of
+// the "text/template" package with a Launch value when the plugin is started, and adds env
+// to its environment, as "NAME=template" strings expanded in the same way. For example, a
+// plugin running in a container can be given access to the socket directory and to the
+// secret of the host, which docker passes from its own environment with "-e PINGO_SECRET":
+//
+//	p := pingo.NewPlugin("unix", "docker", "run", "--rm", "-v", "{{.SocketDir}}:{{.SocketDir}}",
+//		"-e", "PINGO_SECRET", "image")
+//	p.SetSecure(true)
+//	p.SetOptions(pingo.Templates(), pingo.SecretExchange(pingo.SecretEnv), pingo.FlagsLast())
+//
+// The flags of this package must reach the plugin, not docker: see FlagsLast.
+//
+// Each parameter remains a single argument, whatever the values interpolated.
+func Templates(env ...string) Option {
+	return func(o *options) {
+		o.templates = true
+		o.templateEnv = append(o.templateEnv, env...)
+	}
+}
+
+// Expand the templates in the parameters args and in the variables to add to env, which
+// is nil to inherit the environment of the host.
+func (o *options) expandTemplates(args, env []string, l *Launch) ([]string, []string, error) {
+	args, err := l.expand(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	vars, err := l.expand(o.templateEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(vars) > 0 && env == nil {
+		env = os.Environ()
+	}
+	return args, append(env, vars...), nil
+}
+
+// Expand the templates in list with the values of l.
+func (l *Launch) expand(list []string) ([]string, error) {
+	out := make([]string, len(list))
+	for i, s := range list {
+		t, err := template.New("").Option("missingkey=error").Parse(s)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		if err := t.Execute(&b, l); err != nil {
+			return nil, err
+		}
+		out[i] = b.String()
+	}
+	return out, nil
+}
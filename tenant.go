@@ -0,0 +1,94 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Error reported when a call exceeds the rate allowed for its tenant.
+type ErrRateLimited error
+
+// Metadata key of the tenant of a call.
+const tenantKey = "tenant"
+
+type tenantCtxKey struct{}
+
+// WithTenant returns a context making calls performed with it (see CallContext) carry the
+// specified tenant label. Plugins can apply limits per tenant (see SetTenantLimit); the
+// tenant is reported in audit records and instrumentation.
+func WithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantCtxKey{}, tenant)
+}
+
+// Tenant returns the tenant label of the call served with ctx, or an empty string.
+func Tenant(ctx context.Context) string {
+	md, _ := ctx.Value(metadataKey{}).(url.Values)
+	return md.Get(tenantKey)
+}
+
+// SetTenantLimit limits the calls of each tenant to perSecond calls per second on average,
+// with bursts of up to burst calls. Calls over the limit fail with an ErrRateLimited error.
+// Calls without a tenant are not limited. A zero rate removes the limit.
+func SetTenantLimit(perSecond float64, burst int) {
+	DefaultServer().SetTenantLimit(perSecond, burst)
+}
+
+// SetTenantLimit limits the calls of each tenant to the server, as the SetTenantLimit
+// function does.
+func (s *Server) SetTenantLimit(perSecond float64, burst int) {
+	s.r.server.tenants.set(perSecond, burst)
+}
+
+// Token bucket of a tenant.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type tenantLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	buckets map[string]*bucket
+}
+
+func (l *tenantLimiter) set(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.rate, l.burst = rate, float64(burst)
+	l.buckets = make(map[string]*bucket)
+}
+
+// Take a token for a call of tenant.
+func (l *tenantLimiter) allow(tenant string) error {
+	if tenant == "" {
+		return nil
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	b, ok := l.buckets[tenant]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[tenant] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return ErrRateLimited(errors.New("Rate limit exceeded for tenant " + tenant))
+	}
+	b.tokens--
+	return nil
+}
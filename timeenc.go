@@ -0,0 +1,78 @@
+package pingo
+
+import (
+	"context"
+	"strconv"
+	"time"
+)
+
+// Metadata keys of the deadline of a call, in relative and absolute form.
+const (
+	timeoutKey  = "timeout"
+	deadlineKey = "deadline"
+)
+
+// DeadlineMode decides how the deadline of the context of a call reaches the plugin.
+// See Deadlines.
+type DeadlineMode int
+
+const (
+	// Send the time remaining before the deadline. The plugin adds it to its own clock
+	// when the call is received, so the deadline does not depend on the clocks of host
+	// and plugin agreeing; the time the call spends in transit is not accounted for.
+	RelativeDeadlines DeadlineMode = iota
+	// Send the deadline as a UTC timestamp. Transit time is accounted for, but host and
+	// plugin clocks must be synchronized.
+	AbsoluteDeadlines
+	// Do not send deadlines.
+	NoDeadlines
+)
+
+// Deadlines sets how the deadline of the context passed to CallContext is propagated to
+// the context of the method called. The default is RelativeDeadlines.
+func Deadlines(mode DeadlineMode) Option {
+	return func(o *options) {
+		o.deadlines = mode
+	}
+}
+
+// Canonical form of timestamps crossing the RPC boundary: wall clock time in UTC, without
+// the monotonic reading, which is meaningless to another process.
+func formatTime(t time.Time) string {
+	return t.UTC().Round(0).Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) (time.Time, error) {
+	return time.Parse(time.RFC3339Nano, s)
+}
+
+// Set the deadline of ctx, if any, in md as specified by mode. The time remaining is
+// measured with the monotonic clock.
+func setDeadline(md map[string][]string, ctx context.Context, mode DeadlineMode) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return
+	}
+	switch mode {
+	case RelativeDeadlines:
+		md[timeoutKey] = []string{strconv.FormatInt(int64(time.Until(deadline)), 10)}
+	case AbsoluteDeadlines:
+		md[deadlineKey] = []string{formatTime(deadline)}
+	}
+}
+
+// Deadline sent in md for a call received at the specified time. Relative deadlines
+// are converted using the monotonic reading of received.
+func getDeadline(md map[string][]string, received time.Time) (time.Time, bool) {
+	if vals := md[timeoutKey]; len(vals) > 0 {
+		if ns, err := strconv.ParseInt(vals[0], 10, 64); err == nil {
+			return received.Add(time.Duration(ns)), true
+		}
+	}
+	if vals := md[deadlineKey]; len(vals) > 0 {
+		if t, err := parseTime(vals[0]); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
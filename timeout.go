@@ -0,0 +1,59 @@
+package pingo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// Error returned by calls that did not complete within their timeout.
+type ErrTimeout error
+
+// SetCallTimeout bounds the time calls to the plugin may take, so that a method that hangs
+// cannot block the host forever. The time is counted once the plugin is ready to receive
+// the call, not while it starts. Calls taking longer fail with an ErrTimeout error and the
+// method in the plugin is cancelled, as when the context of CallContext is done; see also
+// KillOnTimeout. Contexts with an earlier deadline take priority. Zero, the default, means
+// no timeout.
+//
+// Panics if called after Start.
+func (p *Plugin) SetCallTimeout(d time.Duration) {
+	if p.running {
+		panic("Cannot call SetCallTimeout after Start")
+	}
+	p.callTimeout = d
+}
+
+// KillOnTimeout makes the host kill the plugin when a call times out (see SetCallTimeout),
+// for plugins that cannot recover from a hanging method. The plugin is then restarted as
+// set by SetRestartPolicy.
+func KillOnTimeout() Option {
+	return func(o *options) {
+		o.killOnTimeout = true
+	}
+}
+
+// CallTimeout is like Call, but fails with an ErrTimeout error if the call takes longer
+// than d, which replaces the timeout set with SetCallTimeout.
+func (p *Plugin) CallTimeout(d time.Duration, name string, args interface{}, resp interface{}) error {
+	return callTimeout(context.Background(), p, d, name, args, resp)
+}
+
+// Perform a call, failing if it takes longer than d once the plugin is ready to receive it.
+// Starting the plugin and waiting for it while paused do not count.
+func callTimeout(ctx context.Context, pl *Plugin, d time.Duration, name string, args interface{}, resp interface{}) error {
+	return timedOut(ctx, pl, d, name, performCall(ctx, pl, d, name, args, resp))
+}
+
+// Return the error of a call performed with ctx and timeout d, an ErrTimeout error if the
+// call timed out. The plugin is then killed if set so with KillOnTimeout.
+func timedOut(ctx context.Context, pl *Plugin, d time.Duration, name string, err error) error {
+	if d <= 0 || err != context.DeadlineExceeded || ctx.Err() != nil {
+		return err
+	}
+	if pl.opts.killOnTimeout {
+		pl.handler.Error(errors.New("Killing plugin " + pl.exe + " as call " + name + " timed out"))
+		pl.killProcess()
+	}
+	return ErrTimeout(errors.New("Call " + name + " timed out after " + d.String()))
+}
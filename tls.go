@@ -0,0 +1,164 @@
+package pingo
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"time"
+)
+
+var (
+	errNoCertificate    = ErrHandshake(errors.New("Plugin did not provide a certificate for a TLS connection"))
+	errCertificatePin   = ErrHandshake(errors.New("Certificate of the plugin does not match the one it reported"))
+	errInvalidClientCAs = errors.New("No certificates found in client CA file")
+)
+
+// Serve connections over TLS. Unlike SetSecure, TLS allows to verify plugins with
+// certificates issued by a CA, for plugins that are not started by the host, and
+// plugins can verify the certificates of the hosts that connect.
+//
+// If config is nil, the plugin is trusted to present the certificate it reports on
+// its output: by default, plugins generate a self-signed certificate on start (see
+// TLSCertificate to use one from files). Otherwise, the certificate of the plugin is
+// verified with config, which can also hold the certificate of the host for plugins
+// that require one (see TLSClientCA).
+//
+// Panics if called after Start.
+func (p *Plugin) SetTLS(config *tls.Config) {
+	if p.running {
+		panic("Cannot call SetTLS after Start")
+	}
+	p.tls = true
+	p.tlsConfig = config
+}
+
+// TLSCertificate makes a plugin using TLS (see SetTLS) load its certificate and key from
+// files, in PEM format, instead of generating a self-signed certificate.
+func TLSCertificate(certFile, keyFile string) Option {
+	return func(o *options) {
+		o.tlsCert, o.tlsKey = certFile, keyFile
+	}
+}
+
+// TLSClientCA makes a plugin using TLS (see SetTLS) require hosts to present a certificate
+// signed by one of the CAs in file, in PEM format.
+func TLSClientCA(file string) Option {
+	return func(o *options) {
+		o.tlsClientCA = file
+	}
+}
+
+// Parameters passing the TLS options to the plugin.
+func (o *options) tlsParams() []string {
+	params := []string{"-pingo:tls"}
+	if o.tlsCert != "" {
+		params = append(params, "-pingo:tlscert="+o.tlsCert, "-pingo:tlskey="+o.tlsKey)
+	}
+	if o.tlsClientCA != "" {
+		params = append(params, "-pingo:tlsclientca="+o.tlsClientCA)
+	}
+	return params
+}
+
+// SHA-256 fingerprint of a DER encoded certificate.
+func certFingerprint(der []byte) string {
+	h := cryptoProvider.Hash()
+	h.Write(der)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Configuration for connecting to a plugin listening on addr. Without a configuration
+// from the user, the certificate is pinned to the fingerprint reported by the plugin.
+func (c *ctrl) clientTLS(addr string) (*tls.Config, error) {
+	if c.p.tlsConfig != nil {
+		config := c.p.tlsConfig.Clone()
+		if config.Rand == nil {
+			config.Rand = providerRand{}
+		}
+		if config.ServerName == "" {
+			if host, _, err := net.SplitHostPort(addr); err == nil {
+				config.ServerName = host
+			}
+		}
+		return config, nil
+	}
+	if c.tlsCert == "" {
+		return nil, errNoCertificate
+	}
+	pin := c.tlsCert
+	config := providerTLSConfig()
+	// Verified against the pin instead
+	config.InsecureSkipVerify = true
+	config.VerifyPeerCertificate = func(certs [][]byte, _ [][]*x509.Certificate) error {
+		if len(certs) == 0 || certFingerprint(certs[0]) != pin {
+			return errCertificatePin
+		}
+		return nil
+	}
+	return config, nil
+}
+
+// Configuration for serving connections, and the fingerprint of the certificate.
+func (r *rpcServer) serverTLS() (*tls.Config, string, error) {
+	var (
+		cert tls.Certificate
+		err  error
+	)
+	if r.conf.tlscert != "" {
+		cert, err = tls.LoadX509KeyPair(r.conf.tlscert, r.conf.tlskey)
+	} else {
+		cert, err = selfSignedCert()
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	config := providerTLSConfig()
+	config.Certificates = []tls.Certificate{cert}
+	if r.conf.tlsclientca != "" {
+		pem, err := os.ReadFile(r.conf.tlsclientca)
+		if err != nil {
+			return nil, "", err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, "", errInvalidClientCAs
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, certFingerprint(cert.Certificate[0]), nil
+}
+
+// Generate a certificate for the local host, valid for a year.
+func selfSignedCert() (tls.Certificate, error) {
+	key, err := providerECDSAKey()
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(providerRand{}, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	now := time.Now()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "pingo plugin"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	der, err := x509.CreateCertificate(providerRand{}, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
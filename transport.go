@@ -0,0 +1,448 @@
+package pingo
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"sync"
+	"time"
+)
+
+// Same handshake as the standard "rpc" package over HTTP, so that plain
+// connections remain compatible with rpc.DialHTTP.
+const connectedStatus = "200 Connected to Go RPC"
+
+// Time allowed to complete the handshake of connections, unless set.
+const defaultAuthTimeout = 10 * time.Second
+
+// Limits applied by plugins started with -pingo:hardened.
+const (
+	hardenedAuthTimeout = 2 * time.Second
+	hardenedMaxMessage  = 16 << 20
+)
+
+// Minimum interval between reports of connections failing authentication.
+const authFailureInterval = time.Second
+
+// A net.Conn reading through a buffered reader, to not lose data
+// buffered while parsing the HTTP handshake.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// Secrets used to establish a secure connection.
+type credentials struct {
+	// Secret of the plugin, or key of the capability
+	secret string
+	// Encoded claims of a capability, if any
+	capability string
+	// Configuration for TLS, if used
+	tls *tls.Config
+}
+
+// Dial the plugin and return an RPC client using the connection. If a secret is provided,
+// the connection is encrypted with a key exchanged using the secret.
+func dialRPC(proto, addr string, cred *credentials, opts *options) (*rpc.Client, error) {
+	conn, br, err := dialConn(proto, addr, opts.callPath(), cred, opts)
+	if err != nil {
+		return nil, err
+	}
+	client, _ := newClient(conn, br, opts, false)
+	return client, nil
+}
+
+// Create a client for calls on conn, with the codec set by ClientCodec, if any. The codec
+// of this package is returned too, nil with other codecs.
+func newClient(conn net.Conn, br *bufio.Reader, opts *options, plainErrors bool) (*rpc.Client, *gobClientCodec) {
+	if opts.codec != nil {
+		return rpc.NewClientWithCodec(opts.codec(&bufConn{conn, br})), nil
+	}
+	codec := newGobClientCodec(&bufConn{conn, br}, opts)
+	codec.plainErrors = plainErrors
+	if opts.keepalive > 0 {
+		go codec.keepalive(opts.keepalive, opts.keepaliveDead)
+	}
+	return rpc.NewClientWithCodec(codec), codec
+}
+
+// Dial the plugin and perform the handshake, sending a CONNECT request for path. Returns
+// the connection and the reader buffering the data received on it.
+func dialConn(proto, addr, path string, cred *credentials, opts *options) (net.Conn, *bufio.Reader, error) {
+	conn, err := dial(proto, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	return handshakeConn(conn, path, cred, opts)
+}
+
+// Authenticate a new connection, then send a CONNECT request for path on it, unless path is
+// empty. The connection is closed on errors.
+func handshakeConn(conn net.Conn, path string, cred *credentials, opts *options) (net.Conn, *bufio.Reader, error) {
+	var err error
+	if opts.authTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(opts.authTimeout))
+	}
+	if cred.tls != nil {
+		tconn := tls.Client(conn, cred.tls)
+		if err := tconn.Handshake(); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tconn
+	}
+	if cred.secret != "" {
+		if cred.capability == "" {
+			_, err = conn.Write([]byte{modeSecret})
+		} else if _, err = conn.Write([]byte{modeCapability}); err == nil {
+			err = writeField(conn, []byte(cred.capability))
+		}
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		sconn, err := secureClient(conn, cred.secret)
+		if err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = sconn
+	}
+	if opts.wireDump != nil {
+		conn = opts.wireDump.wrap(conn)
+	}
+	br, err := connect(conn, path)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, br, nil
+}
+
+// Send a CONNECT request for path on conn, if not empty, and read the response.
+func connect(conn net.Conn, path string) (*bufio.Reader, error) {
+	if path == "" {
+		// Other codecs are served without a CONNECT request
+		return bufio.NewReader(conn), nil
+	}
+	io.WriteString(conn, "CONNECT "+path+" HTTP/1.0\n"+errorsHeader+": 1\n\n")
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != connectedStatus {
+		err = errors.New("Unexpected HTTP response: " + resp.Status)
+	}
+	return br, err
+}
+
+// Opens connections to a plugin that is ready.
+type dialer struct {
+	proto, addr string
+	cred        *credentials
+	opts        *options
+	// Connection carrying all others, if multiplexing
+	mux *muxSession
+}
+
+// Open a connection sending a CONNECT request for path, as dialConn does.
+func (d *dialer) dial(path string) (net.Conn, *bufio.Reader, error) {
+	if d.mux == nil {
+		return dialConn(d.proto, d.addr, path, d.cred, d.opts)
+	}
+	conn, err := d.mux.Open()
+	if err != nil {
+		return nil, nil, err
+	}
+	br, err := connect(conn, path)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, br, nil
+}
+
+// Open a connection for calls and return a client using it, as newClient does.
+func (d *dialer) client(plainErrors bool) (*rpc.Client, *gobClientCodec, error) {
+	conn, br, err := d.dial(d.opts.callPath())
+	if err != nil {
+		return nil, nil, err
+	}
+	client, codec := newClient(conn, br, d.opts, plainErrors)
+	return client, codec, nil
+}
+
+// Accept connections until the listener is closed.
+func (r *rpcServer) serve(l net.Listener) error {
+	r.server.startWorkers(r.workers.Calls)
+	if r.workers.Handshakes > 0 {
+		return r.serveWorkers(l)
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if release := r.admit(conn); release != nil {
+			go r.serveConn(conn, release)
+		}
+	}
+}
+
+// Perform the handshake, then serve RPC calls on the connection.
+func (r *rpcServer) serveConn(conn net.Conn, release func()) {
+	if a := r.acceptConn(conn, release); a != nil {
+		r.serveAccepted(a)
+	}
+}
+
+// Admit a connection just accepted, before any work on its handshake. Returns the function
+// releasing its admission, or nil, with the connection closed, if it is refused.
+func (r *rpcServer) admit(conn net.Conn) func() {
+	release, err := r.guard.admit(conn)
+	if err != nil {
+		conn.Close()
+		r.server.instr.connDone(newConnInfo(conn, r.conf.proto, r.secret != ""), time.Now(), err)
+		return nil
+	}
+	return release
+}
+
+// A connection that completed its handshake.
+type acceptedConn struct {
+	conn  net.Conn
+	br    *bufio.Reader
+	scope *claims
+	path  string
+	info  *ConnInfo
+	start time.Time
+	// Releases the admission of the connection
+	release func()
+}
+
+// Perform the handshake of a connection admitted with release. Returns nil, with the
+// connection closed and its admission released, if it fails.
+func (r *rpcServer) acceptConn(conn net.Conn, release func()) *acceptedConn {
+	if r.server.drain.isClosing() {
+		release()
+		conn.Close()
+		return nil
+	}
+	start := time.Now()
+	info := newConnInfo(conn, r.conf.proto, r.secret != "")
+	if r.acceptFilter != nil {
+		if err := r.acceptFilter(conn); err != nil {
+			release()
+			conn.Close()
+			r.server.instr.connDone(info, start, err)
+			return nil
+		}
+	}
+
+	accepted := conn
+	conn, br, scope, path, err := r.handshake(conn, info)
+	if err != nil {
+		r.guard.failed(accepted)
+		r.authFailed(info, err)
+		release()
+		conn.Close()
+		r.server.instr.connDone(info, start, err)
+		return nil
+	}
+	// Connections without a capability authenticated with the secret of the host, unless
+	// the plugin is insecure and cannot tell
+	info.host = scope == nil
+	if info.host && r.secret != "" {
+		// Proven to be the host: no longer counted against its address
+		r.guard.authenticated(accepted)
+		release()
+	}
+	return &acceptedConn{conn: conn, br: br, scope: scope, path: path, info: info, start: start, release: release}
+}
+
+// Serve RPC calls on a connection that completed its handshake.
+func (r *rpcServer) serveAccepted(a *acceptedConn) {
+	defer a.release()
+	conn, br, scope, info := a.conn, a.br, a.scope, a.info
+	var check func(string) error
+	if scope != nil {
+		info.Allow, info.TokenID, check = scope.Allow, scope.ID, scope.check
+		// Drop the connection once its credentials lapse
+		if scope.Expires != 0 {
+			timer := time.AfterFunc(time.Until(scope.expiry()), func() {
+				conn.Close()
+			})
+			defer timer.Stop()
+		}
+	}
+
+	var max int
+	if r.conf.hardened {
+		max = hardenedMaxMessage
+	}
+
+	if r.onConnect != nil {
+		r.onConnect(info)
+	}
+	var serve func(conn net.Conn, br *bufio.Reader, path string)
+	serve = func(conn net.Conn, br *bufio.Reader, path string) {
+		switch stream := streamName(path); {
+		case path == muxPath:
+			// Sessions are served as connections authenticated as this one
+			r.serveMux(&bufConn{conn, br}, serve)
+		case path == callbacksPath && scope == nil:
+			// The connection carries calls to the host, not from it
+			r.serveCallbacks(conn, br)
+		case stream != "":
+			// Streams are idle while the plugin produces data
+			limits := r.limits
+			limits.IdleTimeout = 0
+			conn, br = limits.wrap(conn, br)
+			r.serveStream(conn, br, stream, info, r.callCheck(info, check))
+		default:
+			conn, br = r.limits.wrap(conn, br)
+			r.server.serveCodec(r.serverCodec(&bufConn{conn, br}, br, max), info, r.callCheck(info, check))
+		}
+	}
+	serve(conn, br, a.path)
+	if r.onDisconnect != nil {
+		r.onDisconnect(info)
+	}
+	r.server.instr.connDone(info, a.start, nil)
+}
+
+// Authenticate the connection, if secure, and read the CONNECT request. Returns the
+// connection to use, which must be closed on error, the claims restricting it and the
+// path of the CONNECT request, if any.
+func (r *rpcServer) handshake(conn net.Conn, info *ConnInfo) (net.Conn, *bufio.Reader, *claims, string, error) {
+	if t := r.authTimeout(conn); t > 0 {
+		conn.SetDeadline(time.Now().Add(t))
+	}
+	var scope *claims
+	if r.secret != "" {
+		secret, claims, err := r.readMode(conn)
+		if err != nil {
+			return conn, nil, nil, "", err
+		}
+		sconn, err := secureServer(conn, secret)
+		if err != nil {
+			return conn, nil, nil, "", err
+		}
+		conn, scope = sconn, claims
+	}
+	if r.wireDump != nil {
+		conn = r.wireDump.wrap(conn)
+	}
+
+	br := bufio.NewReader(conn)
+	// Some clients skip the CONNECT request
+	if r.skipsConnect(br) {
+		conn.SetDeadline(time.Time{})
+		return conn, br, scope, "", nil
+	}
+	req, err := http.ReadRequest(br)
+	if err == nil && req.Method != "CONNECT" {
+		err = errors.New("Unexpected HTTP method: " + req.Method)
+	}
+	if err != nil {
+		io.WriteString(conn, "HTTP/1.0 405 Method Not Allowed\n\n")
+		return conn, nil, nil, "", err
+	}
+	io.WriteString(conn, "HTTP/1.0 "+connectedStatus+"\n\n")
+	conn.SetDeadline(time.Time{})
+	info.typedErrors = req.Header.Get(errorsHeader) != ""
+	return conn, br, scope, req.URL.Path, nil
+}
+
+// Time allowed to complete the handshake of conn, zero for no limit.
+func (r *rpcServer) authTimeout(conn net.Conn) time.Duration {
+	switch {
+	case r.limits.AuthTimeout > 0:
+		return r.limits.AuthTimeout
+	case r.limits.AuthTimeout < 0:
+		return 0
+	}
+	if t := r.guard.handshakeTimeout(conn); t > 0 {
+		return t
+	}
+	switch {
+	case r.conf.hardened:
+		return hardenedAuthTimeout
+	case r.limits.IdleTimeout > 0:
+		return r.limits.IdleTimeout
+	}
+	return defaultAuthTimeout
+}
+
+// Report a connection that failed to authenticate to the host, for diagnostics. Reports
+// are limited to one per authFailureInterval, counting the others.
+func (r *rpcServer) authFailed(info *ConnInfo, err error) {
+	if err != errHandshake && err != errInvalidToken && err != errTokenExpired {
+		// Not an authentication failure, such as a peer closing the connection
+		return
+	}
+	a := &r.authFailures
+	a.mu.Lock()
+	if time.Since(a.last) < authFailureInterval {
+		a.dropped++
+		a.mu.Unlock()
+		return
+	}
+	dropped := a.dropped
+	a.last, a.dropped = time.Now(), 0
+	a.mu.Unlock()
+
+	val := err.Error()
+	if info.RemoteAddr != "" {
+		val += " from " + info.RemoteAddr
+	}
+	if dropped > 0 {
+		val += fmt.Sprintf(" (and %d failures not reported)", dropped)
+	}
+	r.output("auth-failure", val)
+	r.logger.Log(LevelWarn, "Authentication failed", Field{"remote", info.RemoteAddr}, Field{"error", err})
+}
+
+// Rate limit of the reports of authentication failures.
+type authFailures struct {
+	mu   sync.Mutex
+	last time.Time
+	// Failures since the last report
+	dropped int
+}
+
+// Read the mode of a secure connection. Returns the secret for the key exchange
+// and, for capabilities, the claims restricting the connection.
+func (r *rpcServer) readMode(conn net.Conn) (string, *claims, error) {
+	var mode [1]byte
+	if _, err := io.ReadFull(conn, mode[:]); err != nil {
+		return "", nil, err
+	}
+	switch mode[0] {
+	case modeSecret:
+		return r.secret, nil, nil
+	case modeCapability:
+		payload, err := readField(conn)
+		if err != nil {
+			return "", nil, err
+		}
+		c, err := parseClaims(string(payload))
+		if err != nil {
+			return "", nil, err
+		}
+		if c.expired() {
+			return "", nil, errTokenExpired
+		}
+		return capabilityKey(r.secret, string(payload)), c, nil
+	}
+	return "", nil, errInvalidToken
+}
@@ -0,0 +1,254 @@
+package pingo
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Error returned by Upgrade when the new version was rolled back.
+type ErrUpgrade error
+
+// UpgradePolicy controls how Upgrade moves the calls of a plugin to a new version.
+type UpgradePolicy struct {
+	// Directory the archive is installed under (see InstallArchive), the current directory
+	// if empty.
+	Dir string
+	// Protocol to start the new version with: "unix", the default, or "tcp".
+	Proto string
+	// Called to configure the new version before it is started, if not nil.
+	Setup func(p *Plugin)
+	// Keys the archive must be signed with, one of which is required (see Archive.Verify).
+	Keys []ed25519.PublicKey
+	// Accept archives that are not signed, if Keys is empty.
+	Unsigned bool
+	// Shares of the calls sent to the new version at each step, increasing up to 1. If
+	// empty, all calls are moved at once.
+	Steps []float64
+	// Duration of each step, at the end of which the health of the new version is checked.
+	Interval time.Duration
+	// Share of the calls to the new version that may fail during a step; if zero, the
+	// errors of calls are not considered, only the health check (see Plugin.Health).
+	MaxErrors float64
+	// Called with the progress of the upgrade, if not nil.
+	Progress func(UpgradeEvent)
+}
+
+// Phases of an upgrade.
+type UpgradePhase int
+
+const (
+	// The new version is installed and started.
+	UpgradeStarted UpgradePhase = iota
+	// A share of the calls is sent to the new version.
+	UpgradeShifted
+	// All calls go to the new version; the previous one is stopped.
+	UpgradeCompleted
+	// The new version was stopped; all calls go to the previous one.
+	UpgradeRolledBack
+)
+
+// UpgradeEvent reports the progress of an upgrade.
+type UpgradeEvent struct {
+	Plugin string
+	Phase  UpgradePhase
+	// Version of the new plugin, from its manifest
+	Version string
+	// Share of the calls sent to the new version
+	Share float64
+	// Cause of a roll back
+	Err error
+}
+
+// An upgrade in progress.
+type upgrade struct {
+	next *Plugin
+	// Share of the calls sent to next
+	share float64
+
+	mu            sync.Mutex
+	calls, failed int
+}
+
+// Count a call to the new version.
+func (u *upgrade) record(err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.calls++
+	if err != nil {
+		u.failed++
+	}
+}
+
+// Reset the counts of calls, returning the share of failed calls.
+func (u *upgrade) failures() float64 {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	var rate float64
+	if u.calls > 0 {
+		rate = float64(u.failed) / float64(u.calls)
+	}
+	u.calls, u.failed = 0, 0
+	return rate
+}
+
+// Upgrade replaces the named plugin with the one packaged in the archive at path. The
+// archive is installed and verified, then the new version is started beside the running one
+// and calls made with Call are moved to it in the steps of the policy. If the new version
+// fails its health check or too many calls to it fail at the end of a step, all calls are
+// moved back, the new version is stopped and an ErrUpgrade error is returned. Otherwise,
+// the previous version is stopped once all calls go to the new one.
+//
+// The archive is extracted into a temporary directory and verified, including its
+// signature, before it is moved into place. It cannot replace the installation the plugin
+// runs from, as when upgrading to the same version. A nil policy is the zero policy, which
+// only accepts archives signed with one of its Keys.
+//
+// If the manager is not running, the plugin is replaced immediately.
+func (m *Manager) Upgrade(name, path string, policy *UpgradePolicy) error {
+	if policy == nil {
+		policy = &UpgradePolicy{}
+	}
+	prev := m.Plugin(name)
+	if prev == nil {
+		return ErrUnknownPlugin(errors.New("Unknown plugin " + name))
+	}
+	if len(policy.Keys) == 0 && !policy.Unsigned {
+		return ErrSignature(errors.New("No keys to verify " + path + " with"))
+	}
+	dir := policy.Dir
+	if dir == "" {
+		dir = "."
+	}
+	a, err := installArchive(path, dir, policy.Keys, filepath.Dir(prev.exe))
+	if err != nil {
+		return err
+	}
+	proto := policy.Proto
+	if proto == "" {
+		proto = "unix"
+	}
+	next, err := a.NewPlugin(proto)
+	if err != nil {
+		return err
+	}
+	if policy.Setup != nil {
+		policy.Setup(next)
+	}
+	progress := func(phase UpgradePhase, share float64, err error) {
+		if policy.Progress != nil {
+			policy.Progress(UpgradeEvent{Plugin: name, Phase: phase, Version: a.Manifest.Version, Share: share, Err: err})
+		}
+	}
+
+	m.mu.Lock()
+	if m.stateRoot != "" {
+		next.SetStateDir(m.stateDir(name))
+	}
+	if !m.running {
+		err := m.replace(name, prev, next)
+		m.mu.Unlock()
+		if err == nil {
+			progress(UpgradeCompleted, 1, nil)
+		}
+		return err
+	}
+	if m.upgrades[name] != nil {
+		m.mu.Unlock()
+		return errors.New("Plugin " + name + " is being upgraded already")
+	}
+	u := &upgrade{next: next}
+	if m.upgrades == nil {
+		m.upgrades = make(map[string]*upgrade)
+	}
+	m.upgrades[name] = u
+	m.mu.Unlock()
+
+	next.Start()
+	progress(UpgradeStarted, 0, nil)
+
+	steps := policy.Steps
+	if len(steps) == 0 {
+		steps = []float64{1}
+	}
+	err = m.checkUpgrade(u, policy)
+	for i := 0; err == nil && i < len(steps); i++ {
+		m.mu.Lock()
+		u.share = steps[i]
+		m.mu.Unlock()
+		progress(UpgradeShifted, steps[i], nil)
+		time.Sleep(policy.Interval)
+		err = m.checkUpgrade(u, policy)
+	}
+
+	m.mu.Lock()
+	delete(m.upgrades, name)
+	if err == nil && !m.running {
+		err = errors.New("Manager was stopped")
+	}
+	if err == nil {
+		err = m.replace(name, prev, next)
+	}
+	m.mu.Unlock()
+
+	if err != nil {
+		next.StopContext(context.Background())
+		progress(UpgradeRolledBack, 0, err)
+		return ErrUpgrade(errors.New("Upgrade of " + name + " rolled back: " + err.Error()))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), prev.exitTimeout)
+	prev.StopContext(ctx)
+	cancel()
+	progress(UpgradeCompleted, 1, nil)
+	return nil
+}
+
+// Check the health of the new version and the errors of the calls it received.
+func (m *Manager) checkUpgrade(u *upgrade, policy *UpgradePolicy) error {
+	timeout := policy.Interval
+	if timeout == 0 {
+		timeout = u.next.initTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	if err := u.next.Health(ctx); err != nil {
+		return err
+	}
+	if rate := u.failures(); policy.MaxErrors > 0 && rate > policy.MaxErrors {
+		return errors.New("Too many calls failed")
+	}
+	return nil
+}
+
+// Replace the plugin prev with next, unless it was removed meanwhile. Must be called with
+// the manager lock held.
+func (m *Manager) replace(name string, prev, next *Plugin) error {
+	if m.plugins[name] != prev {
+		return ErrUnknownPlugin(errors.New("Plugin " + name + " was removed"))
+	}
+	m.plugins[name] = next
+	m.invalidateRoutes()
+	if m.running {
+		m.startSelfTest(name, next)
+	}
+	return nil
+}
+
+// Plugin to send a call for the named plugin to, and the upgrade it is part of, if the
+// call goes to the new version.
+func (m *Manager) pick(name string) (*Plugin, *upgrade) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if u := m.upgrades[name]; u != nil && u.share > 0 && rand.Float64() < u.share {
+		return u.next, u
+	}
+	return m.plugins[name], nil
+}
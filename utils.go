@@ -2,14 +2,21 @@ package pingo
 
 import (
 	"fmt"
+	"io"
 	"math/rand"
 	"strings"
 )
 
 type meta string
 
-func (h meta) output(key, val string) {
-	fmt.Printf("%s: %s: %s\n", string(h), key, val)
+// Lines output by a server for its host, as "prefix: key: value".
+type metaWriter struct {
+	prefix meta
+	w      io.Writer
+}
+
+func (h metaWriter) output(key, val string) {
+	fmt.Fprintf(h.w, "%s: %s: %s\n", string(h.prefix), key, val)
 }
 
 func (h meta) parse(line string) (key, val string) {
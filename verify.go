@@ -0,0 +1,149 @@
+package pingo
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// Error reported when the executable of a plugin does not match its checksum.
+type ErrChecksum error
+
+// Error reported when a manifest is not signed by a trusted key.
+type ErrSignature error
+
+// SetChecksum makes the plugin refuse to start its executable unless it matches sum, a
+// hex-encoded SHA-256 checksum such as those of manifests (see Manifest). The executable is
+// verified each time it is started; on mismatch, calls fail with an ErrChecksum error.
+//
+// The executable is copied into a private directory as it is verified, and the copy is
+// started, so that the file cannot be replaced between its verification and its start.
+//
+// Panics if called after Start.
+func (p *Plugin) SetChecksum(sum string) {
+	if p.running {
+		panic("Cannot call SetChecksum after Start")
+	}
+	p.checksum = sum
+}
+
+// Return the executable to start: the executable of the plugin or, if it has a checksum,
+// a copy verified against it.
+func (c *ctrl) verifiedExe() (string, error) {
+	p := c.p
+	if p.checksum == "" {
+		return p.exe, nil
+	}
+	path, err := exec.LookPath(p.exe)
+	if err != nil {
+		return "", err
+	}
+	dir, err := os.MkdirTemp("", "pingo-exe-")
+	if err != nil {
+		return "", err
+	}
+	c.exedir = dir
+	exe := filepath.Join(dir, filepath.Base(path))
+	sum, err := copyFile(exe, path)
+	if err == nil {
+		err = checkSum(sum, p.checksum, path)
+	}
+	if err != nil {
+		return "", ErrChecksum(errors.New("Refusing to start " + p.exe + ": " + err.Error()))
+	}
+	return exe, nil
+}
+
+// Copy the executable at src to dst, only accessible by the user, returning the checksum
+// of the data copied.
+func copyFile(dst, src string) ([]byte, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0700)
+	if err != nil {
+		return nil, err
+	}
+	h := cryptoProvider.Hash()
+	_, err = io.Copy(io.MultiWriter(out, h), in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Check that the file at path has the hex-encoded SHA-256 checksum sum.
+func checkFile(path, sum string) error {
+	got, err := fileSum(path)
+	if err != nil {
+		return err
+	}
+	return checkSum(got, sum, path)
+}
+
+// Check that the checksum got of the file at path is the hex-encoded checksum sum.
+func checkSum(got []byte, sum, path string) error {
+	want, err := hex.DecodeString(sum)
+	if err != nil || len(want) != len(got) {
+		return errors.New("Invalid checksum " + sum)
+	}
+	if !bytes.Equal(got, want) {
+		return errors.New("Checksum mismatch for " + filepath.Base(path))
+	}
+	return nil
+}
+
+// Return the SHA-256 checksum of the file at path.
+func fileSum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := cryptoProvider.Hash()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// Verify checks that the manifest of the archive is signed by one of keys. As the manifest
+// holds the checksums of the executables, which are verified when they are started, this
+// ensures that the plugin comes from the holder of the key. Keys of the wrong size are
+// ignored.
+func (a *Archive) Verify(keys ...ed25519.PublicKey) error {
+	return verifyManifest(a.Dir, keys)
+}
+
+// Check the signature of the manifest in dir against keys.
+func verifyManifest(dir string, keys []ed25519.PublicKey) error {
+	manifest, err := os.ReadFile(filepath.Join(dir, ManifestFile))
+	if err != nil {
+		return err
+	}
+	sig, err := readOptional(filepath.Join(dir, signatureFile))
+	if err != nil {
+		return err
+	}
+	if sig == nil {
+		return ErrSignature(errors.New("Manifest in " + dir + " is not signed"))
+	}
+	for _, key := range keys {
+		if len(key) == ed25519.PublicKeySize && cryptoProvider.Verify(key, manifest, sig) {
+			return nil
+		}
+	}
+	return ErrSignature(errors.New("Manifest in " + dir + " is not signed by a trusted key"))
+}
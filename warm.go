@@ -0,0 +1,383 @@
+package pingo
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the log of a warm plugin is read for new lines, and its process checked.
+const warmPollInterval = 50 * time.Millisecond
+
+// Size over which the log of a warm plugin is emptied once all of it has been read.
+const warmMaxLog = 1 << 20
+
+var errWarmExited = errors.New("Warm plugin process exited")
+
+// KeepWarm keeps the process of the plugin running when the host stops or exits, so that
+// the next host starting the same plugin connects to the running process instead of
+// starting a new one. This shortens the edit-compile-run loop of hosts starting many
+// plugins during development; it is not meant for production.
+//
+// The handshake of the plugin, including its secret, is saved in dir, along with a
+// checksum of its executable: the process is only reused while the executable is
+// unchanged and the parameters are the same. Once the executable has been rebuilt, the
+// old process is killed and a new one is started. The output of warm plugins is written
+// to a log file in dir and passed to the host from there.
+//
+// Warm plugins keep running until killed, for example with StopWarm, unless they are
+// restarted for being unresponsive (see Watchdog). Only one plugin for each executable and
+// parameters is kept warm by a host. The PrivateSocketDir option is ignored, and KeepWarm
+// has no effect on Windows, on plugins served in process and on plugins with a job queue,
+// whose address changes with each host.
+func KeepWarm(dir string) Option {
+	return func(o *options) {
+		o.warmDir = dir
+	}
+}
+
+// StopWarm kills the processes of the plugins kept warm in dir (see KeepWarm) and removes
+// their files.
+func StopWarm(dir string) error {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, path := range files {
+		if e, ok := readWarmEntry(path); ok && e.alive() {
+			proc, err := os.FindProcess(e.PID)
+			if err == nil {
+				err = proc.Kill()
+			}
+			if err != nil && !errors.Is(err, os.ErrProcessDone) {
+				errs = append(errs, err)
+			}
+		}
+		os.Remove(path)
+		os.Remove(strings.TrimSuffix(path, ".json") + ".log")
+	}
+	return errors.Join(errs...)
+}
+
+// Handshake of a warm plugin, saved for the next host.
+type warmEntry struct {
+	// Checksum of the executable
+	Binary string `json:"binary"`
+	// Parameters the plugin was started with, other than the prefix of its lines
+	Params []string `json:"params"`
+	Prefix string   `json:"prefix"`
+	// Process of the plugin, when it was started, and where it listens
+	PID     int    `json:"pid"`
+	Started string `json:"started"`
+	Proto   string `json:"proto"`
+	Addr    string `json:"addr"`
+	// Secret of the connections
+	Secret string `json:"secret,omitempty"`
+	// Lines output by the plugin before being ready, to be passed to the next host
+	Lines []string `json:"lines"`
+}
+
+// Keys of plugins kept warm by this host.
+var warmKeys = struct {
+	mu   sync.Mutex
+	used map[string]bool
+}{used: make(map[string]bool)}
+
+// A plugin kept warm: either started by this host or adopted from a previous one.
+type warm struct {
+	// Files of the entry and of the output of the plugin
+	path, log string
+	entry     warmEntry
+	// The process was started by a previous host
+	adopted bool
+	// Size of the log when adopted, from where new lines are read
+	offset int64
+	// Closed when the host leaves the process running
+	detached chan struct{}
+	once     sync.Once
+	key      string
+}
+
+// Find the plugin started with params in the warm directory, or prepare to start a new
+// one. Returns nil if the plugin cannot be kept warm.
+func (c *ctrl) openWarm(params []string) (*warm, error) {
+	dir := c.p.opts.warmDir
+	if !canKeepWarm || c.p.jobs != nil {
+		return nil, nil
+	}
+	exe, err := exec.LookPath(c.p.exe)
+	if err != nil {
+		return nil, err
+	}
+	b, err := fileSum(exe)
+	if err != nil {
+		return nil, err
+	}
+	sum := hex.EncodeToString(b)
+	h := sha256.Sum256([]byte(strings.Join(append([]string{c.p.proto, exe}, c.p.params...), "\x00")))
+	key := hex.EncodeToString(h[:8])
+
+	warmKeys.mu.Lock()
+	defer warmKeys.mu.Unlock()
+	if warmKeys.used[key] {
+		// Another plugin of this host uses the process
+		return nil, nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	w := &warm{
+		path:     filepath.Join(dir, key+".json"),
+		log:      filepath.Join(dir, key+".log"),
+		entry:    warmEntry{Binary: sum, Params: withoutPrefix(params), Prefix: string(c.p.meta)},
+		detached: make(chan struct{}),
+		key:      key,
+	}
+	if old, ok := readWarmEntry(w.path); ok && old.alive() {
+		if old.Binary == sum && equalStrings(old.Params, w.entry.Params) {
+			if fi, err := os.Stat(w.log); err == nil {
+				w.entry, w.adopted, w.offset = *old, true, fi.Size()
+				if w.offset > warmMaxLog && os.Truncate(w.log, 0) == nil {
+					w.offset = 0
+				}
+			}
+		} else if proc, err := os.FindProcess(old.PID); err == nil {
+			// Started from an older build or with other parameters
+			proc.Kill()
+		}
+	}
+	if !w.adopted {
+		os.Remove(w.path)
+	}
+	warmKeys.used[key] = true
+	return w, nil
+}
+
+// Read the entry at path, if any.
+func readWarmEntry(path string) (*warmEntry, bool) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	e := &warmEntry{}
+	if err := json.Unmarshal(b, e); err != nil || e.PID <= 0 {
+		return nil, false
+	}
+	return e, true
+}
+
+// Check that the process of the entry is still the one that was started, in case its PID
+// was reused, and that it accepts connections.
+func (e *warmEntry) alive() bool {
+	return processAlive(e.PID) && e.Started != "" && processStarted(e.PID) == e.Started && probe(e.Proto, e.Addr)
+}
+
+// Check that something accepts connections at addr.
+func probe(proto, addr string) bool {
+	conn, err := dial(proto, addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// Parameters other than the prefix, which is random unless set with the Prefix option.
+func withoutPrefix(params []string) []string {
+	var list []string
+	for _, p := range params {
+		if !strings.HasPrefix(p, "-pingo:prefix=") {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Record a line output by a new plugin before it is ready, to be passed to the next host.
+func (w *warm) record(key, line string) {
+	if w.adopted {
+		return
+	}
+	switch key {
+	case "handshake", "objects", "features", "methods", "deprecated", "auth-token", "tls-cert", "ready":
+		w.entry.Lines = append(w.entry.Lines, line)
+	}
+}
+
+// Save the handshake of a new plugin once the host is connected.
+func (w *warm) save(c *ctrl) error {
+	if w.adopted {
+		return nil
+	}
+	w.entry.PID, w.entry.Proto, w.entry.Addr, w.entry.Secret = c.pid, c.proto, c.addr, c.secret
+	w.entry.Started = processStarted(c.pid)
+	b, err := json.Marshal(&w.entry)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.path, b, 0600)
+}
+
+// Leave the process running and stop following its output.
+func (w *warm) detach() {
+	w.once.Do(func() {
+		close(w.detached)
+	})
+}
+
+// Run the plugin, starting a new process unless one was adopted, as wait does.
+func (w *warm) run(c *ctrl, pidCh chan<- int, env []string, exe string, params []string) {
+	defer close(c.waitCh)
+	defer func() {
+		warmKeys.mu.Lock()
+		delete(warmKeys.used, w.key)
+		warmKeys.mu.Unlock()
+	}()
+
+	exited := make(chan struct{})
+	var err error
+	var pid int
+	if w.adopted {
+		pid = w.entry.PID
+		pidCh <- pid
+		close(pidCh)
+		for _, line := range w.entry.Lines {
+			c.linesCh <- OutputLine{Stream: Stdout, Text: line}
+		}
+		go func() {
+			for processAlive(pid) {
+				select {
+				case <-w.detached:
+					return
+				case <-time.After(warmPollInterval):
+				}
+			}
+			err = errWarmExited
+			close(exited)
+		}()
+	} else {
+		// Appending, so that the log can be emptied while written to
+		f, ferr := os.OpenFile(w.log, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|os.O_APPEND, 0600)
+		if ferr != nil {
+			c.waitErr(pidCh, ferr)
+			return
+		}
+		cmd := exec.Command(exe, params...)
+		cmd.Env = env
+		cmd.Stdout, cmd.Stderr = f, f
+		if c.secretPipe != nil {
+			cmd.ExtraFiles = []*os.File{c.secretPipe}
+		}
+		detachProcess(cmd)
+		serr := cmd.Start()
+		f.Close()
+		if c.secretPipe != nil {
+			c.secretPipe.Close()
+		}
+		if serr != nil {
+			c.waitErr(pidCh, serr)
+			return
+		}
+		pid = cmd.Process.Pid
+		pidCh <- pid
+		close(pidCh)
+		go func() {
+			// Reap the process even after the host detached from it
+			err = cmd.Wait()
+			close(exited)
+		}()
+	}
+
+	if w.follow(c, exited) {
+		// Left running for the next host
+		c.waitCh <- nil
+		return
+	}
+	if e, ok := readWarmEntry(w.path); ok && e.PID == pid {
+		os.Remove(w.path)
+	}
+	c.waitCh <- err
+}
+
+// Pass the lines appended to the log of the plugin to the host until the process exits or
+// the host detaches from it. Returns true if detached.
+func (w *warm) follow(c *ctrl, exited <-chan struct{}) bool {
+	f, err := os.Open(w.log)
+	if err != nil {
+		select {
+		case <-exited:
+			return false
+		case <-w.detached:
+			return true
+		}
+	}
+	defer f.Close()
+	f.Seek(w.offset, 0)
+
+	br := bufio.NewReader(f)
+	var partial string
+	done := false
+	read := w.offset
+	for {
+		line, err := br.ReadString('\n')
+		partial += line
+		read += int64(len(line))
+		if err == nil {
+			c.linesCh <- OutputLine{Stream: Stdout, Text: strings.TrimSuffix(partial, "\n")}
+			partial = ""
+			continue
+		}
+		if done {
+			// All output of the exited process was read
+			if partial != "" {
+				c.linesCh <- OutputLine{Stream: Stdout, Text: partial}
+			}
+			return false
+		}
+		select {
+		case <-exited:
+			done = true
+		case <-w.detached:
+			return true
+		case <-time.After(warmPollInterval):
+			if read > warmMaxLog && w.empty(f, read) {
+				br.Reset(f)
+				read = 0
+			}
+		}
+	}
+}
+
+// Empty the log open as f, of which size bytes were read, unless the plugin wrote more.
+// Returns true if emptied.
+func (w *warm) empty(f *os.File, size int64) bool {
+	if fi, err := f.Stat(); err != nil || fi.Size() != size {
+		return false
+	}
+	if err := os.Truncate(w.log, 0); err != nil {
+		return false
+	}
+	_, err := f.Seek(0, 0)
+	return err == nil
+}
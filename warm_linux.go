@@ -0,0 +1,23 @@
+package pingo
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Start time of the process, in clock ticks since boot, or empty if it does not exist.
+func processStarted(pid int) string {
+	b, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return ""
+	}
+	// The command name, in parentheses, can contain spaces
+	s := string(b)
+	fields := strings.Fields(s[strings.LastIndexByte(s, ')')+1:])
+	// Field 22 of stat, the first after the name being field 3
+	if len(fields) < 20 {
+		return ""
+	}
+	return fields[19]
+}
@@ -0,0 +1,18 @@
+//go:build !unix
+
+package pingo
+
+import "os/exec"
+
+// Processes cannot be checked without being children of the host.
+const canKeepWarm = false
+
+func detachProcess(cmd *exec.Cmd) {}
+
+func processAlive(pid int) bool {
+	return false
+}
+
+func processStarted(pid int) string {
+	return ""
+}
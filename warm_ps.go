@@ -0,0 +1,18 @@
+//go:build unix && !linux
+
+package pingo
+
+import (
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Start time of the process, as reported by ps, or empty if it does not exist.
+func processStarted(pid int) string {
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
@@ -0,0 +1,19 @@
+//go:build unix
+
+package pingo
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+const canKeepWarm = true
+
+// Start the process in its own session, so that it survives the host.
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+func processAlive(pid int) bool {
+	return syscall.Kill(pid, 0) == nil
+}
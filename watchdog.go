@@ -0,0 +1,166 @@
+package pingo
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Interval between measurements of the memory used by the plugin.
+	watchdogInterval = time.Second
+	// Longest interval between runs of FreeOSMemory while usage stays near the limit.
+	watchdogMaxFree = time.Minute
+	// Status the plugin exits with when the watchdog stops it.
+	watchdogExitStatus = 3
+)
+
+// Error reported when a plugin warns that its memory usage is close to the limit of its
+// watchdog, or exits because it went over it.
+type ErrMemoryWatchdog error
+
+// MemoryWatchdog makes the plugin watch the memory it uses, its resident set on Linux and
+// the memory obtained by the Go runtime elsewhere, against limit bytes. Above 90% of the
+// limit, the plugin first runs the garbage collector and returns memory to the operating
+// system, then does so less and less often while usage stays high; if that is not enough,
+// it warns the host, which reports an ErrMemoryWatchdog error to the error handler. If
+// the memory used still exceeds the limit, the plugin exits as on Stop, waiting for calls
+// in progress, and with a non-zero status so that it is restarted as set by
+// SetRestartPolicy.
+//
+// This lets the plugin be restarted before the OOM killer of the system picks a process
+// to kill, which might not be the plugin.
+func MemoryWatchdog(limit int64) Option {
+	return func(o *options) {
+		o.watchdog = limit
+	}
+}
+
+// SetMemoryWatchdog sets the limit of the memory watchdog of the plugin, as MemoryWatchdog
+// does for the host. A limit passed by the host takes priority. As memory is shared by the
+// process, only the default server runs the watchdog.
+//
+// SetMemoryWatchdog will panic if called after Run.
+func SetMemoryWatchdog(limit int64) {
+	if defaultServer.running {
+		panic("Do not call SetMemoryWatchdog after Run")
+	}
+	defaultServer.watchdog = limit
+}
+
+// Start the memory watchdog, if a limit is set.
+func (r *rpcServer) startWatchdog() {
+	limit := r.watchdog
+	if r.conf.watchdog > 0 {
+		limit = r.conf.watchdog
+	}
+	if limit <= 0 {
+		return
+	}
+	go r.watchMemory(limit)
+}
+
+func (r *rpcServer) watchMemory(limit int64) {
+	high := limit / 10 * 9
+	warned := false
+	// FreeOSMemory stops the world: it runs when usage crosses high, then with backoff
+	// while usage stays near it, and again before exiting.
+	var backoff time.Duration
+	var next time.Time
+	for now := range time.Tick(watchdogInterval) {
+		used := memoryUsed()
+		if used < high {
+			warned = false
+			if now.After(next) {
+				backoff = 0
+			}
+			continue
+		}
+		if !now.Before(next) || used > limit {
+			debug.FreeOSMemory()
+			backoff = freeBackoff(backoff)
+			next = now.Add(backoff)
+			if used = memoryUsed(); used < high {
+				continue
+			}
+		}
+		if !warned {
+			r.output("memory", "warning "+strconv.FormatInt(used, 10)+" "+strconv.FormatInt(limit, 10))
+			r.logger.Log(LevelError, "Memory used near limit", Field{"used", used}, Field{"limit", limit})
+			warned = true
+		}
+		if used > limit {
+			r.output("memory", "exit "+strconv.FormatInt(used, 10)+" "+strconv.FormatInt(limit, 10))
+			r.logger.Log(LevelError, "Exiting, memory used over limit", Field{"used", used}, Field{"limit", limit})
+			r.exiting.Do(func() {
+				go r.shutdown(watchdogExitStatus)
+			})
+			return
+		}
+	}
+}
+
+// Interval before running FreeOSMemory again after waiting for last.
+func freeBackoff(last time.Duration) time.Duration {
+	if last == 0 {
+		return 5 * watchdogInterval
+	}
+	if last *= 2; last > watchdogMaxFree {
+		return watchdogMaxFree
+	}
+	return last
+}
+
+// Memory used by the process: the resident set if known, otherwise the memory obtained by
+// the Go runtime and not released.
+func memoryUsed() int64 {
+	if runtime.GOOS == "linux" {
+		if rss, err := residentSet(); err == nil {
+			return rss
+		}
+	}
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(samples)
+	return int64(samples[0].Value.Uint64() - samples[1].Value.Uint64())
+}
+
+// Resident set of the process from /proc.
+func residentSet() (int64, error) {
+	data, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) < 2 {
+		return 0, errors.New("Invalid /proc/self/statm")
+	}
+	pages, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return pages * int64(os.Getpagesize()), nil
+}
+
+// Report a message of the watchdog of the plugin.
+func (p *Plugin) memoryReport(val string) {
+	fields := strings.Fields(val)
+	if len(fields) != 3 {
+		p.report(LevelError, ErrInvalidMessage(errors.New("Invalid memory report: "+val)), "Invalid memory report", Field{"report", val})
+		return
+	}
+	usage := fields[1] + " of " + fields[2] + " bytes"
+	used, limit := Field{"used", fields[1]}, Field{"limit", fields[2]}
+	if fields[0] == "exit" {
+		p.report(LevelError, ErrMemoryWatchdog(errors.New("Plugin "+p.exe+" exiting, memory used over limit: "+usage)), "Plugin exiting, memory used over limit", used, limit)
+		return
+	}
+	p.report(LevelError, ErrMemoryWatchdog(errors.New("Plugin "+p.exe+" memory used near limit: "+usage)), "Memory used near limit", used, limit)
+}
@@ -0,0 +1,113 @@
+package pingo
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Directions of the frames of a wire dump.
+const (
+	dumpSent     byte = 'S'
+	dumpReceived byte = 'R'
+)
+
+// Environment variable naming a file where a plugin dumps its connections, if set.
+const wireDumpEnv = "PINGO_WIRE_DUMP"
+
+// Writes the data exchanged on connections as frames. See WireDump for the format.
+type wireDump struct {
+	mu    sync.Mutex
+	w     io.Writer
+	conns uint32
+}
+
+func (d *wireDump) frame(dir byte, conn uint32, b []byte) {
+	var hdr [17]byte
+	hdr[0] = dir
+	binary.BigEndian.PutUint64(hdr[1:], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(hdr[9:], conn)
+	binary.BigEndian.PutUint32(hdr[13:], uint32(len(b)))
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.w.Write(hdr[:])
+	d.w.Write(b)
+}
+
+// Wrap conn so that its traffic is dumped.
+func (d *wireDump) wrap(conn net.Conn) net.Conn {
+	return &dumpConn{Conn: conn, d: d, id: atomic.AddUint32(&d.conns, 1)}
+}
+
+type dumpConn struct {
+	net.Conn
+	d  *wireDump
+	id uint32
+}
+
+func (c *dumpConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.d.frame(dumpReceived, c.id, b[:n])
+	}
+	return n, err
+}
+
+func (c *dumpConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.d.frame(dumpSent, c.id, b[:n])
+	}
+	return n, err
+}
+
+// WireDump makes the connections to the plugin write the data they exchange to w, as
+// frames each preceded by a header of 17 bytes: the direction ('S' for sent by the host,
+// 'R' for received), the time in Unix nanoseconds (8 bytes), the number of the connection
+// (4 bytes) and the length of the data (4 bytes), all big endian. Data is dumped before
+// encryption.
+//
+// Plugins dump their side of connections if started with the PINGO_WIRE_DUMP environment
+// variable set to the name of a file, or after calling SetWireDump.
+func WireDump(w io.Writer) Option {
+	return func(o *options) {
+		o.wireDump = &wireDump{w: w}
+	}
+}
+
+// SetWireDump makes the plugin write the data exchanged on its connections to w, in the
+// format described for WireDump.
+//
+// SetWireDump will panic if called after Run.
+func SetWireDump(w io.Writer) {
+	DefaultServer().SetWireDump(w)
+}
+
+// SetWireDump makes the server write the data exchanged on its connections to w, as the
+// SetWireDump function does.
+func (s *Server) SetWireDump(w io.Writer) {
+	if s.r.running {
+		panic("Do not call SetWireDump after Run")
+	}
+	s.r.wireDump = &wireDump{w: w}
+}
+
+// Dump connections to the file named in the environment, unless set programmatically.
+func (r *rpcServer) wireDumpFromEnv() {
+	name := os.Getenv(wireDumpEnv)
+	if name == "" || r.wireDump != nil {
+		return
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		r.logger.Log(LevelWarn, "Cannot open wire dump", Field{"file", name}, Field{"error", err})
+		return
+	}
+	r.wireDump = &wireDump{w: f}
+}
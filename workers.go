@@ -0,0 +1,116 @@
+package pingo
+
+import (
+	"net"
+)
+
+// WorkerPool bounds the goroutines a plugin uses to serve its connections. By default,
+// the plugin starts goroutines as needed: one for the handshake and requests of each
+// connection and one for each call. Plugins serving thousands of hosts at once, as in
+// remote mode, can use a fixed number of workers instead, so that a burst of connections
+// or calls queues up rather than starting goroutines without bound.
+//
+// Each connection still has a goroutine reading its requests once the handshake is done.
+// Zero values mean no bound.
+type WorkerPool struct {
+	// Goroutines performing the handshakes of accepted connections, including the key
+	// exchange of secure ones.
+	Handshakes int
+	// Accepted connections waiting for a handshake worker. While it is full, the plugin
+	// stops accepting connections, which wait in the backlog of the listener.
+	Backlog int
+	// Goroutines running calls, shared by all connections.
+	Calls int
+	// Calls waiting for a worker while all are busy, as many as Calls if zero. Further
+	// calls fail with ErrBusy. Requests are read from connections meanwhile, so that
+	// keepalives and cancellations are not held up by calls.
+	CallBacklog int
+}
+
+// ErrBusy is returned by calls to a plugin whose call workers are all busy, with as many
+// calls waiting for them (see WorkerPool). Hosts can match it with errors.Is.
+var ErrBusy = NewError("busy", "All workers of the plugin are busy")
+
+// SetWorkerPool makes the plugin serve connections with a bounded pool of workers.
+//
+// Methods blocking until other calls to the plugin complete must not be used with a bound
+// on calls, as they could wait forever for a worker.
+//
+// SetWorkerPool will panic if called after Run.
+func SetWorkerPool(p WorkerPool) {
+	DefaultServer().SetWorkerPool(p)
+}
+
+// SetWorkerPool makes the server serve connections with a bounded pool of workers, as the
+// SetWorkerPool function does.
+func (s *Server) SetWorkerPool(p WorkerPool) {
+	if s.r.running {
+		panic("Do not call SetWorkerPool after Run")
+	}
+	s.r.workers = p
+	s.r.server.calls = nil
+	if p.Calls > 0 {
+		backlog := p.CallBacklog
+		if backlog <= 0 {
+			backlog = p.Calls
+		}
+		s.r.server.calls = make(chan func(), backlog)
+	}
+}
+
+// Start the workers running calls, if bounded.
+func (d *dispatcher) startWorkers(n int) {
+	for i := 0; i < n; i++ {
+		go func() {
+			for fn := range d.calls {
+				fn()
+			}
+		}()
+	}
+}
+
+// Run fn in its own goroutine or, if calls are bounded, as soon as a worker is free.
+// Returns false, without running fn, if the backlog of calls waiting for a worker is full.
+func (d *dispatcher) spawn(fn func()) bool {
+	if d.calls == nil {
+		go fn()
+		return true
+	}
+	select {
+	case d.calls <- fn:
+		return true
+	default:
+		return false
+	}
+}
+
+// A connection admitted, waiting for a handshake worker.
+type admittedConn struct {
+	conn    net.Conn
+	release func()
+}
+
+// Accept connections until the listener is closed, performing their handshake with the
+// handshake workers.
+func (r *rpcServer) serveWorkers(l net.Listener) error {
+	queue := make(chan admittedConn, r.workers.Backlog)
+	defer close(queue)
+	for i := 0; i < r.workers.Handshakes; i++ {
+		go func() {
+			for c := range queue {
+				if a := r.acceptConn(c.conn, c.release); a != nil {
+					go r.serveAccepted(a)
+				}
+			}
+		}()
+	}
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		if release := r.admit(conn); release != nil {
+			queue <- admittedConn{conn, release}
+		}
+	}
+}